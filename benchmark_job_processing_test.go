@@ -2,82 +2,145 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-	"sync"
+	"io"
+	"log/slog"
 	"testing"
-	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/worker"
+	"github.com/illegalcall/task-master/pkg/database"
 )
 
-// Job represents a simplified job structure.
-type Job struct {
-	ID   int
-	Name string
+// acceptAllDriver stands in for Postgres: every statement succeeds and
+// affects one row, so the benchmark measures the worker rather than the
+// database
+type acceptAllDriver struct{}
+
+func (acceptAllDriver) Open(string) (driver.Conn, error) { return acceptAllConn{}, nil }
+
+type acceptAllConn struct{}
+
+func (acceptAllConn) Prepare(string) (driver.Stmt, error) { return acceptAllStmt{}, nil }
+func (acceptAllConn) Close() error                        { return nil }
+func (acceptAllConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
 }
 
-// processJobLogicForBenchmark simulates the actual job processing logic.
-// In production, processJobLogic may sleep for 10s to simulate heavy work,
-// but here we use a 1ms sleep to make the benchmark run quickly.
-func processJobLogicForBenchmark(job Job) error {
-	// Simulate processing time.
-	time.Sleep(1 * time.Millisecond)
-	// Optionally simulate an error (e.g., for jobs with certain IDs)
-	// if job.ID%1000 == 0 {
-	//     return fmt.Errorf("simulated error for job %d", job.ID)
-	// }
-	return nil
+type acceptAllStmt struct{}
+
+func (acceptAllStmt) Close() error  { return nil }
+func (acceptAllStmt) NumInput() int { return -1 }
+func (acceptAllStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (acceptAllStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("queries are not supported")
 }
 
-// BenchmarkJobProcessing measures the throughput of processing a large number
-// of jobs concurrently using a worker pool.
+func init() {
+	sql.Register("acceptall", acceptAllDriver{})
+}
+
+// benchmarkSession is the consumer group session of the benchmark partition
+type benchmarkSession struct {
+	sarama.ConsumerGroupSession
+	marked int64
+}
+
+func (s *benchmarkSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked = msg.Offset + 1
+}
+
+func (s *benchmarkSession) Commit() {}
+
+func (s *benchmarkSession) Context() context.Context {
+	return context.Background()
+}
+
+// benchmarkClaim is a partition holding the benchmark's job messages
+type benchmarkClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *benchmarkClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+// BenchmarkJobProcessing measures the throughput of the worker pool: b.N job
+// messages are consumed from one partition by Worker.ConsumeClaim with 50
+// jobs processed at once. The jobs are sleep jobs of 1ms, and every fifth
+// one fails.
 func BenchmarkJobProcessing(b *testing.B) {
 	// Report memory allocations (optional).
 	b.ReportAllocs()
 
-	// Create a channel to queue jobs.
-	jobs := make(chan Job, b.N)
-
-	// Define the number of concurrent workers.
-	numWorkers := 50
-	var wg sync.WaitGroup
-
-	// Create an error channel to capture errors from workers.
-	errCh := make(chan error, numWorkers)
-
-	// Start the worker pool.
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			for job := range jobs {
-				if err := processJobLogicForBenchmark(job); err != nil {
-					// Send the error to the error channel and return.
-					errCh <- fmt.Errorf("Worker %d: job %d failed: %v", workerID, job.ID, err)
-					return
-				}
-			}
-		}(i)
+	// Job logging would dominate the measurement
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { slog.SetDefault(logger) })
+
+	miniRedis := miniredis.RunT(b)
+	db, err := sqlx.Open("acceptall", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	clients := &database.Clients{
+		DB:    db,
+		Redis: redis.NewClient(&redis.Options{Addr: miniRedis.Addr()}),
 	}
+	defer clients.Redis.Close()
 
-	// Reset the benchmark timer after the worker pool has been set up.
-	b.ResetTimer()
+	cfg := &config.Config{
+		Kafka: config.KafkaConfig{
+			Topic:    "jobs",
+			RetryMax: 1,
+		},
+		Worker: config.WorkerConfig{
+			Concurrency: 50,
+			MaxPending:  500,
+		},
+	}
+	w := worker.NewWorker(cfg, clients, nil, nil)
 
-	// Enqueue b.N jobs into the channel.
+	// Queue b.N jobs in the partition, with the payloads the API would store
+	claim := &benchmarkClaim{messages: make(chan *sarama.ConsumerMessage, b.N)}
 	for i := 0; i < b.N; i++ {
-		jobs <- Job{
-			ID:   i,
-			Name: fmt.Sprintf("Job-%d", i),
+		payload := `{"duration_ms": 1}`
+		if i%5 == 0 {
+			payload = `{"duration_ms": 1, "error": "simulated error"}`
+		}
+		miniRedis.Set(fmt.Sprintf("job:%d:payload", i), payload)
+		claim.messages <- &sarama.ConsumerMessage{
+			Topic:  "jobs",
+			Offset: int64(i),
+			Value:  []byte(fmt.Sprintf(`{"id": %d, "name": "Job-%d", "type": "sleep"}`, i, i)),
 		}
 	}
-	close(jobs)
+	close(claim.messages)
 
-	// Wait until all workers have finished processing.
-	wg.Wait()
-	close(errCh)
+	// Reset the benchmark timer after the partition has been set up.
+	b.ResetTimer()
 
-	// Check if any errors occurred.
-	for err := range errCh {
-		if err != nil {
-			b.Fatal(err)
-		}
+	// ConsumeClaim returns once every message has been processed
+	session := &benchmarkSession{}
+	if err := w.ConsumeClaim(session, claim); err != nil {
+		b.Fatal(err)
+	}
+
+	b.StopTimer()
+	if session.marked != int64(b.N) {
+		b.Fatalf("committed up to offset %d, want %d", session.marked, b.N)
 	}
 }
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/illegalcall/task-master/internal/api"
 	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/outbox"
+	"github.com/illegalcall/task-master/internal/scheduler"
+	"github.com/illegalcall/task-master/internal/storage"
 	"github.com/illegalcall/task-master/pkg/database"
 	"github.com/illegalcall/task-master/pkg/kafka"
 )
@@ -14,22 +20,36 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 
+	// `migrate [up|down [n]|status]` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := database.RunMigrateCommand(context.Background(), cfg.Database.URL, os.Args[2:], os.Stdout); err != nil {
+			slog.Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize database clients
 	db, err := database.NewClients(cfg.Database.URL, cfg.Redis.Addr)
 	if err != nil {
 		slog.Error("Failed to initialize database clients", "error", err)
 		os.Exit(1)
 	}
-	defer db.DB.Close()
 	slog.Info("✅ Connected to databases")
 
+	if cfg.Database.AutoMigrate {
+		if err := db.Migrate(context.Background()); err != nil {
+			slog.Error("Failed to apply database migrations", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize Kafka producer
 	producer, err := kafka.NewProducer(cfg.Kafka.Broker, cfg.Kafka.RetryMax, int64(cfg.Kafka.RetryBackoff))
 	if err != nil {
 		slog.Error("Failed to create Kafka producer", "error", err)
 		os.Exit(1)
 	}
-	defer producer.Close()
 	slog.Info("✅ Connected to Kafka")
 
 	// Create and start server
@@ -38,8 +58,65 @@ func main() {
 		slog.Error("Failed to create server", "error", err)
 		os.Exit(1)
 	}
-	if err := server.Start(); err != nil {
+	if err := server.EnsureAdminUser(context.Background()); err != nil {
+		slog.Error("Failed to provision admin user", "error", err)
+		os.Exit(1)
+	}
+
+	// Serve until SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Publish queued jobs until the server has drained, so jobs created by
+	// in-flight requests go out before shutdown
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		outbox.NewRelay(cfg.Outbox, db.DB, producer).Run(relayCtx)
+		close(relayDone)
+	}()
+
+	// Queue scheduled jobs when they are due; one replica leads at a time
+	schedulerDone := make(chan struct{})
+	go func() {
+		scheduler.NewScheduler(cfg, db).Run(ctx)
+		close(schedulerDone)
+	}()
+
+	// Release the documents of jobs finished longer than Storage.TTL ago
+	sweeperDone := make(chan struct{})
+	go func() {
+		storage.NewSweeper(server.Storage(), db.DB, cfg.Storage.TTL).Run(ctx)
+		close(sweeperDone)
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Start() }()
+	select {
+	case err := <-serverErr:
 		slog.Error("Server error", "error", err)
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// Stop accepting requests and let in-flight ones finish, then stop the
+	// scheduler, the sweeper and the outbox relay, flush pending Kafka messages and close
+	// the databases
+	slog.Info("Shutting down server", "timeout", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down server gracefully", "error", err)
+	}
+	<-schedulerDone
+	<-sweeperDone
+	stopRelay()
+	<-relayDone
+	if err := producer.Close(); err != nil {
+		slog.Error("Failed to close Kafka producer", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database clients", "error", err)
 	}
+	slog.Info("Server stopped")
 }
@@ -4,8 +4,11 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/jobs"
 	"github.com/illegalcall/task-master/internal/worker"
 	"github.com/illegalcall/task-master/pkg/database"
 	"github.com/illegalcall/task-master/pkg/kafka"
@@ -15,30 +18,71 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 
+	// `migrate [up|down [n]|status]` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := database.RunMigrateCommand(context.Background(), cfg.Database.URL, os.Args[2:], os.Stdout); err != nil {
+			slog.Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Configure LLM providers used by document parsing jobs
+	jobs.InitExtractors(cfg.LLM)
+	// and the limits on downloading their documents
+	jobs.InitDocumentFetcher(cfg.Fetch, cfg.Storage.MaxSize)
+
 	// Initialize database clients
 	db, err := database.NewClients(cfg.Database.URL, cfg.Redis.Addr)
 	if err != nil {
 		slog.Error("Failed to initialize database clients", "error", err)
 		os.Exit(1)
 	}
-	defer db.DB.Close()
 	slog.Info("✅ Connected to databases")
 
+	if cfg.Database.AutoMigrate {
+		if err := db.Migrate(context.Background()); err != nil {
+			slog.Error("Failed to apply database migrations", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize Kafka consumer
 	consumer, err := kafka.NewConsumer(cfg.Kafka.Broker, cfg.Kafka.Group)
 	if err != nil {
 		slog.Error("Failed to create Kafka consumer", "error", err)
 		os.Exit(1)
 	}
-	defer consumer.Close()
+
+	// Producer for job retries and the dead-letter topic
+	producer, err := kafka.NewProducer(cfg.Kafka.Broker, cfg.Kafka.RetryMax, int64(cfg.Kafka.RetryBackoff))
+	if err != nil {
+		slog.Error("Failed to create Kafka producer", "error", err)
+		os.Exit(1)
+	}
 	slog.Info("✅ Connected to Kafka")
 
 	// Create and start worker
-	worker := worker.NewWorker(cfg, db, consumer)
+	worker := worker.NewWorker(cfg, db, consumer, producer)
 
-	ctx := context.Background()
+	// Process jobs until SIGINT or SIGTERM; Start drains running jobs
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	if err := worker.Start(ctx); err != nil {
 		slog.Error("Worker error", "error", err)
 		os.Exit(1)
 	}
+
+	// Leave the consumer group, flush pending Kafka messages and close the
+	// databases
+	if err := consumer.Close(); err != nil {
+		slog.Error("Failed to close Kafka consumer", "error", err)
+	}
+	if err := producer.Close(); err != nil {
+		slog.Error("Failed to close Kafka producer", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database clients", "error", err)
+	}
+	slog.Info("Worker shut down")
 }
@@ -1,12 +1,34 @@
 package api
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	jwtv4 "github.com/golang-jwt/jwt/v4"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything after the first 72 bytes
+	maxPasswordLength = 72
+	minUsernameLength = 3
+	maxUsernameLength = 64
 )
 
+// dummyPasswordHash is compared against when a username doesn't exist so
+// that failed logins take the same time whether or not the user exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -17,6 +39,16 @@ type LoginResponse struct {
 	TokenType string `json:"type"`
 }
 
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
 func (s *Server) handleLogin(c *fiber.Ctx) error {
 	var req LoginRequest
 	if err := c.BodyParser(&req); err != nil {
@@ -32,21 +64,45 @@ func (s *Server) handleLogin(c *fiber.Ctx) error {
 		})
 	}
 
-	// TODO: Replace with database authentication
-	if !isValidCredentials(req.Username, req.Password) {
+	var user models.User
+	err := s.db.DB.Get(&user, "SELECT "+models.UserColumns+" FROM users WHERE username = $1", req.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid credentials",
 		})
 	}
+	if err != nil {
+		s.logger.Error("Error fetching user", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to authenticate",
+		})
+	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": req.Username,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(), // Default to 24h if not set
-		"iat":      time.Now().Unix(),
-	})
+	// A locked account is answered like an unknown one, so the lockout
+	// doesn't tell whether the username exists
+	if user.LockedUntil != nil && user.LockedUntil.After(time.Now()) {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		s.logger.Warn("Login refused for locked account", "userID", user.ID, "lockedUntil", *user.LockedUntil)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid credentials",
+		})
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		s.recordFailedLogin(user.ID)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid credentials",
+		})
+	}
+
+	if user.FailedAttempts > 0 || user.LockedUntil != nil {
+		if _, err := s.db.DB.Exec("UPDATE users SET failed_attempts = 0, locked_until = NULL WHERE id = $1", user.ID); err != nil {
+			s.logger.Error("Failed to reset failed login attempts", "userID", user.ID, "error", err)
+		}
+	}
 
-	tokenString, err := token.SignedString([]byte(s.cfg.JWT.Secret))
+	tokenString, err := s.issueToken(user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
@@ -59,7 +115,264 @@ func (s *Server) handleLogin(c *fiber.Ctx) error {
 	})
 }
 
-// TODO: Replace with database lookup
-func isValidCredentials(username, password string) bool {
-	return username == "admin" && password == "password"
+// recordFailedLogin counts a failed login and locks the account once
+// Auth.MaxFailedLogins consecutive failures are reached
+func (s *Server) recordFailedLogin(userID int) {
+	var failed int
+	err := s.db.DB.QueryRow(
+		"UPDATE users SET failed_attempts = failed_attempts + 1 WHERE id = $1 RETURNING failed_attempts",
+		userID,
+	).Scan(&failed)
+	if err != nil {
+		s.logger.Error("Failed to record failed login", "userID", userID, "error", err)
+		return
+	}
+
+	maxFailed := s.cfg.Auth.MaxFailedLogins
+	if maxFailed <= 0 || failed < maxFailed {
+		return
+	}
+
+	lockedUntil := time.Now().Add(s.cfg.Auth.LockoutDuration)
+	if _, err := s.db.DB.Exec(
+		"UPDATE users SET failed_attempts = 0, locked_until = $1 WHERE id = $2",
+		lockedUntil, userID,
+	); err != nil {
+		s.logger.Error("Failed to lock account", "userID", userID, "error", err)
+		return
+	}
+	s.logger.Warn("Account locked after repeated failed logins", "userID", userID, "lockedUntil", lockedUntil)
+}
+
+// issueToken signs a JWT identifying the user
+func (s *Server) issueToken(user models.User) (string, error) {
+	expiration := s.cfg.JWT.Expiration
+	if expiration <= 0 {
+		expiration = 24 * time.Hour
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":      strconv.Itoa(user.ID),
+		"user_id":  user.ID,
+		"username": user.Username,
+		"role":     user.Role,
+		"exp":      now.Add(expiration).Unix(),
+		"iat":      now.Unix(),
+	})
+	return token.SignedString([]byte(s.cfg.JWT.Secret))
+}
+
+func (s *Server) handleRegister(c *fiber.Ctx) error {
+	var req RegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if len(req.Username) < minUsernameLength || len(req.Username) > maxUsernameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Username must be between %d and %d characters", minUsernameLength, maxUsernameLength),
+		})
+	}
+	if err := validatePassword(req.Password); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create user",
+		})
+	}
+
+	user := models.User{Username: req.Username}
+	err = s.db.DB.QueryRow(
+		"INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id, role, created_at",
+		req.Username, string(hash),
+	).Scan(&user.ID, &user.Role, &user.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Username is already taken",
+			})
+		}
+		s.logger.Error("Failed to create user", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create user",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"user": user,
+	})
+}
+
+func (s *Server) handleChangePassword(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	userID := caller.ID
+
+	var req ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.CurrentPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Current password is required",
+		})
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var user models.User
+	err = s.db.DB.Get(&user, "SELECT "+models.UserColumns+" FROM users WHERE id = $1", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		s.logger.Error("Error fetching user", "userID", userID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to change password",
+		})
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)) != nil {
+		s.recordFailedLogin(user.ID)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Current password is incorrect",
+		})
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to change password",
+		})
+	}
+
+	if _, err := s.db.DB.Exec(
+		"UPDATE users SET password_hash = $1, failed_attempts = 0, locked_until = NULL, updated_at = $2 WHERE id = $3",
+		string(hash), time.Now(), userID,
+	); err != nil {
+		s.logger.Error("Failed to update password", "userID", userID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to change password",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	}
+	return nil
+}
+
+// authUser is the caller identified by a validated JWT
+type authUser struct {
+	ID   int
+	Role string
+}
+
+// IsAdmin reports whether the caller may see every user's jobs
+func (u authUser) IsAdmin() bool {
+	return u.Role == models.RoleAdmin
+}
+
+// CanAccess reports whether the caller may read a job owned by ownerID.
+// Jobs created before ownership was tracked have no owner and are only
+// visible to admins.
+func (u authUser) CanAccess(ownerID *int) bool {
+	return u.IsAdmin() || (ownerID != nil && *ownerID == u.ID)
+}
+
+// currentUser returns the caller carried by the token that the JWT
+// middleware validated for this request
+func currentUser(c *fiber.Ctx) (authUser, error) {
+	token, ok := c.Locals("user").(*jwtv4.Token)
+	if !ok {
+		return authUser{}, errors.New("missing authentication token")
+	}
+	claims, ok := token.Claims.(jwtv4.MapClaims)
+	if !ok {
+		return authUser{}, errors.New("invalid token claims")
+	}
+	id, ok := claims["user_id"].(float64)
+	if !ok || id <= 0 {
+		return authUser{}, errors.New("token does not identify a user")
+	}
+	// Tokens issued before roles existed carry no role and are plain users
+	role, _ := claims["role"].(string)
+	if role == "" {
+		role = models.RoleUser
+	}
+	return authUser{ID: int(id), Role: role}, nil
+}
+
+// requireAdmin rejects callers that aren't admins. Admin responses are
+// never cached, so each request is checked.
+func (s *Server) requireAdmin(c *fiber.Ctx) error {
+	skipCache(c)
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !caller.IsAdmin() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Admin access required",
+		})
+	}
+	return c.Next()
+}
+
+// EnsureAdminUser creates the admin account configured by Auth.AdminUsername
+// and Auth.AdminPassword if it doesn't exist yet. An existing account with
+// that name is left untouched so a restart never resets its password.
+func (s *Server) EnsureAdminUser(ctx context.Context) error {
+	if s.cfg.Auth.AdminUsername == "" {
+		return nil
+	}
+	if err := validatePassword(s.cfg.Auth.AdminPassword); err != nil {
+		return fmt.Errorf("invalid admin password: %w", err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(s.cfg.Auth.AdminPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash admin password: %w", err)
+	}
+
+	result, err := s.db.DB.ExecContext(ctx,
+		"INSERT INTO users (username, password_hash, role) VALUES ($1, $2, $3) ON CONFLICT (username) DO NOTHING",
+		s.cfg.Auth.AdminUsername, string(hash), models.RoleAdmin,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create admin user: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		s.logger.Info("Created admin user", "username", s.cfg.Auth.AdminUsername)
+	}
+	return nil
 }
@@ -2,23 +2,61 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"database/sql/driver"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"testing"
 	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gofiber/fiber/v2"
+	jwtware "github.com/gofiber/jwt/v3"
+	jwtv4 "github.com/golang-jwt/jwt/v4"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/illegalcall/task-master/internal/models"
 )
 
+var userColumns = []string{"id", "username", "password_hash", "role", "failed_attempts", "locked_until", "created_at"}
+
+var selectUserByName = regexp.QuoteMeta("SELECT " + models.UserColumns + " FROM users WHERE username = $1")
+
+// testPasswordHash hashes a password with the minimum cost to keep tests fast
+func testPasswordHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(hash)
+}
+
+func postJSON(t *testing.T, app *fiber.App, method, path string, body interface{}, headers ...string) *http.Response {
+	t.Helper()
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	return resp
+}
+
 func TestHandleLogin(t *testing.T) {
-	server, _, _ := setupTestServer(t)
+	server, mock, _ := setupTestServer(t)
+	hash := testPasswordHash(t, "password")
 
 	tests := []struct {
 		name           string
 		reqBody        LoginRequest
+		setupMocks     func()
 		expectedStatus int
 		checkResponse  func(*testing.T, *http.Response)
 	}{
@@ -28,6 +66,11 @@ func TestHandleLogin(t *testing.T) {
 				Username: "admin",
 				Password: "password",
 			},
+			setupMocks: func() {
+				mock.ExpectQuery(selectUserByName).
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "admin", hash, models.RoleUser, 0, nil, time.Now()))
+			},
 			expectedStatus: fiber.StatusOK,
 			checkResponse: func(t *testing.T, resp *http.Response) {
 				var result LoginResponse
@@ -48,16 +91,40 @@ func TestHandleLogin(t *testing.T) {
 				// Verify claims
 				claims := token.Claims.(jwt.MapClaims)
 				assert.Equal(t, "admin", claims["username"])
+				assert.Equal(t, float64(1), claims["user_id"])
+				assert.Equal(t, "1", claims["sub"])
 				exp := int64(claims["exp"].(float64))
 				assert.Greater(t, exp, time.Now().Unix())
 			},
 		},
+		{
+			name: "successful login resets failed attempts",
+			reqBody: LoginRequest{
+				Username: "admin",
+				Password: "password",
+			},
+			setupMocks: func() {
+				mock.ExpectQuery(selectUserByName).
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "admin", hash, models.RoleUser, 2, nil, time.Now()))
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET failed_attempts = 0, locked_until = NULL WHERE id = $1")).
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: fiber.StatusOK,
+			checkResponse:  func(t *testing.T, resp *http.Response) {},
+		},
 		{
 			name: "invalid credentials",
 			reqBody: LoginRequest{
 				Username: "wrong",
 				Password: "wrong",
 			},
+			setupMocks: func() {
+				mock.ExpectQuery(selectUserByName).
+					WithArgs("wrong").
+					WillReturnRows(sqlmock.NewRows(userColumns))
+			},
 			expectedStatus: fiber.StatusUnauthorized,
 			checkResponse: func(t *testing.T, resp *http.Response) {
 				var result map[string]string
@@ -66,12 +133,69 @@ func TestHandleLogin(t *testing.T) {
 				assert.Equal(t, "Invalid credentials", result["error"])
 			},
 		},
+		{
+			name: "wrong password counts a failed attempt",
+			reqBody: LoginRequest{
+				Username: "admin",
+				Password: "wrong-password",
+			},
+			setupMocks: func() {
+				mock.ExpectQuery(selectUserByName).
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "admin", hash, models.RoleUser, 0, nil, time.Now()))
+				mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET failed_attempts = failed_attempts + 1 WHERE id = $1 RETURNING failed_attempts")).
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"failed_attempts"}).AddRow(1))
+			},
+			expectedStatus: fiber.StatusUnauthorized,
+			checkResponse:  func(t *testing.T, resp *http.Response) {},
+		},
+		{
+			name: "repeated failures lock the account",
+			reqBody: LoginRequest{
+				Username: "admin",
+				Password: "wrong-password",
+			},
+			setupMocks: func() {
+				mock.ExpectQuery(selectUserByName).
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "admin", hash, models.RoleUser, 2, nil, time.Now()))
+				mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET failed_attempts = failed_attempts + 1 WHERE id = $1 RETURNING failed_attempts")).
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"failed_attempts"}).AddRow(3))
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET failed_attempts = 0, locked_until = $1 WHERE id = $2")).
+					WithArgs(sqlmock.AnyArg(), 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: fiber.StatusUnauthorized,
+			checkResponse:  func(t *testing.T, resp *http.Response) {},
+		},
+		{
+			name: "locked account is rejected even with the right password",
+			reqBody: LoginRequest{
+				Username: "admin",
+				Password: "password",
+			},
+			setupMocks: func() {
+				mock.ExpectQuery(selectUserByName).
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(1, "admin", hash, models.RoleUser, 0, time.Now().Add(10*time.Minute), time.Now()))
+			},
+			// Answered like an unknown username
+			expectedStatus: fiber.StatusUnauthorized,
+			checkResponse: func(t *testing.T, resp *http.Response) {
+				var result map[string]interface{}
+				assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+				assert.Equal(t, map[string]interface{}{"error": "Invalid credentials"}, result)
+			},
+		},
 		{
 			name: "missing credentials",
 			reqBody: LoginRequest{
 				Username: "",
 				Password: "",
 			},
+			setupMocks:     func() {},
 			expectedStatus: fiber.StatusBadRequest,
 			checkResponse: func(t *testing.T, resp *http.Response) {
 				var result map[string]string
@@ -84,15 +208,159 @@ func TestHandleLogin(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			body, _ := json.Marshal(tt.reqBody)
-			req := httptest.NewRequest("POST", "/api/login", bytes.NewReader(body))
-			req.Header.Set("Content-Type", "application/json")
+			tt.setupMocks()
 
-			resp, err := server.app.Test(req)
-			assert.NoError(t, err)
+			resp := postJSON(t, server.app, "POST", "/api/login", tt.reqBody)
 			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
 
 			tt.checkResponse(t, resp)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestHandleRegister(t *testing.T) {
+	server, mock, _ := setupTestServer(t)
+	insertUser := regexp.QuoteMeta("INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id, role, created_at")
+
+	// Successful registration stores a bcrypt hash, never the password
+	mock.ExpectQuery(insertUser).
+		WithArgs("alice", bcryptHashOf("correct horse")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "role", "created_at"}).AddRow(7, models.RoleUser, time.Now()))
+
+	resp := postJSON(t, server.app, "POST", "/api/register", RegisterRequest{Username: "alice", Password: "correct horse"})
+	assert.Equal(t, fiber.StatusCreated, resp.StatusCode)
+
+	var result map[string]map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, float64(7), result["user"]["id"])
+	assert.Equal(t, "alice", result["user"]["username"])
+	assert.Equal(t, models.RoleUser, result["user"]["role"])
+	assert.NotContains(t, result["user"], "password_hash")
+
+	// Duplicate usernames conflict
+	mock.ExpectQuery(insertUser).
+		WithArgs("alice", sqlmock.AnyArg()).
+		WillReturnError(&pq.Error{Code: "23505"})
+
+	resp = postJSON(t, server.app, "POST", "/api/register", RegisterRequest{Username: "alice", Password: "another password"})
+	assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+
+	// Weak passwords and short usernames are rejected before touching the database
+	resp = postJSON(t, server.app, "POST", "/api/register", RegisterRequest{Username: "bob", Password: "short"})
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	resp = postJSON(t, server.app, "POST", "/api/register", RegisterRequest{Username: "b", Password: "long enough"})
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleChangePassword(t *testing.T) {
+	server, mock, _ := setupTestServer(t)
+	hash := testPasswordHash(t, "old password")
+
+	// Exercise the real JWT middleware so the user ID round-trips through the token
+	server.app.Put("/secure/password", jwtware.New(jwtware.Config{
+		SigningKey: []byte(server.cfg.JWT.Secret),
+	}), server.handleChangePassword)
+
+	token, err := server.issueToken(models.User{ID: 7, Username: "alice"})
+	require.NoError(t, err)
+	auth := []string{"Authorization", "Bearer " + token}
+
+	selectUserByID := regexp.QuoteMeta("SELECT " + models.UserColumns + " FROM users WHERE id = $1")
+
+	// Wrong current password
+	mock.ExpectQuery(selectUserByID).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "alice", hash, models.RoleUser, 0, nil, time.Now()))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET failed_attempts = failed_attempts + 1 WHERE id = $1 RETURNING failed_attempts")).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_attempts"}).AddRow(1))
+
+	resp := postJSON(t, server.app, "PUT", "/secure/password",
+		ChangePasswordRequest{CurrentPassword: "wrong password", NewPassword: "new password"}, auth...)
+	assert.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+
+	// Correct current password
+	mock.ExpectQuery(selectUserByID).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "alice", hash, models.RoleUser, 0, nil, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET password_hash = $1, failed_attempts = 0, locked_until = NULL, updated_at = $2 WHERE id = $3")).
+		WithArgs(bcryptHashOf("new password"), sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	resp = postJSON(t, server.app, "PUT", "/secure/password",
+		ChangePasswordRequest{CurrentPassword: "old password", NewPassword: "new password"}, auth...)
+	assert.Equal(t, fiber.StatusNoContent, resp.StatusCode)
+
+	// Requests without a token never reach the handler
+	resp = postJSON(t, server.app, "PUT", "/secure/password",
+		ChangePasswordRequest{CurrentPassword: "old password", NewPassword: "new password"})
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestEnsureAdminUser(t *testing.T) {
+	server, mock, _ := setupTestServer(t)
+	insertAdmin := regexp.QuoteMeta("INSERT INTO users (username, password_hash, role) VALUES ($1, $2, $3) ON CONFLICT (username) DO NOTHING")
+
+	// Nothing is provisioned unless configured
+	require.NoError(t, server.EnsureAdminUser(context.Background()))
+
+	server.cfg.Auth.AdminUsername = "root"
+	server.cfg.Auth.AdminPassword = "short"
+	assert.Error(t, server.EnsureAdminUser(context.Background()))
+
+	server.cfg.Auth.AdminPassword = "correct horse"
+	mock.ExpectExec(insertAdmin).
+		WithArgs("root", bcryptHashOf("correct horse"), models.RoleAdmin).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	require.NoError(t, server.EnsureAdminUser(context.Background()))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCurrentUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwtv4.MapClaims
+		want   authUser
+		err    bool
+	}{
+		{"admin", jwtv4.MapClaims{"user_id": float64(1), "role": models.RoleAdmin}, authUser{ID: 1, Role: models.RoleAdmin}, false},
+		{"user", jwtv4.MapClaims{"user_id": float64(7), "role": models.RoleUser}, authUser{ID: 7, Role: models.RoleUser}, false},
+		{"token issued before roles", jwtv4.MapClaims{"user_id": float64(7)}, authUser{ID: 7, Role: models.RoleUser}, false},
+		{"token without user", jwtv4.MapClaims{"role": models.RoleAdmin}, authUser{}, true},
+		{"no token", nil, authUser{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				if tt.claims != nil {
+					c.Locals("user", &jwtv4.Token{Claims: tt.claims})
+				}
+				got, err := currentUser(c)
+				if tt.err {
+					assert.Error(t, err)
+				} else {
+					assert.NoError(t, err)
+					assert.Equal(t, tt.want, got)
+				}
+				return nil
+			})
+			_, err := app.Test(httptest.NewRequest("GET", "/", nil))
+			require.NoError(t, err)
 		})
 	}
 }
+
+// bcryptHashOf matches a bcrypt hash of the given password
+type bcryptHashOf string
+
+func (b bcryptHashOf) Match(v driver.Value) bool {
+	hash, ok := v.(string)
+	return ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(b)) == nil
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cache"
+)
+
+// responseCache caches GET responses for expiration. It runs before the JWT
+// middleware, so responses are cached per caller: a cached job is only
+// served to a request carrying the credentials it was made for. Only 200
+// responses are kept, none of admin routes, and hits aren't marked as cacheable by shared caches.
+func responseCache(expiration time.Duration) fiber.Handler {
+	return cache.New(cache.Config{
+		Expiration:   expiration,
+		KeyGenerator: cacheKey,
+		// Next also runs after the handler, where it keeps errors and
+		// rejected requests out of the cache
+		Next: func(c *fiber.Ctx) bool {
+			return c.Response().StatusCode() != fiber.StatusOK || c.Locals(uncachedKey) != nil
+		},
+	})
+}
+
+// uncachedKey is the local marking a request whose response isn't cached
+const uncachedKey = "uncached"
+
+// skipCache keeps the response to c out of the response cache
+func skipCache(c *fiber.Ctx) {
+	c.Locals(uncachedKey, true)
+}
+
+// cacheKey keys a response by the caller's Authorization header, hashed so
+// tokens aren't kept in memory, and the URL including its query, so every
+// page and filter of a listing is cached separately
+func cacheKey(c *fiber.Ctx) string {
+	sum := sha256.Sum256(c.Request().Header.Peek(fiber.HeaderAuthorization))
+	return hex.EncodeToString(sum[:]) + c.OriginalURL()
+}
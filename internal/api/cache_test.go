@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+// setupAppServer returns a server with the middleware and routes of
+// NewServer, which setupTestServer replaces
+func setupAppServer(t *testing.T) (*Server, sqlmock.Sqlmock) {
+	server, mock, miniRedis := setupTestServer(t)
+	t.Cleanup(miniRedis.Close)
+	server.cfg.Server.MaxRequests = 100
+
+	app, err := NewServer(server.cfg, server.db, server.producer)
+	require.NoError(t, err)
+	return app, mock
+}
+
+// get sends a GET request for path as user, or without a token if user is nil
+func get(t *testing.T, server *Server, path string, user *models.User) *http.Response {
+	req := httptest.NewRequest("GET", path, nil)
+	if user != nil {
+		authorize(t, server, req, *user)
+	}
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestResponseCacheIsPerCaller(t *testing.T) {
+	server, mock := setupAppServer(t)
+	selectJob := regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")
+
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(jobRow(1, models.StatusPending, models.JobTypePDFParse))
+	resp := get(t, server, "/api/jobs/1", &alice)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	// Alice's job is looked up again for bob, who doesn't own it, and for a
+	// caller without a token it isn't looked up at all
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(jobRow(1, models.StatusPending, models.JobTypePDFParse))
+	assert.Equal(t, fiber.StatusNotFound, get(t, server, "/api/jobs/1", &bob).StatusCode)
+	assert.Equal(t, fiber.StatusBadRequest, get(t, server, "/api/jobs/1", nil).StatusCode)
+
+	// Bob's 404 isn't cached either
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(jobRow(1, models.StatusPending, models.JobTypePDFParse))
+	assert.Equal(t, fiber.StatusNotFound, get(t, server, "/api/jobs/1", &bob).StatusCode)
+
+	// Alice gets her cached response
+	resp = get(t, server, "/api/jobs/1", &alice)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hit", resp.Header.Get("X-Cache"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResponseCacheKeepsQueries(t *testing.T) {
+	server, mock := setupAppServer(t)
+
+	list := func(status string, total int) {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM jobs WHERE owner_id = $1 AND status = $2")).
+			WithArgs(alice.ID, status).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(total))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT "+models.JobColumns+" FROM jobs WHERE owner_id = $1 AND status = $2")).
+			WithArgs(alice.ID, status, 51).
+			WillReturnRows(sqlmock.NewRows(jobColumns))
+	}
+
+	// Each filter is a response of its own
+	list(models.StatusCompleted, 2)
+	list(models.StatusFailed, 1)
+	for _, tc := range []struct {
+		status string
+		total  float64
+	}{{models.StatusCompleted, 2}, {models.StatusFailed, 1}} {
+		resp := get(t, server, "/api/jobs?status="+tc.status, &alice)
+		require.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, tc.total, body["total"], tc.status)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResponseCacheSkipsAdminRoutes(t *testing.T) {
+	server, _ := setupAppServer(t)
+	stats := func() models.ReconcilerStats {
+		resp := get(t, server, "/api/reconciler/stats", &root)
+		require.Equal(t, fiber.StatusOK, resp.StatusCode)
+		assert.NotEqual(t, "hit", resp.Header.Get("X-Cache"))
+		var stats models.ReconcilerStats
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+		return stats
+	}
+
+	ctx := context.Background()
+	require.NoError(t, server.db.Redis.HSet(ctx, models.ReconcilerStatsKey, models.ReconcilerStatRuns, 1).Err())
+	assert.Equal(t, int64(1), stats().Runs)
+	require.NoError(t, server.db.Redis.HSet(ctx, models.ReconcilerStatsKey, models.ReconcilerStatRuns, 2).Err())
+	assert.Equal(t, int64(2), stats().Runs)
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/jobs"
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+// The contract tests submit jobs through the API and read them back the way
+// the worker does, checking that handlers get the input the caller sent
+
+// capturedMessage matches any outbox message value and keeps it
+type capturedMessage struct {
+	value []byte
+}
+
+func (m *capturedMessage) Match(v driver.Value) bool {
+	m.value, _ = v.([]byte)
+	return true
+}
+
+// workerInput decodes the Kafka message and stored payload of a job the way
+// the worker does, returning the message and the payload for its handler
+func workerInput(t *testing.T, server *Server, message []byte) (jobs.Message, jobs.JobType, json.RawMessage) {
+	var msg jobs.Message
+	require.NoError(t, json.Unmarshal(message, &msg))
+	assert.Equal(t, jobs.SchemaVersion, msg.SchemaVersion)
+
+	stored, err := server.db.Redis.Get(context.Background(), "job:1:payload").Bytes()
+	require.NoError(t, err)
+	env, err := jobs.DecodeEnvelope(stored, msg.Type)
+	require.NoError(t, err)
+	jobType, ok := jobs.LookupJobType(msg.Type)
+	require.True(t, ok)
+	_, err = jobType.Prepare(env.Payload)
+	require.NoError(t, err)
+	return msg, jobType, env.Payload
+}
+
+func TestParseDocumentContract(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	message := &capturedMessage{}
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertPDFJob).
+		WithArgs("PDF Parse Job", models.StatusPending, sqlmock.AnyArg(), models.JobTypePDFParse, sqlmock.AnyArg(), alice.ID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("test-topic", nil, message, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// The caller's webhook hears about the parsing
+	notified := make(chan jobs.ParsingStatusUpdate, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var update jobs.ParsingStatusUpdate
+		if json.NewDecoder(r.Body).Decode(&update) == nil {
+			notified <- update
+		}
+	}))
+	defer webhook.Close()
+	// The webhook listens on loopback, which workers only reach when allowed
+	jobs.InitDocumentFetcher(config.FetchConfig{AllowPrivateNetworks: true}, 0)
+	jobs.InitParsingTracker(jobs.DefaultParsingTrackerConfig())
+	defer func() {
+		jobs.InitDocumentFetcher(config.FetchConfig{}, 0)
+		jobs.InitParsingTracker(jobs.DefaultParsingTrackerConfig())
+	}()
+
+	pdf := []byte("%PDF-1.4\ninvoice")
+	body, _ := json.Marshal(models.NewParseDocumentPayload{
+		PDFSource:      base64.StdEncoding.EncodeToString(pdf),
+		ExpectedSchema: `{"total": "number"}`,
+		Name:           "invoice",
+		Description:    "Extract the invoice total",
+		Options: models.ParseDocumentOptions{
+			Language:            "de",
+			ConfidenceThreshold: 0.8,
+			MaxPages:            2,
+			ParsingMethod:       "ollama",
+		},
+		WebhookURL: webhook.URL,
+	})
+	req := httptest.NewRequest("POST", "/jobs/parse-document", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	authorize(t, server, req, alice)
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	msg, jobType, payload := workerInput(t, server, message.value)
+	assert.Equal(t, 1, msg.ID)
+	assert.Equal(t, models.JobTypePDFParse, msg.Type)
+
+	// The handler reads the stored copy of the submitted PDF
+	originalExtractPDFText := jobs.ExtractPDFText
+	defer func() { jobs.ExtractPDFText = originalExtractPDFText }()
+	ctx, cancel := context.WithCancel(context.Background())
+	var document, documentType string
+	var pages int
+	jobs.ExtractPDFText = func(ctx context.Context, source, sourceType string, maxPages int) (string, error) {
+		document, documentType, pages = source, sourceType, maxPages
+		cancel()
+		return "", errors.New("stop after extraction")
+	}
+	_, err = jobType.Handle(ctx, payload)
+	require.Error(t, err)
+
+	assert.Equal(t, "path", documentType)
+	assert.Equal(t, 2, pages)
+	stored, err := server.storage.Exists(context.Background(), document)
+	require.NoError(t, err)
+	assert.True(t, stored, "the handler reads the PDF the API stored")
+	var parsed jobs.ParseDocumentPayload
+	require.NoError(t, json.Unmarshal(payload, &parsed))
+	assert.Equal(t, map[string]interface{}{"total": "number"}, parsed.OutputSchema)
+	assert.Equal(t, "Extract the invoice total", parsed.Description)
+	assert.Equal(t, jobs.ParseOptions{
+		Language:            "de",
+		ConfidenceThreshold: 0.8,
+		MaxPages:            2,
+		ParsingMethod:       "ollama",
+	}, parsed.Options)
+	assert.Equal(t, webhook.URL, parsed.WebhookURL)
+	select {
+	case update := <-notified:
+		assert.NotEmpty(t, update.DocumentID)
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for the webhook")
+	}
+}
+
+func TestCreateJobContract(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	message := &capturedMessage{}
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO jobs (name, status, type, owner_id, payload, run_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id")).
+		WithArgs("Nap", models.StatusPending, models.JobTypeSleep, alice.ID, sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("test-topic", nil, message, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"name": "Nap", "type": "sleep", "payload": {"duration_ms": 1}}`))
+	req.Header.Set("Content-Type", "application/json")
+	authorize(t, server, req, alice)
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	msg, jobType, payload := workerInput(t, server, message.value)
+	assert.Equal(t, models.JobTypeSleep, msg.Type)
+	result, err := jobType.Handle(context.Background(), payload)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"slept_ms": 1}, result.Data)
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/outbox"
+	"github.com/illegalcall/task-master/pkg/kafka"
+)
+
+// headerReplayedFrom marks messages replayed from the dead-letter table
+const headerReplayedFrom = "x-replayed-from-dead-letter"
+
+// deadLetterDetail is a dead letter with its message, as returned by
+// GET /api/dead-letters/:id
+type deadLetterDetail struct {
+	models.DeadLetter
+	Key     *string     `json:"key,omitempty"`
+	Payload interface{} `json:"payload"`
+}
+
+func newDeadLetterDetail(dl models.DeadLetter) deadLetterDetail {
+	detail := deadLetterDetail{DeadLetter: dl}
+	if dl.Key != nil {
+		key := string(dl.Key)
+		detail.Key = &key
+	}
+	// Messages that failed to decode may not be JSON at all
+	if json.Valid(dl.Value) {
+		detail.Payload = json.RawMessage(dl.Value)
+	} else {
+		detail.Payload = string(dl.Value)
+	}
+	return detail
+}
+
+// handleListDeadLetters returns dead letters newest first, optionally
+// filtered by job_id and replayed=true|false
+func (s *Server) handleListDeadLetters(c *fiber.Ctx) error {
+	limit := defaultJobListLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxJobListLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxJobListLimit),
+			})
+		}
+		limit = n
+	}
+
+	var conditions []string
+	var args []interface{}
+	if value := c.Query("job_id"); value != "" {
+		jobID, err := strconv.Atoi(value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid job_id"})
+		}
+		args = append(args, jobID)
+		conditions = append(conditions, fmt.Sprintf("job_id = $%d", len(args)))
+	}
+	switch c.Query("replayed") {
+	case "":
+	case "true":
+		conditions = append(conditions, "replayed_at IS NOT NULL")
+	case "false":
+		conditions = append(conditions, "replayed_at IS NULL")
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "replayed must be true or false"})
+	}
+
+	var total int
+	if err := s.db.DB.Get(&total, "SELECT COUNT(*) FROM dead_letters"+whereClause(conditions), args...); err != nil {
+		s.logger.Error("Error counting dead letters", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch dead letters"})
+	}
+
+	// The cursor is the ID of the last dead letter on the previous page
+	if value := c.Query("cursor"); value != "" {
+		cursor, err := strconv.Atoi(value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid cursor"})
+		}
+		args = append(args, cursor)
+		conditions = append(conditions, fmt.Sprintf("id < $%d", len(args)))
+	}
+	args = append(args, limit+1)
+	query := "SELECT " + models.DeadLetterColumns + " FROM dead_letters" + whereClause(conditions) +
+		fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	deadLetters := []models.DeadLetter{}
+	if err := s.db.DB.Select(&deadLetters, query, args...); err != nil {
+		s.logger.Error("Error fetching dead letters", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch dead letters"})
+	}
+
+	response := fiber.Map{"total": total}
+	if len(deadLetters) > limit {
+		deadLetters = deadLetters[:limit]
+		response["next_cursor"] = strconv.Itoa(deadLetters[limit-1].ID)
+	}
+	response["dead_letters"] = deadLetters
+	return c.JSON(response)
+}
+
+// handleGetDeadLetter returns a dead letter including its message
+func (s *Server) handleGetDeadLetter(c *fiber.Ctx) error {
+	dl, err := s.loadDeadLetter(c)
+	if dl == nil {
+		return err
+	}
+	return c.JSON(fiber.Map{
+		"dead_letter": newDeadLetterDetail(*dl),
+	})
+}
+
+// handleReplayDeadLetter publishes a dead-lettered message back to its
+// original topic with its original headers. The job, if any, must still be
+// failed and is reset to pending the same way as POST /api/jobs/:id/retry.
+func (s *Server) handleReplayDeadLetter(c *fiber.Ctx) error {
+	dl, err := s.loadDeadLetter(c)
+	if dl == nil {
+		return err
+	}
+
+	headers := make(map[string]string, len(dl.Headers)+1)
+	for k, v := range dl.Headers {
+		if !strings.HasPrefix(k, "x-dead-letter-") {
+			headers[k] = v
+		}
+	}
+	headers[headerReplayedFrom] = strconv.Itoa(dl.ID)
+
+	if dl.JobID != nil {
+		var job models.Job
+		err := s.db.DB.Get(&job, "SELECT "+models.JobColumns+" FROM jobs WHERE id = $1", *dl.JobID)
+		if err != nil {
+			s.logger.Error("Error fetching dead-lettered job", "jobID", *dl.JobID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to replay dead letter"})
+		}
+		// The job and its message are queued through the outbox together
+		_, err = s.resetFailedJob(c.Context(), job, func(models.Job) (outbox.Message, error) {
+			return outbox.Message{Topic: dl.Topic, Key: dl.Key, Value: dl.Value, Headers: headers}, nil
+		})
+		if err != nil {
+			return c.Status(retryErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+		}
+	} else {
+		msg := &sarama.ProducerMessage{
+			Topic:   dl.Topic,
+			Value:   sarama.ByteEncoder(dl.Value),
+			Headers: kafka.RecordHeaders(headers),
+		}
+		if dl.Key != nil {
+			msg.Key = sarama.ByteEncoder(dl.Key)
+		}
+		if _, _, err := s.producer.SendMessage(msg); err != nil {
+			s.logger.Error("Failed to replay dead letter", "deadLetterID", dl.ID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to replay dead letter"})
+		}
+	}
+
+	now := time.Now()
+	if _, err := s.db.DB.Exec("UPDATE dead_letters SET replayed_at = $1 WHERE id = $2", now, dl.ID); err != nil {
+		s.logger.Warn("Failed to mark dead letter as replayed", "deadLetterID", dl.ID, "error", err)
+	}
+	dl.ReplayedAt = &now
+
+	return c.JSON(fiber.Map{
+		"dead_letter": dl,
+	})
+}
+
+// handleDeleteDeadLetter purges one dead letter. Only the record used by
+// the API is removed; the dead-letter topic keeps the message until Kafka
+// retention expires it.
+func (s *Server) handleDeleteDeadLetter(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter ID"})
+	}
+
+	result, err := s.db.DB.Exec("DELETE FROM dead_letters WHERE id = $1", id)
+	if err != nil {
+		s.logger.Error("Failed to delete dead letter", "deadLetterID", id, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete dead letter"})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Dead letter not found"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// handlePurgeDeadLetters deletes every dead letter, or with replayed=true
+// only those that have been replayed
+func (s *Server) handlePurgeDeadLetters(c *fiber.Ctx) error {
+	query := "DELETE FROM dead_letters"
+	switch c.Query("replayed") {
+	case "":
+	case "true":
+		query += " WHERE replayed_at IS NOT NULL"
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "replayed must be true when given"})
+	}
+
+	result, err := s.db.DB.Exec(query)
+	if err != nil {
+		s.logger.Error("Failed to purge dead letters", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to purge dead letters"})
+	}
+	purged, _ := result.RowsAffected()
+	return c.JSON(fiber.Map{"purged": purged})
+}
+
+// loadDeadLetter fetches the dead letter named by the :id parameter. When it
+// can't, it writes the error response itself and returns a nil dead letter.
+func (s *Server) loadDeadLetter(c *fiber.Ctx) (*models.DeadLetter, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter ID"})
+	}
+
+	var dl models.DeadLetter
+	err = s.db.DB.Get(&dl, "SELECT "+models.DeadLetterColumns+" FROM dead_letters WHERE id = $1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Dead letter not found"})
+	}
+	if err != nil {
+		s.logger.Error("Error fetching dead letter", "deadLetterID", id, "error", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch dead letter"})
+	}
+	return &dl, nil
+}
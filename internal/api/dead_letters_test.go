@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/IBM/sarama"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+var deadLetterColumns = []string{"id", "job_id", "topic", "kafka_partition", "kafka_offset", "key", "value", "headers", "error", "attempts", "created_at", "replayed_at"}
+
+func deadLetterRow(id int, jobID interface{}, value string) *sqlmock.Rows {
+	headers := fmt.Sprintf(`{"trace-id": "abc", %q: "boom", %q: "3"}`, models.HeaderDeadLetterError, models.HeaderDeadLetterAttempts)
+	return sqlmock.NewRows(deadLetterColumns).
+		AddRow(id, jobID, "jobs", 0, 42, []byte("key-1"), []byte(value), []byte(headers), "boom", 3, time.Now(), nil)
+}
+
+func TestHandleListDeadLetters(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM dead_letters WHERE job_id = $1 AND replayed_at IS NULL")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT "+models.DeadLetterColumns+" FROM dead_letters WHERE job_id = $1 AND replayed_at IS NULL AND id < $2 ORDER BY id DESC LIMIT $3")).
+		WithArgs(1, 10, 3).
+		WillReturnRows(sqlmock.NewRows(deadLetterColumns).
+			AddRow(9, 1, "jobs", 0, 42, nil, []byte(`{"id":1}`), []byte(`{}`), "boom", 3, time.Now(), nil).
+			AddRow(8, 1, "jobs", 0, 41, nil, []byte(`{"id":1}`), []byte(`{}`), "boom", 3, time.Now(), nil).
+			AddRow(7, 1, "jobs", 0, 40, nil, []byte(`{"id":1}`), []byte(`{}`), "boom", 3, time.Now(), nil))
+
+	req := authorize(t, server, httptest.NewRequest("GET", "/dead-letters?job_id=1&replayed=false&limit=2&cursor=10", nil), root)
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	var body struct {
+		DeadLetters []models.DeadLetter `json:"dead_letters"`
+		Total       int                 `json:"total"`
+		NextCursor  string              `json:"next_cursor"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Len(t, body.DeadLetters, 2)
+	assert.Equal(t, 3, body.Total)
+	assert.Equal(t, "8", body.NextCursor)
+
+	// Dead letters are admin only
+	req = authorize(t, server, httptest.NewRequest("GET", "/dead-letters", nil), alice)
+	resp, err = server.app.Test(req)
+	require.NoError(t, err)
+	assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleGetDeadLetter(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	selectDeadLetter := regexp.QuoteMeta("SELECT " + models.DeadLetterColumns + " FROM dead_letters WHERE id = $1")
+	get := func(id int) (int, map[string]interface{}) {
+		req := authorize(t, server, httptest.NewRequest("GET", fmt.Sprintf("/dead-letters/%d", id), nil), root)
+		resp, err := server.app.Test(req)
+		require.NoError(t, err)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	// JSON messages are returned as JSON
+	mock.ExpectQuery(selectDeadLetter).WithArgs(1).WillReturnRows(deadLetterRow(1, 5, `{"id":5,"type":"test_job"}`))
+	status, body := get(1)
+	require.Equal(t, fiber.StatusOK, status)
+	dl := body["dead_letter"].(map[string]interface{})
+	assert.Equal(t, "key-1", dl["key"])
+	assert.Equal(t, float64(5), dl["payload"].(map[string]interface{})["id"])
+	assert.Equal(t, "boom", dl["headers"].(map[string]interface{})[models.HeaderDeadLetterError])
+
+	// Messages that never decoded are returned as text
+	mock.ExpectQuery(selectDeadLetter).WithArgs(2).WillReturnRows(deadLetterRow(2, nil, "not json"))
+	status, body = get(2)
+	require.Equal(t, fiber.StatusOK, status)
+	assert.Equal(t, "not json", body["dead_letter"].(map[string]interface{})["payload"])
+
+	mock.ExpectQuery(selectDeadLetter).WithArgs(3).WillReturnRows(sqlmock.NewRows(deadLetterColumns))
+	status, _ = get(3)
+	assert.Equal(t, fiber.StatusNotFound, status)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleReplayDeadLetter(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	selectDeadLetter := regexp.QuoteMeta("SELECT " + models.DeadLetterColumns + " FROM dead_letters WHERE id = $1")
+	markReplayed := regexp.QuoteMeta("UPDATE dead_letters SET replayed_at = $1 WHERE id = $2")
+	replay := func(id int) int {
+		req := authorize(t, server, httptest.NewRequest("POST", fmt.Sprintf("/dead-letters/%d/replay", id), nil), root)
+		resp, err := server.app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+	producer := server.producer.(*MockProducer)
+
+	// The job is reset and the original message goes back to its topic
+	mock.ExpectQuery(selectDeadLetter).WithArgs(1).WillReturnRows(deadLetterRow(1, 5, `{"id":5}`))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")).
+		WithArgs(5).
+		WillReturnRows(jobRow(5, models.StatusFailed, "test_job"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(resetJob).
+		WithArgs(models.StatusPending, 5, models.StatusFailed).
+		WillReturnRows(resetRow(1, []byte(testPayload)))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("jobs", []byte("key-1"), []byte(`{"id":5}`), models.Headers{"trace-id": "abc", headerReplayedFrom: "1"}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(markReplayed).WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.Equal(t, fiber.StatusOK, replay(1))
+	assert.Empty(t, producer.messages, "the job's message goes through the outbox")
+	status, _ := miniRedis.Get("job:5")
+	assert.Equal(t, models.StatusPending, status)
+
+	// A job that was already retried some other way isn't queued twice
+	mock.ExpectQuery(selectDeadLetter).WithArgs(2).WillReturnRows(deadLetterRow(2, 6, `{"id":6}`))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")).
+		WithArgs(6).
+		WillReturnRows(jobRow(6, models.StatusCompleted, "test_job"))
+	assert.Equal(t, fiber.StatusConflict, replay(2))
+
+	// Messages without a job are published as they were
+	mock.ExpectQuery(selectDeadLetter).WithArgs(3).WillReturnRows(deadLetterRow(3, nil, "not json"))
+	mock.ExpectExec(markReplayed).WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Equal(t, fiber.StatusOK, replay(3))
+	require.Len(t, producer.messages, 1)
+	msg := producer.messages[0]
+	assert.Equal(t, "jobs", msg.Topic)
+	assert.Equal(t, sarama.ByteEncoder("not json"), msg.Value)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleDeleteDeadLetters(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	send := func(method, target string) (int, string) {
+		req := authorize(t, server, httptest.NewRequest(method, target, nil), root)
+		resp, err := server.app.Test(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_letters WHERE id = $1")).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	status, _ := send("DELETE", "/dead-letters/1")
+	assert.Equal(t, fiber.StatusNoContent, status)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_letters WHERE id = $1")).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	status, _ = send("DELETE", "/dead-letters/2")
+	assert.Equal(t, fiber.StatusNotFound, status)
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM dead_letters WHERE replayed_at IS NOT NULL")).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	status, body := send("DELETE", "/dead-letters?replayed=true")
+	require.Equal(t, fiber.StatusOK, status)
+	assert.JSONEq(t, `{"purged": 4}`, body)
+
+	status, _ = send("DELETE", "/dead-letters?replayed=false")
+	assert.Equal(t, fiber.StatusBadRequest, status)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
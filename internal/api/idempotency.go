@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+const (
+	// headerIdempotencyKey makes retried job submissions return the job
+	// created by the first one instead of creating another
+	headerIdempotencyKey = "Idempotency-Key"
+	// headerIdempotentReplayed is set on responses to replayed submissions
+	headerIdempotentReplayed = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+var (
+	errIdempotencyKeyTooLong = fmt.Errorf("%s must be at most %d characters", headerIdempotencyKey, maxIdempotencyKeyLength)
+	errIdempotencyKeyReused  = fmt.Errorf("%s was already used with a different request", headerIdempotencyKey)
+	// errIdempotencyKeyTaken means a concurrent request recorded the key first
+	errIdempotencyKeyTaken = errors.New("idempotency key recorded by a concurrent request")
+)
+
+// idempotencyKey is the Idempotency-Key of a request and a hash of the
+// request it came with
+type idempotencyKey struct {
+	Key  string
+	Hash string
+}
+
+// requestIdempotencyKey returns the request's idempotency key, or nil if it
+// has none
+func requestIdempotencyKey(c *fiber.Ctx) (*idempotencyKey, error) {
+	hash, err := newIdempotencyHash(c)
+	if hash == nil || err != nil {
+		return nil, err
+	}
+	hash.Write(c.Body())
+	return hash.idempotencyKey(), nil
+}
+
+// idempotencyHash hashes a request with an Idempotency-Key
+type idempotencyHash struct {
+	hash.Hash
+	key string
+}
+
+// newIdempotencyHash starts hashing a request for its idempotency key, or
+// returns nil if the request has none. The caller writes the body to it.
+func newIdempotencyHash(c *fiber.Ctx) (*idempotencyHash, error) {
+	key := c.Get(headerIdempotencyKey)
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, errIdempotencyKeyTooLong
+	}
+
+	h := &idempotencyHash{Hash: sha256.New(), key: key}
+	h.Write([]byte(c.Method() + " " + c.Path() + "\n"))
+	return h, nil
+}
+
+// idempotencyKey returns the key with the hash of what was written so far
+func (h *idempotencyHash) idempotencyKey() *idempotencyKey {
+	return &idempotencyKey{Key: h.key, Hash: hex.EncodeToString(h.Sum(nil))}
+}
+
+// idempotentJob returns the job created within the idempotency window by an
+// earlier request of ownerID with the same key, or nil if there is none. It
+// returns errIdempotencyKeyReused if that request had a different body.
+func (s *Server) idempotentJob(ctx context.Context, ownerID int, key *idempotencyKey) (*models.Job, error) {
+	var recorded struct {
+		RequestHash string `db:"request_hash"`
+		JobID       int    `db:"job_id"`
+	}
+	err := s.db.DB.GetContext(ctx, &recorded,
+		"SELECT request_hash, job_id FROM idempotency_keys WHERE owner_id = $1 AND key = $2 AND created_at > $3",
+		ownerID, key.Key, time.Now().Add(-s.cfg.Server.IdempotencyWindow),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up idempotency key: %w", err)
+	}
+	if recorded.RequestHash != key.Hash {
+		return nil, errIdempotencyKeyReused
+	}
+
+	var job models.Job
+	if err := s.db.DB.GetContext(ctx, &job, "SELECT "+models.JobColumns+" FROM jobs WHERE id = $1", recorded.JobID); err != nil {
+		return nil, fmt.Errorf("failed to fetch idempotent job: %w", err)
+	}
+	return &job, nil
+}
+
+// recordIdempotencyKey records key as having created jobID as part of tx.
+// A key whose window has passed is taken over. It returns
+// errIdempotencyKeyTaken if another request holds the key.
+func (s *Server) recordIdempotencyKey(ctx context.Context, tx *sqlx.Tx, ownerID int, key *idempotencyKey, jobID int) error {
+	now := time.Now()
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (owner_id, key, request_hash, job_id, created_at) VALUES ($1, $2, $3, $4, $5) "+
+			"ON CONFLICT (owner_id, key) DO UPDATE SET request_hash = EXCLUDED.request_hash, job_id = EXCLUDED.job_id, created_at = EXCLUDED.created_at "+
+			"WHERE idempotency_keys.created_at <= $6",
+		ownerID, key.Key, key.Hash, jobID, now, now.Add(-s.cfg.Server.IdempotencyWindow),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record idempotency key: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errIdempotencyKeyTaken
+	}
+	return nil
+}
+
+// replayIdempotentJob looks up the job of an earlier request with the same
+// idempotency key and, if there is one, responds with it through respond.
+// It reports whether a response was sent.
+func (s *Server) replayIdempotentJob(c *fiber.Ctx, ownerID int, key *idempotencyKey, respond func(models.Job) error) (bool, error) {
+	job, err := s.idempotentJob(c.Context(), ownerID, key)
+	if errors.Is(err, errIdempotencyKeyReused) {
+		return true, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		s.logger.Error("Failed to check idempotency key", "error", err)
+		return true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create job",
+		})
+	}
+	if job == nil {
+		return false, nil
+	}
+	c.Set(headerIdempotentReplayed, "true")
+	return true, respond(*job)
+}
+
+// idempotencyKeyTaken responds to a request whose idempotency key was
+// recorded by a concurrent request, once its own transaction rolled back
+func (s *Server) idempotencyKeyTaken(c *fiber.Ctx, ownerID int, key *idempotencyKey, respond func(models.Job) error) error {
+	if replayed, err := s.replayIdempotentJob(c, ownerID, key, respond); replayed {
+		return err
+	}
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error": fmt.Sprintf("A request with this %s is already in progress", headerIdempotencyKey),
+	})
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+var (
+	selectIdempotencyKey = regexp.QuoteMeta("SELECT request_hash, job_id FROM idempotency_keys WHERE owner_id = $1 AND key = $2 AND created_at > $3")
+	insertIdempotencyKey = regexp.QuoteMeta("INSERT INTO idempotency_keys (owner_id, key, request_hash, job_id, created_at) VALUES ($1, $2, $3, $4, $5) " +
+		"ON CONFLICT (owner_id, key) DO UPDATE SET request_hash = EXCLUDED.request_hash, job_id = EXCLUDED.job_id, created_at = EXCLUDED.created_at " +
+		"WHERE idempotency_keys.created_at <= $6")
+	insertSleepJob = regexp.QuoteMeta("INSERT INTO jobs (name, status, type, owner_id, payload, run_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id")
+)
+
+const sleepJobBody = `{"name": "Test Job", "type": "sleep"}`
+
+// requestHash is the hash recorded for a POST /jobs request with body
+func requestHash(t *testing.T, body string) string {
+	var hash string
+	app := fiber.New()
+	app.Post("/jobs", func(c *fiber.Ctx) error {
+		key, err := requestIdempotencyKey(c)
+		require.NoError(t, err)
+		hash = key.Hash
+		return nil
+	})
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+	req.Header.Set(headerIdempotencyKey, "key")
+	_, err := app.Test(req)
+	require.NoError(t, err)
+	return hash
+}
+
+// createJobWithKey submits body as alice with an idempotency key
+func createJobWithKey(t *testing.T, server *Server, body, key string) (int, map[string]interface{}, string) {
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerIdempotencyKey, key)
+	authorize(t, server, req, alice)
+
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	var result map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return resp.StatusCode, result, resp.Header.Get(headerIdempotentReplayed)
+}
+
+func TestCreateJobRecordsIdempotencyKey(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+	hash := requestHash(t, sleepJobBody)
+
+	mock.ExpectQuery(selectIdempotencyKey).
+		WithArgs(alice.ID, "key-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertSleepJob).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(insertIdempotencyKey).
+		WithArgs(alice.ID, "key-1", hash, 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOutbox).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	status, result, replayed := createJobWithKey(t, server, sleepJobBody, "key-1")
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Equal(t, float64(1), result["job"].(map[string]interface{})["id"])
+	assert.Empty(t, replayed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateJobReplaysIdempotentRequest(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+	hash := requestHash(t, sleepJobBody)
+
+	// The original job is returned, in its current state, without creating another
+	mock.ExpectQuery(selectIdempotencyKey).
+		WithArgs(alice.ID, "key-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}).AddRow(hash, 3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")).
+		WithArgs(3).
+		WillReturnRows(jobRow(3, models.StatusCompleted, models.JobTypeSleep))
+
+	status, result, replayed := createJobWithKey(t, server, sleepJobBody, "key-1")
+	assert.Equal(t, fiber.StatusOK, status)
+	job := result["job"].(map[string]interface{})
+	assert.Equal(t, float64(3), job["id"])
+	assert.Equal(t, models.StatusCompleted, job["status"])
+	assert.Equal(t, "true", replayed)
+	assert.Empty(t, server.producer.(*MockProducer).messages)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateJobRejectsReusedIdempotencyKey(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	mock.ExpectQuery(selectIdempotencyKey).
+		WithArgs(alice.ID, "key-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}).AddRow(requestHash(t, sleepJobBody), 3))
+
+	status, result, _ := createJobWithKey(t, server, `{"name": "Other Job", "type": "sleep"}`, "key-1")
+	assert.Equal(t, fiber.StatusConflict, status)
+	assert.Contains(t, result["error"], headerIdempotencyKey)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Keys are bounded in length
+	status, _, _ = createJobWithKey(t, server, sleepJobBody, strings.Repeat("k", maxIdempotencyKeyLength+1))
+	assert.Equal(t, fiber.StatusBadRequest, status)
+}
+
+func TestCreateJobWithIdempotencyKeyTakenConcurrently(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+	hash := requestHash(t, sleepJobBody)
+
+	// Another request records the key between the lookup and the insert;
+	// this request's job is rolled back and the other one's is returned
+	mock.ExpectQuery(selectIdempotencyKey).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertSleepJob).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec(insertIdempotencyKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	mock.ExpectQuery(selectIdempotencyKey).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}).AddRow(hash, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")).
+		WithArgs(1).
+		WillReturnRows(jobRow(1, models.StatusPending, models.JobTypeSleep))
+
+	status, result, replayed := createJobWithKey(t, server, sleepJobBody, "key-1")
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Equal(t, float64(1), result["job"].(map[string]interface{})["id"])
+	assert.Equal(t, "true", replayed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+const (
+	defaultJobListLimit = 50
+	maxJobListLimit     = 200
+)
+
+// jobListQuery holds the parsed query parameters of GET /api/jobs
+type jobListQuery struct {
+	Limit         int
+	Ascending     bool
+	Status        string
+	Type          string
+	Name          string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Cursor        *jobCursor
+}
+
+// jobCursor is the (created_at, id) position of the last job on a page.
+// Jobs are ordered by both so pages stay stable when timestamps collide.
+type jobCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func (c jobCursor) encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeJobCursor(s string) (*jobCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, errors.New("invalid cursor")
+	}
+	cursor := &jobCursor{}
+	if cursor.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	if cursor.ID, err = strconv.Atoi(id); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// parseJobListQuery reads limit, cursor, sort, status, type, name,
+// created_after and created_before from the query string
+func parseJobListQuery(c *fiber.Ctx) (jobListQuery, error) {
+	q := jobListQuery{
+		Limit:  defaultJobListLimit,
+		Status: c.Query("status"),
+		Type:   c.Query("type"),
+		Name:   c.Query("name"),
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxJobListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxJobListLimit)
+		}
+		q.Limit = n
+	}
+
+	switch sort := c.Query("sort", "created_at_desc"); sort {
+	case "created_at_desc":
+	case "created_at_asc":
+		q.Ascending = true
+	default:
+		return q, fmt.Errorf("unknown sort %q (expected created_at_desc or created_at_asc)", sort)
+	}
+
+	for param, dst := range map[string]**time.Time{
+		"created_after":  &q.CreatedAfter,
+		"created_before": &q.CreatedBefore,
+	} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return q, fmt.Errorf("%s must be an RFC 3339 timestamp", param)
+		}
+		// created_at is stored without a time zone, in the server's local
+		// time zone, so the bound is converted to it
+		t = t.Local()
+		*dst = &t
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		var err error
+		if q.Cursor, err = decodeJobCursor(cursor); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// filters returns the WHERE conditions and arguments shared by the page
+// and count queries. ownerID is nil when the caller may see every job.
+func (q jobListQuery) filters(ownerID *int) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if ownerID != nil {
+		add("owner_id = $%d", *ownerID)
+	}
+	if q.Status != "" {
+		add("status = $%d", q.Status)
+	}
+	if q.Type != "" {
+		add("type = $%d", q.Type)
+	}
+	if q.Name != "" {
+		add(`name ILIKE $%d ESCAPE '\'`, "%"+escapeLike(q.Name)+"%")
+	}
+	if q.CreatedAfter != nil {
+		add("created_at >= $%d", *q.CreatedAfter)
+	}
+	if q.CreatedBefore != nil {
+		add("created_at < $%d", *q.CreatedBefore)
+	}
+	return conditions, args
+}
+
+// pageSQL builds the query for one page; it fetches one extra row to tell
+// whether another page follows
+func (q jobListQuery) pageSQL(ownerID *int) (string, []interface{}) {
+	conditions, args := q.filters(ownerID)
+
+	direction, comparison := "DESC", "<"
+	if q.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	if q.Cursor != nil {
+		args = append(args, q.Cursor.CreatedAt, q.Cursor.ID)
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) %s ($%d, $%d)", comparison, len(args)-1, len(args)))
+	}
+
+	args = append(args, q.Limit+1)
+	query := "SELECT " + models.JobColumns + " FROM jobs" + whereClause(conditions) +
+		fmt.Sprintf(" ORDER BY created_at %s, id %s LIMIT $%d", direction, direction, len(args))
+	return query, args
+}
+
+// countSQL builds the query for the total number of jobs matching the filters
+func (q jobListQuery) countSQL(ownerID *int) (string, []interface{}) {
+	conditions, args := q.filters(ownerID)
+	return "SELECT COUNT(*) FROM jobs" + whereClause(conditions), args
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike makes s match literally inside a LIKE pattern
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// handleListJobs returns one page of the caller's jobs, newest first by
+// default, with the total number of jobs matching the filters
+func (s *Server) handleListJobs(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	query, err := parseJobListQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var ownerID *int
+	if !caller.IsAdmin() {
+		ownerID = &caller.ID
+	}
+
+	var total int
+	countQuery, countArgs := query.countSQL(ownerID)
+	if err := s.db.DB.Get(&total, countQuery, countArgs...); err != nil {
+		s.logger.Error("Error counting jobs", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch jobs"})
+	}
+
+	jobs := []models.Job{}
+	pageQuery, pageArgs := query.pageSQL(ownerID)
+	if err := s.db.DB.Select(&jobs, pageQuery, pageArgs...); err != nil {
+		s.logger.Error("Error fetching jobs", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch jobs"})
+	}
+
+	response := fiber.Map{"total": total}
+	if len(jobs) > query.Limit {
+		jobs = jobs[:query.Limit]
+		last := jobs[len(jobs)-1]
+		response["next_cursor"] = jobCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+
+	s.overlayRedisStatuses(c, jobs)
+	response["jobs"] = jobs
+	return c.JSON(response)
+}
+
+// overlayRedisStatuses replaces each job's status with the fresher one in
+// Redis, if any, using a single MGET
+func (s *Server) overlayRedisStatuses(c *fiber.Ctx, jobs []models.Job) {
+	if len(jobs) == 0 {
+		return
+	}
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = fmt.Sprintf("job:%d", job.ID)
+	}
+
+	statuses, err := s.db.Redis.MGet(c.Context(), keys...).Result()
+	if err != nil {
+		s.logger.Warn("Failed to read job statuses from Redis", "error", err)
+		return
+	}
+	for i, status := range statuses {
+		if status, ok := status.(string); ok {
+			jobs[i].Status = status
+		}
+	}
+}
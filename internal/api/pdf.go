@@ -1,28 +1,62 @@
 package api
 
 import (
-	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
-	"reflect"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/IBM/sarama"
 	"github.com/gofiber/fiber/v2"
+	"github.com/illegalcall/task-master/internal/fetch"
+	"github.com/illegalcall/task-master/internal/jobs"
 	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/storage"
 )
 
 const (
-	maxPDFSize = 10 * 1024 * 1024 // 10MB
+	maxPDFSize           = 10 * 1024 * 1024 // 10MB
+	maxDescriptionLength = 4000             // characters
 )
 
-// handlePDFParseJob handles the POST /api/jobs/parse-document endpoint
+// languageTag matches BCP 47 language tags such as "en" or "pt-BR"
+var languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// handlePDFParseJob handles the POST /api/jobs/parse-document endpoint.
+// The PDF is sent either in a JSON body, base64-encoded or by URL, or as a
+// multipart/form-data upload, see handlePDFUpload.
 func (s *Server) handlePDFParseJob(c *fiber.Ctx) error {
 	ctx := c.Context()
 
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if isMultipartForm(c) {
+		return s.handlePDFUpload(c, caller)
+	}
+
+	// Retried submissions with the same Idempotency-Key get the original job
+	idemKey, err := requestIdempotencyKey(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if idemKey != nil {
+		if replayed, err := s.replayIdempotentJob(c, caller.ID, idemKey, s.pdfJobResponder(c)); replayed {
+			return err
+		}
+	}
+
 	// Parse the request payload
 	var payload models.NewParseDocumentPayload
 	if err := c.BodyParser(&payload); err != nil {
@@ -42,134 +76,170 @@ func (s *Server) handlePDFParseJob(c *fiber.Ctx) error {
 	}
 	fmt.Println("Payload validation successful")
 
-	// Store the PDF file
-	var pdfPath string
-	var err error
+	// Store the PDF file; a PDF stored before is referenced rather than
+	// stored again
+	var blob storage.Blob
 	if strings.HasPrefix(payload.PDFSource, "http://") || strings.HasPrefix(payload.PDFSource, "https://") {
 		fmt.Println("Storing PDF from URL:", payload.PDFSource)
-		pdfPath, err = s.storage.StoreFromURL(ctx, payload.PDFSource)
+		blob, err = s.storage.StoreFromURL(ctx, payload.PDFSource)
 	} else {
 		fmt.Println("Storing PDF from base64 data")
-		pdfData, err := base64.StdEncoding.DecodeString(payload.PDFSource)
+		var pdfData []byte
+		pdfData, err = base64.StdEncoding.DecodeString(payload.PDFSource)
 		if err != nil {
 			fmt.Println("Error decoding base64 PDF data:", err)
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "Invalid base64-encoded PDF data",
 			})
 		}
-		pdfPath, err = s.storage.StoreFromBytes(ctx, pdfData)
+		blob, err = s.storage.StoreFromBytes(ctx, pdfData)
+	}
+	if errors.Is(err, storage.ErrFileTooLarge) {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("PDF exceeds the maximum allowed size of %d bytes", s.cfg.Storage.MaxSize),
+		})
+	}
+	if errors.Is(err, fetch.ErrBlocked) || errors.Is(err, fetch.ErrTooManyRedirects) || errors.Is(err, fetch.ErrNotPDF) {
+		s.logger.Info("Refused to store PDF", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
 	}
 	if err != nil {
-		fmt.Println("Failed to store PDF:", err)
+		s.logger.Error("Failed to store PDF", "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to store PDF: %v", err),
 		})
 	}
-	fmt.Println("PDF stored successfully at path:", pdfPath)
+	s.logger.Debug("PDF stored", "path", blob.Path, "digest", blob.Digest)
 
-	// Create a new job
-	basicJob := models.Job{
-		Name:   "PDF Parse Job",
-		Status: models.StatusPending,
-		Type:   models.JobTypePDFParse,
-	}
-	job := models.PDFParsingJob{
-		Job:  basicJob,
-		Data: payload,
-	}
-	fmt.Println("Job created:", job)
-	fmt.Println("job.Data:",job.Data)
-	fmt.Println("job.data.type:",reflect.TypeOf(job.Data))
-	// Insert job into the database
-	// Marshal the job payload to JSON
-	payloadBytes, err := json.Marshal(job.Data)
+	return s.createPDFJob(c, caller, idemKey, &payload, blob)
+}
+
+// pdfJobResponder returns the function responding with a PDF parse job
+// replayed for an idempotent request, along with the digest recorded for
+// its PDF
+func (s *Server) pdfJobResponder(c *fiber.Ctx) func(models.Job) error {
+	return func(job models.Job) error {
+		var digest sql.NullString
+		if err := s.db.DB.GetContext(c.Context(), &digest, "SELECT document_digest FROM jobs WHERE id = $1", job.ID); err != nil {
+			s.logger.Warn("Failed to fetch document digest", "jobID", job.ID, "error", err)
+		}
+		return respondPDFJob(c, job, digest.String)
+	}
+}
+
+// respondPDFJob responds with a PDF parse job and the SHA-256 digest of its
+// PDF
+func respondPDFJob(c *fiber.Ctx, job models.Job, digest string) error {
+	return c.JSON(fiber.Map{
+		"job_id": job.ID,
+		"status": job.Status,
+		"digest": digest,
+	})
+}
+
+// createPDFJob creates and queues the PDF parse job of a validated request
+// whose PDF is stored as blob, and responds with it. The job's reference to
+// the PDF is released if no job is created; otherwise it is recorded with
+// the job, and the sweeper releases it once the job has finished and the
+// storage TTL has passed. The PDF is removed with its last reference.
+func (s *Server) createPDFJob(c *fiber.Ctx, caller authUser, idemKey *idempotencyKey, payload *models.NewParseDocumentPayload, blob storage.Blob) error {
+	ctx := c.Context()
+	pdfPath := blob.Path
+	respond := s.pdfJobResponder(c)
+	schema, _ := jobs.DecodeOutputSchema(json.RawMessage(payload.ExpectedSchema))
+
+	// The worker reads the stored copy of the PDF
+	envelope, err := encodeEnvelope(models.JobTypePDFParse, jobs.ParseDocumentPayload{
+		Document:     pdfPath,
+		DocumentType: "path",
+		OutputSchema: schema,
+		Description:  payload.Description,
+		Options: jobs.ParseOptions{
+			Language:            payload.Options.Language,
+			OCREnabled:          payload.Options.OCREnabled,
+			ConfidenceThreshold: payload.Options.ConfidenceThreshold,
+			MaxPages:            payload.Options.MaxPages,
+			ParsingMethod:       payload.Options.ParsingMethod,
+		},
+		WebhookURL: payload.WebhookURL,
+	})
 	if err != nil {
-		fmt.Println("Failed to marshal job payload:", err)
-		_ = s.storage.Delete(ctx, pdfPath)
+		s.logger.Error("Failed to encode job payload", "error", err)
+		_ = s.storage.Release(ctx, pdfPath)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create job due to payload marshalling error",
 		})
 	}
-	fmt.Println("Job payload marshalled to JSON successfully")
 
-	// Insert job into the database
-	err = s.db.DB.QueryRow(
-		"INSERT INTO jobs (name, status, created_at, type, payload) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		job.Job.Name, job.Job.Status, time.Now(), job.Job.Type, payloadBytes,
-	).Scan(&job.ID)
+	// Create a new job
+	job := models.Job{
+		Name:    "PDF Parse Job",
+		Status:  models.StatusPending,
+		Type:    models.JobTypePDFParse,
+		OwnerID: &caller.ID,
+	}
+
+	// The job row and its Kafka message are committed together; the outbox
+	// relay publishes the message
+	tx, err := s.db.DB.BeginTxx(ctx, nil)
 	if err != nil {
-		fmt.Println("Failed to insert job into database:", err)
-		_ = s.storage.Delete(ctx, pdfPath)
+		s.logger.Error("Failed to begin transaction", "error", err)
+		_ = s.storage.Release(ctx, pdfPath)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create job because of db error",
 		})
 	}
-	fmt.Println("Job inserted into database with ID:", job.ID)
-
+	defer tx.Rollback()
 
-	// Store job payload in Redis
-	jobPayload := struct {
-		models.NewParseDocumentPayload
-		PDFPath string `json:"pdf_path"`
-	}{
-		NewParseDocumentPayload: payload,
-		PDFPath:                 pdfPath,
-	}
-	payloadBytes_2, _ := json.Marshal(jobPayload)
-	redisKey := fmt.Sprintf("job:%d:payload", job.ID)
-	if err := s.db.Redis.Set(ctx, redisKey, payloadBytes_2, s.cfg.Storage.TTL).Err(); err != nil {
-		fmt.Println("Failed to store job payload in Redis:", err)
-		_ = s.storage.Delete(ctx, pdfPath)
+	// Insert job into the database, with the PDF it holds
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO jobs (name, status, created_at, type, payload, owner_id, document, document_digest) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id",
+		job.Name, job.Status, time.Now(), job.Type, string(envelope), caller.ID, pdfPath, blob.Digest,
+	).Scan(&job.ID)
+	if err != nil {
+		s.logger.Error("Failed to insert job", "error", err)
+		_ = s.storage.Release(ctx, pdfPath)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to store job payload",
+			"error": "Failed to create job because of db error",
 		})
 	}
-	fmt.Println("Job payload stored in Redis under key:", redisKey)
+	s.logger.Debug("Job inserted", "jobID", job.ID)
 
-	// Set initial status in Redis
-	statusKey := fmt.Sprintf("job:%d", job.ID)
-	if err := s.db.Redis.Set(ctx, statusKey, models.StatusPending, 0).Err(); err != nil {
-		fmt.Println("Failed to set job status in Redis:", err)
-		_ = s.storage.Delete(ctx, pdfPath)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to set job status",
-		})
+	if idemKey != nil {
+		if err := s.recordIdempotencyKey(ctx, tx, caller.ID, idemKey, job.ID); err != nil {
+			_ = s.storage.Release(ctx, pdfPath)
+			if errors.Is(err, errIdempotencyKeyTaken) {
+				tx.Rollback()
+				return s.idempotencyKeyTaken(c, caller.ID, idemKey, respond)
+			}
+			s.logger.Error("Failed to record idempotency key", "jobID", job.ID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create job because of db error",
+			})
+		}
 	}
-	fmt.Println("Job status set in Redis under key:", statusKey)
 
-	// Send to Kafka
-	fmt.Println("Sending job to Kafka:", job)
-	jobBytes, _ := json.Marshal(job)
-	msg := &sarama.ProducerMessage{
-		Topic: s.cfg.Kafka.Topic,
-		Value: sarama.StringEncoder(jobBytes),
-	}
-	if _, _, err := s.producer.SendMessage(msg); err != nil {
-		fmt.Println("Failed to queue job to Kafka:", err)
-		_ = s.storage.Delete(ctx, pdfPath)
+	// Store the job payload for the worker and queue the job
+	if err := s.queueJob(ctx, tx, job, envelope); err != nil {
+		s.logger.Error("Failed to queue job", "jobID", job.ID, "error", err)
+		_ = s.storage.Release(ctx, pdfPath)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to queue job",
 		})
 	}
-	fmt.Println("Job queued successfully to Kafka topic:", s.cfg.Kafka.Topic)
-
-	// Schedule file cleanup after TTL
-	fmt.Println("Scheduling file cleanup for PDF path:", pdfPath, "after TTL:", s.cfg.Storage.TTL)
-	go func() {
-		time.Sleep(s.cfg.Storage.TTL)
-		_ = s.storage.Delete(context.Background(), pdfPath)
-		fmt.Println("Executed file cleanup for PDF path:", pdfPath)
-	}()
-
-	fmt.Println("Job processing completed for job ID:", job.ID)
-	return c.JSON(fiber.Map{
-		"job_id": job.ID,
-		"status": job.Status,
-	})
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Failed to commit job", "jobID", job.ID, "error", err)
+		_ = s.storage.Release(ctx, pdfPath)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create job because of db error",
+		})
+	}
+	s.logger.Info("Job queued in the outbox", "jobID", job.ID, "topic", s.cfg.Kafka.Topic)
+	return respondPDFJob(c, job, blob.Digest)
 }
 
-
-
 // validatePDFParsePayload validates the PDF parse job payload
 func validatePDFParsePayload(payload *models.NewParseDocumentPayload) error {
 	// Validate PDF source
@@ -201,16 +271,54 @@ func validatePDFParsePayload(payload *models.NewParseDocumentPayload) error {
 		}
 	}
 
+	return validatePDFParseRequest(payload)
+}
+
+// validatePDFParseRequest validates the fields of a PDF parse job payload
+// other than the PDF itself
+func validatePDFParseRequest(payload *models.NewParseDocumentPayload) error {
 	// Validate expected schema
 	if len(payload.ExpectedSchema) == 0 {
 		return fmt.Errorf("expected_schema is required")
 	}
 
-	// Validate that expected_schema is valid JSON
-	var js json.RawMessage
-    if err := json.Unmarshal([]byte(payload.ExpectedSchema), &js); err != nil {
-        return fmt.Errorf("invalid JSON schema: %v", err)
-    }
+	// Validate that expected_schema is a JSON object
+	if _, err := jobs.DecodeOutputSchema(json.RawMessage(payload.ExpectedSchema)); err != nil {
+		return fmt.Errorf("invalid JSON schema: %v", err)
+	}
 
+	if utf8.RuneCountInString(payload.Description) > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+	if payload.WebhookURL != "" {
+		u, err := url.ParseRequestURI(payload.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook_url must be an http or https URL")
+		}
+	}
+	return validateParseOptions(&payload.Options)
+}
+
+// validateParseOptions validates the options of a PDF parse job
+func validateParseOptions(options *models.ParseDocumentOptions) error {
+	if options.Language != "" && !languageTag.MatchString(options.Language) {
+		return fmt.Errorf("options.language must be a BCP 47 language tag such as \"en\" or \"pt-BR\"")
+	}
+	// Text is only read from text-based PDFs so far
+	if options.OCREnabled {
+		return fmt.Errorf("options.ocr_enabled is not supported yet")
+	}
+	if options.ConfidenceThreshold < 0 || options.ConfidenceThreshold > 1 {
+		return fmt.Errorf("options.confidence_threshold must be between 0.0 and 1.0")
+	}
+	if options.MaxPages < 0 {
+		return fmt.Errorf("options.max_pages must not be negative")
+	}
+	if options.ParsingMethod != "" {
+		method := strings.ToLower(strings.TrimSpace(options.ParsingMethod))
+		if !slices.Contains(jobs.RegisteredExtractors(), method) {
+			return fmt.Errorf("options.parsing_method must be one of: %s", strings.Join(jobs.RegisteredExtractors(), ", "))
+		}
+	}
 	return nil
 }
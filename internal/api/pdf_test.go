@@ -3,117 +3,164 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
-	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/IBM/sarama"
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
-	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/fetch"
+	"github.com/illegalcall/task-master/internal/jobs"
 	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/storage"
 )
 
-// MockStorage implements storage.Storage interface for testing
+// MockStorage implements storage.Storage interface for testing. Calls are
+// recorded without their context: handlers pass fasthttp's request context,
+// which is reused once the request is done.
 type MockStorage struct {
 	mock.Mock
 }
 
-func (m *MockStorage) StoreFromURL(ctx context.Context, url string) (string, error) {
-	args := m.Called(ctx, url)
-	return args.String(0), args.Error(1)
+func (m *MockStorage) StoreFromURL(ctx context.Context, url string) (storage.Blob, error) {
+	args := m.Called(url)
+	return storage.Blob{Path: args.String(0)}, args.Error(1)
 }
 
-func (m *MockStorage) StoreFromBytes(ctx context.Context, data []byte) (string, error) {
-	args := m.Called(ctx, data)
-	return args.String(0), args.Error(1)
+func (m *MockStorage) StoreFromBytes(ctx context.Context, data []byte) (storage.Blob, error) {
+	args := m.Called(data)
+	return storage.Blob{Path: args.String(0)}, args.Error(1)
 }
 
-func (m *MockStorage) Delete(ctx context.Context, path string) error {
-	args := m.Called(ctx, path)
+func (m *MockStorage) StoreFromReader(ctx context.Context, r io.Reader) (storage.Blob, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return storage.Blob{}, err
+	}
+	args := m.Called(data)
+	return storage.Blob{Path: args.String(0)}, args.Error(1)
+}
+
+func (m *MockStorage) Release(ctx context.Context, path string) error {
+	args := m.Called(path)
 	return args.Error(0)
 }
 
+func (m *MockStorage) Exists(ctx context.Context, path string) (bool, error) {
+	args := m.Called(path)
+	return args.Bool(0), args.Error(1)
+}
+
+// insertPDFJob is the statement creating a PDF parse job
+var insertPDFJob = regexp.QuoteMeta("INSERT INTO jobs (name, status, created_at, type, payload, owner_id, document, document_digest) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id")
+
+// expectPDFJob expects a PDF parse job to be created with ID jobID and
+// queued through the outbox
+func expectPDFJob(mock sqlmock.Sqlmock, jobID int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertPDFJob).
+		WithArgs("PDF Parse Job", models.StatusPending, sqlmock.AnyArg(), models.JobTypePDFParse, sqlmock.AnyArg(), alice.ID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(jobID))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("test-topic", nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
 func TestHandlePDFParseJob(t *testing.T) {
-	// Setup test server with mocked storage
-	app := fiber.New()
+	server, dbMock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
 	mockStorage := &MockStorage{}
-	
-	cfg := &config.Config{
-		Storage: config.StorageConfig{
-			TempDir: os.TempDir(),
-			MaxSize: 10 * 1024 * 1024,
-			TTL:     time.Hour,
-		},
-	}
-
-	app.Post("/api/jobs/parse-document", (&Server{
-		app:     app,
-		cfg:     cfg,
-		storage: mockStorage,
-		// Mock other dependencies as needed
-	}).handlePDFParseJob)
+	server.storage = mockStorage
 
 	tests := []struct {
 		name           string
-		payload        models.ParseDocumentPayload
-		setupMocks     func(*MockStorage)
+		payload        models.NewParseDocumentPayload
+		setupMocks     func(*MockStorage, sqlmock.Sqlmock)
 		expectedStatus int
 		expectError    bool
 	}{
 		{
 			name: "Valid URL PDF Source",
-			payload: models.ParseDocumentPayload{
+			payload: models.NewParseDocumentPayload{
 				PDFSource:      "https://example.com/test.pdf",
-				ExpectedSchema: json.RawMessage(`{"type": "object"}`),
-				Description:    "Test PDF parsing",
-				WebhookURL:    "https://webhook.example.com",
+				ExpectedSchema: `{"type": "object"}`,
+				Name:           "invoice",
 			},
-			setupMocks: func(m *MockStorage) {
-				m.On("StoreFromURL", mock.Anything, "https://example.com/test.pdf").
+			setupMocks: func(m *MockStorage, db sqlmock.Sqlmock) {
+				m.On("StoreFromURL", "https://example.com/test.pdf").
 					Return("/tmp/test.pdf", nil)
-				m.On("Delete", mock.Anything, "/tmp/test.pdf").
-					Return(nil)
+				expectPDFJob(db, 1)
 			},
 			expectedStatus: fiber.StatusOK,
 			expectError:    false,
 		},
 		{
 			name: "Valid Base64 PDF Source",
-			payload: models.ParseDocumentPayload{
+			payload: models.NewParseDocumentPayload{
 				PDFSource:      base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n...")),
-				ExpectedSchema: json.RawMessage(`{"type": "object"}`),
+				ExpectedSchema: `{"type": "object"}`,
+				Name:           "invoice",
 			},
-			setupMocks: func(m *MockStorage) {
-				m.On("StoreFromBytes", mock.Anything, mock.Anything).
+			setupMocks: func(m *MockStorage, db sqlmock.Sqlmock) {
+				m.On("StoreFromBytes", mock.Anything).
 					Return("/tmp/test.pdf", nil)
-				m.On("Delete", mock.Anything, "/tmp/test.pdf").
-					Return(nil)
+				expectPDFJob(db, 2)
 			},
 			expectedStatus: fiber.StatusOK,
 			expectError:    false,
 		},
 		{
 			name: "Storage Error",
-			payload: models.ParseDocumentPayload{
+			payload: models.NewParseDocumentPayload{
 				PDFSource:      "https://example.com/test.pdf",
-				ExpectedSchema: json.RawMessage(`{"type": "object"}`),
+				ExpectedSchema: `{"type": "object"}`,
+				Name:           "invoice",
 			},
-			setupMocks: func(m *MockStorage) {
-				m.On("StoreFromURL", mock.Anything, mock.Anything).
+			setupMocks: func(m *MockStorage, db sqlmock.Sqlmock) {
+				m.On("StoreFromURL", mock.Anything).
 					Return("", assert.AnError)
 			},
 			expectedStatus: fiber.StatusInternalServerError,
 			expectError:    true,
 		},
+		{
+			name: "URL May Not Be Fetched",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "http://169.254.169.254/latest/meta-data",
+				ExpectedSchema: `{"type": "object"}`,
+				Name:           "invoice",
+			},
+			setupMocks: func(m *MockStorage, db sqlmock.Sqlmock) {
+				m.On("StoreFromURL", mock.Anything).
+					Return("", fmt.Errorf("failed to download file: %w", fetch.ErrBlocked))
+			},
+			expectedStatus: fiber.StatusBadRequest,
+			expectError:    true,
+		},
+		{
+			name: "Schema Is Not An Object",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `["type"]`,
+				Name:           "invoice",
+			},
+			expectedStatus: fiber.StatusBadRequest,
+			expectError:    true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -122,7 +169,7 @@ func TestHandlePDFParseJob(t *testing.T) {
 			mockStorage.ExpectedCalls = nil
 			mockStorage.Calls = nil
 			if tt.setupMocks != nil {
-				tt.setupMocks(mockStorage)
+				tt.setupMocks(mockStorage, dbMock)
 			}
 
 			// Convert payload to JSON
@@ -130,11 +177,12 @@ func TestHandlePDFParseJob(t *testing.T) {
 			require.NoError(t, err)
 
 			// Create request
-			req := httptest.NewRequest("POST", "/api/jobs/parse-document", bytes.NewReader(payloadBytes))
+			req := httptest.NewRequest("POST", "/jobs/parse-document", bytes.NewReader(payloadBytes))
 			req.Header.Set("Content-Type", "application/json")
+			authorize(t, server, req, alice)
 
 			// Execute request
-			resp, err := app.Test(req)
+			resp, err := server.app.Test(req)
 			require.NoError(t, err)
 
 			// Check status code
@@ -157,6 +205,7 @@ func TestHandlePDFParseJob(t *testing.T) {
 
 			// Verify all mock expectations were met
 			mockStorage.AssertExpectations(t)
+			assert.NoError(t, dbMock.ExpectationsWereMet())
 		})
 	}
 }
@@ -164,44 +213,123 @@ func TestHandlePDFParseJob(t *testing.T) {
 func TestValidatePDFParsePayload(t *testing.T) {
 	tests := []struct {
 		name        string
-		payload     models.ParseDocumentPayload
+		payload     models.NewParseDocumentPayload
 		expectError bool
 	}{
 		{
 			name: "Valid URL payload",
-			payload: models.ParseDocumentPayload{
+			payload: models.NewParseDocumentPayload{
 				PDFSource:      "https://example.com/test.pdf",
-				ExpectedSchema: json.RawMessage(`{"type": "object"}`),
+				ExpectedSchema: `{"type": "object"}`,
 			},
 			expectError: false,
 		},
 		{
 			name: "Valid base64 payload",
-			payload: models.ParseDocumentPayload{
+			payload: models.NewParseDocumentPayload{
 				PDFSource:      base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\ntest")),
-				ExpectedSchema: json.RawMessage(`{"type": "object"}`),
+				ExpectedSchema: `{"type": "object"}`,
 			},
 			expectError: false,
 		},
 		{
 			name: "Empty PDF source",
-			payload: models.ParseDocumentPayload{
-				ExpectedSchema: json.RawMessage(`{"type": "object"}`),
+			payload: models.NewParseDocumentPayload{
+				ExpectedSchema: `{"type": "object"}`,
 			},
 			expectError: true,
 		},
 		{
 			name: "Empty schema",
-			payload: models.ParseDocumentPayload{
+			payload: models.NewParseDocumentPayload{
 				PDFSource: "https://example.com/test.pdf",
 			},
 			expectError: true,
 		},
 		{
 			name: "Invalid schema JSON",
-			payload: models.ParseDocumentPayload{
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{invalid`,
+			},
+			expectError: true,
+		},
+		{
+			name: "Valid options",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{"type": "object"}`,
+				Description:    "Extract the invoice total",
+				Options: models.ParseDocumentOptions{
+					Language:            "pt-BR",
+					ConfidenceThreshold: 0.8,
+					MaxPages:            3,
+					ParsingMethod:       "OpenAI",
+				},
+				WebhookURL: "https://hooks.example.com/parsed",
+			},
+			expectError: false,
+		},
+		{
+			name: "Invalid language",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{"type": "object"}`,
+				Options:        models.ParseDocumentOptions{Language: "Brazilian Portuguese"},
+			},
+			expectError: true,
+		},
+		{
+			name: "OCR requested",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{"type": "object"}`,
+				Options:        models.ParseDocumentOptions{OCREnabled: true},
+			},
+			expectError: true,
+		},
+		{
+			name: "Confidence threshold out of range",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{"type": "object"}`,
+				Options:        models.ParseDocumentOptions{ConfidenceThreshold: 1.5},
+			},
+			expectError: true,
+		},
+		{
+			name: "Negative max pages",
+			payload: models.NewParseDocumentPayload{
 				PDFSource:      "https://example.com/test.pdf",
-				ExpectedSchema: json.RawMessage(`{invalid`),
+				ExpectedSchema: `{"type": "object"}`,
+				Options:        models.ParseDocumentOptions{MaxPages: -1},
+			},
+			expectError: true,
+		},
+		{
+			name: "Unknown parsing method",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{"type": "object"}`,
+				Options:        models.ParseDocumentOptions{ParsingMethod: "tesseract"},
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid webhook URL",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{"type": "object"}`,
+				WebhookURL:     "ftp://hooks.example.com/parsed",
+			},
+			expectError: true,
+		},
+		{
+			name: "Description too long",
+			payload: models.NewParseDocumentPayload{
+				PDFSource:      "https://example.com/test.pdf",
+				ExpectedSchema: `{"type": "object"}`,
+				Description:    strings.Repeat("a", maxDescriptionLength+1),
 			},
 			expectError: true,
 		},
@@ -224,20 +352,20 @@ func TestParseDocumentHandler(t *testing.T) {
 	defer miniRedis.Close()
 
 	// Test payload
-	payload := models.ParseDocumentPayload{
-		PDFSource:      "data:application/pdf;base64,JVBER...",
-		ExpectedSchema: json.RawMessage(`{"field": "value"}`),
+	payload := models.NewParseDocumentPayload{
+		PDFSource:      base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\ntest")),
+		ExpectedSchema: `{"field": "value"}`,
+		Name:           "invoice",
 	}
 	body, _ := json.Marshal(payload)
 
 	// Expect job creation with PDF parse type
-	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO jobs (name, status, type) VALUES ($1, $2, $3) RETURNING id")).
-		WithArgs("PDF Parse Job", models.StatusPending, models.JobTypePDFParse).
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	expectPDFJob(mock, 1)
 
 	// Create test request
-	req := httptest.NewRequest("POST", "/api/jobs/parse-document", bytes.NewReader(body))
+	req := httptest.NewRequest("POST", "/jobs/parse-document", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
+	authorize(t, server, req, alice)
 
 	// Run the test
 	resp, err := server.app.Test(req)
@@ -256,24 +384,18 @@ func TestParseDocumentHandler(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, models.StatusPending, redisVal)
 
-	// Verify Redis payload
+	// The worker gets the stored PDF and the schema in an envelope
 	payloadVal, err := miniRedis.Get("job:1:payload")
 	assert.NoError(t, err)
-	assert.NotEmpty(t, payloadVal)
-
-	// Verify Kafka message
-	mockProducer := server.producer.(*MockProducer)
-	assert.Len(t, mockProducer.messages, 1)
-	kafkaMsg := mockProducer.messages[0]
-	assert.Equal(t, server.cfg.Kafka.Topic, kafkaMsg.Topic)
-
-	var jobMsg models.Job
-	err = json.Unmarshal([]byte(kafkaMsg.Value.(sarama.StringEncoder)), &jobMsg)
-	assert.NoError(t, err)
-	assert.Equal(t, 1, jobMsg.ID)
-	assert.Equal(t, "PDF Parse Job", jobMsg.Name)
-	assert.Equal(t, models.StatusPending, jobMsg.Status)
-	assert.Equal(t, models.JobTypePDFParse, jobMsg.Type)
+	var envelope jobs.Envelope
+	require.NoError(t, json.Unmarshal([]byte(payloadVal), &envelope))
+	assert.Equal(t, jobs.SchemaVersion, envelope.SchemaVersion)
+	assert.Equal(t, models.JobTypePDFParse, envelope.Type)
+	var stored jobs.ParseDocumentPayload
+	require.NoError(t, json.Unmarshal(envelope.Payload, &stored))
+	assert.Equal(t, "path", stored.DocumentType)
+	assert.FileExists(t, stored.Document)
+	assert.Equal(t, map[string]interface{}{"field": "value"}, stored.OutputSchema)
 
 	// Verify mock expectations
 	assert.NoError(t, mock.ExpectationsWereMet())
@@ -288,20 +410,20 @@ func TestParseDocumentHandlerIntegration(t *testing.T) {
 	defer miniRedis.Close()
 
 	// Test payload with real PDF data
-	payload := models.ParseDocumentPayload{
+	payload := models.NewParseDocumentPayload{
 		PDFSource:      "https://example.com/test.pdf",
-		ExpectedSchema: json.RawMessage(`{"field": "value"}`),
+		ExpectedSchema: `{"field": "value"}`,
+		Name:           "invoice",
 	}
 	body, _ := json.Marshal(payload)
 
 	// Expect job creation with PDF parse type
-	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO jobs (name, status, type) VALUES ($1, $2, $3) RETURNING id")).
-		WithArgs("PDF Parse Job", models.StatusPending, models.JobTypePDFParse).
-		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	expectPDFJob(mock, 1)
 
 	// Create test request
-	req := httptest.NewRequest("POST", "/api/jobs/parse-document", bytes.NewReader(body))
+	req := httptest.NewRequest("POST", "/jobs/parse-document", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
+	authorize(t, server, req, alice)
 
 	// Run the test
 	resp, err := server.app.Test(req)
@@ -317,4 +439,50 @@ func TestParseDocumentHandlerIntegration(t *testing.T) {
 
 	// Verify mock expectations
 	assert.NoError(t, mock.ExpectationsWereMet())
-} 
\ No newline at end of file
+}
+
+func TestHandlePDFParseJobReusesStoredPDF(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+	dir := setupUploadStorage(t, server, 1024)
+
+	// The same invoice submitted twice is stored once, with a reference
+	// per job
+	body, _ := json.Marshal(models.NewParseDocumentPayload{
+		PDFSource:      base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\ninvoice")),
+		ExpectedSchema: `{"total": "number"}`,
+	})
+	sum := sha256.Sum256([]byte("%PDF-1.4\ninvoice"))
+	var documents []string
+	for jobID := 1; jobID <= 2; jobID++ {
+		expectPDFJob(mock, jobID)
+		req := httptest.NewRequest("POST", "/jobs/parse-document", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		authorize(t, server, req, alice)
+		resp, err := server.app.Test(req)
+		require.NoError(t, err)
+		require.Equal(t, fiber.StatusOK, resp.StatusCode)
+		var result map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, hex.EncodeToString(sum[:]), result["digest"])
+
+		stored, err := miniRedis.Get(fmt.Sprintf("job:%d:payload", jobID))
+		require.NoError(t, err)
+		env, err := jobs.DecodeEnvelope([]byte(stored), models.JobTypePDFParse)
+		require.NoError(t, err)
+		var payload jobs.ParseDocumentPayload
+		require.NoError(t, json.Unmarshal(env.Payload, &payload))
+		documents = append(documents, payload.Document)
+	}
+	require.NoError(t, mock.ExpectationsWereMet())
+	assert.NotEqual(t, documents[0], documents[1])
+	assert.Len(t, storedFiles(t, filepath.Join(dir, "blobs")), 1)
+
+	// The PDF is kept until the last job referencing it expires
+	require.NoError(t, server.storage.Release(context.Background(), documents[0]))
+	exists, err := server.storage.Exists(context.Background(), documents[1])
+	require.NoError(t, err)
+	assert.True(t, exists)
+	require.NoError(t, server.storage.Release(context.Background(), documents[1]))
+	assert.Empty(t, storedFiles(t, dir))
+}
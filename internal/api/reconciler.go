@@ -0,0 +1,20 @@
+package api
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+// handleGetReconcilerStats returns what the workers' job reconciler fixed:
+// stuck jobs requeued or failed and Redis statuses repaired, over all passes
+func (s *Server) handleGetReconcilerStats(c *fiber.Ctx) error {
+	var stats models.ReconcilerStats
+	if err := s.db.Redis.HGetAll(c.Context(), models.ReconcilerStatsKey).Scan(&stats); err != nil {
+		s.logger.Error("Failed to fetch reconciler stats", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch reconciler stats",
+		})
+	}
+	return c.JSON(stats)
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+func TestHandleGetReconcilerStats(t *testing.T) {
+	server, _, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	miniRedis.HSet(models.ReconcilerStatsKey,
+		models.ReconcilerStatRuns, "12",
+		models.ReconcilerStatRequeued, "3",
+		models.ReconcilerStatRedisRepaired, "5",
+		models.ReconcilerStatLastRunAt, "2024-01-01T00:00:00Z",
+	)
+
+	req := authorize(t, server, httptest.NewRequest("GET", "/reconciler/stats", nil), root)
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	var stats models.ReconcilerStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, models.ReconcilerStats{Runs: 12, Requeued: 3, RedisRepaired: 5, LastRunAt: "2024-01-01T00:00:00Z"}, stats)
+
+	// Stats are admin only
+	req = authorize(t, server, httptest.NewRequest("GET", "/reconciler/stats", nil), alice)
+	resp, err = server.app.Test(req)
+	require.NoError(t, err)
+	assert.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+}
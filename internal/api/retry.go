@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/illegalcall/task-master/internal/jobs"
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/outbox"
+)
+
+var (
+	errJobNotRetryable = errors.New("only failed jobs can be retried")
+	errJobInputExpired = errors.New("the job's stored input has expired; submit the job again")
+	errJobInputInvalid = errors.New("the job's stored input is no longer valid")
+)
+
+// handleRetryJob re-queues a failed job
+func (s *Server) handleRetryJob(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	jobID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid job ID",
+		})
+	}
+
+	var job models.Job
+	err = s.db.DB.Get(&job, "SELECT "+models.JobColumns+" FROM jobs WHERE id = $1", jobID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !caller.CanAccess(job.OwnerID)) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found",
+		})
+	}
+	if err != nil {
+		s.logger.Error("Error fetching job", "jobID", jobID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to retry job",
+		})
+	}
+
+	job, err = s.retryJob(c.Context(), job)
+	if err != nil {
+		return c.Status(retryErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"job": job,
+	})
+}
+
+// handleRetryJobs re-queues the caller's failed jobs matching the same
+// filters as GET /api/jobs, at most limit of them per request
+func (s *Server) handleRetryJobs(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	query, err := parseJobListQuery(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	query.Status = models.StatusFailed
+	query.Cursor = nil
+
+	var ownerID *int
+	if !caller.IsAdmin() {
+		ownerID = &caller.ID
+	}
+
+	var jobs []models.Job
+	pageQuery, pageArgs := query.pageSQL(ownerID)
+	if err := s.db.DB.Select(&jobs, pageQuery, pageArgs...); err != nil {
+		s.logger.Error("Error fetching failed jobs", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch jobs"})
+	}
+
+	// Retried jobs stop matching the filter, so repeating the request
+	// continues with the next batch
+	hasMore := len(jobs) > query.Limit
+	if hasMore {
+		jobs = jobs[:query.Limit]
+	}
+
+	retried := []int{}
+	failures := []fiber.Map{}
+	for _, job := range jobs {
+		if _, err := s.retryJob(c.Context(), job); err != nil {
+			failures = append(failures, fiber.Map{"job_id": job.ID, "error": err.Error()})
+			continue
+		}
+		retried = append(retried, job.ID)
+	}
+
+	return c.JSON(fiber.Map{
+		"retried":  retried,
+		"errors":   failures,
+		"has_more": hasMore,
+	})
+}
+
+// retryJob checks that a failed job can still run, resets it to pending
+// and queues it again
+func (s *Server) retryJob(ctx context.Context, job models.Job) (models.Job, error) {
+	return s.resetFailedJob(ctx, job, func(job models.Job) (outbox.Message, error) {
+		value, err := json.Marshal(jobs.NewMessage(job))
+		return outbox.Message{Topic: s.cfg.Kafka.Topic, Value: value}, err
+	})
+}
+
+// resetFailedJob resets a failed job to pending, counting the retry and
+// starting its attempts over, once its input is checked to still be
+// available. The payload kept in Postgres is stored in Redis again for the
+// worker, as the copy there expires after Storage.TTL. The job's Kafka
+// message, returned by message for the reset job, is added to the outbox in
+// the same transaction, so the job is queued if and only if it is reset.
+func (s *Server) resetFailedJob(ctx context.Context, job models.Job, message func(models.Job) (outbox.Message, error)) (models.Job, error) {
+	if job.Status != models.StatusFailed {
+		return job, errJobNotRetryable
+	}
+
+	tx, err := s.db.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Failed to begin transaction", "jobID", job.ID, "error", err)
+		return job, errors.New("failed to reset job")
+	}
+	defer tx.Rollback()
+
+	// The status condition makes concurrent retries of the same job queue it once
+	var payload []byte
+	err = tx.QueryRowContext(ctx,
+		"UPDATE jobs SET status = $1, error = NULL, result = NULL, started_at = NULL, finished_at = NULL, attempts = 0, retries = retries + 1 WHERE id = $2 AND status = $3 RETURNING retries, payload",
+		models.StatusPending, job.ID, models.StatusFailed,
+	).Scan(&job.Retries, &payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, errJobNotRetryable
+	}
+	if err != nil {
+		s.logger.Error("Failed to reset job for retry", "jobID", job.ID, "error", err)
+		return job, errors.New("failed to reset job")
+	}
+	if len(payload) == 0 {
+		return job, errJobInputExpired
+	}
+	if job.Type == models.JobTypePDFParse {
+		if err := s.checkPDFJobInput(ctx, payload); err != nil {
+			return job, err
+		}
+	}
+	// Stored before the commit, like queueJob does, so the worker finds the
+	// payload whenever the message arrives
+	if err := s.db.Redis.Set(ctx, fmt.Sprintf("job:%d:payload", job.ID), payload, s.cfg.Storage.TTL).Err(); err != nil {
+		s.logger.Error("Failed to restore job payload", "jobID", job.ID, "error", err)
+		return job, errors.New("failed to queue job")
+	}
+	job.Status = models.StatusPending
+	job.Error = nil
+	job.StartedAt = nil
+	job.FinishedAt = nil
+	job.Attempts = 0
+
+	msg, err := message(job)
+	if err == nil {
+		err = outbox.Enqueue(ctx, tx, msg)
+	}
+	if err != nil {
+		s.logger.Error("Failed to queue retried job", "jobID", job.ID, "error", err)
+		return job, errors.New("failed to queue job")
+	}
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Failed to commit job retry", "jobID", job.ID, "error", err)
+		return job, errors.New("failed to reset job")
+	}
+
+	if err := s.db.Redis.Set(ctx, fmt.Sprintf("job:%d", job.ID), models.StatusPending, 0).Err(); err != nil {
+		s.logger.Warn("Failed to update Redis status to pending", "jobID", job.ID, "error", err)
+	}
+	if err := s.db.Redis.Del(ctx, fmt.Sprintf("job:%d:result", job.ID)).Err(); err != nil {
+		s.logger.Warn("Failed to invalidate cached job result", "jobID", job.ID, "error", err)
+	}
+	return job, nil
+}
+
+// checkPDFJobInput re-validates the stored payload envelope of a PDF parse
+// job and checks that its PDF hasn't been cleaned up after Storage.TTL
+func (s *Server) checkPDFJobInput(ctx context.Context, data []byte) error {
+	env, err := jobs.DecodeEnvelope(data, models.JobTypePDFParse)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJobInputInvalid, err)
+	}
+	jobType, _ := jobs.LookupJobType(models.JobTypePDFParse)
+	prepared, err := jobType.Prepare(env.Payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJobInputInvalid, err)
+	}
+	payload := prepared.(*jobs.ParseDocumentPayload)
+	if payload.DocumentType != "path" {
+		return nil
+	}
+
+	exists, err := s.storage.Exists(ctx, payload.Document)
+	if err != nil {
+		return fmt.Errorf("failed to check stored PDF: %w", err)
+	}
+	if !exists {
+		return errJobInputExpired
+	}
+	return nil
+}
+
+// retryErrorStatus maps a retryJob error to an HTTP status
+func retryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errJobNotRetryable):
+		return fiber.StatusConflict
+	case errors.Is(err, errJobInputExpired):
+		return fiber.StatusGone
+	case errors.Is(err, errJobInputInvalid):
+		return fiber.StatusUnprocessableEntity
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/jobs"
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+var resetJob = regexp.QuoteMeta("UPDATE jobs SET status = $1, error = NULL, result = NULL, started_at = NULL, finished_at = NULL, attempts = 0, retries = retries + 1 WHERE id = $2 AND status = $3 RETURNING retries, payload")
+
+// testPayload is the stored payload envelope of the test jobs
+const testPayload = `{"schema_version":2,"type":"test_job","payload":{}}`
+
+// resetRow returns the row of resetJob for a job with the given stored
+// payload
+func resetRow(retries int, payload interface{}) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"retries", "payload"}).AddRow(retries, payload)
+}
+
+// expectRetry expects a failed job holding payload to be reset with its
+// retries counted and its message, matched by message, added to the outbox
+// in one transaction
+func expectRetry(mock sqlmock.Sqlmock, jobID, retries int, payload string, message sqlmock.Argument) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(resetJob).
+		WithArgs(models.StatusPending, jobID, models.StatusFailed).
+		WillReturnRows(resetRow(retries, []byte(payload)))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("test-topic", nil, message, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func jobRow(id int, status, jobType string) *sqlmock.Rows {
+	return sqlmock.NewRows(jobColumns).
+		AddRow(id, "Test Job", status, jobType, time.Now(), "boom", time.Now(), time.Now(), 3, alice.ID, 0, nil)
+}
+
+// pdfPayload returns the payload envelope handlePDFParseJob stores for a
+// PDF parse job of pdfPath
+func pdfPayload(t *testing.T, pdfPath string) string {
+	payload, err := encodeEnvelope(models.JobTypePDFParse, jobs.ParseDocumentPayload{
+		Document:     pdfPath,
+		DocumentType: "path",
+		OutputSchema: map[string]interface{}{"type": "object"},
+	})
+	require.NoError(t, err)
+	return string(payload)
+}
+
+func TestHandleRetryJob(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	selectJob := regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")
+	retry := func(jobID int, user models.User) (int, map[string]interface{}) {
+		req := authorize(t, server, httptest.NewRequest("POST", fmt.Sprintf("/jobs/%d/retry", jobID), nil), user)
+		resp, err := server.app.Test(req)
+		require.NoError(t, err)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	// A failed job is reset, its cached result dropped and it is queued
+	// again, with its payload back in Redis after it expired there
+	miniRedis.Set("job:1", models.StatusFailed)
+	miniRedis.Set("job:1:result", `{"stale": true}`)
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(jobRow(1, models.StatusFailed, "test_job"))
+	message := &capturedMessage{}
+	expectRetry(mock, 1, 1, testPayload, message)
+
+	status, body := retry(1, alice)
+	require.Equal(t, fiber.StatusOK, status, body)
+	job := body["job"].(map[string]interface{})
+	assert.Equal(t, models.StatusPending, job["status"])
+	assert.Equal(t, float64(1), job["retries"])
+	assert.Nil(t, job["error"])
+	assert.Equal(t, float64(0), job["attempts"], "a retried job starts its attempts over")
+
+	redisStatus, _ := miniRedis.Get("job:1")
+	assert.Equal(t, models.StatusPending, redisStatus)
+	assert.False(t, miniRedis.Exists("job:1:result"), "the cached result should be invalidated")
+	payload, _ := miniRedis.Get("job:1:payload")
+	assert.Equal(t, testPayload, payload)
+	assert.Equal(t, server.cfg.Storage.TTL, miniRedis.TTL("job:1:payload"))
+	assert.Contains(t, string(message.value), `"id":1`)
+	assert.Contains(t, string(message.value), `"attempts":0`)
+
+	// Only failed jobs can be retried
+	mock.ExpectQuery(selectJob).WithArgs(2).WillReturnRows(jobRow(2, models.StatusProcessing, "test_job"))
+	status, _ = retry(2, alice)
+	assert.Equal(t, fiber.StatusConflict, status)
+
+	// A job without a stored payload can't run again
+	mock.ExpectQuery(selectJob).WithArgs(3).WillReturnRows(jobRow(3, models.StatusFailed, models.JobTypePDFParse))
+	mock.ExpectBegin()
+	mock.ExpectQuery(resetJob).WithArgs(models.StatusPending, 3, models.StatusFailed).WillReturnRows(resetRow(1, nil))
+	mock.ExpectRollback()
+	status, body = retry(3, alice)
+	assert.Equal(t, fiber.StatusGone, status)
+	assert.Equal(t, errJobInputExpired.Error(), body["error"])
+
+	// Neither can a PDF job whose PDF was already cleaned up
+	mock.ExpectQuery(selectJob).WithArgs(4).WillReturnRows(jobRow(4, models.StatusFailed, models.JobTypePDFParse))
+	mock.ExpectBegin()
+	mock.ExpectQuery(resetJob).
+		WithArgs(models.StatusPending, 4, models.StatusFailed).
+		WillReturnRows(resetRow(1, []byte(pdfPayload(t, filepath.Join(server.cfg.Storage.TempDir, "pdf-deleted.pdf")))))
+	mock.ExpectRollback()
+	status, _ = retry(4, alice)
+	assert.Equal(t, fiber.StatusGone, status)
+	assert.False(t, miniRedis.Exists("job:4:payload"))
+
+	// A PDF job whose input is still stored is re-queued
+	blob, err := server.storage.StoreFromBytes(context.Background(), []byte("%PDF-1.4\ntest"))
+	require.NoError(t, err)
+	mock.ExpectQuery(selectJob).WithArgs(5).WillReturnRows(jobRow(5, models.StatusFailed, models.JobTypePDFParse))
+	expectRetry(mock, 5, 2, pdfPayload(t, blob.Path), sqlmock.AnyArg())
+	status, _ = retry(5, alice)
+	assert.Equal(t, fiber.StatusOK, status)
+
+	// Other users' jobs are not found
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(jobRow(1, models.StatusFailed, "test_job"))
+	status, _ = retry(1, bob)
+	assert.Equal(t, fiber.StatusNotFound, status)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleRetryJobs(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	// Failed jobs matching the filter are selected, one page at a time
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT "+models.JobColumns+" FROM jobs WHERE owner_id = $1 AND status = $2 AND type = $3 ORDER BY created_at DESC, id DESC LIMIT $4")).
+		WithArgs(alice.ID, models.StatusFailed, "test_job", 3).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(1, "Test Job", models.StatusFailed, "test_job", time.Now(), "boom", nil, nil, 3, alice.ID, 0, nil).
+			AddRow(2, "Test Job", models.StatusFailed, "test_job", time.Now(), "boom", nil, nil, 3, alice.ID, 0, nil).
+			AddRow(3, "Test Job", models.StatusFailed, "test_job", time.Now(), "boom", nil, nil, 3, alice.ID, 0, nil))
+	expectRetry(mock, 1, 1, testPayload, sqlmock.AnyArg())
+	// Job 2 was retried concurrently by someone else, so nothing is queued
+	mock.ExpectBegin()
+	mock.ExpectQuery(resetJob).
+		WithArgs(models.StatusPending, 2, models.StatusFailed).
+		WillReturnRows(sqlmock.NewRows([]string{"retries", "payload"}))
+	mock.ExpectRollback()
+
+	// The status filter is always "failed", whatever the caller passes
+	req := authorize(t, server, httptest.NewRequest("POST", "/jobs/retry?type=test_job&status=completed&limit=2", nil), alice)
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	var body struct {
+		Retried []int `json:"retried"`
+		Errors  []struct {
+			JobID int    `json:"job_id"`
+			Error string `json:"error"`
+		} `json:"errors"`
+		HasMore bool `json:"has_more"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, []int{1}, body.Retried)
+	require.Len(t, body.Errors, 1)
+	assert.Equal(t, 2, body.Errors[0].JobID)
+	assert.True(t, body.HasMore)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -2,20 +2,26 @@ package api
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cache"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	jwtware "github.com/gofiber/jwt/v3"
+	"github.com/jmoiron/sqlx"
 
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/fetch"
+	"github.com/illegalcall/task-master/internal/jobs"
 	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/outbox"
 	"github.com/illegalcall/task-master/internal/storage"
 	"github.com/illegalcall/task-master/pkg/database"
 )
@@ -31,12 +37,12 @@ type Server struct {
 
 func NewServer(cfg *config.Config, db *database.Clients, producer sarama.SyncProducer) (*Server, error) {
 	// Initialize storage
-	localStorage, err := storage.NewLocalStorage(cfg.Storage.TempDir)
+	localStorage, err := storage.NewLocalStorage(cfg.Storage.TempDir, cfg.Storage.MaxSize, fetch.New(cfg.Fetch, cfg.Storage.MaxSize))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize storage: %w", err)
 	}
 
-	app := fiber.New()
+	app := fiber.New(appConfig())
 
 	// Middleware
 	app.Use(logger.New(logger.Config{
@@ -46,10 +52,7 @@ func NewServer(cfg *config.Config, db *database.Clients, producer sarama.SyncPro
 		Max:        cfg.Server.MaxRequests,
 		Expiration: cfg.Server.RequestTimeout,
 	}))
-	app.Use(cache.New(cache.Config{
-		Expiration:   cfg.Server.CacheExpiration,
-		CacheControl: true,
-	}))
+	app.Use(responseCache(cfg.Server.CacheExpiration))
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:3000",
@@ -58,6 +61,7 @@ func NewServer(cfg *config.Config, db *database.Clients, producer sarama.SyncPro
 		ExposeHeaders:    "Content-Length, Content-Type",
 		AllowCredentials: true,
 	}))
+	app.Use(bufferBody(fiber.DefaultBodyLimit))
 
 	server := &Server{
 		app:      app,
@@ -79,6 +83,7 @@ func (s *Server) setupRoutes() {
 
 	// Public routes
 	api.Post("/login", s.handleLogin)
+	api.Post("/register", s.handleRegister)
 
 	// Protected routes
 	protected := api.Use(jwtware.New(jwtware.Config{
@@ -86,25 +91,77 @@ func (s *Server) setupRoutes() {
 	}))
 	protected.Post("/jobs", s.handleCreateJob)
 	protected.Get("/jobs/:id", s.handleGetJob)
+	protected.Get("/jobs/:id/result", s.handleGetJobResult)
+	protected.Post("/jobs/:id/cancel", s.handleCancelJob)
+	protected.Post("/jobs/:id/retry", s.handleRetryJob)
+	protected.Post("/jobs/retry", s.handleRetryJobs)
+	protected.Get("/dead-letters", s.requireAdmin, s.handleListDeadLetters)
+	protected.Get("/dead-letters/:id", s.requireAdmin, s.handleGetDeadLetter)
+	protected.Post("/dead-letters/:id/replay", s.requireAdmin, s.handleReplayDeadLetter)
+	protected.Delete("/dead-letters/:id", s.requireAdmin, s.handleDeleteDeadLetter)
+	protected.Delete("/dead-letters", s.requireAdmin, s.handlePurgeDeadLetters)
+	protected.Get("/reconciler/stats", s.requireAdmin, s.handleGetReconcilerStats)
 	protected.Get("/jobs", s.handleListJobs)
 	protected.Post("/jobs/parse-document", s.handlePDFParseJob)
+	protected.Put("/users/me/password", s.handleChangePassword)
+}
+
+// Storage returns where the server stores submitted documents
+func (s *Server) Storage() storage.Storage {
+	return s.storage
 }
 
 func (s *Server) Start() error {
 	return s.app.Listen(s.cfg.Server.Port)
 }
 
+// Shutdown stops accepting connections and waits for in-flight requests to
+// finish until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.app.ShutdownWithContext(ctx)
+}
+
 func (s *Server) handleCreateJob(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	idemKey, err := requestIdempotencyKey(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	respond := func(job models.Job) error {
+		return c.JSON(fiber.Map{
+			"job": job,
+		})
+	}
+	if idemKey != nil {
+		if replayed, err := s.replayIdempotentJob(c, caller.ID, idemKey, respond); replayed {
+			return err
+		}
+	}
+
 	// Parse request
 	var req struct {
-		Name string `json:"name"`
-		Type string `json:"type"`
+		Name    string          `json:"name"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+		RunAt   *time.Time      `json:"run_at"`
+		Delay   string          `json:"delay"`
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
+	if len(req.Payload) == 0 {
+		req.Payload = json.RawMessage("{}")
+	}
 
 	// Validate
 	if req.Name == "" {
@@ -119,13 +176,57 @@ func (s *Server) handleCreateJob(c *fiber.Ctx) error {
 		})
 	}
 
-	// Insert job into database
+	// Only public job types can be created here; the others have their own
+	// endpoints that prepare the payload
+	jobType, ok := jobs.LookupJobType(req.Type)
+	if !ok || !jobType.Public {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Unknown job type %q", req.Type),
+		})
+	}
+	if _, err := jobType.Prepare(req.Payload); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	envelope, err := encodeEnvelope(req.Type, req.Payload)
+	if err != nil {
+		s.logger.Error("Failed to encode job payload", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create job",
+		})
+	}
+	runAt, err := scheduledRunAt(req.RunAt, req.Delay, time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	status := models.StatusPending
+	if runAt != nil {
+		status = models.StatusScheduled
+	}
+
+	// The job row and its Kafka message are committed together; the outbox
+	// relay publishes the message
+	tx, err := s.db.DB.BeginTxx(c.Context(), nil)
+	if err != nil {
+		s.logger.Error("Failed to begin transaction", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create job",
+		})
+	}
+	defer tx.Rollback()
+
+	// Insert job into database. Scheduled jobs keep their payload here until
+	// they are due, as Redis only holds it for Storage.TTL.
 	var jobID int
-	err := s.db.DB.QueryRow(
-		"INSERT INTO jobs (name, status, type) VALUES ($1, $2, $3) RETURNING id",
-		req.Name, models.StatusPending, req.Type,
+	err = tx.QueryRowContext(c.Context(),
+		"INSERT INTO jobs (name, status, type, owner_id, payload, run_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		req.Name, status, req.Type, caller.ID, string(envelope), runAt,
 	).Scan(&jobID)
 	if err != nil {
+		s.logger.Error("Failed to insert job", "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create job",
 		})
@@ -133,38 +234,112 @@ func (s *Server) handleCreateJob(c *fiber.Ctx) error {
 
 	// Create job object
 	job := models.Job{
-		ID:     jobID,
-		Name:   req.Name,
-		Status: models.StatusPending,
-		Type:   req.Type,
+		ID:      jobID,
+		Name:    req.Name,
+		Status:  status,
+		Type:    req.Type,
+		OwnerID: &caller.ID,
+		RunAt:   runAt,
 	}
 
-	// Set initial status in Redis
-	redisKey := fmt.Sprintf("job:%d", jobID)
-	if err := s.db.Redis.Set(c.Context(), redisKey, models.StatusPending, 0).Err(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to set job status",
-		})
+	if idemKey != nil {
+		if err := s.recordIdempotencyKey(c.Context(), tx, caller.ID, idemKey, jobID); err != nil {
+			if errors.Is(err, errIdempotencyKeyTaken) {
+				tx.Rollback()
+				return s.idempotencyKeyTaken(c, caller.ID, idemKey, respond)
+			}
+			s.logger.Error("Failed to record idempotency key", "jobID", jobID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to create job",
+			})
+		}
 	}
-
-	// Send to Kafka
-	jobBytes, _ := json.Marshal(job)
-	msg := &sarama.ProducerMessage{
-		Topic: s.cfg.Kafka.Topic,
-		Value: sarama.StringEncoder(jobBytes),
+	// Scheduled jobs are queued by the scheduler once they are due
+	if runAt != nil {
+		err = s.db.Redis.Set(c.Context(), fmt.Sprintf("job:%d", jobID), models.StatusScheduled, 0).Err()
+	} else {
+		err = s.queueJob(c.Context(), tx, job, envelope)
 	}
-	if _, _, err := s.producer.SendMessage(msg); err != nil {
+	if err != nil {
+		s.logger.Error("Failed to queue job", "jobID", jobID, "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to queue job",
 		})
 	}
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Failed to commit job", "jobID", jobID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create job",
+		})
+	}
 
-	return c.JSON(fiber.Map{
-		"job": job,
+	return respond(job)
+}
+
+// scheduledRunAt returns when a job submitted at now with the given run_at
+// or delay should run, or nil if it should run right away. A time that has
+// already passed runs the job right away.
+func scheduledRunAt(runAt *time.Time, delay string, now time.Time) (*time.Time, error) {
+	if runAt != nil && delay != "" {
+		return nil, errors.New("Only one of run_at and delay can be set")
+	}
+	if delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("Invalid delay %q: must be a non-negative duration such as 90s or 2h", delay)
+		}
+		due := now.Add(d)
+		runAt = &due
+	}
+	if runAt == nil || !runAt.After(now) {
+		return nil, nil
+	}
+	// Timestamps are stored without a time zone, in the server's local time
+	// zone, so runAt is converted to it
+	due := runAt.In(now.Location())
+	return &due, nil
+}
+
+// queueJob stores the payload envelope and initial status of a job inserted
+// by tx for the worker, and adds the job's Kafka message to the outbox so it
+// is published once tx commits. Redis is written first so the worker finds
+// the payload whenever the message arrives; if tx rolls back, the keys are
+// left behind for a job ID that is never used.
+func (s *Server) queueJob(ctx context.Context, tx *sqlx.Tx, job models.Job, envelope []byte) error {
+	value, err := json.Marshal(jobs.NewMessage(job))
+	if err != nil {
+		return fmt.Errorf("failed to encode job message: %w", err)
+	}
+	if err := s.db.Redis.Set(ctx, fmt.Sprintf("job:%d:payload", job.ID), envelope, s.cfg.Storage.TTL).Err(); err != nil {
+		return fmt.Errorf("failed to store job payload: %w", err)
+	}
+	if err := s.db.Redis.Set(ctx, fmt.Sprintf("job:%d", job.ID), models.StatusPending, 0).Err(); err != nil {
+		return fmt.Errorf("failed to set job status: %w", err)
+	}
+	return outbox.Enqueue(ctx, tx, outbox.Message{
+		Topic: s.cfg.Kafka.Topic,
+		Value: value,
 	})
 }
 
+// encodeEnvelope encodes a job payload in its envelope, the form the worker
+// reads it in
+func encodeEnvelope(jobType string, payload interface{}) ([]byte, error) {
+	envelope, err := jobs.NewEnvelope(jobType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
 func (s *Server) handleGetJob(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	jobID, err := c.ParamsInt("id")
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -173,9 +348,10 @@ func (s *Server) handleGetJob(c *fiber.Ctx) error {
 	}
 
 	var job models.Job
-	query := "SELECT id, name, status, type FROM jobs WHERE id = $1"
+	query := "SELECT " + models.JobColumns + " FROM jobs WHERE id = $1"
 	err = s.db.DB.Get(&job, query, jobID)
-	if err != nil {
+	// Other users' jobs are reported as missing so their IDs can't be probed
+	if err != nil || !caller.CanAccess(job.OwnerID) {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Job not found",
 		})
@@ -192,22 +368,156 @@ func (s *Server) handleGetJob(c *fiber.Ctx) error {
 	})
 }
 
-func (s *Server) handleListJobs(c *fiber.Ctx) error {
-	var jobs []models.Job
-	err := s.db.DB.Select(&jobs, "SELECT id, name, status, type FROM jobs ORDER BY created_at DESC")
+// handleGetJobResult returns the stored result of a job. Postgres holds the
+// result; Redis only caches completed results for Storage.TTL.
+func (s *Server) handleGetJobResult(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	jobID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid job ID",
+		})
+	}
+
+	// Ownership is always checked against Postgres; the cache is keyed by job only
+	var row struct {
+		Status  string  `db:"status"`
+		Error   *string `db:"error"`
+		OwnerID *int    `db:"owner_id"`
+	}
+	err = s.db.DB.Get(&row, "SELECT status, error, owner_id FROM jobs WHERE id = $1", jobID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !caller.CanAccess(row.OwnerID)) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found",
+		})
+	}
 	if err != nil {
-		slog.Error("Error fetching jobs", "error", err)
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch jobs"})
+		s.logger.Error("Error fetching job result", "jobID", jobID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch job result",
+		})
+	}
+
+	if !isFinished(row.Status) {
+		// Not finished yet
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"job_id": jobID,
+			"status": row.Status,
+		})
+	}
+
+	response := fiber.Map{
+		"job_id": jobID,
+		"status": row.Status,
+		"result": nil,
+	}
+	if row.Error != nil {
+		response["error"] = *row.Error
+	}
+	if row.Status != models.StatusCompleted {
+		return c.JSON(response)
 	}
 
-	// Update statuses from Redis
-	ctx := context.Background()
-	for i, job := range jobs {
-		redisKey := fmt.Sprintf("job:%d", job.ID)
-		if redisStatus, err := s.db.Redis.Get(ctx, redisKey).Result(); err == nil {
-			jobs[i].Status = redisStatus
+	cacheKey := fmt.Sprintf("job:%d:result", jobID)
+	if cached, err := s.db.Redis.Get(c.Context(), cacheKey).Bytes(); err == nil {
+		response["result"] = json.RawMessage(cached)
+		return c.JSON(response)
+	}
+
+	var result []byte
+	if err := s.db.DB.Get(&result, "SELECT result FROM jobs WHERE id = $1", jobID); err != nil {
+		s.logger.Error("Error fetching job result", "jobID", jobID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch job result",
+		})
+	}
+	if len(result) > 0 {
+		if err := s.db.Redis.Set(c.Context(), cacheKey, result, s.cfg.Storage.TTL).Err(); err != nil {
+			s.logger.Warn("Failed to cache job result", "jobID", jobID, "error", err)
 		}
+		response["result"] = json.RawMessage(result)
 	}
+	return c.JSON(response)
+}
 
-	return c.JSON(fiber.Map{"jobs": jobs})
+// isFinished reports whether a job status is terminal
+func isFinished(status string) bool {
+	switch status {
+	case models.StatusCompleted, models.StatusFailed, models.StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// handleCancelJob marks a pending or processing job as cancelled and tells
+// the workers, so a running job is aborted and a queued one is skipped
+func (s *Server) handleCancelJob(c *fiber.Ctx) error {
+	caller, err := currentUser(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	jobID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid job ID",
+		})
+	}
+
+	var row struct {
+		Status  string `db:"status"`
+		OwnerID *int   `db:"owner_id"`
+	}
+	err = s.db.DB.Get(&row, "SELECT status, owner_id FROM jobs WHERE id = $1", jobID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !caller.CanAccess(row.OwnerID)) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found",
+		})
+	}
+	if err != nil {
+		s.logger.Error("Error fetching job", "jobID", jobID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel job",
+		})
+	}
+
+	// Only unfinished jobs can be cancelled; the status condition keeps a
+	// worker that finishes concurrently from being overwritten
+	result, err := s.db.DB.Exec(
+		"UPDATE jobs SET status = $1, finished_at = $2 WHERE id = $3 AND status IN ($4, $5, $6)",
+		models.StatusCancelled, time.Now(), jobID, models.StatusScheduled, models.StatusPending, models.StatusProcessing,
+	)
+	if err != nil {
+		s.logger.Error("Failed to cancel job", "jobID", jobID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel job",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":  "Job has already finished",
+			"status": row.Status,
+		})
+	}
+
+	if err := s.db.Redis.Set(c.Context(), fmt.Sprintf("job:%d", jobID), models.StatusCancelled, 0).Err(); err != nil {
+		s.logger.Warn("Failed to update Redis status to cancelled", "jobID", jobID, "error", err)
+	}
+	if err := s.db.Redis.Publish(c.Context(), models.JobCancelChannel, jobID).Err(); err != nil {
+		// Workers still skip the job when its message is consumed
+		s.logger.Warn("Failed to notify workers of cancellation", "jobID", jobID, "error", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"job_id": jobID,
+		"status": models.StatusCancelled,
+	})
 }
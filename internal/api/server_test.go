@@ -2,9 +2,14 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +17,7 @@ import (
 	"github.com/IBM/sarama"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/gofiber/fiber/v2"
+	jwtware "github.com/gofiber/jwt/v3"
 	"github.com/jmoiron/sqlx"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
@@ -120,8 +126,9 @@ func setupTestServer(t *testing.T) (*Server, sqlmock.Sqlmock, *miniredis.Minired
 	// Create test config
 	cfg := &config.Config{
 		Server: config.ServerConfig{
-			Port:        ":8080",
-			Environment: "development",
+			Port:              ":8080",
+			Environment:       "development",
+			IdempotencyWindow: time.Hour,
 		},
 		JWT: config.JWTConfig{
 			Secret:     "test-secret",
@@ -130,6 +137,14 @@ func setupTestServer(t *testing.T) (*Server, sqlmock.Sqlmock, *miniredis.Minired
 		Kafka: config.KafkaConfig{
 			Topic: "test-topic",
 		},
+		Auth: config.AuthConfig{
+			MaxFailedLogins: 3,
+			LockoutDuration: 15 * time.Minute,
+		},
+		Storage: config.StorageConfig{
+			TempDir: t.TempDir(),
+			TTL:     time.Hour,
+		},
 	}
 
 	// Create test clients
@@ -142,37 +157,90 @@ func setupTestServer(t *testing.T) (*Server, sqlmock.Sqlmock, *miniredis.Minired
 	require.NoError(t, err)
 	require.NotNil(t, server)
 
-	// Disable JWT middleware for tests
-	app := fiber.New()
+	// Skip the rate limiting and caching middleware for tests
+	app := fiber.New(appConfig())
 	server.app = app
 
 	// Register only the routes we want to test
 	app.Post("/api/login", server.handleLogin)
-	app.Post("/jobs", server.handleCreateJob)
-	app.Get("/jobs/:id", server.handleGetJob)
-	app.Get("/jobs", server.handleListJobs)
+	app.Post("/api/register", server.handleRegister)
+	app.Put("/api/users/me/password", server.handleChangePassword)
+
+	// Job routes keep the JWT middleware so ownership comes from a real token
+	requireJWT := jwtware.New(jwtware.Config{
+		SigningKey: []byte(cfg.JWT.Secret),
+	})
+	app.Post("/jobs", requireJWT, server.handleCreateJob)
+	app.Get("/jobs/:id", requireJWT, server.handleGetJob)
+	app.Get("/jobs/:id/result", requireJWT, server.handleGetJobResult)
+	app.Get("/jobs", requireJWT, server.handleListJobs)
+	app.Post("/jobs/:id/cancel", requireJWT, server.handleCancelJob)
+	app.Post("/jobs/:id/retry", requireJWT, server.handleRetryJob)
+	app.Post("/jobs/retry", requireJWT, server.handleRetryJobs)
+	app.Get("/dead-letters", requireJWT, server.requireAdmin, server.handleListDeadLetters)
+	app.Get("/dead-letters/:id", requireJWT, server.requireAdmin, server.handleGetDeadLetter)
+	app.Post("/dead-letters/:id/replay", requireJWT, server.requireAdmin, server.handleReplayDeadLetter)
+	app.Delete("/dead-letters/:id", requireJWT, server.requireAdmin, server.handleDeleteDeadLetter)
+	app.Delete("/dead-letters", requireJWT, server.requireAdmin, server.handlePurgeDeadLetters)
+	app.Get("/reconciler/stats", requireJWT, server.requireAdmin, server.handleGetReconcilerStats)
+	app.Post("/jobs/parse-document", requireJWT, server.handlePDFParseJob)
 
 	return server, mock, miniRedis
 }
 
+// Test callers; alice and bob are regular users
+var (
+	alice = models.User{ID: 7, Username: "alice", Role: models.RoleUser}
+	bob   = models.User{ID: 8, Username: "bob", Role: models.RoleUser}
+	root  = models.User{ID: 1, Username: "root", Role: models.RoleAdmin}
+)
+
+// authorize signs a token for user and attaches it to req
+func authorize(t *testing.T, server *Server, req *http.Request, user models.User) *http.Request {
+	token, err := server.issueToken(user)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// insertOutbox is the statement adding a Kafka message to the outbox
+var insertOutbox = regexp.QuoteMeta("INSERT INTO outbox (topic, key, value, headers) VALUES ($1, $2, $3, $4)")
+
+// messageContaining matches a message value argument containing substr
+type messageContaining string
+
+func (m messageContaining) Match(v driver.Value) bool {
+	value, ok := v.([]byte)
+	return ok && strings.Contains(string(value), string(m))
+}
+
+// jobColumns are the columns selected by models.JobColumns
+var jobColumns = []string{"id", "name", "status", "type", "created_at", "error", "started_at", "finished_at", "attempts", "owner_id", "retries", "run_at"}
+
+// sleepEnvelope is the stored form of the payload {"duration_ms": 10}
+const sleepEnvelope = `{"schema_version":2,"type":"sleep","payload":{"duration_ms":10}}`
+
 // 🔹 Test Job Creation
+
 func TestHandleCreateJob(t *testing.T) {
 	server, mock, miniRedis := setupTestServer(t)
 	defer miniRedis.Close()
 
-	// Expect the INSERT query with Type field
-	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO jobs (name, status, type) VALUES ($1, $2, $3) RETURNING id")).
-		WithArgs("Test Job", models.StatusPending, "test_job").
+	// The job and its Kafka message are written in one transaction
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO jobs (name, status, type, owner_id, payload, run_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id")).
+		WithArgs("Test Job", models.StatusPending, models.JobTypeSleep, alice.ID, sleepEnvelope, nil).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("test-topic", nil, messageContaining(`"id":1`), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
 	// Create test request with Type field
-	reqBody := map[string]string{
-		"name": "Test Job",
-		"type": "test_job",
-	}
-	body, _ := json.Marshal(reqBody)
+	body := []byte(`{"name": "Test Job", "type": "sleep", "payload": {"duration_ms": 10}}`)
 	req := httptest.NewRequest("POST", "/jobs", bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
+	authorize(t, server, req, alice)
 
 	// Run the test
 	resp, err := server.app.Test(req)
@@ -190,21 +258,148 @@ func TestHandleCreateJob(t *testing.T) {
 	// Validate job response fields
 	assert.Equal(t, float64(1), job["id"], "Job ID should be 1")
 	assert.Equal(t, "Test Job", job["name"], "Job name should match input")
-	assert.Equal(t, "test_job", job["type"], "Job type should match input")
+	assert.Equal(t, models.JobTypeSleep, job["type"], "Job type should match input")
 	assert.Equal(t, models.StatusPending, job["status"], "Job should be in pending state")
+	assert.Equal(t, float64(alice.ID), job["owner_id"], "Job should be owned by the caller")
 
-	// Verify Redis contains the job status
+	// Verify Redis contains the job status and the payload for the worker
 	redisVal, err := miniRedis.Get("job:1")
 	assert.NoError(t, err, "Redis should contain job key")
 	assert.Equal(t, models.StatusPending, redisVal, "Redis status should be 'pending'")
+	payload, err := miniRedis.Get("job:1:payload")
+	assert.NoError(t, err, "Redis should contain the job payload")
+	assert.JSONEq(t, sleepEnvelope, payload)
+	assert.Equal(t, time.Hour, miniRedis.TTL("job:1:payload"))
 
-	// Verify Kafka message was published
-	mockProducer := server.producer.(*MockProducer)
-	assert.Len(t, mockProducer.messages, 1, "Kafka should have 1 message")
-	assert.Contains(t, string(mockProducer.messages[0].Value.(sarama.StringEncoder)), `"id":1`, "Kafka message should contain job ID")
+	// Kafka is left to the outbox relay
+	assert.Empty(t, server.producer.(*MockProducer).messages)
 
 	// Verify mock expectations
 	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Requests without a token never reach the handler
+	req = httptest.NewRequest("POST", "/jobs", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = server.app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHandleCreateJobRollsBackWhenQueueingFails(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO jobs (name, status, type, owner_id, payload, run_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id")).
+		WithArgs("Test Job", models.StatusPending, models.JobTypeSleep, alice.ID, `{"schema_version":2,"type":"sleep","payload":{}}`, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(insertOutbox).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"name": "Test Job", "type": "sleep"}`))
+	req.Header.Set("Content-Type", "application/json")
+	authorize(t, server, req, alice)
+
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	assert.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+
+	// Without its message the job row is never committed
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleCreateJobRejectsInvalidJobs(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	for name, body := range map[string]string{
+		"unknown type":     `{"name": "Test Job", "type": "test_job"}`,
+		"non-public type":  `{"name": "Test Job", "type": "pdf_parse", "payload": {}}`,
+		"invalid payload":  `{"name": "Test Job", "type": "sleep", "payload": {"duration_ms": -1}}`,
+		"malformed":        `{"name": "Test Job", "type": "sleep", "payload": {"duration_ms": "soon"}}`,
+		"invalid delay":    `{"name": "Test Job", "type": "sleep", "delay": "tomorrow"}`,
+		"negative delay":   `{"name": "Test Job", "type": "sleep", "delay": "-5m"}`,
+		"invalid run_at":   `{"name": "Test Job", "type": "sleep", "run_at": "tomorrow"}`,
+		"run_at and delay": `{"name": "Test Job", "type": "sleep", "run_at": "2030-01-01T00:00:00Z", "delay": "5m"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			authorize(t, server, req, alice)
+
+			resp, err := server.app.Test(req)
+			require.NoError(t, err)
+			assert.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		})
+	}
+
+	// Nothing was created or queued
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, server.producer.(*MockProducer).messages)
+}
+
+func TestHandleCreateScheduledJob(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	// The job waits in Postgres with its payload; nothing is queued yet
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO jobs (name, status, type, owner_id, payload, run_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id")).
+		WithArgs("Test Job", models.StatusScheduled, models.JobTypeSleep, alice.ID, sleepEnvelope, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	body := `{"name": "Test Job", "type": "sleep", "payload": {"duration_ms": 10}, "delay": "1h"}`
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	authorize(t, server, req, alice)
+
+	before := time.Now()
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Job models.Job `json:"job"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, models.StatusScheduled, result.Job.Status)
+	require.NotNil(t, result.Job.RunAt)
+	assert.WithinDuration(t, before.Add(time.Hour), *result.Job.RunAt, time.Minute)
+
+	status, _ := miniRedis.Get("job:1")
+	assert.Equal(t, models.StatusScheduled, status)
+	assert.False(t, miniRedis.Exists("job:1:payload"), "the payload is stored once the job is due")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduledRunAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+
+	runAt, err := scheduledRunAt(nil, "", now)
+	require.NoError(t, err)
+	assert.Nil(t, runAt)
+
+	runAt, err = scheduledRunAt(nil, "90s", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(90*time.Second), *runAt)
+
+	// A zero delay or a time that has passed runs the job now
+	runAt, err = scheduledRunAt(nil, "0s", now)
+	require.NoError(t, err)
+	assert.Nil(t, runAt)
+	runAt, err = scheduledRunAt(&earlier, "", now)
+	require.NoError(t, err)
+	assert.Nil(t, runAt)
+
+	// Times in other zones are kept as the same instant
+	inTokyo := later.In(time.FixedZone("JST", 9*60*60))
+	runAt, err = scheduledRunAt(&inTokyo, "", now)
+	require.NoError(t, err)
+	assert.True(t, runAt.Equal(later))
+	assert.Equal(t, time.UTC, runAt.Location())
 }
 
 // 🔹 Test Fetching Job
@@ -219,16 +414,16 @@ func TestHandleGetJob(t *testing.T) {
 	jobStatus := models.StatusCompleted
 
 	// Expect SELECT query with Type field
-	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, status, type FROM jobs WHERE id = $1")).
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT "+models.JobColumns+" FROM jobs WHERE id = $1")).
 		WithArgs(jobID).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "status", "type"}).
-			AddRow(jobID, jobName, jobStatus, jobType))
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(jobID, jobName, jobStatus, jobType, time.Now(), nil, time.Now(), time.Now(), 2, alice.ID, 0, nil))
 
 	// Set Redis status
 	miniRedis.Set("job:1", models.StatusCompleted)
 
 	// Create test request
-	req := httptest.NewRequest("GET", "/jobs/1", nil)
+	req := authorize(t, server, httptest.NewRequest("GET", "/jobs/1", nil), alice)
 
 	// Run the test
 	resp, err := server.app.Test(req)
@@ -248,14 +443,289 @@ func TestHandleGetJob(t *testing.T) {
 	assert.Equal(t, jobName, job["name"], "Job name should match")
 	assert.Equal(t, jobType, job["type"], "Job type should match")
 	assert.Equal(t, models.StatusCompleted, job["status"], "Job status should match Redis override")
+	assert.Equal(t, float64(2), job["attempts"], "Job attempts should be returned")
+	assert.NotEmpty(t, job["finished_at"], "Job finish time should be returned")
 
 	// Verify mock expectations
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+// 🔹 Test Job Ownership
+func TestJobOwnership(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	selectJob := regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")
+	aliceJob := func() *sqlmock.Rows {
+		return sqlmock.NewRows(jobColumns).
+			AddRow(1, "Alice's Job", models.StatusPending, "test_job", time.Now(), nil, nil, nil, 0, alice.ID, 0, nil)
+	}
+
+	get := func(path string, user models.User) int {
+		resp, err := server.app.Test(authorize(t, server, httptest.NewRequest("GET", path, nil), user))
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// Other users can't see the job, and can't tell it exists
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(aliceJob())
+	assert.Equal(t, fiber.StatusNotFound, get("/jobs/1", bob))
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT status, error, owner_id FROM jobs WHERE id = $1")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "error", "owner_id"}).AddRow(models.StatusCompleted, nil, alice.ID))
+	assert.Equal(t, fiber.StatusNotFound, get("/jobs/1/result", bob))
+
+	// Admins can see everyone's jobs
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(aliceJob())
+	assert.Equal(t, fiber.StatusOK, get("/jobs/1", root))
+
+	// Jobs created before ownership was tracked are admin-only
+	mock.ExpectQuery(selectJob).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(2, "Legacy Job", models.StatusPending, "test_job", time.Now(), nil, nil, nil, 0, nil, 0, nil))
+	assert.Equal(t, fiber.StatusNotFound, get("/jobs/2", alice))
+
+	// Listing is scoped to the caller unless they are an admin
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM jobs WHERE owner_id = $1")).
+		WithArgs(bob.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE owner_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2")).
+		WithArgs(bob.ID, defaultJobListLimit+1).
+		WillReturnRows(sqlmock.NewRows(jobColumns))
+	assert.Equal(t, fiber.StatusOK, get("/jobs", bob))
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM jobs")).
+		WithoutArgs().
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs ORDER BY created_at DESC, id DESC LIMIT $1")).
+		WithArgs(defaultJobListLimit + 1).
+		WillReturnRows(aliceJob())
+	assert.Equal(t, fiber.StatusOK, get("/jobs", root))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// 🔹 Test Listing Jobs
+func TestHandleListJobs(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	list := func(path string) (int, map[string]interface{}) {
+		resp, err := server.app.Test(authorize(t, server, httptest.NewRequest("GET", path, nil), alice))
+		require.NoError(t, err)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	after := "2024-04-01T00:00:00Z"
+	afterTime, _ := time.Parse(time.RFC3339, after)
+	afterTime = afterTime.Local()
+
+	// Filters apply to both the count and the page; the extra row signals a next page
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM jobs WHERE owner_id = $1 AND status = $2 AND type = $3 AND name ILIKE $4 ESCAPE '\' AND created_at >= $5`)).
+		WithArgs(alice.ID, models.StatusCompleted, "test_job", `%50\%%`, afterTime).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT `+models.JobColumns+` FROM jobs WHERE owner_id = $1 AND status = $2 AND type = $3 AND name ILIKE $4 ESCAPE '\' AND created_at >= $5 ORDER BY created_at DESC, id DESC LIMIT $6`)).
+		WithArgs(alice.ID, models.StatusCompleted, "test_job", `%50\%%`, afterTime, 3).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(3, "50% off", models.StatusCompleted, "test_job", created, nil, nil, nil, 1, alice.ID, 0, nil).
+			AddRow(2, "50% more", models.StatusCompleted, "test_job", created, nil, nil, nil, 1, alice.ID, 0, nil).
+			AddRow(1, "50% less", models.StatusCompleted, "test_job", created, nil, nil, nil, 1, alice.ID, 0, nil))
+
+	// Redis holds a fresher status for one of the jobs
+	miniRedis.Set("job:2", models.StatusProcessing)
+
+	status, body := list("/jobs?status=completed&type=test_job&name=50%25&created_after=" + after + "&limit=2")
+	require.Equal(t, fiber.StatusOK, status)
+	assert.Equal(t, float64(5), body["total"])
+	jobs := body["jobs"].([]interface{})
+	require.Len(t, jobs, 2)
+	assert.Equal(t, models.StatusCompleted, jobs[0].(map[string]interface{})["status"])
+	assert.Equal(t, models.StatusProcessing, jobs[1].(map[string]interface{})["status"])
+
+	cursor, ok := body["next_cursor"].(string)
+	require.True(t, ok, "a next cursor should be returned when more jobs match")
+
+	// The cursor continues after the last job of the previous page
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM jobs WHERE owner_id = $1")).
+		WithArgs(alice.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE owner_id = $1 AND (created_at, id) > ($2, $3) ORDER BY created_at ASC, id ASC LIMIT $4")).
+		WithArgs(alice.ID, created, 2, 3).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(3, "50% off", models.StatusCompleted, "test_job", created, nil, nil, nil, 1, alice.ID, 0, nil))
+
+	status, body = list("/jobs?sort=created_at_asc&limit=2&cursor=" + cursor)
+	require.Equal(t, fiber.StatusOK, status)
+	assert.Len(t, body["jobs"], 1)
+	assert.NotContains(t, body, "next_cursor", "the last page has no next cursor")
+
+	// Bounds with an offset are compared as the same instant in the server's
+	// time zone, which created_at is stored in
+	before := localTime(time.Date(2024, 4, 1, 4, 0, 0, 0, time.UTC))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM jobs WHERE owner_id = $1 AND created_at < $2")).
+		WithArgs(alice.ID, before).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE owner_id = $1 AND created_at < $2 ORDER BY created_at DESC, id DESC LIMIT $3")).
+		WithArgs(alice.ID, before, 51).
+		WillReturnRows(sqlmock.NewRows(jobColumns))
+
+	status, _ = list("/jobs?created_before=2024-04-01T09:00:00%2B05:00")
+	assert.Equal(t, fiber.StatusOK, status)
+
+	// Invalid parameters are rejected before touching the database
+	for _, query := range []string{"limit=0", "limit=1000", "sort=name", "created_before=yesterday", "cursor=not-a-cursor"} {
+		status, _ := list("/jobs?" + query)
+		assert.Equal(t, fiber.StatusBadRequest, status, query)
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// localTime matches a time argument at the same instant in the server's
+// local time zone
+type localTime time.Time
+
+func (want localTime) Match(v driver.Value) bool {
+	got, ok := v.(time.Time)
+	return ok && got.Equal(time.Time(want)) && got.Location() == time.Local
+}
+
+// 🔹 Test Fetching Job Results
+func TestHandleGetJobResult(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	statusQuery := regexp.QuoteMeta("SELECT status, error, owner_id FROM jobs WHERE id = $1")
+	statusColumns := []string{"status", "error", "owner_id"}
+	resultQuery := regexp.QuoteMeta("SELECT result FROM jobs WHERE id = $1")
+
+	getResult := func(path string) (int, map[string]interface{}) {
+		req := authorize(t, server, httptest.NewRequest("GET", path, nil), alice)
+		resp, err := server.app.Test(req)
+		require.NoError(t, err)
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	// Cache miss reads Postgres and populates Redis
+	mock.ExpectQuery(statusQuery).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(models.StatusCompleted, nil, alice.ID))
+	mock.ExpectQuery(resultQuery).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"result"}).AddRow([]byte(`{"data":{"invoiceNumber":"12345"}}`)))
+
+	status, body := getResult("/jobs/1/result")
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Equal(t, models.StatusCompleted, body["status"])
+	assert.Equal(t, map[string]interface{}{"data": map[string]interface{}{"invoiceNumber": "12345"}}, body["result"])
+
+	cached, err := miniRedis.Get("job:1:result")
+	assert.NoError(t, err, "Result should be cached in Redis")
+	assert.JSONEq(t, `{"data":{"invoiceNumber":"12345"}}`, cached)
+
+	// Cache hit skips reading the result from Postgres
+	mock.ExpectQuery(statusQuery).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(models.StatusCompleted, nil, alice.ID))
+	status, body = getResult("/jobs/1/result")
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.NotNil(t, body["result"])
+
+	// Failed jobs return the stored error
+	mock.ExpectQuery(statusQuery).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(models.StatusFailed, "failed to process PDF", alice.ID))
+
+	status, body = getResult("/jobs/2/result")
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Equal(t, "failed to process PDF", body["error"])
+	assert.Nil(t, body["result"])
+	assert.False(t, miniRedis.Exists("job:2:result"), "Failed jobs should not be cached")
+
+	// Unfinished jobs are reported as accepted
+	mock.ExpectQuery(statusQuery).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(statusColumns).AddRow(models.StatusProcessing, nil, alice.ID))
+
+	status, body = getResult("/jobs/3/result")
+	assert.Equal(t, fiber.StatusAccepted, status)
+	assert.Equal(t, models.StatusProcessing, body["status"])
+
+	// Unknown jobs
+	mock.ExpectQuery(statusQuery).
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(statusColumns))
+
+	status, _ = getResult("/jobs/4/result")
+	assert.Equal(t, fiber.StatusNotFound, status)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// 🔹 Test Cancelling Jobs
+func TestHandleCancelJob(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+
+	selectJob := regexp.QuoteMeta("SELECT status, owner_id FROM jobs WHERE id = $1")
+	cancelJob := regexp.QuoteMeta("UPDATE jobs SET status = $1, finished_at = $2 WHERE id = $3 AND status IN ($4, $5, $6)")
+	jobRow := func(status string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"status", "owner_id"}).AddRow(status, alice.ID)
+	}
+
+	cancel := func(path string, user models.User) int {
+		req := authorize(t, server, httptest.NewRequest("POST", path, nil), user)
+		resp, err := server.app.Test(req)
+		require.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	// Workers are told about the cancellation
+	sub := server.db.Redis.Subscribe(context.Background(), models.JobCancelChannel)
+	defer sub.Close()
+	_, err := sub.Receive(context.Background())
+	require.NoError(t, err)
+
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(jobRow(models.StatusProcessing))
+	mock.ExpectExec(cancelJob).
+		WithArgs(models.StatusCancelled, sqlmock.AnyArg(), 1, models.StatusScheduled, models.StatusPending, models.StatusProcessing).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Equal(t, fiber.StatusOK, cancel("/jobs/1/cancel", alice))
+
+	status, _ := miniRedis.Get("job:1")
+	assert.Equal(t, models.StatusCancelled, status)
+	select {
+	case msg := <-sub.Channel():
+		assert.Equal(t, "1", msg.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("expected a cancellation message")
+	}
+
+	// Finished jobs can't be cancelled
+	mock.ExpectQuery(selectJob).WithArgs(2).WillReturnRows(jobRow(models.StatusCompleted))
+	mock.ExpectExec(cancelJob).
+		WithArgs(models.StatusCancelled, sqlmock.AnyArg(), 2, models.StatusScheduled, models.StatusPending, models.StatusProcessing).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.Equal(t, fiber.StatusConflict, cancel("/jobs/2/cancel", alice))
+
+	// Other users' jobs are not found
+	mock.ExpectQuery(selectJob).WithArgs(1).WillReturnRows(jobRow(models.StatusPending))
+	assert.Equal(t, fiber.StatusNotFound, cancel("/jobs/1/cancel", bob))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestServer(t *testing.T) {
 	cfg := &config.Config{
-		// ... config setup ...
+		Storage: config.StorageConfig{
+			TempDir: t.TempDir(),
+		},
 	}
 
 	db := &database.Clients{
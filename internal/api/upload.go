@@ -0,0 +1,267 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/storage"
+)
+
+const (
+	// documentUploadPath is where PDFs are uploaded as multipart/form-data
+	documentUploadPath = "/api/jobs/parse-document"
+	// maxFormFieldSize bounds each form field of an upload other than the
+	// file
+	maxFormFieldSize = 1024 * 1024 // 1MB
+)
+
+// errMalformedUpload marks errors reading an upload from the request, as
+// opposed to errors storing it
+var errMalformedUpload = errors.New("malformed multipart upload")
+
+// appConfig streams request bodies, so uploads are written to storage as
+// they arrive rather than read into memory first. bufferBody reads every
+// other body into memory as Fiber would.
+func appConfig() fiber.Config {
+	return fiber.Config{
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	}
+}
+
+// bufferBody reads request bodies of up to limit bytes into memory and
+// rejects larger ones, leaving document uploads streaming for their handler.
+// Uploads close the connection afterwards, since their handler may stop
+// reading before the end of the body.
+func bufferBody(limit int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		stream := c.Context().RequestBodyStream()
+		if stream == nil {
+			return c.Next()
+		}
+		if c.Method() == fiber.MethodPost && isDocumentUpload(c) && isMultipartForm(c) {
+			c.Context().SetConnectionClose()
+			return c.Next()
+		}
+
+		if c.Request().Header.ContentLength() > limit {
+			return bodyTooLarge(c, limit)
+		}
+		body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Failed to read request body",
+			})
+		}
+		if len(body) > limit {
+			return bodyTooLarge(c, limit)
+		}
+		c.Request().SetBody(body)
+		return c.Next()
+	}
+}
+
+// isDocumentUpload reports whether c is routed to the document upload
+// handler, matching its path the way the router does: ignoring trailing
+// slashes and case unless the app is configured otherwise
+func isDocumentUpload(c *fiber.Ctx) bool {
+	cfg := c.App().Config()
+	path := c.Path()
+	if !cfg.StrictRouting && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
+	if cfg.CaseSensitive {
+		return path == documentUploadPath
+	}
+	return strings.EqualFold(path, documentUploadPath)
+}
+
+// bodyTooLarge rejects a request whose body is over limit bytes. The rest of
+// the body is left unread, so the connection is closed.
+func bodyTooLarge(c *fiber.Ctx, limit int) error {
+	c.Context().SetConnectionClose()
+	return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+		"error": fmt.Sprintf("Request body exceeds the maximum allowed size of %d bytes", limit),
+	})
+}
+
+// isMultipartForm reports whether the request body is multipart/form-data
+func isMultipartForm(c *fiber.Ctx) bool {
+	return strings.HasPrefix(strings.ToLower(c.Get(fiber.HeaderContentType)), fiber.MIMEMultipartForm)
+}
+
+// uploadPart marks errors reading a part of an upload with
+// errMalformedUpload
+type uploadPart struct {
+	io.Reader
+}
+
+func (p uploadPart) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", errMalformedUpload, err)
+	}
+	return n, err
+}
+
+// handlePDFUpload handles POST /api/jobs/parse-document requests sent as
+// multipart/form-data. The PDF is the "file" part and is streamed into
+// storage as it arrives; the other fields of the JSON request are form
+// fields, with the options named as in the options object.
+func (s *Server) handlePDFUpload(c *fiber.Ctx, caller authUser) error {
+	ctx := c.Context()
+
+	// The idempotency key hashes the fields and file rather than the raw
+	// body, whose boundary changes between retries
+	hash, err := newIdempotencyHash(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "multipart/form-data request has no boundary",
+		})
+	}
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	var payload models.NewParseDocumentPayload
+	var blob storage.Blob
+	// releaseUpload releases the stored PDF of a request that creates no job
+	releaseUpload := func() {
+		if blob.Path != "" {
+			_ = s.storage.Release(ctx, blob.Path)
+		}
+	}
+	badRequest := func(message string) error {
+		releaseUpload()
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+
+	form := multipart.NewReader(body, boundary)
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return badRequest("Invalid multipart/form-data body")
+		}
+
+		if part.FormName() == "file" {
+			if blob.Path != "" {
+				return badRequest("Only one file may be uploaded")
+			}
+			var file io.Reader = uploadPart{part}
+			if hash != nil {
+				hash.Write([]byte("file\n"))
+				file = io.TeeReader(file, hash)
+			}
+			// Check the PDF magic number before storing anything
+			pdf := bufio.NewReader(file)
+			if magic, err := pdf.Peek(4); err != nil || string(magic) != "%PDF" {
+				return badRequest("invalid PDF format")
+			}
+			blob, err = s.storage.StoreFromReader(ctx, pdf)
+			if errors.Is(err, storage.ErrFileTooLarge) {
+				c.Context().SetConnectionClose()
+				return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+					"error": fmt.Sprintf("PDF exceeds the maximum allowed size of %d bytes", s.cfg.Storage.MaxSize),
+				})
+			}
+			if errors.Is(err, errMalformedUpload) {
+				return badRequest("Invalid multipart/form-data body")
+			}
+			if err != nil {
+				s.logger.Error("Failed to store uploaded PDF", "error", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": fmt.Sprintf("Failed to store PDF: %v", err),
+				})
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(uploadPart{part}, maxFormFieldSize+1))
+		if err != nil {
+			return badRequest("Invalid multipart/form-data body")
+		}
+		if len(value) > maxFormFieldSize {
+			return badRequest(fmt.Sprintf("%s must be at most %d bytes", part.FormName(), maxFormFieldSize))
+		}
+		if hash != nil {
+			fmt.Fprintf(hash, "%s=%q\n", part.FormName(), value)
+		}
+		if err := setUploadField(&payload, part.FormName(), string(value)); err != nil {
+			return badRequest(err.Error())
+		}
+	}
+
+	if blob.Path == "" {
+		return badRequest("file is required")
+	}
+	if err := validatePDFParseRequest(&payload); err != nil {
+		return badRequest(err.Error())
+	}
+
+	// Retried uploads with the same Idempotency-Key get the original job
+	var idemKey *idempotencyKey
+	if hash != nil {
+		idemKey = hash.idempotencyKey()
+		if replayed, err := s.replayIdempotentJob(c, caller.ID, idemKey, s.pdfJobResponder(c)); replayed {
+			releaseUpload()
+			return err
+		}
+	}
+
+	return s.createPDFJob(c, caller, idemKey, &payload, blob)
+}
+
+// setUploadField sets the field of payload that the form field name of an
+// upload carries. Unknown fields are ignored, as in JSON requests.
+func setUploadField(payload *models.NewParseDocumentPayload, name, value string) error {
+	var err error
+	switch name {
+	case "expected_schema":
+		payload.ExpectedSchema = value
+	case "name":
+		payload.Name = value
+	case "description":
+		payload.Description = value
+	case "webhook_url":
+		payload.WebhookURL = value
+	case "language":
+		payload.Options.Language = value
+	case "ocr_enabled":
+		if payload.Options.OCREnabled, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("ocr_enabled must be true or false")
+		}
+	case "confidence_threshold":
+		if payload.Options.ConfidenceThreshold, err = strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("confidence_threshold must be a number")
+		}
+	case "max_pages":
+		if payload.Options.MaxPages, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("max_pages must be an integer")
+		}
+	case "parsing_method":
+		payload.Options.ParsingMethod = value
+	}
+	return nil
+}
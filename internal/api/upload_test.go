@@ -0,0 +1,241 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/jobs"
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/storage"
+)
+
+// uploadPDF uploads file with the form fields as alice, sending the fields
+// before the file
+func uploadPDF(t *testing.T, server *Server, fields [][2]string, file []byte, key string) (*http.Response, map[string]interface{}) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, field := range fields {
+		require.NoError(t, form.WriteField(field[0], field[1]))
+	}
+	if file != nil {
+		part, err := form.CreateFormFile("file", "invoice.pdf")
+		require.NoError(t, err)
+		_, err = part.Write(file)
+		require.NoError(t, err)
+	}
+	require.NoError(t, form.Close())
+
+	req := httptest.NewRequest("POST", "/jobs/parse-document", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if key != "" {
+		req.Header.Set(headerIdempotencyKey, key)
+	}
+	authorize(t, server, req, alice)
+	resp, err := server.app.Test(req)
+	require.NoError(t, err)
+	var result map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return resp, result
+}
+
+// setupUploadStorage gives server a local storage holding files of up to
+// maxSize bytes and returns its directory
+func setupUploadStorage(t *testing.T, server *Server, maxSize int64) string {
+	dir := t.TempDir()
+	localStorage, err := storage.NewLocalStorage(dir, maxSize, nil)
+	require.NoError(t, err)
+	server.storage = localStorage
+	server.cfg.Storage.MaxSize = maxSize
+	return dir
+}
+
+// storedFiles lists the files under dir
+func storedFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestHandlePDFUpload(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+	dir := setupUploadStorage(t, server, 1024)
+
+	expectPDFJob(mock, 1)
+	pdf := []byte("%PDF-1.4\ninvoice")
+	resp, result := uploadPDF(t, server, [][2]string{
+		{"expected_schema", `{"total": "number"}`},
+		{"name", "invoice"},
+		{"language", "de"},
+		{"max_pages", "2"},
+	}, pdf, "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, result)
+	assert.Equal(t, float64(1), result["job_id"])
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// The worker gets the stored file and the options sent as form fields
+	stored, err := miniRedis.Get("job:1:payload")
+	require.NoError(t, err)
+	env, err := jobs.DecodeEnvelope([]byte(stored), models.JobTypePDFParse)
+	require.NoError(t, err)
+	var payload jobs.ParseDocumentPayload
+	require.NoError(t, json.Unmarshal(env.Payload, &payload))
+	assert.Equal(t, "path", payload.DocumentType)
+	assert.Equal(t, map[string]interface{}{"total": "number"}, payload.OutputSchema)
+	assert.Equal(t, jobs.ParseOptions{Language: "de", MaxPages: 2}, payload.Options)
+	content, err := os.ReadFile(payload.Document)
+	require.NoError(t, err)
+	assert.Equal(t, pdf, content)
+	require.NoError(t, server.storage.Release(context.Background(), payload.Document))
+
+	schema := [2]string{"expected_schema", `{"total": "number"}`}
+	tests := []struct {
+		name           string
+		fields         [][2]string
+		file           []byte
+		expectedStatus int
+	}{
+		{"File Too Large", [][2]string{schema}, append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte("x"), 64*1024)...), fiber.StatusRequestEntityTooLarge},
+		{"Not A PDF", [][2]string{schema}, []byte("<html></html>"), fiber.StatusBadRequest},
+		{"Missing File", [][2]string{schema}, nil, fiber.StatusBadRequest},
+		{"Missing Schema", nil, pdf, fiber.StatusBadRequest},
+		{"Invalid Option", [][2]string{schema, {"max_pages", "two"}}, pdf, fiber.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, result := uploadPDF(t, server, tt.fields, tt.file, "")
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			assert.NotEmpty(t, result["error"])
+
+			// Nothing is left in storage
+			assert.Empty(t, storedFiles(t, dir))
+		})
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// selectDocumentDigest looks up the digest a replayed PDF parse job responds with
+var selectDocumentDigest = regexp.QuoteMeta("SELECT document_digest FROM jobs WHERE id = $1")
+
+// capturedHash matches any request hash and keeps it
+type capturedHash struct {
+	value string
+}
+
+func (h *capturedHash) Match(v driver.Value) bool {
+	h.value, _ = v.(string)
+	return true
+}
+
+func TestHandlePDFUploadReplaysIdempotentRequest(t *testing.T) {
+	server, mock, miniRedis := setupTestServer(t)
+	defer miniRedis.Close()
+	dir := setupUploadStorage(t, server, 1024)
+	fields := [][2]string{{"expected_schema", `{"total": "number"}`}}
+	pdf := []byte("%PDF-1.4\ninvoice")
+
+	hash := &capturedHash{}
+	mock.ExpectQuery(selectIdempotencyKey).
+		WithArgs(alice.ID, "key-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertPDFJob).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(insertIdempotencyKey).
+		WithArgs(alice.ID, "key-1", hash, 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOutbox).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	resp, result := uploadPDF(t, server, fields, pdf, "key-1")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.NoError(t, mock.ExpectationsWereMet())
+	sum := sha256.Sum256(pdf)
+	digest := hex.EncodeToString(sum[:])
+	assert.Equal(t, digest, result["digest"])
+
+	// The retry is sent with another boundary but gets the same job, and its
+	// copy of the file is not kept
+	mock.ExpectQuery(selectIdempotencyKey).
+		WithArgs(alice.ID, "key-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}).AddRow(hash.value, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + models.JobColumns + " FROM jobs WHERE id = $1")).
+		WithArgs(1).
+		WillReturnRows(jobRow(1, models.StatusPending, models.JobTypePDFParse))
+	mock.ExpectQuery(selectDocumentDigest).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"document_digest"}).AddRow(digest))
+	resp, result = uploadPDF(t, server, fields, pdf, "key-1")
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(1), result["job_id"])
+	assert.Equal(t, digest, result["digest"])
+	assert.Equal(t, "true", resp.Header.Get(headerIdempotentReplayed))
+	assert.Len(t, storedFiles(t, filepath.Join(dir, "refs")), 1)
+
+	// A different file with the same key is rejected
+	mock.ExpectQuery(selectIdempotencyKey).
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "job_id"}).AddRow(hash.value, 1))
+	resp, _ = uploadPDF(t, server, fields, []byte("%PDF-1.4\nreceipt"), "key-1")
+	assert.Equal(t, fiber.StatusConflict, resp.StatusCode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBufferBody(t *testing.T) {
+	app := fiber.New(appConfig())
+	app.Use(bufferBody(16))
+	app.Post("/echo", func(c *fiber.Ctx) error {
+		return c.Send(c.Body())
+	})
+
+	send := func(body string) *http.Response {
+		resp, err := app.Test(httptest.NewRequest("POST", "/echo", strings.NewReader(body)))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := send("small body")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "small body", string(body))
+
+	// Bodies over the limit are rejected, including ones larger than what
+	// Fiber reads before streaming
+	assert.Equal(t, fiber.StatusRequestEntityTooLarge, send(strings.Repeat("x", 17)).StatusCode)
+	assert.Equal(t, fiber.StatusRequestEntityTooLarge, send(strings.Repeat("x", 64*1024)).StatusCode)
+
+	// Uploads stream to their handler under any path the router sends there
+	app.Post(documentUploadPath, func(c *fiber.Ctx) error {
+		_, err := io.Copy(io.Discard, c.Context().RequestBodyStream())
+		return err
+	})
+	for _, path := range []string{documentUploadPath, documentUploadPath + "/", strings.ToUpper(documentUploadPath)} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(strings.Repeat("x", 64*1024)))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		assert.Equal(t, fiber.StatusOK, resp.StatusCode, path)
+	}
+}
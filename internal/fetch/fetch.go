@@ -0,0 +1,246 @@
+// Package fetch downloads documents from, and sends requests to,
+// user-supplied URLs. Since the URLs come from users, hosts are checked
+// against allow and deny lists, and the addresses they resolve to are
+// checked when connecting, so neither a host name nor a redirect can reach
+// loopback, link-local or private addresses. Downloads are bounded in size,
+// redirects and time, and must be PDFs.
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+)
+
+// defaultTimeout bounds downloads when no timeout is configured
+const defaultTimeout = 30 * time.Second
+
+var (
+	// ErrBlocked is returned for URLs whose host is denied or not allowed,
+	// or that resolve to an address that may not be fetched
+	ErrBlocked = errors.New("URL may not be fetched")
+	// ErrTooLarge is returned once a download exceeds the maximum size
+	ErrTooLarge = errors.New("document exceeds the maximum allowed size")
+	// ErrNotPDF is returned for downloads that aren't PDFs
+	ErrNotPDF = errors.New("document is not a PDF")
+	// ErrTooManyRedirects is returned when a download is redirected more
+	// often than allowed
+	ErrTooManyRedirects = errors.New("too many redirects")
+)
+
+// pdfContentTypes are the content types a PDF may be served with. A
+// response without a content type is accepted too; either way the body
+// must start with the PDF magic number.
+var pdfContentTypes = map[string]bool{
+	"application/pdf":          true,
+	"application/x-pdf":        true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// Fetcher downloads PDFs within the limits of a config.FetchConfig
+type Fetcher struct {
+	cfg      config.FetchConfig
+	maxBytes int64
+	client   *http.Client
+}
+
+// New returns a Fetcher downloading documents of up to maxBytes bytes; a
+// maxBytes of 0 or less means no limit
+func New(cfg config.FetchConfig, maxBytes int64) *Fetcher {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	f := &Fetcher{cfg: cfg, maxBytes: maxBytes}
+
+	dialer := &net.Dialer{Timeout: cfg.Timeout, Control: f.checkAddress}
+	f.client = &http.Client{
+		// Proxies are not used, since the address checked would be the
+		// proxy's rather than the host's
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: cfg.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: f.checkRedirect,
+	}
+	return f
+}
+
+// Open starts downloading rawURL and returns the body once the response is
+// known to be a PDF. Reading the body fails with ErrTooLarge once it
+// exceeds the maximum size. The download must finish within the timeout,
+// and the body must be closed.
+func (f *Fetcher) Open(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	fail := func(err error) (io.ReadCloser, error) {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("unexpected status %d", resp.StatusCode))
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !pdfContentTypes[strings.ToLower(mediaType)] {
+			return fail(fmt.Errorf("%w: content type %q", ErrNotPDF, contentType))
+		}
+	}
+	if f.maxBytes > 0 && resp.ContentLength > f.maxBytes {
+		return fail(ErrTooLarge)
+	}
+
+	var r io.Reader = resp.Body
+	if f.maxBytes > 0 {
+		r = &limitedReader{r: r, remaining: f.maxBytes}
+	}
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(4); err != nil || string(magic) != "%PDF" {
+		if errors.Is(err, ErrTooLarge) {
+			return fail(ErrTooLarge)
+		}
+		return fail(ErrNotPDF)
+	}
+	return &responseBody{Reader: buffered, body: resp.Body, cancel: cancel}, nil
+}
+
+// Do sends req under the same checks as downloads on its URL, its redirects
+// and the addresses connected to, for requests other than downloads such as
+// webhook notifications. Unlike Open, it doesn't check the response or apply
+// the timeout to reading it.
+func (f *Fetcher) Do(req *http.Request) (*http.Response, error) {
+	if err := f.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	return f.client.Do(req)
+}
+
+// checkURL checks the scheme and host of a URL to be fetched
+func (f *Fetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be http or https", ErrBlocked)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("%w: URL has no host", ErrBlocked)
+	}
+	if matchHost(host, f.cfg.DeniedHosts) {
+		return fmt.Errorf("%w: host %q is denied", ErrBlocked, host)
+	}
+	if len(f.cfg.AllowedHosts) > 0 && !matchHost(host, f.cfg.AllowedHosts) {
+		return fmt.Errorf("%w: host %q is not allowed", ErrBlocked, host)
+	}
+	return nil
+}
+
+// checkRedirect checks every redirect target like the original URL
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.cfg.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	return f.checkURL(req.URL)
+}
+
+// checkAddress refuses connections to addresses that may not be fetched.
+// It runs for the address a host name resolved to, just before connecting,
+// so a host can't resolve to one address when checked and another when
+// connected to.
+func (f *Fetcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: invalid address %q", ErrBlocked, address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: invalid address %q", ErrBlocked, address)
+	}
+	if !f.cfg.AllowPrivateNetworks && isPrivateAddress(ip) {
+		return fmt.Errorf("%w: address %s is not public", ErrBlocked, ip)
+	}
+	return nil
+}
+
+// isPrivateAddress reports whether ip is a loopback, link-local, private
+// (RFC 1918 or unique local), unspecified or multicast address
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// matchHost reports whether host is one of hosts or a subdomain of one
+func matchHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		h = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+		if h != "" && (host == h || strings.HasSuffix(host, "."+h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseBody is the body of a download. Closing it ends the download's
+// timeout.
+type responseBody struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (b *responseBody) Close() error {
+	defer b.cancel()
+	return b.body.Close()
+}
+
+// limitedReader fails with ErrTooLarge once more than remaining bytes are
+// read from r
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrTooLarge
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		// Only the bytes within the limit are returned
+		return n + int(l.remaining), ErrTooLarge
+	}
+	return n, err
+}
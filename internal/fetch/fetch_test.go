@@ -0,0 +1,186 @@
+package fetch
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/config"
+)
+
+const testPDF = "%PDF-1.4\ninvoice"
+
+// local allows the loopback addresses test servers listen on
+var local = config.FetchConfig{AllowPrivateNetworks: true, MaxRedirects: 2}
+
+func serve(t *testing.T, handler http.HandlerFunc) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func servePDF(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/pdf")
+	io.WriteString(w, testPDF)
+}
+
+func fetch(f *Fetcher, url string) (string, error) {
+	body, err := f.Open(context.Background(), url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	return string(data), err
+}
+
+func TestOpen(t *testing.T) {
+	url := serve(t, servePDF)
+
+	data, err := fetch(New(local, 1024), url)
+	require.NoError(t, err)
+	assert.Equal(t, testPDF, data)
+
+	// Without AllowPrivateNetworks the loopback server can't be reached
+	_, err = fetch(New(config.FetchConfig{}, 1024), url)
+	assert.ErrorIs(t, err, ErrBlocked)
+}
+
+func TestOpenChecksHosts(t *testing.T) {
+	url := serve(t, servePDF)
+
+	cases := map[string]struct {
+		allowed, denied []string
+		want            error
+	}{
+		"allowed":              {allowed: []string{"127.0.0.1"}},
+		"not allowed":          {allowed: []string{"example.com"}, want: ErrBlocked},
+		"denied":               {denied: []string{"127.0.0.1"}, want: ErrBlocked},
+		"denied despite allow": {allowed: []string{"127.0.0.1"}, denied: []string{"127.0.0.1"}, want: ErrBlocked},
+	}
+	for name, tc := range cases {
+		cfg := local
+		cfg.AllowedHosts, cfg.DeniedHosts = tc.allowed, tc.denied
+		_, err := fetch(New(cfg, 1024), url)
+		if tc.want == nil {
+			assert.NoError(t, err, name)
+		} else {
+			assert.ErrorIs(t, err, tc.want, name)
+		}
+	}
+
+	_, err := fetch(New(local, 1024), "file:///etc/passwd")
+	assert.ErrorIs(t, err, ErrBlocked)
+}
+
+func TestOpenFollowsRedirects(t *testing.T) {
+	target := serve(t, servePDF)
+	redirect := func(to string) string {
+		return serve(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, to, http.StatusFound)
+		})
+	}
+	twice := redirect(redirect(target))
+
+	data, err := fetch(New(local, 1024), twice)
+	require.NoError(t, err)
+	assert.Equal(t, testPDF, data)
+
+	_, err = fetch(New(local, 1024), redirect(twice))
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Redirect targets are checked like the URL itself
+	cfg := local
+	cfg.DeniedHosts = []string{"localhost"}
+	_, err = fetch(New(cfg, 1024), redirect(strings.Replace(target, "127.0.0.1", "localhost", 1)))
+	assert.ErrorIs(t, err, ErrBlocked)
+}
+
+func TestOpenChecksDocument(t *testing.T) {
+	large := strings.Repeat("x", 2048)
+	cases := map[string]struct {
+		handler http.HandlerFunc
+		want    error
+	}{
+		"too large": {func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, testPDF+large)
+		}, ErrTooLarge},
+		"too large without length": {func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/pdf")
+			io.WriteString(w, testPDF)
+			w.(http.Flusher).Flush()
+			io.WriteString(w, large)
+		}, ErrTooLarge},
+		"html": {func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, testPDF)
+		}, ErrNotPDF},
+		"not a pdf": {func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.WriteString(w, "MZ executable")
+		}, ErrNotPDF},
+	}
+	for name, tc := range cases {
+		_, err := fetch(New(local, 1024), serve(t, tc.handler))
+		assert.ErrorIs(t, err, tc.want, name)
+	}
+
+	// A document of exactly the maximum size is fetched
+	data, err := fetch(New(local, int64(len(testPDF))), serve(t, servePDF))
+	require.NoError(t, err)
+	assert.Equal(t, testPDF, data)
+}
+
+func TestOpenTimesOut(t *testing.T) {
+	url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		servePDF(w, r)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+
+	cfg := local
+	cfg.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := fetch(New(cfg, 1024), url)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestDo(t *testing.T) {
+	url := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	do := func(f *Fetcher, url string) error {
+		req, err := http.NewRequest("POST", url, strings.NewReader("{}"))
+		require.NoError(t, err)
+		resp, err := f.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, do(New(local, 0), url))
+	assert.ErrorIs(t, do(New(config.FetchConfig{}, 0), url), ErrBlocked)
+	assert.ErrorIs(t, do(New(local, 0), "file:///etc/passwd"), ErrBlocked)
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "fe80::1", "fd00::1", "0.0.0.0", "::ffff:127.0.0.1"} {
+		assert.True(t, isPrivateAddress(net.ParseIP(addr)), addr)
+	}
+	for _, addr := range []string{"8.8.8.8", "172.32.0.1", "2606:4700::1111"} {
+		assert.False(t, isPrivateAddress(net.ParseIP(addr)), addr)
+	}
+}
@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+// SchemaVersion is the version of the job envelopes and payloads written by
+// this build. Version 1 is the bare payload stored before envelopes existed.
+const SchemaVersion = 2
+
+// ErrUnsupportedSchemaVersion marks jobs written by a newer build. They are
+// retried rather than failed, so a worker of that build can run them.
+var ErrUnsupportedSchemaVersion = errors.New("unsupported job schema version")
+
+// Envelope is the canonical form of a job's payload, as the API stores it
+// for the worker: the payload with its job type and the schema version it
+// was written at
+type Envelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// NewEnvelope wraps payload, a JSON document or a value to encode as one,
+// in an envelope at the current SchemaVersion
+func NewEnvelope(jobType string, payload interface{}) (Envelope, error) {
+	raw, ok := payload.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(payload); err != nil {
+			return Envelope{}, fmt.Errorf("failed to encode %s payload: %w", jobType, err)
+		}
+	}
+	return Envelope{SchemaVersion: SchemaVersion, Type: jobType, Payload: raw}, nil
+}
+
+// DecodeEnvelope reads the stored payload of a job of type jobType and
+// upgrades it to the current SchemaVersion. Bare payloads written before
+// envelopes existed are read as version 1. Errors wrap ErrInvalidJob, or
+// ErrUnsupportedSchemaVersion for payloads written by a newer build.
+func DecodeEnvelope(data []byte, jobType string) (Envelope, error) {
+	env := Envelope{SchemaVersion: 1, Type: jobType, Payload: data}
+	var stored struct {
+		SchemaVersion *int            `json:"schema_version"`
+		Type          string          `json:"type"`
+		Payload       json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &stored); err == nil && stored.SchemaVersion != nil {
+		env = Envelope{SchemaVersion: *stored.SchemaVersion, Type: stored.Type, Payload: stored.Payload}
+	}
+
+	if env.Type != jobType {
+		return Envelope{}, fmt.Errorf("%w: payload is for a %q job, not %q", ErrInvalidJob, env.Type, jobType)
+	}
+	t, ok := LookupJobType(env.Type)
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: unknown job type %q", ErrInvalidJob, env.Type)
+	}
+	return t.Upgrade(env)
+}
+
+// Message is the Kafka message announcing a job. SchemaVersion is the
+// version of the build that queued it, so a worker can tell that the job's
+// payload may be newer than it understands.
+type Message struct {
+	models.Job
+	SchemaVersion int `json:"schema_version"`
+}
+
+// NewMessage returns the Kafka message announcing job
+func NewMessage(job models.Job) Message {
+	return Message{Job: job, SchemaVersion: SchemaVersion}
+}
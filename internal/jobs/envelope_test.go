@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	// Current envelopes are read as they are
+	env, err := NewEnvelope(models.JobTypeSleep, SleepPayload{DurationMs: 10})
+	if err != nil {
+		t.Fatalf("Expected envelope, got error: %v", err)
+	}
+	data, _ := json.Marshal(env)
+	decoded, err := DecodeEnvelope(data, models.JobTypeSleep)
+	if err != nil {
+		t.Fatalf("Expected envelope to decode, got error: %v", err)
+	}
+	if decoded.SchemaVersion != SchemaVersion || string(decoded.Payload) != `{"duration_ms":10}` {
+		t.Errorf("Unexpected envelope: %+v", decoded)
+	}
+
+	// Bare payloads stored before envelopes existed are version 1
+	decoded, err = DecodeEnvelope([]byte(`{"duration_ms": 10}`), models.JobTypeSleep)
+	if err != nil {
+		t.Fatalf("Expected legacy payload to decode, got error: %v", err)
+	}
+	if decoded.SchemaVersion != SchemaVersion || decoded.Type != models.JobTypeSleep || string(decoded.Payload) != `{"duration_ms": 10}` {
+		t.Errorf("Unexpected envelope for legacy payload: %+v", decoded)
+	}
+}
+
+func TestDecodeEnvelopeConvertsLegacyParseDocumentPayload(t *testing.T) {
+	legacy := `{"pdf_source": "https://example.com/invoice.pdf", "expected_schema": "{\"total\": \"number\"}", "name": "invoice", "pdf_path": "/tmp/pdf-1.pdf"}`
+
+	env, err := DecodeEnvelope([]byte(legacy), models.JobTypePDFParse)
+	if err != nil {
+		t.Fatalf("Expected legacy payload to convert, got error: %v", err)
+	}
+	pdf, _ := LookupJobType(models.JobTypePDFParse)
+	prepared, err := pdf.Prepare(env.Payload)
+	if err != nil {
+		t.Fatalf("Expected converted payload to be valid, got error: %v", err)
+	}
+	want := &ParseDocumentPayload{
+		Document:     "/tmp/pdf-1.pdf",
+		DocumentType: "path",
+		OutputSchema: map[string]interface{}{"total": "number"},
+	}
+	if !reflect.DeepEqual(prepared, want) {
+		t.Errorf("Expected %+v, got %+v", want, prepared)
+	}
+
+	// Version 1 payloads already in the handler's shape are kept
+	current := `{"document": "/tmp/pdf-1.pdf", "documentType": "path", "outputSchema": {"total": "number"}}`
+	env, err = DecodeEnvelope([]byte(current), models.JobTypePDFParse)
+	if err != nil || string(env.Payload) != current {
+		t.Errorf("Expected payload to be kept, got %s, %v", env.Payload, err)
+	}
+
+	invalid := `{"pdf_path": "/tmp/pdf-1.pdf", "expected_schema": "[1, 2]"}`
+	if _, err := DecodeEnvelope([]byte(invalid), models.JobTypePDFParse); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected ErrInvalidJob for a legacy payload without a schema object, got %v", err)
+	}
+}
+
+func TestDecodeEnvelopeRejects(t *testing.T) {
+	cases := map[string]struct {
+		data string
+		want error
+	}{
+		"newer version": {`{"schema_version": 3, "type": "sleep", "payload": {}}`, ErrUnsupportedSchemaVersion},
+		"no version":    {`{"schema_version": 0, "type": "sleep", "payload": {}}`, ErrUnsupportedSchemaVersion},
+		"other type":    {`{"schema_version": 2, "type": "pdf_parse", "payload": {}}`, ErrInvalidJob},
+	}
+	for name, tc := range cases {
+		if _, err := DecodeEnvelope([]byte(tc.data), models.JobTypeSleep); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+
+	if _, err := DecodeEnvelope([]byte(`{}`), "unknown"); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected ErrInvalidJob for an unknown job type, got %v", err)
+	}
+}
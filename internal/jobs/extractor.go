@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+)
+
+// StructuredExtractor converts extracted document text into JSON matching a schema.
+// Every LLM backend (Gemini, OpenAI-compatible, Anthropic-compatible, Ollama) implements it.
+type StructuredExtractor interface {
+	GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error)
+}
+
+// ExtractorFactory creates a StructuredExtractor from provider settings
+type ExtractorFactory func(ctx context.Context, cfg config.LLMProviderConfig, timeout time.Duration) (StructuredExtractor, error)
+
+// Provider names understood by the registry and by ParseOptions.ParsingMethod
+const (
+	ProviderGemini    = "gemini"
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+)
+
+// defaultLLMTimeout is used when no timeout has been configured
+const defaultLLMTimeout = 60 * time.Second
+
+// extractorRegistry holds the registered providers and their configuration
+type extractorRegistry struct {
+	factories map[string]ExtractorFactory
+	cfg       config.LLMConfig
+	mutex     sync.RWMutex
+}
+
+var extractors = &extractorRegistry{
+	factories: make(map[string]ExtractorFactory),
+	cfg:       config.LLMConfig{Provider: ProviderGemini},
+}
+
+func init() {
+	RegisterExtractor(ProviderGemini, newGeminiExtractor)
+	RegisterExtractor(ProviderOpenAI, newOpenAIExtractor)
+	RegisterExtractor(ProviderAnthropic, newAnthropicExtractor)
+	RegisterExtractor(ProviderOllama, newOllamaExtractor)
+}
+
+// InitExtractors sets the default provider and per-provider settings used
+// when creating extractors
+func InitExtractors(cfg config.LLMConfig) {
+	extractors.mutex.Lock()
+	defer extractors.mutex.Unlock()
+
+	if cfg.Provider == "" {
+		cfg.Provider = ProviderGemini
+	}
+	extractors.cfg = cfg
+}
+
+// RegisterExtractor adds or replaces the factory for a provider name
+func RegisterExtractor(name string, factory ExtractorFactory) {
+	extractors.mutex.Lock()
+	defer extractors.mutex.Unlock()
+
+	extractors.factories[strings.ToLower(name)] = factory
+}
+
+// RegisteredExtractors returns the names of all registered providers
+func RegisteredExtractors() []string {
+	extractors.mutex.RLock()
+	defer extractors.mutex.RUnlock()
+
+	names := make([]string, 0, len(extractors.factories))
+	for name := range extractors.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providerSettings returns the configured settings and timeout for a provider
+func providerSettings(name string) (config.LLMProviderConfig, time.Duration) {
+	extractors.mutex.RLock()
+	defer extractors.mutex.RUnlock()
+
+	timeout := extractors.cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultLLMTimeout
+	}
+	return extractors.cfg.Providers[name], timeout
+}
+
+// NewStructuredExtractor creates the extractor for the given provider name.
+// An empty name selects the configured default provider.
+func NewStructuredExtractor(ctx context.Context, provider string) (StructuredExtractor, string, error) {
+	extractors.mutex.RLock()
+	name := strings.ToLower(strings.TrimSpace(provider))
+	if name == "" {
+		name = extractors.cfg.Provider
+	}
+	factory, ok := extractors.factories[name]
+	extractors.mutex.RUnlock()
+
+	if !ok {
+		return nil, name, fmt.Errorf("unknown LLM provider %q (available: %s)", name, strings.Join(RegisteredExtractors(), ", "))
+	}
+
+	providerCfg, timeout := providerSettings(name)
+	extractor, err := factory(ctx, providerCfg, timeout)
+	if err != nil {
+		return nil, name, err
+	}
+	return extractor, name, nil
+}
+
+// buildExtractionPrompt builds the instruction sent to every provider
+func buildExtractionPrompt(text string, schema map[string]interface{}, description string) (string, error) {
+	schemaBytes, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal schema: %w", err)
+	}
+
+	return fmt.Sprintf(`
+Extract structured data from the following document text according to the provided JSON schema.
+Use the description to guide your extraction.
+
+DESCRIPTION:
+%s
+
+JSON SCHEMA:
+%s
+
+DOCUMENT TEXT:
+%s
+
+Respond with ONLY a valid JSON object matching the schema. Do not include any explanations or markdown formatting.
+`, description, string(schemaBytes), text), nil
+}
+
+// cleanJSONResponse strips markdown code fences from a model response and
+// checks that what remains is valid JSON
+func cleanJSONResponse(responseText string) ([]byte, error) {
+	cleanResponse := strings.TrimSpace(responseText)
+	cleanResponse = strings.TrimPrefix(cleanResponse, "```json")
+	cleanResponse = strings.TrimPrefix(cleanResponse, "```")
+	cleanResponse = strings.TrimSuffix(cleanResponse, "```")
+	cleanResponse = strings.TrimSpace(cleanResponse)
+
+	var jsonResponse interface{}
+	if err := json.Unmarshal([]byte(cleanResponse), &jsonResponse); err != nil {
+		return nil, fmt.Errorf("invalid JSON response from LLM: %w", err)
+	}
+
+	return []byte(cleanResponse), nil
+}
+
+// postJSON sends a JSON request and decodes a JSON response into out
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}, out interface{}) error {
+	reqBytes, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBytes))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
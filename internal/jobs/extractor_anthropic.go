@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+)
+
+// Anthropic defaults used when no base URL or model is configured
+const (
+	defaultAnthropicBaseURL   = "https://api.anthropic.com"
+	defaultAnthropicModel     = "claude-3-5-haiku-latest"
+	anthropicAPIVersion       = "2023-06-01"
+	defaultAnthropicMaxTokens = 4096
+)
+
+// AnthropicExtractor implements StructuredExtractor against an
+// Anthropic-compatible messages API
+type AnthropicExtractor struct {
+	apiKey     string
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	MaxTokens int                `json:"max_tokens"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+}
+
+type anthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+}
+
+// newAnthropicExtractor is the registry factory for Anthropic-compatible providers
+func newAnthropicExtractor(ctx context.Context, cfg config.LLMProviderConfig, timeout time.Duration) (StructuredExtractor, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("ANTHROPIC_API_KEY is not set")
+	}
+	return NewAnthropicExtractor(cfg, timeout), nil
+}
+
+// NewAnthropicExtractor creates an Anthropic-compatible extractor
+func NewAnthropicExtractor(cfg config.LLMProviderConfig, timeout time.Duration) *AnthropicExtractor {
+	e := &AnthropicExtractor{
+		apiKey:     cfg.APIKey,
+		baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		model:      cfg.Model,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+	if e.baseURL == "" {
+		e.baseURL = defaultAnthropicBaseURL
+	}
+	if e.model == "" {
+		e.model = defaultAnthropicModel
+	}
+	return e
+}
+
+// GenerateContent sends the extraction prompt to the messages endpoint
+func (e *AnthropicExtractor) GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error) {
+	prompt, err := buildExtractionPrompt(text, schema, description)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody := anthropicRequest{
+		Model:     e.model,
+		MaxTokens: defaultAnthropicMaxTokens,
+		System:    "You extract structured data from documents and reply with JSON only.",
+		Messages:  []anthropicMessage{{Role: "user", Content: prompt}},
+	}
+	headers := map[string]string{
+		"x-api-key":         e.apiKey,
+		"anthropic-version": anthropicAPIVersion,
+	}
+
+	var resp anthropicResponse
+	if err := postJSON(ctx, e.httpClient, fmt.Sprintf("%s/v1/messages", e.baseURL), headers, reqBody, &resp); err != nil {
+		return nil, err
+	}
+
+	var output strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			output.WriteString(block.Text)
+		}
+	}
+	if output.Len() == 0 {
+		return nil, errors.New("no response generated")
+	}
+
+	return cleanJSONResponse(output.String())
+}
@@ -0,0 +1,83 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+)
+
+// Ollama defaults used when no base URL or model is configured
+const (
+	defaultOllamaBaseURL = "http://localhost:11434"
+	defaultOllamaModel   = "llama3"
+)
+
+// OllamaExtractor implements StructuredExtractor against a local
+// Ollama-style generate API. No API key is required.
+type OllamaExtractor struct {
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+type ollamaRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	Format string `json:"format"`
+	Stream bool   `json:"stream"`
+}
+
+type ollamaResponse struct {
+	Response string `json:"response"`
+}
+
+// newOllamaExtractor is the registry factory for Ollama-style local providers
+func newOllamaExtractor(ctx context.Context, cfg config.LLMProviderConfig, timeout time.Duration) (StructuredExtractor, error) {
+	return NewOllamaExtractor(cfg, timeout), nil
+}
+
+// NewOllamaExtractor creates an Ollama-style extractor
+func NewOllamaExtractor(cfg config.LLMProviderConfig, timeout time.Duration) *OllamaExtractor {
+	e := &OllamaExtractor{
+		baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		model:      cfg.Model,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+	if e.baseURL == "" {
+		e.baseURL = defaultOllamaBaseURL
+	}
+	if e.model == "" {
+		e.model = defaultOllamaModel
+	}
+	return e
+}
+
+// GenerateContent requests a non-streamed JSON completion
+func (e *OllamaExtractor) GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error) {
+	prompt, err := buildExtractionPrompt(text, schema, description)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody := ollamaRequest{
+		Model:  e.model,
+		Prompt: prompt,
+		Format: "json",
+		Stream: false,
+	}
+
+	var resp ollamaResponse
+	if err := postJSON(ctx, e.httpClient, fmt.Sprintf("%s/api/generate", e.baseURL), nil, reqBody, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Response == "" {
+		return nil, errors.New("no response generated")
+	}
+
+	return cleanJSONResponse(resp.Response)
+}
@@ -0,0 +1,98 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+)
+
+// OpenAI defaults used when no base URL or model is configured
+const (
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	defaultOpenAIModel   = "gpt-4o-mini"
+)
+
+// OpenAIExtractor implements StructuredExtractor against any OpenAI-compatible
+// chat completions API
+type OpenAIExtractor struct {
+	apiKey     string
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIRequest struct {
+	Model          string            `json:"model"`
+	Messages       []openAIMessage   `json:"messages"`
+	Temperature    float64           `json:"temperature"`
+	ResponseFormat map[string]string `json:"response_format,omitempty"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// newOpenAIExtractor is the registry factory for OpenAI-compatible providers
+func newOpenAIExtractor(ctx context.Context, cfg config.LLMProviderConfig, timeout time.Duration) (StructuredExtractor, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("OPENAI_API_KEY is not set")
+	}
+	return NewOpenAIExtractor(cfg, timeout), nil
+}
+
+// NewOpenAIExtractor creates an OpenAI-compatible extractor
+func NewOpenAIExtractor(cfg config.LLMProviderConfig, timeout time.Duration) *OpenAIExtractor {
+	e := &OpenAIExtractor{
+		apiKey:     cfg.APIKey,
+		baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		model:      cfg.Model,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+	if e.baseURL == "" {
+		e.baseURL = defaultOpenAIBaseURL
+	}
+	if e.model == "" {
+		e.model = defaultOpenAIModel
+	}
+	return e
+}
+
+// GenerateContent asks the chat completions endpoint for a JSON object
+func (e *OpenAIExtractor) GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error) {
+	prompt, err := buildExtractionPrompt(text, schema, description)
+	if err != nil {
+		return nil, err
+	}
+
+	reqBody := openAIRequest{
+		Model: e.model,
+		Messages: []openAIMessage{
+			{Role: "system", Content: "You extract structured data from documents and reply with JSON only."},
+			{Role: "user", Content: prompt},
+		},
+		ResponseFormat: map[string]string{"type": "json_object"},
+	}
+	headers := map[string]string{"Authorization": "Bearer " + e.apiKey}
+
+	var resp openAIResponse
+	if err := postJSON(ctx, e.httpClient, fmt.Sprintf("%s/chat/completions", e.baseURL), headers, reqBody, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("no response generated")
+	}
+
+	return cleanJSONResponse(resp.Choices[0].Message.Content)
+}
@@ -0,0 +1,251 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+)
+
+var testSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"invoiceNumber": map[string]interface{}{"type": "string"},
+	},
+}
+
+// withExtractorConfig installs cfg for the duration of the test
+func withExtractorConfig(t *testing.T, cfg config.LLMConfig) {
+	t.Helper()
+	extractors.mutex.RLock()
+	original := extractors.cfg
+	extractors.mutex.RUnlock()
+
+	InitExtractors(cfg)
+	t.Cleanup(func() {
+		extractors.mutex.Lock()
+		extractors.cfg = original
+		extractors.mutex.Unlock()
+	})
+}
+
+// decodeRequest decodes the JSON body of a provider request
+func decodeRequest(t *testing.T, r *http.Request) map[string]interface{} {
+	t.Helper()
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		t.Errorf("Failed to decode request body: %v", err)
+	}
+	return body
+}
+
+func TestOpenAIExtractor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer test-key" {
+			t.Errorf("Unexpected Authorization header: %s", got)
+		}
+		body := decodeRequest(t, r)
+		if body["model"] != "test-model" {
+			t.Errorf("Unexpected model: %v", body["model"])
+		}
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"{\"invoiceNumber\":\"12345\"}"}}]}`))
+	}))
+	defer server.Close()
+
+	extractor := NewOpenAIExtractor(config.LLMProviderConfig{
+		APIKey:  "test-key",
+		BaseURL: server.URL + "/v1",
+		Model:   "test-model",
+	}, time.Second)
+
+	out, err := extractor.GenerateContent(context.Background(), "Invoice #12345", testSchema, "Extract invoice")
+	if err != nil {
+		t.Fatalf("GenerateContent returned error: %v", err)
+	}
+	if string(out) != `{"invoiceNumber":"12345"}` {
+		t.Errorf("Unexpected output: %s", out)
+	}
+}
+
+func TestAnthropicExtractor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if got := r.Header.Get("x-api-key"); got != "test-key" {
+			t.Errorf("Unexpected x-api-key header: %s", got)
+		}
+		if r.Header.Get("anthropic-version") == "" {
+			t.Error("Missing anthropic-version header")
+		}
+		body := decodeRequest(t, r)
+		if body["max_tokens"] == nil {
+			t.Error("Missing max_tokens")
+		}
+		w.Write([]byte("{\"content\":[{\"type\":\"text\",\"text\":\"```json\\n{\\\"invoiceNumber\\\":\\\"12345\\\"}\\n```\"}]}"))
+	}))
+	defer server.Close()
+
+	extractor := NewAnthropicExtractor(config.LLMProviderConfig{
+		APIKey:  "test-key",
+		BaseURL: server.URL,
+	}, time.Second)
+
+	out, err := extractor.GenerateContent(context.Background(), "Invoice #12345", testSchema, "Extract invoice")
+	if err != nil {
+		t.Fatalf("GenerateContent returned error: %v", err)
+	}
+	if string(out) != `{"invoiceNumber":"12345"}` {
+		t.Errorf("Unexpected output: %s", out)
+	}
+}
+
+func TestOllamaExtractor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/generate" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		body := decodeRequest(t, r)
+		if body["format"] != "json" || body["stream"] != false {
+			t.Errorf("Unexpected request options: %v", body)
+		}
+		if !strings.Contains(body["prompt"].(string), "Invoice #12345") {
+			t.Error("Prompt does not contain document text")
+		}
+		w.Write([]byte(`{"response":"{\"invoiceNumber\":\"12345\"}","done":true}`))
+	}))
+	defer server.Close()
+
+	extractor := NewOllamaExtractor(config.LLMProviderConfig{BaseURL: server.URL}, time.Second)
+
+	out, err := extractor.GenerateContent(context.Background(), "Invoice #12345", testSchema, "Extract invoice")
+	if err != nil {
+		t.Fatalf("GenerateContent returned error: %v", err)
+	}
+	if string(out) != `{"invoiceNumber":"12345"}` {
+		t.Errorf("Unexpected output: %s", out)
+	}
+}
+
+func TestGeminiExtractor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/models/test-model:generateContent" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("key") != "test-key" {
+			t.Errorf("Unexpected API key: %s", r.URL.Query().Get("key"))
+		}
+		w.Write([]byte(`{"candidates":[{"content":{"parts":[{"text":"{\"invoiceNumber\":\"12345\"}"}]}}]}`))
+	}))
+	defer server.Close()
+
+	withExtractorConfig(t, config.LLMConfig{
+		Provider: ProviderGemini,
+		Providers: map[string]config.LLMProviderConfig{
+			ProviderGemini: {APIKey: "test-key", BaseURL: server.URL, Model: "test-model"},
+		},
+	})
+
+	extractor, provider, err := NewStructuredExtractor(context.Background(), "")
+	if err != nil {
+		t.Fatalf("NewStructuredExtractor returned error: %v", err)
+	}
+	if provider != ProviderGemini {
+		t.Errorf("Expected default provider gemini, got %s", provider)
+	}
+
+	out, err := extractor.GenerateContent(context.Background(), "Invoice #12345", testSchema, "Extract invoice")
+	if err != nil {
+		t.Fatalf("GenerateContent returned error: %v", err)
+	}
+	if string(out) != `{"invoiceNumber":"12345"}` {
+		t.Errorf("Unexpected output: %s", out)
+	}
+}
+
+func TestExtractorErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/chat/completions") {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":"rate limited"}`))
+			return
+		}
+		w.Write([]byte(`{"response":"not json"}`))
+	}))
+	defer server.Close()
+
+	openAI := NewOpenAIExtractor(config.LLMProviderConfig{APIKey: "k", BaseURL: server.URL}, time.Second)
+	if _, err := openAI.GenerateContent(context.Background(), "text", testSchema, ""); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("Expected status error, got %v", err)
+	}
+
+	ollama := NewOllamaExtractor(config.LLMProviderConfig{BaseURL: server.URL}, time.Second)
+	if _, err := ollama.GenerateContent(context.Background(), "text", testSchema, ""); err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Errorf("Expected invalid JSON error, got %v", err)
+	}
+}
+
+func TestNewStructuredExtractorSelection(t *testing.T) {
+	withExtractorConfig(t, config.LLMConfig{
+		Provider: ProviderOllama,
+		Providers: map[string]config.LLMProviderConfig{
+			ProviderOpenAI: {APIKey: "openai-key"},
+		},
+	})
+
+	// Default provider comes from config
+	extractor, provider, err := NewStructuredExtractor(context.Background(), "")
+	if err != nil {
+		t.Fatalf("NewStructuredExtractor returned error: %v", err)
+	}
+	if _, ok := extractor.(*OllamaExtractor); !ok || provider != ProviderOllama {
+		t.Errorf("Expected Ollama extractor, got %T (%s)", extractor, provider)
+	}
+
+	// Per-job parsing method overrides the default
+	extractor, provider, err = NewStructuredExtractor(context.Background(), "OpenAI")
+	if err != nil {
+		t.Fatalf("NewStructuredExtractor returned error: %v", err)
+	}
+	if _, ok := extractor.(*OpenAIExtractor); !ok || provider != ProviderOpenAI {
+		t.Errorf("Expected OpenAI extractor, got %T (%s)", extractor, provider)
+	}
+
+	// Providers that need a key fail without one
+	if _, _, err := NewStructuredExtractor(context.Background(), ProviderAnthropic); err == nil {
+		t.Error("Expected error for anthropic without API key, got nil")
+	}
+
+	// Unknown providers are rejected
+	if _, _, err := NewStructuredExtractor(context.Background(), "bogus"); err == nil {
+		t.Error("Expected error for unknown provider, got nil")
+	}
+}
+
+func TestRegisterExtractor(t *testing.T) {
+	mock := &MockGeminiClient{MockResponse: []byte(`{"ok":true}`)}
+	RegisterExtractor("custom", func(ctx context.Context, cfg config.LLMProviderConfig, timeout time.Duration) (StructuredExtractor, error) {
+		return mock, nil
+	})
+	defer func() {
+		extractors.mutex.Lock()
+		delete(extractors.factories, "custom")
+		extractors.mutex.Unlock()
+	}()
+
+	extractor, provider, err := NewStructuredExtractor(context.Background(), "custom")
+	if err != nil {
+		t.Fatalf("NewStructuredExtractor returned error: %v", err)
+	}
+	if extractor != mock || provider != "custom" {
+		t.Errorf("Expected registered custom extractor, got %T (%s)", extractor, provider)
+	}
+}
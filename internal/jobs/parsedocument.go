@@ -1,8 +1,11 @@
 package jobs
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/tidwall/gjson"
 )
@@ -19,6 +22,8 @@ type ParseDocumentPayload struct {
 	Description string `json:"description"`
 	// Options contains optional parsing parameters
 	Options ParseOptions `json:"options,omitempty"`
+	// WebhookURL, if set, is notified of every parsing status change
+	WebhookURL string `json:"webhookURL,omitempty"`
 }
 
 // ParseOptions contains optional configuration for document parsing
@@ -31,6 +36,8 @@ type ParseOptions struct {
 	ConfidenceThreshold float64 `json:"confidenceThreshold,omitempty"`
 	// MaxPages limits processing to the first N pages (0 = all pages)
 	MaxPages int `json:"maxPages,omitempty"`
+	// ParsingMethod selects the LLM provider (gemini, openai, anthropic, ollama); empty uses the configured default
+	ParsingMethod string `json:"parsingMethod,omitempty"`
 }
 
 // Validate checks if the ParseDocumentPayload is valid
@@ -59,10 +66,85 @@ func (p *ParseDocumentPayload) Validate() error {
 	if p.Options.ConfidenceThreshold < 0 || p.Options.ConfidenceThreshold > 1 {
 		return errors.New("confidenceThreshold must be between 0.0 and 1.0")
 	}
+	if p.Options.MaxPages < 0 {
+		return errors.New("maxPages must not be negative")
+	}
+	if p.WebhookURL != "" {
+		u, err := url.Parse(p.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("webhookURL must be an http or https URL")
+		}
+	}
 
 	return nil
 }
 
+// Instructions returns the guidance given to the LLM for the document: the
+// description, followed by what the language and confidence options ask for
+func (p *ParseDocumentPayload) Instructions() string {
+	parts := make([]string, 0, 3)
+	if p.Description != "" {
+		parts = append(parts, p.Description)
+	}
+	if p.Options.Language != "" {
+		parts = append(parts, fmt.Sprintf("The document is written in the language with BCP 47 tag %q.", p.Options.Language))
+	}
+	if p.Options.ConfidenceThreshold > 0 {
+		parts = append(parts, fmt.Sprintf("Only fill in a field if you are at least %.0f%% confident of its value; use null otherwise.",
+			p.Options.ConfidenceThreshold*100))
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// legacyParseDocumentPayload is the version 1 payload the API stored for
+// PDF parse jobs: the parse-document request and the path of the stored PDF
+type legacyParseDocumentPayload struct {
+	PDFSource      string          `json:"pdf_source"`
+	ExpectedSchema json.RawMessage `json:"expected_schema"`
+	Name           string          `json:"name"`
+	PDFPath        string          `json:"pdf_path"`
+}
+
+// convertLegacyParseDocumentPayload converts a version 1 PDF parse payload
+// into a ParseDocumentPayload reading the stored PDF. Payloads already in
+// that shape are kept as they are.
+func convertLegacyParseDocumentPayload(payload json.RawMessage) (json.RawMessage, error) {
+	var legacy legacyParseDocumentPayload
+	if err := json.Unmarshal(payload, &legacy); err != nil {
+		return nil, err
+	}
+	if legacy.PDFPath == "" {
+		return payload, nil
+	}
+
+	schema, err := DecodeOutputSchema(legacy.ExpectedSchema)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ParseDocumentPayload{
+		Document:     legacy.PDFPath,
+		DocumentType: "path",
+		OutputSchema: schema,
+	})
+}
+
+// DecodeOutputSchema reads a JSON schema given either as an object or as a
+// string holding one, as the parse-document endpoint accepts it
+func DecodeOutputSchema(raw json.RawMessage) (map[string]interface{}, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		raw = json.RawMessage(text)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("expected_schema must be a JSON object: %w", err)
+	}
+	if len(schema) == 0 {
+		return nil, errors.New("expected_schema must not be empty")
+	}
+	return schema, nil
+}
+
 // ValidateWithGJSON performs validation using gjson
 func ValidateWithGJSON(payload []byte) error {
 	if !gjson.ValidBytes(payload) {
@@ -1,7 +1,6 @@
 package jobs
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -13,6 +12,10 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/fetch"
+	"github.com/illegalcall/task-master/internal/pdf"
 )
 
 // Make these functions variables so they can be mocked in tests
@@ -21,14 +24,18 @@ var (
 	NewGeminiClient = newGeminiClientImpl
 )
 
-// GeminiClient is an interface for the Gemini LLM service
-type GeminiClient interface {
-	GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error)
-}
+// Gemini defaults used when no base URL or model is configured
+const (
+	defaultGeminiBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+	defaultGeminiModel   = "gemini-pro"
+)
 
-// HTTPGeminiClient implements the GeminiClient interface using HTTP requests
+// HTTPGeminiClient implements the StructuredExtractor interface using the Gemini REST API
 type HTTPGeminiClient struct {
-	apiKey string
+	apiKey     string
+	baseURL    string
+	model      string
+	httpClient *http.Client
 	// Optional function for testing/mocking
 	generateContentFunc func(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error)
 }
@@ -60,48 +67,53 @@ type GeminiCandidate struct {
 	} `json:"content"`
 }
 
-// newGeminiClientImpl creates a new Gemini client using the API key from environment variables
+// newGeminiClientImpl creates a new Gemini client from the configured provider
+// settings, falling back to the GEMINI_API_KEY environment variable
 func newGeminiClientImpl(ctx context.Context) (*HTTPGeminiClient, error) {
-	apiKey := os.Getenv("GEMINI_API_KEY")
+	cfg, timeout := providerSettings(ProviderGemini)
+	apiKey := cfg.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("GEMINI_API_KEY")
+	}
 	if apiKey == "" {
 		return nil, errors.New("GEMINI_API_KEY environment variable is not set")
 	}
 
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = defaultGeminiBaseURL
+	}
+	model := cfg.Model
+	if model == "" {
+		model = defaultGeminiModel
+	}
+
 	return &HTTPGeminiClient{
-		apiKey: apiKey,
+		apiKey:     apiKey,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		model:      model,
+		httpClient: &http.Client{Timeout: timeout},
 	}, nil
 }
 
+// newGeminiExtractor is the registry factory for Gemini. It goes through the
+// NewGeminiClient variable, which reads its own settings, so tests can keep
+// swapping the client out.
+func newGeminiExtractor(ctx context.Context, _ config.LLMProviderConfig, _ time.Duration) (StructuredExtractor, error) {
+	return NewGeminiClient(ctx)
+}
+
 // GenerateContent sends a request to Gemini to convert extracted text into structured JSON
 func (c *HTTPGeminiClient) GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error) {
 	// If there's a test override function, use it instead
 	if c.generateContentFunc != nil {
 		return c.generateContentFunc(ctx, text, schema, description)
 	}
-	
-	// Convert schema to a readable string format
-	schemaBytes, err := json.MarshalIndent(schema, "", "  ")
+
+	prompt, err := buildExtractionPrompt(text, schema, description)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal schema: %w", err)
+		return nil, err
 	}
-	schemaStr := string(schemaBytes)
-
-	// Build the prompt for the model
-	prompt := fmt.Sprintf(`
-Extract structured data from the following document text according to the provided JSON schema.
-Use the description to guide your extraction.
-
-DESCRIPTION:
-%s
-
-JSON SCHEMA:
-%s
-
-DOCUMENT TEXT:
-%s
-
-Respond with ONLY a valid JSON object matching the schema. Do not include any explanations or markdown formatting.
-`, description, schemaStr, text)
 
 	// Create the request to Gemini API
 	reqBody := GeminiRequest{
@@ -116,101 +128,95 @@ Respond with ONLY a valid JSON object matching the schema. Do not include any ex
 		},
 	}
 
-	reqBytes, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	httpClient := c.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultLLMTimeout}
 	}
-
-	// Gemini API endpoint
-	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/gemini-pro:generateContent?key=%s", c.apiKey)
-
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBytes))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	baseURL := c.baseURL
+	if baseURL == "" {
+		baseURL = defaultGeminiBaseURL
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+	model := c.model
+	if model == "" {
+		model = defaultGeminiModel
 	}
-	defer resp.Body.Close()
+	url := fmt.Sprintf("%s/models/%s:generateContent?key=%s", baseURL, model, c.apiKey)
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	// Parse the response
 	var geminiResp GeminiResponse
-	if err := json.NewDecoder(resp.Body).Decode(&geminiResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	if err := postJSON(ctx, httpClient, url, nil, reqBody, &geminiResp); err != nil {
+		return nil, err
 	}
 
 	if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 {
 		return nil, errors.New("no response generated")
 	}
 
-	// Extract the response text
-	responseText := geminiResp.Candidates[0].Content.Parts[0].Text
-	
-	// Clean up response - remove any markdown code block formatting
-	cleanResponse := strings.TrimSpace(responseText)
-	cleanResponse = strings.TrimPrefix(cleanResponse, "```json")
-	cleanResponse = strings.TrimPrefix(cleanResponse, "```")
-	cleanResponse = strings.TrimSuffix(cleanResponse, "```")
-	cleanResponse = strings.TrimSpace(cleanResponse)
+	return cleanJSONResponse(geminiResp.Candidates[0].Content.Parts[0].Text)
+}
 
-	// Validate the response is valid JSON
-	var jsonResponse interface{}
-	if err := json.Unmarshal([]byte(cleanResponse), &jsonResponse); err != nil {
-		return nil, fmt.Errorf("invalid JSON response from LLM: %w", err)
+// extractPDFFile extracts the text of a PDF on disk
+func extractPDFFile(filePath string, maxPages int) (string, error) {
+	pages, err := pdf.ExtractTextFromFile(filePath, maxPages)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract PDF text: %w", err)
 	}
-
-	return []byte(cleanResponse), nil
+	return formatPages(pages)
 }
 
-// SimplePDFExtractor extracts text from a PDF file
-// Note: In a real implementation, you would use a proper PDF parsing library
-func SimplePDFExtractor(filePath string) (string, error) {
-	// In a real implementation, you would use a PDF library here
-	// For now, we'll just return a placeholder or read the file as text
-	// to avoid external dependencies
-	
-	content, err := ioutil.ReadFile(filePath)
+// extractPDFBytes extracts the text of an in-memory PDF
+func extractPDFBytes(data []byte, maxPages int) (string, error) {
+	pages, err := pdf.ExtractText(data, maxPages)
 	if err != nil {
-		return "", fmt.Errorf("failed to read file: %w", err)
+		return "", fmt.Errorf("failed to extract PDF text: %w", err)
 	}
-	
-	// For simplicity, we'll just return the first part of the file as text
-	// In a real implementation, you would parse the PDF properly
-	return fmt.Sprintf("PDF Content (simulated): %s", string(content[:min(len(content), 1000)])), nil
+	return formatPages(pages)
 }
 
-// min returns the minimum of two integers
-func min(a, b int) int {
-	if a < b {
-		return a
+// formatPages joins extracted pages into a single text with page markers so
+// the LLM can tell where each page starts
+func formatPages(pages []pdf.Page) (string, error) {
+	var b strings.Builder
+	for _, page := range pages {
+		if page.Text == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "--- Page %d ---\n%s", page.Number, page.Text)
+	}
+	if b.Len() == 0 {
+		return "", errors.New("no extractable text found in PDF (scanned documents are not supported)")
 	}
-	return b
+	return b.String(), nil
 }
 
-// extractPDFTextImpl extracts text content from a PDF document
-func extractPDFTextImpl(documentSource string, documentType string, maxPages int) (string, error) {
+// documentFetcher downloads the documents of jobs given by URL and sends
+// their webhook notifications. Until InitDocumentFetcher configures it, it
+// refuses private addresses and documents over 10MB.
+var documentFetcher = fetch.New(config.FetchConfig{MaxRedirects: 3}, 10*1024*1024)
+
+// InitDocumentFetcher sets the limits on downloading documents given by URL,
+// and on sending webhooks, which trackers created afterwards use; maxSize
+// bounds the size of documents
+func InitDocumentFetcher(cfg config.FetchConfig, maxSize int64) {
+	documentFetcher = fetch.New(cfg, maxSize)
+}
+
+// extractPDFTextImpl extracts text content from a PDF document. ctx bounds
+// the download of a document given by URL.
+func extractPDFTextImpl(ctx context.Context, documentSource string, documentType string, maxPages int) (string, error) {
 	switch documentType {
 	case "path":
-		// For simplicity, we'll just use our simple extractor
-		return SimplePDFExtractor(documentSource)
+		return extractPDFFile(documentSource, maxPages)
 
 	case "url":
 		// Download the file to a temporary location
-		resp, err := http.Get(documentSource)
+		body, err := documentFetcher.Open(ctx, documentSource)
 		if err != nil {
 			return "", fmt.Errorf("failed to download file: %w", err)
 		}
-		defer resp.Body.Close()
+		defer body.Close()
 
 		tempFile, err := ioutil.TempFile("", "pdf-*.pdf")
 		if err != nil {
@@ -219,13 +225,13 @@ func extractPDFTextImpl(documentSource string, documentType string, maxPages int
 		defer os.Remove(tempFile.Name())
 		defer tempFile.Close()
 
-		_, err = io.Copy(tempFile, resp.Body)
+		_, err = io.Copy(tempFile, body)
 		if err != nil {
 			return "", fmt.Errorf("failed to write downloaded content: %w", err)
 		}
 		tempFile.Close() // Close to flush writes
 
-		return SimplePDFExtractor(tempFile.Name())
+		return extractPDFFile(tempFile.Name(), maxPages)
 
 	case "base64":
 		// Decode base64 content
@@ -234,20 +240,7 @@ func extractPDFTextImpl(documentSource string, documentType string, maxPages int
 			return "", fmt.Errorf("failed to decode base64: %w", err)
 		}
 
-		// Save to temporary file
-		tempFile, err := ioutil.TempFile("", "pdf-*.pdf")
-		if err != nil {
-			return "", fmt.Errorf("failed to create temp file: %w", err)
-		}
-		defer os.Remove(tempFile.Name())
-		defer tempFile.Close()
-
-		if _, err := tempFile.Write(decoded); err != nil {
-			return "", fmt.Errorf("failed to write to temp file: %w", err)
-		}
-		tempFile.Close() // Close to flush writes
-
-		return SimplePDFExtractor(tempFile.Name())
+		return extractPDFBytes(decoded, maxPages)
 
 	default:
 		return "", fmt.Errorf("unsupported document type: %s", documentType)
@@ -275,6 +268,7 @@ func ParseDocumentWithTracking(ctx context.Context, payload []byte) (Result, err
 	// Parse the payload to get the document ID
 	var parsedPayload struct {
 		DocumentID string `json:"documentID"`
+		WebhookURL string `json:"webhookURL"`
 	}
 	if err := json.Unmarshal(payload, &parsedPayload); err != nil {
 		return Result{}, fmt.Errorf("failed to extract document ID: %w", err)
@@ -286,6 +280,10 @@ func ParseDocumentWithTracking(ctx context.Context, payload []byte) (Result, err
 	}
 
 	tracker := GetParsingTracker()
+	if parsedPayload.WebhookURL != "" {
+		tracker.SetWebhook(documentID, parsedPayload.WebhookURL)
+		defer tracker.SetWebhook(documentID, "")
+	}
 	
 	// Update status to uploaded if this is the first time
 	tracker.UpdateStatus(documentID, StatusUploaded, nil)
@@ -312,7 +310,17 @@ func ParseDocumentWithTracking(ctx context.Context, payload []byte) (Result, err
 		if attempt > 1 {
 			tracker.UpdateStatus(documentID, StatusRetrying, nil)
 			// Add a small delay before retrying to prevent hammering the system
-			time.Sleep(time.Millisecond * 100)
+			select {
+			case <-time.After(time.Millisecond * 100):
+			case <-ctx.Done():
+			}
+		}
+
+		// Stop retrying once the job has been cancelled
+		if err := ctx.Err(); err != nil {
+			finalErr = fmt.Errorf("document parsing cancelled: %w", err)
+			tracker.UpdateStatus(documentID, StatusFailed, finalErr)
+			break
 		}
 		
 		// Update status to parsing
@@ -329,7 +337,7 @@ func ParseDocumentWithTracking(ctx context.Context, payload []byte) (Result, err
 		// Extract text from the PDF
 		tracker.UpdateStatus(documentID, StatusParsing, nil)
 		maxPages := parsedPayload.Options.MaxPages
-		text, err := ExtractPDFText(parsedPayload.Document, parsedPayload.DocumentType, maxPages)
+		text, err := ExtractPDFText(ctx, parsedPayload.Document, parsedPayload.DocumentType, maxPages)
 		if err != nil {
 			finalErr = fmt.Errorf("text extraction error: %w", err)
 			tracker.UpdateStatus(documentID, StatusFailed, finalErr)
@@ -338,30 +346,27 @@ func ParseDocumentWithTracking(ctx context.Context, payload []byte) (Result, err
 
 		// Process with LLM
 		tracker.UpdateStatus(documentID, StatusConverting, nil)
-		geminiClient, err := NewGeminiClient(ctx)
+		extractor, provider, err := NewStructuredExtractor(ctx, parsedPayload.Options.ParsingMethod)
 		if err != nil {
-			finalErr = fmt.Errorf("failed to initialize Gemini client: %w", err)
+			finalErr = fmt.Errorf("failed to initialize LLM provider: %w", err)
 			tracker.UpdateStatus(documentID, StatusFailed, finalErr)
 			continue // Try again if retries are available
 		}
 
-		structuredData, err := geminiClient.GenerateContent(
+		// Generate structured data, re-prompting if it doesn't match the schema
+		parsedContent, validation, err := generateValidated(
 			ctx,
+			extractor,
 			text,
 			parsedPayload.OutputSchema,
-			parsedPayload.Description,
+			parsedPayload.Instructions(),
 		)
 		if err != nil {
-			finalErr = fmt.Errorf("LLM processing error: %w", err)
-			tracker.UpdateStatus(documentID, StatusFailed, finalErr)
-			continue // Try again if retries are available
-		}
-
-		// Parse the structured data into our response format
-		var parsedContent interface{}
-		if err := json.Unmarshal(structuredData, &parsedContent); err != nil {
-			finalErr = fmt.Errorf("failed to parse LLM response: %w", err)
+			finalErr = err
 			tracker.UpdateStatus(documentID, StatusFailed, finalErr)
+			if errors.Is(err, ErrInvalidJob) {
+				break // The corrections are used up
+			}
 			continue // Try again if retries are available
 		}
 
@@ -376,8 +381,13 @@ func ParseDocumentWithTracking(ctx context.Context, payload []byte) (Result, err
 				"documentType":     parsedPayload.DocumentType,
 				"extractedTextLen": len(text),
 				"attempts":         attempt,
+				"provider":         provider,
+				"options":          parsedPayload.Options,
 			},
 		}
+		for k, v := range validation.metaInfo() {
+			parsedDocument.MetaInfo[k] = v
+		}
 
 		result = Result{
 			Data: parsedDocument,
@@ -457,31 +467,27 @@ func simpleParseDocument(ctx context.Context, payload []byte) (Result, error) {
 
 	// 2. Extract text from the PDF
 	maxPages := parsedPayload.Options.MaxPages
-	text, err := ExtractPDFText(parsedPayload.Document, parsedPayload.DocumentType, maxPages)
+	text, err := ExtractPDFText(ctx, parsedPayload.Document, parsedPayload.DocumentType, maxPages)
 	if err != nil {
 		return Result{}, fmt.Errorf("text extraction error: %w", err)
 	}
 
-	// 3. Process the extracted text with LLM (Gemini)
-	geminiClient, err := NewGeminiClient(ctx)
+	// 3. Process the extracted text with the selected LLM provider
+	extractor, provider, err := NewStructuredExtractor(ctx, parsedPayload.Options.ParsingMethod)
 	if err != nil {
-		return Result{}, fmt.Errorf("failed to initialize Gemini client: %w", err)
+		return Result{}, fmt.Errorf("failed to initialize LLM provider: %w", err)
 	}
 
-	structuredData, err := geminiClient.GenerateContent(
+	// 4. Generate structured data and validate it against the output schema
+	parsedContent, validation, err := generateValidated(
 		ctx,
+		extractor,
 		text,
 		parsedPayload.OutputSchema,
-		parsedPayload.Description,
+		parsedPayload.Instructions(),
 	)
 	if err != nil {
-		return Result{}, fmt.Errorf("LLM processing error: %w", err)
-	}
-
-	// 4. Parse the structured data into our response format
-	var parsedContent interface{}
-	if err := json.Unmarshal(structuredData, &parsedContent); err != nil {
-		return Result{}, fmt.Errorf("failed to parse LLM response: %w", err)
+		return Result{}, err
 	}
 
 	// 5. Prepare the result
@@ -492,8 +498,13 @@ func simpleParseDocument(ctx context.Context, payload []byte) (Result, error) {
 			"processingTimeMs": elapsedTime.Milliseconds(),
 			"documentType":     parsedPayload.DocumentType,
 			"extractedTextLen": len(text),
+			"provider":         provider,
+			"options":          parsedPayload.Options,
 		},
 	}
+	for k, v := range validation.metaInfo() {
+		parsedDocument.MetaInfo[k] = v
+	}
 
 	result := Result{
 		Data: parsedDocument,
@@ -2,10 +2,18 @@ package jobs
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/fetch"
 )
 
 // MockGeminiClient is a mock implementation of the GeminiClient interface for testing
@@ -35,7 +43,7 @@ func TestParseDocumentHandler(t *testing.T) {
 
 	// Create a mock extractor that returns a predefined text
 	mockText := "Invoice #12345\nDate: 2023-07-01\nVendor: ABC Corp\nTotal: $100.00\nItems:\n1. Item A - $50.00\n2. Item B - $50.00"
-	ExtractPDFText = func(documentSource string, documentType string, maxPages int) (string, error) {
+	ExtractPDFText = func(ctx context.Context, documentSource string, documentType string, maxPages int) (string, error) {
 		return mockText, nil
 	}
 
@@ -121,7 +129,7 @@ func TestParseDocumentHandler(t *testing.T) {
 		}
 
 		// Extract text using our mock
-		text, err := ExtractPDFText(parsedPayload.Document, parsedPayload.DocumentType, parsedPayload.Options.MaxPages)
+		text, err := ExtractPDFText(ctx, parsedPayload.Document, parsedPayload.DocumentType, parsedPayload.Options.MaxPages)
 		if err != nil {
 			return Result{}, err
 		}
@@ -253,4 +261,93 @@ func TestParseDocumentHandlerIntegration(t *testing.T) {
 	if parsedDoc.Content == nil {
 		t.Errorf("Parsed content is nil")
 	}
-} 
\ No newline at end of file
+} 
+// minimalPDF is a single-page, uncompressed PDF containing two lines of text
+const minimalPDF = `%PDF-1.4
+1 0 obj
+<< /Type /Catalog /Pages 2 0 R >>
+endobj
+2 0 obj
+<< /Type /Pages /Kids [3 0 R] /Count 1 >>
+endobj
+3 0 obj
+<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>
+endobj
+4 0 obj
+<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>
+endobj
+5 0 obj
+<< /Length 58 >>
+stream
+BT /F1 12 Tf 72 720 Td (Invoice #12345) Tj 0 -14 Td (Total: $100.00) Tj ET
+endstream
+endobj
+trailer
+<< /Root 1 0 R >>
+%%EOF
+`
+
+// TestExtractPDFTextImpl tests text extraction for path and base64 sources
+func TestExtractPDFTextImpl(t *testing.T) {
+	expected := "--- Page 1 ---\nInvoice #12345\nTotal: $100.00"
+
+	// base64 source
+	encoded := base64.StdEncoding.EncodeToString([]byte(minimalPDF))
+	text, err := extractPDFTextImpl(context.Background(), encoded, "base64", 0)
+	if err != nil {
+		t.Fatalf("Failed to extract text from base64 PDF: %v", err)
+	}
+	if text != expected {
+		t.Errorf("Unexpected text: %q", text)
+	}
+
+	// path source
+	path := filepath.Join(t.TempDir(), "invoice.pdf")
+	if err := os.WriteFile(path, []byte(minimalPDF), 0644); err != nil {
+		t.Fatalf("Failed to write test PDF: %v", err)
+	}
+	text, err = extractPDFTextImpl(context.Background(), path, "path", 1)
+	if err != nil {
+		t.Fatalf("Failed to extract text from PDF file: %v", err)
+	}
+	if text != expected {
+		t.Errorf("Unexpected text: %q", text)
+	}
+
+	// Data that isn't a PDF must fail instead of being passed through as text
+	garbage := base64.StdEncoding.EncodeToString([]byte("not a pdf"))
+	if _, err := extractPDFTextImpl(context.Background(), garbage, "base64", 0); err == nil {
+		t.Error("Expected error for non-PDF data, got nil")
+	}
+
+	// url source, downloaded within the fetcher's limits
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte(minimalPDF))
+	}))
+	defer server.Close()
+	if _, err := extractPDFTextImpl(context.Background(), server.URL, "url", 0); !errors.Is(err, fetch.ErrBlocked) {
+		t.Errorf("Expected loopback URL to be blocked, got %v", err)
+	}
+
+	originalFetcher := documentFetcher
+	defer func() { documentFetcher = originalFetcher }()
+	InitDocumentFetcher(config.FetchConfig{AllowPrivateNetworks: true}, 1024*1024)
+	text, err = extractPDFTextImpl(context.Background(), server.URL, "url", 0)
+	if err != nil {
+		t.Fatalf("Failed to extract text from PDF URL: %v", err)
+	}
+	if text != expected {
+		t.Errorf("Unexpected text: %q", text)
+	}
+	// Cancelling the job stops a download in progress
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := extractPDFTextImpl(ctx, stalled.URL, "url", 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the download to stop with the job's context, got %v", err)
+	}
+}
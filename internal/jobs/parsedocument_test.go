@@ -50,6 +50,35 @@ func TestParseDocumentPayloadValidation(t *testing.T) {
 	if err := invalidPayload.Validate(); err == nil {
 		t.Error("Expected error for invalid confidence threshold, got nil")
 	}
+
+	// Test negative max pages
+	invalidPayload = validPayload
+	invalidPayload.Options.MaxPages = -1
+	if err := invalidPayload.Validate(); err == nil {
+		t.Error("Expected error for negative max pages, got nil")
+	}
+
+	// Test webhook URL that isn't http(s)
+	invalidPayload = validPayload
+	invalidPayload.WebhookURL = "ftp://example.com/hook"
+	if err := invalidPayload.Validate(); err == nil {
+		t.Error("Expected error for invalid webhook URL, got nil")
+	}
+}
+
+func TestParseDocumentPayloadInstructions(t *testing.T) {
+	payload := ParseDocumentPayload{Description: "Extract the invoice total."}
+	if got := payload.Instructions(); got != "Extract the invoice total." {
+		t.Errorf("Expected the description alone, got %q", got)
+	}
+
+	payload.Options = ParseOptions{Language: "de", ConfidenceThreshold: 0.8}
+	want := "Extract the invoice total.\n\n" +
+		"The document is written in the language with BCP 47 tag \"de\".\n\n" +
+		"Only fill in a field if you are at least 80% confident of its value; use null otherwise."
+	if got := payload.Instructions(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
 }
 
 func TestGJSONValidation(t *testing.T) {
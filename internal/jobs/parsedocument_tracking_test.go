@@ -3,6 +3,7 @@ package jobs
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -38,7 +39,7 @@ func TestParseDocumentWithTracking(t *testing.T) {
 
 	// Mock extraction to fail once then succeed
 	extractionAttempts := 0
-	ExtractPDFText = func(documentSource string, documentType string, maxPages int) (string, error) {
+	ExtractPDFText = func(ctx context.Context, documentSource string, documentType string, maxPages int) (string, error) {
 		extractionAttempts++
 		if extractionAttempts == 1 {
 			return "", &MockError{message: "simulated extraction failure"}
@@ -172,4 +173,31 @@ type MockError struct {
 
 func (e *MockError) Error() string {
 	return e.message
-} 
\ No newline at end of file
+} 
+func TestParseDocumentWithTrackingCancelled(t *testing.T) {
+	originalExtractPDFText := ExtractPDFText
+	originalTracker := globalTracker
+	defer func() {
+		ExtractPDFText = originalExtractPDFText
+		globalTracker = originalTracker
+	}()
+	globalTracker = NewParsingTracker(DefaultParsingTrackerConfig())
+
+	extracted := false
+	ExtractPDFText = func(ctx context.Context, documentSource string, documentType string, maxPages int) (string, error) {
+		extracted = true
+		return "Mock document text", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	payload := []byte(`{"documentID": "cancelled-doc", "document": "test.pdf", "documentType": "path", "outputSchema": {"type": "object"}}`)
+	_, err := ParseDocumentWithTracking(ctx, payload)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if extracted {
+		t.Error("Expected a cancelled job not to extract text")
+	}
+}
@@ -80,6 +80,8 @@ type ParsingTracker struct {
 	statuses map[string]ParsingStatusUpdate
 	// webhookClient is responsible for sending webhook notifications
 	webhookClient WebhookClient
+	// webhooks holds the URLs individual documents asked to be notified at
+	webhooks map[string]string
 	// metrics tracks overall parsing metrics
 	metrics DocumentParsingMetrics
 	// config holds the configuration for the tracker
@@ -92,27 +94,30 @@ type ParsingTracker struct {
 
 // NewParsingTracker creates a new instance of ParsingTracker
 func NewParsingTracker(config ParsingTrackerConfig) *ParsingTracker {
-	var webhookClient WebhookClient
-	if config.WebhookEnabled {
-		webhookClient = &HTTPWebhookClient{}
-	} else {
-		// Use a no-op client when webhooks are disabled
-		webhookClient = &noopWebhookClient{}
-	}
-
+	// The client is also used for the webhooks of individual documents, so
+	// it is created even when the configured webhook is disabled. It sends
+	// within the limits set by InitDocumentFetcher.
 	return &ParsingTracker{
-		statuses:     make(map[string]ParsingStatusUpdate),
-		webhookClient: webhookClient,
-		metrics:     DocumentParsingMetrics{},
-		config:      config,
+		statuses:      make(map[string]ParsingStatusUpdate),
+		webhookClient: NewHTTPWebhookClient(documentFetcher),
+		webhooks:      make(map[string]string),
+		metrics:       DocumentParsingMetrics{},
+		config:        config,
 	}
 }
 
-// noopWebhookClient is a webhook client that does nothing (for when webhooks are disabled)
-type noopWebhookClient struct{}
+// SetWebhook makes status changes of a document also be sent to url, in
+// addition to the configured webhook. An empty url removes the document's
+// webhook.
+func (t *ParsingTracker) SetWebhook(documentID, url string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-func (c *noopWebhookClient) Send(url string, data interface{}) error {
-	return nil
+	if url == "" {
+		delete(t.webhooks, documentID)
+		return
+	}
+	t.webhooks[documentID] = url
 }
 
 // UpdateStatus updates the status of a document
@@ -148,6 +153,7 @@ func (t *ParsingTracker) UpdateStatus(documentID string, status DocumentStatus,
 	// Get a local copy of subscribers to avoid holding the lock during notifications
 	subscribers := make([]chan<- ParsingStatusUpdate, len(t.statusSubscribers))
 	copy(subscribers, t.statusSubscribers)
+	documentWebhook := t.webhooks[documentID]
 	
 	t.mutex.Unlock()
 	
@@ -157,6 +163,11 @@ func (t *ParsingTracker) UpdateStatus(documentID string, status DocumentStatus,
 			t.webhookClient.Send(t.config.WebhookURL, update)
 		}()
 	}
+	if documentWebhook != "" && t.webhookClient != nil {
+		go func() {
+			t.webhookClient.Send(documentWebhook, update)
+		}()
+	}
 	
 	// Notify subscribers
 	for _, ch := range subscribers {
@@ -81,6 +81,32 @@ func TestParsingTracker_UpdateStatus(t *testing.T) {
 	}
 }
 
+func TestParsingTracker_DocumentWebhook(t *testing.T) {
+	// The configured webhook is disabled, but documents can still ask for one
+	mockWebhook := &MockWebhookClient{}
+	tracker := NewParsingTracker(DefaultParsingTrackerConfig())
+	tracker.webhookClient = mockWebhook
+
+	tracker.SetWebhook("doc123", "http://example.com/doc123")
+	tracker.UpdateStatus("doc123", StatusParsing, nil)
+	tracker.UpdateStatus("doc456", StatusParsing, nil)
+	tracker.SetWebhook("doc123", "")
+	tracker.UpdateStatus("doc123", StatusComplete, nil)
+
+	// Wait a moment for the async webhook call to happen
+	time.Sleep(100 * time.Millisecond)
+
+	mockWebhook.mu.Lock()
+	defer mockWebhook.mu.Unlock()
+	if len(mockWebhook.Calls) != 1 {
+		t.Fatalf("Expected 1 webhook call, got %d", len(mockWebhook.Calls))
+	}
+	call := mockWebhook.Calls[0]
+	if update := call.Data.(ParsingStatusUpdate); call.URL != "http://example.com/doc123" || update.Status != StatusParsing {
+		t.Errorf("Unexpected webhook call: %+v", call)
+	}
+}
+
 func TestParsingTracker_ShouldRetry(t *testing.T) {
 	config := DefaultParsingTrackerConfig()
 	config.MaxRetries = 2
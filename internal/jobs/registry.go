@@ -0,0 +1,188 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+// ErrInvalidJob marks jobs that can never succeed, such as an unknown type
+// or a payload that fails validation, so they aren't retried
+var ErrInvalidJob = errors.New("invalid job")
+
+// PayloadDecoder parses a raw job payload into the job type's payload value
+type PayloadDecoder func(payload []byte) (interface{}, error)
+
+// PayloadValidator checks a payload returned by the job type's decoder
+type PayloadValidator func(payload interface{}) error
+
+// PayloadConverter rewrites a payload written at one schema version into
+// the shape of the next version
+type PayloadConverter func(payload json.RawMessage) (json.RawMessage, error)
+
+// JobType describes how jobs of one type are decoded, validated and run
+type JobType struct {
+	Name string
+	// Public job types can be created directly through POST /api/jobs;
+	// others have their own endpoint that prepares the payload
+	Public   bool
+	Decode   PayloadDecoder
+	Validate PayloadValidator // optional
+	Handle   JobHandlerFunc
+	// Converters upgrade older payloads, keyed by the version they convert
+	// from; payloads of versions without one are kept as they are
+	Converters map[int]PayloadConverter
+}
+
+// Prepare decodes and validates a raw payload. Errors wrap ErrInvalidJob.
+func (t JobType) Prepare(payload []byte) (interface{}, error) {
+	decoded, err := t.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %s payload: %v", ErrInvalidJob, t.Name, err)
+	}
+	if t.Validate != nil {
+		if err := t.Validate(decoded); err != nil {
+			return nil, fmt.Errorf("%w: invalid %s payload: %v", ErrInvalidJob, t.Name, err)
+		}
+	}
+	return decoded, nil
+}
+
+// Upgrade converts env to the current SchemaVersion one version at a time
+func (t JobType) Upgrade(env Envelope) (Envelope, error) {
+	if env.SchemaVersion < 1 || env.SchemaVersion > SchemaVersion {
+		return Envelope{}, fmt.Errorf("%w: %s payload has version %d, this build reads up to %d",
+			ErrUnsupportedSchemaVersion, t.Name, env.SchemaVersion, SchemaVersion)
+	}
+	for ; env.SchemaVersion < SchemaVersion; env.SchemaVersion++ {
+		convert := t.Converters[env.SchemaVersion]
+		if convert == nil {
+			continue
+		}
+		payload, err := convert(env.Payload)
+		if err != nil {
+			return Envelope{}, fmt.Errorf("%w: failed to convert version %d %s payload: %v", ErrInvalidJob, env.SchemaVersion, t.Name, err)
+		}
+		env.Payload = payload
+	}
+	return env, nil
+}
+
+// DecodeJSON returns a PayloadDecoder that unmarshals payloads into a new *T
+func DecodeJSON[T any]() PayloadDecoder {
+	return func(payload []byte) (interface{}, error) {
+		decoded := new(T)
+		if err := json.Unmarshal(payload, decoded); err != nil {
+			return nil, err
+		}
+		return decoded, nil
+	}
+}
+
+// jobTypeRegistry holds the registered job types by name
+type jobTypeRegistry struct {
+	types map[string]JobType
+	mutex sync.RWMutex
+}
+
+var jobTypes = &jobTypeRegistry{
+	types: make(map[string]JobType),
+}
+
+func init() {
+	RegisterJobType(JobType{
+		Name:   models.JobTypePDFParse,
+		Decode: DecodeJSON[ParseDocumentPayload](),
+		Validate: func(payload interface{}) error {
+			return payload.(*ParseDocumentPayload).Validate()
+		},
+		Handle: ParseDocumentHandler,
+		Converters: map[int]PayloadConverter{
+			1: convertLegacyParseDocumentPayload,
+		},
+	})
+	RegisterJobType(JobType{
+		Name:   models.JobTypeSleep,
+		Public: true,
+		Decode: DecodeJSON[SleepPayload](),
+		Validate: func(payload interface{}) error {
+			return payload.(*SleepPayload).Validate()
+		},
+		Handle: SleepHandler,
+	})
+}
+
+// RegisterJobType adds or replaces a job type
+func RegisterJobType(t JobType) {
+	jobTypes.mutex.Lock()
+	defer jobTypes.mutex.Unlock()
+
+	jobTypes.types[t.Name] = t
+}
+
+// LookupJobType returns the registered job type with the given name
+func LookupJobType(name string) (JobType, bool) {
+	jobTypes.mutex.RLock()
+	defer jobTypes.mutex.RUnlock()
+
+	t, ok := jobTypes.types[name]
+	return t, ok
+}
+
+// RegisteredJobTypes returns the names of all registered job types
+func RegisteredJobTypes() []string {
+	jobTypes.mutex.RLock()
+	defer jobTypes.mutex.RUnlock()
+
+	names := make([]string, 0, len(jobTypes.types))
+	for name := range jobTypes.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// maxSleep bounds the duration of a sleep job
+const maxSleep = time.Hour
+
+// SleepPayload is the payload of a sleep job, which waits and then succeeds
+// or fails as requested. It is useful for trying out and load testing the
+// job pipeline.
+type SleepPayload struct {
+	// DurationMs is how long the job runs, in milliseconds
+	DurationMs int `json:"duration_ms"`
+	// Error, if set, makes the job fail with this message
+	Error string `json:"error,omitempty"`
+}
+
+// Validate checks that the sleep duration is within bounds
+func (p *SleepPayload) Validate() error {
+	if p.DurationMs < 0 || int64(p.DurationMs) > maxSleep.Milliseconds() {
+		return fmt.Errorf("duration_ms must be between 0 and %d", maxSleep.Milliseconds())
+	}
+	return nil
+}
+
+// SleepHandler handles sleep jobs
+func SleepHandler(ctx context.Context, payload []byte) (Result, error) {
+	var p SleepPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return Result{}, fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	select {
+	case <-time.After(time.Duration(p.DurationMs) * time.Millisecond):
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+	if p.Error != "" {
+		return Result{}, errors.New(p.Error)
+	}
+	return Result{Data: map[string]interface{}{"slept_ms": p.DurationMs}}, nil
+}
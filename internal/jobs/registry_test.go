@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+func TestRegisteredJobTypes(t *testing.T) {
+	names := RegisteredJobTypes()
+	if len(names) != 2 || names[0] != models.JobTypePDFParse || names[1] != models.JobTypeSleep {
+		t.Fatalf("Unexpected job types: %v", names)
+	}
+
+	if _, ok := LookupJobType("unknown"); ok {
+		t.Error("Expected unknown job type not to be found")
+	}
+	sleep, ok := LookupJobType(models.JobTypeSleep)
+	if !ok || !sleep.Public {
+		t.Error("Expected sleep to be a public job type")
+	}
+	pdf, ok := LookupJobType(models.JobTypePDFParse)
+	if !ok || pdf.Public {
+		t.Error("Expected pdf_parse to be registered but not public")
+	}
+}
+
+func TestJobTypePrepare(t *testing.T) {
+	sleep, _ := LookupJobType(models.JobTypeSleep)
+
+	payload, err := sleep.Prepare([]byte(`{"duration_ms": 250}`))
+	if err != nil {
+		t.Fatalf("Expected valid payload, got error: %v", err)
+	}
+	if p := payload.(*SleepPayload); p.DurationMs != 250 {
+		t.Errorf("Expected duration 250, got %d", p.DurationMs)
+	}
+
+	for _, invalid := range []string{`not json`, `{"duration_ms": -1}`, `{"duration_ms": 3600001}`} {
+		if _, err := sleep.Prepare([]byte(invalid)); !errors.Is(err, ErrInvalidJob) {
+			t.Errorf("Expected ErrInvalidJob for %s, got %v", invalid, err)
+		}
+	}
+
+	pdf, _ := LookupJobType(models.JobTypePDFParse)
+	if _, err := pdf.Prepare([]byte(`{"document": ""}`)); !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected ErrInvalidJob for a PDF payload without a document, got %v", err)
+	}
+}
+
+func TestSleepHandler(t *testing.T) {
+	result, err := SleepHandler(context.Background(), []byte(`{"duration_ms": 1}`))
+	if err != nil {
+		t.Fatalf("SleepHandler returned error: %v", err)
+	}
+	if data := result.Data.(map[string]interface{}); data["slept_ms"] != 1 {
+		t.Errorf("Unexpected result: %v", result.Data)
+	}
+
+	if _, err := SleepHandler(context.Background(), []byte(`{"error": "boom"}`)); err == nil || err.Error() != "boom" {
+		t.Errorf("Expected the requested error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := SleepHandler(ctx, []byte(`{"duration_ms": 60000}`)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled sleep to stop, got %v", err)
+	}
+}
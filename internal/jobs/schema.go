@@ -0,0 +1,390 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSchemaCorrections is how many times the LLM is re-prompted with
+// validation errors before the output is rejected
+const maxSchemaCorrections = 2
+
+// SchemaViolation describes one way a value fails to match its JSON schema
+type SchemaViolation struct {
+	// Path is a JSON pointer to the offending value ("" for the root)
+	Path string `json:"path"`
+	// Message explains which keyword failed
+	Message string `json:"message"`
+}
+
+func (v SchemaViolation) String() string {
+	path := v.Path
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s: %s", path, v.Message)
+}
+
+// ValidateAgainstSchema checks a decoded JSON value against a schema. It
+// supports the draft 2020-12 keywords type, properties, required,
+// additionalProperties, items, enum, const, format, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, minLength, maxLength, minItems and
+// maxItems. Unknown keywords are ignored.
+func ValidateAgainstSchema(value interface{}, schema map[string]interface{}) []SchemaViolation {
+	var violations []SchemaViolation
+	validateValue(value, schema, "", &violations)
+	return violations
+}
+
+func validateValue(value interface{}, schema map[string]interface{}, path string, out *[]SchemaViolation) {
+	if schema == nil {
+		return
+	}
+	add := func(format string, args ...interface{}) {
+		*out = append(*out, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if t, ok := schema["type"]; ok {
+		types := schemaTypes(t)
+		if len(types) > 0 && !matchesAnyType(value, types) {
+			add("expected type %s, got %s", strings.Join(types, " or "), jsonType(value))
+			// Further keywords would only produce noise for the wrong type
+			return
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, candidate := range enum {
+			if jsonEqual(value, candidate) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("value %s is not one of the allowed values %s", compactJSON(value), compactJSON(enum))
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !jsonEqual(value, c) {
+		add("value must be %s", compactJSON(c))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		validateObject(v, schema, path, out)
+	case []interface{}:
+		validateArray(v, schema, path, out)
+	case string:
+		validateString(v, schema, add)
+	case float64:
+		validateNumber(v, schema, add)
+	}
+}
+
+func validateObject(obj map[string]interface{}, schema map[string]interface{}, path string, out *[]SchemaViolation) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, ok := r.(string)
+			if !ok {
+				continue
+			}
+			if _, exists := obj[name]; !exists {
+				*out = append(*out, SchemaViolation{Path: path, Message: fmt.Sprintf("missing required property %q", name)})
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	// Iterate in a stable order so violation lists are deterministic
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := path + "/" + escapePointer(key)
+		if propSchema, ok := properties[key].(map[string]interface{}); ok {
+			validateValue(obj[key], propSchema, childPath, out)
+			continue
+		}
+		if _, declared := properties[key]; declared {
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				*out = append(*out, SchemaViolation{Path: path, Message: fmt.Sprintf("unexpected property %q", key)})
+			}
+		case map[string]interface{}:
+			validateValue(obj[key], additional, childPath, out)
+		}
+	}
+}
+
+func validateArray(arr []interface{}, schema map[string]interface{}, path string, out *[]SchemaViolation) {
+	if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(arr)) < min {
+		*out = append(*out, SchemaViolation{Path: path, Message: fmt.Sprintf("expected at least %v items, got %d", min, len(arr))})
+	}
+	if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(arr)) > max {
+		*out = append(*out, SchemaViolation{Path: path, Message: fmt.Sprintf("expected at most %v items, got %d", max, len(arr))})
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for i, item := range arr {
+			validateValue(item, items, fmt.Sprintf("%s/%d", path, i), out)
+		}
+	}
+}
+
+func validateString(s string, schema map[string]interface{}, add func(string, ...interface{})) {
+	length := float64(len([]rune(s)))
+	if min, ok := schemaNumber(schema, "minLength"); ok && length < min {
+		add("string shorter than minLength %v", min)
+	}
+	if max, ok := schemaNumber(schema, "maxLength"); ok && length > max {
+		add("string longer than maxLength %v", max)
+	}
+	if format, ok := schema["format"].(string); ok && !matchesFormat(s, format) {
+		add("value %q is not a valid %s", s, format)
+	}
+}
+
+func validateNumber(n float64, schema map[string]interface{}, add func(string, ...interface{})) {
+	if min, ok := schemaNumber(schema, "minimum"); ok && n < min {
+		add("value %v is less than minimum %v", n, min)
+	}
+	if max, ok := schemaNumber(schema, "maximum"); ok && n > max {
+		add("value %v is greater than maximum %v", n, max)
+	}
+	if min, ok := schemaNumber(schema, "exclusiveMinimum"); ok && n <= min {
+		add("value %v must be greater than %v", n, min)
+	}
+	if max, ok := schemaNumber(schema, "exclusiveMaximum"); ok && n >= max {
+		add("value %v must be less than %v", n, max)
+	}
+}
+
+// schemaTypes normalises the "type" keyword, which may be a string or a list
+func schemaTypes(t interface{}) []string {
+	switch v := t.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var types []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func matchesAnyType(value interface{}, types []string) bool {
+	for _, t := range types {
+		switch t {
+		case "object":
+			if _, ok := value.(map[string]interface{}); ok {
+				return true
+			}
+		case "array":
+			if _, ok := value.([]interface{}); ok {
+				return true
+			}
+		case "string":
+			if _, ok := value.(string); ok {
+				return true
+			}
+		case "number":
+			if _, ok := value.(float64); ok {
+				return true
+			}
+		case "integer":
+			if n, ok := value.(float64); ok && n == math.Trunc(n) {
+				return true
+			}
+		case "boolean":
+			if _, ok := value.(bool); ok {
+				return true
+			}
+		case "null":
+			if value == nil {
+				return true
+			}
+		default:
+			// Unknown type names can't be checked; don't reject the value
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	switch v := schema[key].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	timePattern = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`)
+)
+
+// matchesFormat checks the common string formats; unknown formats pass
+func matchesFormat(s, format string) bool {
+	switch format {
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "time":
+		return timePattern.MatchString(s)
+	case "email":
+		addr, err := mail.ParseAddress(s)
+		return err == nil && addr.Address == s
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	case "uuid":
+		return uuidPattern.MatchString(s)
+	case "ipv4":
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() != nil && !strings.Contains(s, ":")
+	case "ipv6":
+		ip := net.ParseIP(s)
+		return ip != nil && strings.Contains(s, ":")
+	}
+	return true
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return compactJSON(a) == compactJSON(b)
+}
+
+func compactJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
+
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// schemaValidationInfo summarises schema validation for ParsedDocument.MetaInfo
+type schemaValidationInfo struct {
+	// Corrections is the number of corrective re-prompts that were needed
+	Corrections int
+	// Violations holds the violations reported for each rejected response
+	Violations []string
+}
+
+// metaInfo returns the fields recorded in ParsedDocument.MetaInfo
+func (i schemaValidationInfo) metaInfo() map[string]interface{} {
+	meta := map[string]interface{}{
+		"schemaValid":       true,
+		"schemaCorrections": i.Corrections,
+	}
+	if len(i.Violations) > 0 {
+		meta["schemaViolations"] = i.Violations
+	}
+	return meta
+}
+
+// generateValidated asks the extractor for structured data and validates it
+// against the schema. When the output doesn't match, the model is re-prompted
+// with the validation errors; if it still doesn't match after
+// maxSchemaCorrections attempts, an error listing the violations is returned.
+// That error wraps ErrInvalidJob, as running the job again won't help.
+func generateValidated(ctx context.Context, extractor StructuredExtractor, text string, schema map[string]interface{}, description string) (interface{}, schemaValidationInfo, error) {
+	var info schemaValidationInfo
+	prompt := description
+
+	for attempt := 0; ; attempt++ {
+		structuredData, err := extractor.GenerateContent(ctx, text, schema, prompt)
+		if err != nil {
+			return nil, info, fmt.Errorf("LLM processing error: %w", err)
+		}
+
+		var parsedContent interface{}
+		if err := json.Unmarshal(structuredData, &parsedContent); err != nil {
+			return nil, info, fmt.Errorf("failed to parse LLM response: %w", err)
+		}
+
+		violations := ValidateAgainstSchema(parsedContent, schema)
+		if len(violations) == 0 {
+			return parsedContent, info, nil
+		}
+
+		messages := make([]string, len(violations))
+		for i, v := range violations {
+			messages[i] = v.String()
+		}
+		info.Violations = append(info.Violations, messages...)
+
+		if attempt >= maxSchemaCorrections {
+			return nil, info, fmt.Errorf("%w: LLM output does not match schema after %d corrections: %s", ErrInvalidJob, attempt, strings.Join(messages, "; "))
+		}
+
+		info.Corrections++
+		prompt = correctionPrompt(description, structuredData, messages)
+	}
+}
+
+// correctionPrompt extends the original description with the rejected
+// response and the reasons it was rejected
+func correctionPrompt(description string, previous []byte, violations []string) string {
+	return fmt.Sprintf(`%s
+
+Your previous response did not match the JSON schema.
+
+PREVIOUS RESPONSE:
+%s
+
+VALIDATION ERRORS:
+- %s
+
+Return a corrected JSON object that fixes every validation error.`, description, string(previous), strings.Join(violations, "\n- "))
+}
@@ -0,0 +1,178 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var invoiceSchema = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"invoiceNumber", "total"},
+	"properties": map[string]interface{}{
+		"invoiceNumber": map[string]interface{}{"type": "string", "minLength": 1},
+		"total":         map[string]interface{}{"type": "number", "minimum": 0},
+		"currency":      map[string]interface{}{"type": "string", "enum": []interface{}{"USD", "EUR"}},
+		"issuedAt":      map[string]interface{}{"type": "string", "format": "date"},
+		"contact":       map[string]interface{}{"type": "string", "format": "email"},
+		"lineItems": map[string]interface{}{
+			"type":     "array",
+			"maxItems": 2,
+			"items": map[string]interface{}{
+				"type":     "object",
+				"required": []interface{}{"quantity"},
+				"properties": map[string]interface{}{
+					"quantity": map[string]interface{}{"type": "integer", "exclusiveMinimum": 0},
+				},
+			},
+		},
+	},
+	"additionalProperties": false,
+}
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("Invalid test JSON: %v", err)
+	}
+	return v
+}
+
+func TestValidateAgainstSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     []string
+	}{
+		{
+			name:     "valid document",
+			document: `{"invoiceNumber":"INV-1","total":10.5,"currency":"EUR","issuedAt":"2024-01-31","contact":"billing@example.com","lineItems":[{"quantity":2}]}`,
+		},
+		{
+			name:     "missing required and wrong type",
+			document: `{"total":"ten"}`,
+			want: []string{
+				`/: missing required property "invoiceNumber"`,
+				`/total: expected type number, got string`,
+			},
+		},
+		{
+			name:     "enum format and minimum",
+			document: `{"invoiceNumber":"","total":-1,"currency":"GBP","issuedAt":"31/01/2024","contact":"nobody"}`,
+			want: []string{
+				`/contact: value "nobody" is not a valid email`,
+				`/currency: value "GBP" is not one of the allowed values ["USD","EUR"]`,
+				`/invoiceNumber: string shorter than minLength 1`,
+				`/issuedAt: value "31/01/2024" is not a valid date`,
+				`/total: value -1 is less than minimum 0`,
+			},
+		},
+		{
+			name:     "array items and additional properties",
+			document: `{"invoiceNumber":"INV-1","total":1,"lineItems":[{"quantity":1.5},{},{"quantity":0}],"notes":"x"}`,
+			want: []string{
+				`/lineItems: expected at most 2 items, got 3`,
+				`/lineItems/0/quantity: expected type integer, got number`,
+				`/lineItems/1: missing required property "quantity"`,
+				`/lineItems/2/quantity: value 0 must be greater than 0`,
+				`/: unexpected property "notes"`,
+			},
+		},
+		{
+			name:     "root type mismatch",
+			document: `[1,2]`,
+			want:     []string{`/: expected type object, got array`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := ValidateAgainstSchema(decodeJSON(t, tt.document), invoiceSchema)
+			var got []string
+			for _, v := range violations {
+				got = append(got, v.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Violations mismatch\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateAgainstSchemaIgnoresUnknownKeywords(t *testing.T) {
+	// Example-shaped schemas (as sent by older clients) impose no constraints
+	schema := map[string]interface{}{"invoiceNumber": "string", "$schema": "https://json-schema.org/draft/2020-12/schema"}
+	if violations := ValidateAgainstSchema(decodeJSON(t, `{"anything":true}`), schema); len(violations) != 0 {
+		t.Errorf("Expected no violations, got %v", violations)
+	}
+}
+
+// sequenceExtractor returns canned responses in order and records descriptions
+type sequenceExtractor struct {
+	responses    []string
+	descriptions []string
+}
+
+func (s *sequenceExtractor) GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error) {
+	s.descriptions = append(s.descriptions, description)
+	response := s.responses[len(s.descriptions)-1]
+	return []byte(response), nil
+}
+
+func TestGenerateValidatedCorrectsOutput(t *testing.T) {
+	extractor := &sequenceExtractor{responses: []string{
+		`{"invoiceNumber":"INV-1"}`,
+		`{"invoiceNumber":"INV-1","total":42}`,
+	}}
+
+	content, info, err := generateValidated(context.Background(), extractor, "text", invoiceSchema, "Extract invoice")
+	if err != nil {
+		t.Fatalf("generateValidated returned error: %v", err)
+	}
+	if content.(map[string]interface{})["total"] != float64(42) {
+		t.Errorf("Expected corrected content, got %v", content)
+	}
+	if info.Corrections != 1 || len(info.Violations) != 1 {
+		t.Errorf("Unexpected validation info: %+v", info)
+	}
+	if len(extractor.descriptions) != 2 {
+		t.Fatalf("Expected 2 LLM calls, got %d", len(extractor.descriptions))
+	}
+	correction := extractor.descriptions[1]
+	if !strings.HasPrefix(correction, "Extract invoice") || !strings.Contains(correction, `missing required property "total"`) {
+		t.Errorf("Correction prompt missing original description or errors: %s", correction)
+	}
+
+	meta := info.metaInfo()
+	if meta["schemaValid"] != true || meta["schemaCorrections"] != 1 {
+		t.Errorf("Unexpected meta info: %v", meta)
+	}
+}
+
+func TestGenerateValidatedFailsAfterCorrections(t *testing.T) {
+	responses := make([]string, maxSchemaCorrections+1)
+	for i := range responses {
+		responses[i] = `{"invoiceNumber":5,"total":1}`
+	}
+	extractor := &sequenceExtractor{responses: responses}
+
+	_, info, err := generateValidated(context.Background(), extractor, "text", invoiceSchema, "")
+	if err == nil {
+		t.Fatal("Expected error for output that never matches the schema, got nil")
+	}
+	if !errors.Is(err, ErrInvalidJob) {
+		t.Errorf("Expected ErrInvalidJob so the job isn't retried, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "/invoiceNumber: expected type string") {
+		t.Errorf("Error does not list violations: %v", err)
+	}
+	if len(extractor.descriptions) != maxSchemaCorrections+1 {
+		t.Errorf("Expected %d LLM calls, got %d", maxSchemaCorrections+1, len(extractor.descriptions))
+	}
+	if info.Corrections != maxSchemaCorrections {
+		t.Errorf("Expected %d corrections, got %d", maxSchemaCorrections, info.Corrections)
+	}
+}
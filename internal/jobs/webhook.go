@@ -2,32 +2,38 @@ package jobs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/illegalcall/task-master/internal/fetch"
 )
 
+// webhookTimeout bounds sending a webhook notification
+const webhookTimeout = 10 * time.Second
+
 // WebhookClient is an interface for sending webhook notifications
 type WebhookClient interface {
 	Send(url string, data interface{}) error
 }
 
-// HTTPWebhookClient implements WebhookClient using standard HTTP requests
+// HTTPWebhookClient implements WebhookClient using standard HTTP requests.
+// Webhook URLs are supplied by users, so they are sent through a fetcher,
+// which refuses private addresses and bounds redirects as for downloads.
 type HTTPWebhookClient struct {
-	client *http.Client
+	fetcher *fetch.Fetcher
+}
+
+// NewHTTPWebhookClient creates a webhook client sending through fetcher
+func NewHTTPWebhookClient(fetcher *fetch.Fetcher) *HTTPWebhookClient {
+	return &HTTPWebhookClient{fetcher: fetcher}
 }
 
 // Send sends a webhook notification to the specified URL
 func (c *HTTPWebhookClient) Send(url string, data interface{}) error {
-	// If the client hasn't been initialized, create it with default settings
-	if c.client == nil {
-		c.client = &http.Client{
-			Timeout: 10 * time.Second,
-		}
-	}
-
 	// Marshal the data to JSON
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -35,14 +41,16 @@ func (c *HTTPWebhookClient) Send(url string, data interface{}) error {
 	}
 
 	// Create the request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create webhook request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// Send the request
-	resp, err := c.client.Do(req)
+	resp, err := c.fetcher.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send webhook request: %w", err)
 	}
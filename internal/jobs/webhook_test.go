@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/fetch"
+)
+
+func TestHTTPWebhookClient_Send(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer server.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+
+	// Webhooks may not reach private addresses, directly or by redirect
+	client := NewHTTPWebhookClient(fetch.New(config.FetchConfig{MaxRedirects: 3}, 0))
+	if err := client.Send(server.URL, map[string]string{"status": "completed"}); !errors.Is(err, fetch.ErrBlocked) {
+		t.Errorf("Expected loopback webhook to be blocked, got %v", err)
+	}
+	client = NewHTTPWebhookClient(fetch.New(config.FetchConfig{AllowPrivateNetworks: true, DeniedHosts: []string{"localhost"}, MaxRedirects: 3}, 0))
+	if err := client.Send(redirect.URL, map[string]string{"status": "completed"}); !errors.Is(err, fetch.ErrBlocked) {
+		t.Errorf("Expected webhook host to be blocked, got %v", err)
+	}
+	client = NewHTTPWebhookClient(fetch.New(config.FetchConfig{AllowPrivateNetworks: true}, 0))
+	if err := client.Send(redirect.URL, map[string]string{"status": "completed"}); !errors.Is(err, fetch.ErrTooManyRedirects) {
+		t.Errorf("Expected webhook redirect to be refused, got %v", err)
+	}
+	if received != 0 {
+		t.Fatalf("Expected no webhook to be received, got %d", received)
+	}
+
+	client = NewHTTPWebhookClient(fetch.New(config.FetchConfig{AllowPrivateNetworks: true, MaxRedirects: 1}, 0))
+	if err := client.Send(redirect.URL, map[string]string{"status": "completed"}); err != nil {
+		t.Fatalf("Failed to send webhook: %v", err)
+	}
+	if received != 1 {
+		t.Errorf("Expected 1 webhook to be received, got %d", received)
+	}
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DeadLetter is a job message that exhausted its retries and was published
+// to the dead-letter topic
+type DeadLetter struct {
+	ID         int        `json:"id" db:"id"`
+	JobID      *int       `json:"job_id,omitempty" db:"job_id"`
+	Topic      string     `json:"topic" db:"topic"`
+	Partition  int32      `json:"partition" db:"kafka_partition"`
+	Offset     int64      `json:"offset" db:"kafka_offset"`
+	Key        []byte     `json:"-" db:"key"`
+	Value      []byte     `json:"-" db:"value"`
+	Headers    Headers    `json:"headers" db:"headers"`
+	Error      string     `json:"error" db:"error"`
+	Attempts   int        `json:"attempts" db:"attempts"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	ReplayedAt *time.Time `json:"replayed_at,omitempty" db:"replayed_at"`
+}
+
+// DeadLetterColumns lists the columns scanned into a DeadLetter
+const DeadLetterColumns = "id, job_id, topic, kafka_partition, kafka_offset, key, value, headers, error, attempts, created_at, replayed_at"
+
+// Dead-letter headers added to the original message headers
+const (
+	HeaderDeadLetterError     = "x-dead-letter-error"
+	HeaderDeadLetterAttempts  = "x-dead-letter-attempts"
+	HeaderDeadLetterTopic     = "x-dead-letter-original-topic"
+	HeaderDeadLetterPartition = "x-dead-letter-original-partition"
+	HeaderDeadLetterOffset    = "x-dead-letter-original-offset"
+	HeaderDeadLetterFailedAt  = "x-dead-letter-failed-at"
+)
+
+// Headers are Kafka message headers stored in a JSONB column
+type Headers map[string]string
+
+func (h Headers) Value() (driver.Value, error) {
+	if h == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	// lib/pq sends []byte as bytea, so JSON goes over the wire as text
+	return string(data), nil
+}
+
+func (h *Headers) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Headers", src)
+	}
+	return json.Unmarshal(data, h)
+}
@@ -1,58 +1,61 @@
 package models
 
-import (
-	"encoding/json"
-	"time"
-)
+import "time"
 
 type Job struct {
-	ID        int       `json:"id" db:"id"`
-	Name      string    `json:"name" db:"name"`
-	Status    string    `json:"status" db:"status"`
-	Type      string    `json:"type" db:"type"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ID         int        `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Status     string     `json:"status" db:"status"`
+	Type       string     `json:"type" db:"type"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	Error      *string    `json:"error,omitempty" db:"error"`
+	StartedAt  *time.Time `json:"started_at,omitempty" db:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" db:"finished_at"`
+	Attempts   int        `json:"attempts" db:"attempts"`
+	OwnerID    *int       `json:"owner_id,omitempty" db:"owner_id"`
+	Retries    int        `json:"retries" db:"retries"`
+	RunAt      *time.Time `json:"run_at,omitempty" db:"run_at"`
 }
 
-// pdf parsing job
-type PDFParsingJob struct {
-	Job
-	Data NewParseDocumentPayload `json:"data"`
-}
+// JobColumns lists the columns scanned into a Job
+const JobColumns = "id, name, status, type, created_at, error, started_at, finished_at, attempts, owner_id, retries, run_at"
 
 const (
-	StatusPending   = "pending"
-	StatusFailed    = "failed"
-	StatusCompleted = "completed"
-	JobTypePDFParse = "pdf_parse"
+	StatusScheduled  = "scheduled"
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusFailed     = "failed"
+	StatusCompleted  = "completed"
+	StatusCancelled  = "cancelled"
+	JobTypePDFParse  = "pdf_parse"
+	JobTypeSleep     = "sleep"
 )
 
-type Result struct {
-	Message string      `json:"message"`
-	Data    interface{} `json:"data"`
-}
+// JobCancelChannel is the Redis pub/sub channel on which the API announces
+// the IDs of cancelled jobs so workers can abort them
+const JobCancelChannel = "jobs:cancel"
 
-type JobHandlerFunc func(payload []byte) (Result, error)
-
-// ParseDocumentPayload represents the payload for PDF parsing jobs
-type ParseDocumentPayload struct {
-	PDFSource      string          `json:"pdf_source" validate:"required"`      // URL or base64-encoded PDF data
-	ExpectedSchema json.RawMessage `json:"expected_schema" validate:"required"` // JSON schema for desired output
-	Description    string          `json:"description"`                         // Additional context for parsing
-	Options        struct {
-		Language      string `json:"language,omitempty"`       // Optional language specification
-		ParsingMethod string `json:"parsing_method,omitempty"` // Optional parsing method preference
-	} `json:"options,omitempty"`
-	WebhookURL string `json:"webhook_url,omitempty" validate:"omitempty,url"` // Optional webhook for notifications
-}
+// HeaderAttempts is the Kafka header carrying how many times a job message
+// has already been attempted. It mirrors jobs.attempts, which workers count
+// attempts by, when the message was queued.
+const HeaderAttempts = "x-attempts"
 
 type NewParseDocumentPayload struct {
-	PDFSource      string `json:"pdf_source" validate:"required"`      // URL or base64-encoded PDF data
-	ExpectedSchema string `json:"expected_schema" validate:"required"` // JSON schema for desired output
-	Name           string `json:"name" validate:"required"`
+	PDFSource      string               `json:"pdf_source" validate:"required"`      // URL or base64-encoded PDF data
+	ExpectedSchema string               `json:"expected_schema" validate:"required"` // JSON schema for desired output
+	Name           string               `json:"name" validate:"required"`
+	Description    string               `json:"description,omitempty"` // Additional context for parsing
+	Options        ParseDocumentOptions `json:"options,omitempty"`
+	WebhookURL     string               `json:"webhook_url,omitempty"` // Notified of parsing status changes
 }
 
-func (n NewParseDocumentPayload) JSON() any {
-	panic("unimplemented")
+// ParseDocumentOptions tunes the extraction of one document
+type ParseDocumentOptions struct {
+	Language            string  `json:"language,omitempty"`             // BCP 47 tag of the document's language, e.g. "en" or "pt-BR"
+	OCREnabled          bool    `json:"ocr_enabled,omitempty"`          // OCR for image-based pages; rejected until supported
+	ConfidenceThreshold float64 `json:"confidence_threshold,omitempty"` // Minimum confidence for extracted fields, 0.0-1.0
+	MaxPages            int     `json:"max_pages,omitempty"`            // Only the first N pages are read; 0 reads all
+	ParsingMethod       string  `json:"parsing_method,omitempty"`       // LLM provider; empty uses the configured default
 }
 
 // PDFSourceType indicates the type of PDF source provided
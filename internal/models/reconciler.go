@@ -0,0 +1,28 @@
+package models
+
+// ReconcilerStatsKey is the Redis hash in which workers count what the job
+// reconciler fixed, summed over all workers
+const ReconcilerStatsKey = "jobs:reconciler:stats"
+
+// Fields of ReconcilerStatsKey
+const (
+	ReconcilerStatRuns          = "runs"
+	ReconcilerStatRequeued      = "requeued"
+	ReconcilerStatFailed        = "failed"
+	ReconcilerStatRedisRepaired = "redis_repaired"
+	ReconcilerStatLastRunAt     = "last_run_at"
+)
+
+// ReconcilerStats counts what the job reconciler fixed
+type ReconcilerStats struct {
+	// Runs is the number of completed reconciler passes
+	Runs int64 `json:"runs" redis:"runs"`
+	// Requeued is the number of stuck jobs queued again
+	Requeued int64 `json:"requeued" redis:"requeued"`
+	// Failed is the number of stuck jobs failed for running out of attempts
+	Failed int64 `json:"failed" redis:"failed"`
+	// RedisRepaired is the number of Redis statuses set to match Postgres
+	RedisRepaired int64 `json:"redis_repaired" redis:"redis_repaired"`
+	// LastRunAt is when the last pass finished, in RFC 3339
+	LastRunAt string `json:"last_run_at,omitempty" redis:"last_run_at"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+type User struct {
+	ID             int        `json:"id" db:"id"`
+	Username       string     `json:"username" db:"username"`
+	PasswordHash   string     `json:"-" db:"password_hash"`
+	Role           string     `json:"role" db:"role"`
+	FailedAttempts int        `json:"-" db:"failed_attempts"`
+	LockedUntil    *time.Time `json:"-" db:"locked_until"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
+
+// UserColumns lists the columns scanned into a User
+const UserColumns = "id, username, password_hash, role, failed_attempts, locked_until, created_at"
+
+// User roles; admins can see every user's jobs
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
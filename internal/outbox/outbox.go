@@ -0,0 +1,154 @@
+// Package outbox implements a transactional outbox: Kafka messages are
+// written to the outbox table in the same transaction as the rows they
+// announce, and a relay publishes them afterwards. A message is published
+// at least once, and only if its transaction commits.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/pkg/kafka"
+)
+
+// pruneInterval is how often the relay deletes messages sent longer than
+// the retention period ago
+const pruneInterval = time.Hour
+
+// Message is a Kafka message waiting in the outbox
+type Message struct {
+	ID      int64          `db:"id"`
+	Topic   string         `db:"topic"`
+	Key     []byte         `db:"key"`
+	Value   []byte         `db:"value"`
+	Headers models.Headers `db:"headers"`
+}
+
+// Enqueue adds msg to the outbox as part of tx
+func Enqueue(ctx context.Context, tx sqlx.ExecerContext, msg Message) error {
+	// A nil []byte would be stored as an empty key rather than NULL
+	var key interface{}
+	if msg.Key != nil {
+		key = msg.Key
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO outbox (topic, key, value, headers) VALUES ($1, $2, $3, $4)",
+		msg.Topic, key, msg.Value, msg.Headers,
+	); err != nil {
+		return fmt.Errorf("failed to add message to outbox: %w", err)
+	}
+	return nil
+}
+
+// Relay publishes the messages in the outbox to Kafka in the order they
+// were written. Several relays can run against the same database; each
+// message is claimed by one of them at a time.
+type Relay struct {
+	cfg      config.OutboxConfig
+	db       *sqlx.DB
+	producer sarama.SyncProducer
+}
+
+func NewRelay(cfg config.OutboxConfig, db *sqlx.DB, producer sarama.SyncProducer) *Relay {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	return &Relay{cfg: cfg, db: db, producer: producer}
+}
+
+// Run publishes pending messages every PollInterval until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pruneTicker.C:
+			if err := r.prune(ctx, time.Now()); err != nil {
+				slog.Error("Failed to prune outbox", "error", err)
+			}
+		case <-ticker.C:
+			// Keep going while there is a backlog
+			for ctx.Err() == nil {
+				sent, err := r.publishBatch(ctx)
+				if err != nil {
+					slog.Error("Failed to relay outbox messages", "error", err)
+					break
+				}
+				if sent < r.cfg.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// publishBatch publishes up to BatchSize pending messages and marks them
+// sent, returning how many were sent. It stops at the first message Kafka
+// rejects so that messages keep their order; that message is tried again
+// on the next poll. A relay that dies between publishing and committing
+// leaves the messages pending, so they are published again.
+func (r *Relay) publishBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var pending []Message
+	if err := tx.SelectContext(ctx, &pending,
+		"SELECT id, topic, key, value, headers FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED",
+		r.cfg.BatchSize,
+	); err != nil {
+		return 0, fmt.Errorf("failed to load outbox messages: %w", err)
+	}
+
+	sent := 0
+	var sendErr error
+	for _, msg := range pending {
+		producerMsg := &sarama.ProducerMessage{
+			Topic:   msg.Topic,
+			Value:   sarama.ByteEncoder(msg.Value),
+			Headers: kafka.RecordHeaders(msg.Headers),
+		}
+		if msg.Key != nil {
+			producerMsg.Key = sarama.ByteEncoder(msg.Key)
+		}
+		if _, _, err := r.producer.SendMessage(producerMsg); err != nil {
+			sendErr = fmt.Errorf("failed to publish outbox message %d: %w", msg.ID, err)
+			break
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE outbox SET sent_at = $1 WHERE id = $2", time.Now(), msg.ID); err != nil {
+			return 0, fmt.Errorf("failed to mark outbox message %d as sent: %w", msg.ID, err)
+		}
+		sent++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return sent, sendErr
+}
+
+// prune deletes the messages sent more than Retention before now
+func (r *Relay) prune(ctx context.Context, now time.Time) error {
+	if r.cfg.Retention <= 0 {
+		return nil
+	}
+	_, err := r.db.ExecContext(ctx, "DELETE FROM outbox WHERE sent_at < $1", now.Add(-r.cfg.Retention))
+	return err
+}
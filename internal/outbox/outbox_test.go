@@ -0,0 +1,129 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/IBM/sarama"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+// MockProducer records sent messages and fails once fail messages were sent
+type MockProducer struct {
+	sarama.SyncProducer
+	messages []*sarama.ProducerMessage
+	fail     int
+}
+
+func (m *MockProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if m.fail > 0 && len(m.messages) == m.fail {
+		return 0, 0, errors.New("kafka unavailable")
+	}
+	m.messages = append(m.messages, msg)
+	return 0, int64(len(m.messages)), nil
+}
+
+var (
+	selectPending = regexp.QuoteMeta("SELECT id, topic, key, value, headers FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED")
+	markSent      = regexp.QuoteMeta("UPDATE outbox SET sent_at = $1 WHERE id = $2")
+)
+
+func setupTestRelay(t *testing.T, producer *MockProducer) (*Relay, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return NewRelay(config.OutboxConfig{BatchSize: 10, Retention: time.Hour}, sqlx.NewDb(db, "sqlmock"), producer), mock
+}
+
+func pendingRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "topic", "key", "value", "headers"}).
+		AddRow(1, "jobs", nil, []byte(`{"id":1}`), []byte(`{}`)).
+		AddRow(2, "jobs", []byte("2"), []byte(`{"id":2}`), []byte(`{"trace-id":"abc"}`)).
+		AddRow(3, "jobs", nil, []byte(`{"id":3}`), []byte(`{}`))
+}
+
+func TestEnqueue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO outbox (topic, key, value, headers) VALUES ($1, $2, $3, $4)")).
+		WithArgs("jobs", nil, []byte(`{"id":1}`), `{"trace-id":"abc"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = Enqueue(context.Background(), sqlx.NewDb(db, "sqlmock"), Message{
+		Topic:   "jobs",
+		Value:   []byte(`{"id":1}`),
+		Headers: models.Headers{"trace-id": "abc"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPublishBatch(t *testing.T) {
+	producer := &MockProducer{}
+	relay, mock := setupTestRelay(t, producer)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectPending).WithArgs(10).WillReturnRows(pendingRows())
+	for id := 1; id <= 3; id++ {
+		mock.ExpectExec(markSent).WithArgs(sqlmock.AnyArg(), id).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	sent, err := relay.publishBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+
+	// Messages are published in order with their key and headers
+	require.Len(t, producer.messages, 3)
+	for i, msg := range producer.messages {
+		assert.Equal(t, "jobs", msg.Topic)
+		value, _ := msg.Value.Encode()
+		assert.Contains(t, string(value), string(rune('1'+i)))
+	}
+	key, _ := producer.messages[1].Key.Encode()
+	assert.Equal(t, []byte("2"), key)
+	assert.Equal(t, []sarama.RecordHeader{{Key: []byte("trace-id"), Value: []byte("abc")}}, producer.messages[1].Headers)
+	assert.Nil(t, producer.messages[0].Key)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPublishBatchStopsAtFailedMessage(t *testing.T) {
+	producer := &MockProducer{fail: 1}
+	relay, mock := setupTestRelay(t, producer)
+
+	// The first message is marked sent; the rest stay pending for the next
+	// poll so they aren't published out of order
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectPending).WithArgs(10).WillReturnRows(pendingRows())
+	mock.ExpectExec(markSent).WithArgs(sqlmock.AnyArg(), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	sent, err := relay.publishBatch(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Len(t, producer.messages, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPrune(t *testing.T) {
+	relay, mock := setupTestRelay(t, &MockProducer{})
+	now := time.Now()
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM outbox WHERE sent_at < $1")).
+		WithArgs(now.Add(-time.Hour)).
+		WillReturnResult(sqlmock.NewResult(0, 5))
+
+	assert.NoError(t, relay.prune(context.Background(), now))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,319 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/ascii85"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// maxDecodedSize caps the output of a single stream to protect against
+// decompression bombs
+const maxDecodedSize = 64 << 20 // 64MB
+
+// decodeStream applies the stream's filter chain and returns the decoded data
+func (d *document) decodeStream(s stream) ([]byte, error) {
+	filters := d.resolve(s.hdr["Filter"])
+	params := d.resolve(s.hdr["DecodeParms"])
+
+	var names []name
+	var parms []dict
+	switch f := filters.(type) {
+	case nil:
+		return s.raw, nil
+	case name:
+		names = []name{f}
+		p, _ := params.(dict)
+		parms = []dict{p}
+	case array:
+		pa, _ := params.(array)
+		for i, item := range f {
+			n, ok := d.resolve(item).(name)
+			if !ok {
+				return nil, fmt.Errorf("invalid filter entry %v", item)
+			}
+			names = append(names, n)
+			var p dict
+			if i < len(pa) {
+				p, _ = d.resolve(pa[i]).(dict)
+			}
+			parms = append(parms, p)
+		}
+	default:
+		return nil, fmt.Errorf("invalid filter %v", f)
+	}
+
+	data := s.raw
+	for i, f := range names {
+		var err error
+		switch f {
+		case "FlateDecode", "Fl":
+			data, err = decodeFlate(data)
+			if err == nil {
+				data, err = applyPredictor(data, d.intParam(parms[i], "Predictor", 1), d.intParam(parms[i], "Colors", 1), d.intParam(parms[i], "BitsPerComponent", 8), d.intParam(parms[i], "Columns", 1))
+			}
+		case "LZWDecode", "LZW":
+			data, err = decodeLZW(data, d.intParam(parms[i], "EarlyChange", 1))
+			if err == nil {
+				data, err = applyPredictor(data, d.intParam(parms[i], "Predictor", 1), d.intParam(parms[i], "Colors", 1), d.intParam(parms[i], "BitsPerComponent", 8), d.intParam(parms[i], "Columns", 1))
+			}
+		case "ASCII85Decode", "A85":
+			data, err = decodeASCII85(data)
+		case "ASCIIHexDecode", "AHx":
+			data, err = decodeASCIIHex(data)
+		default:
+			return nil, fmt.Errorf("unsupported filter %s", f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+	}
+	return data, nil
+}
+
+func (d *document) intParam(p dict, key name, def int) int {
+	if p == nil {
+		return def
+	}
+	if v, ok := d.resolve(p[key]).(int); ok {
+		return v
+	}
+	return def
+}
+
+// decodeFlate inflates zlib data. Truncated streams are common in the wild,
+// so whatever could be decoded before an error is returned.
+func decodeFlate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if len(out) > maxDecodedSize {
+		return nil, errors.New("decoded stream too large")
+	}
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decodeLZW implements the LZW variant used by PDF (MSB-first codes, 9 to 12
+// bits). earlyChange mirrors the /EarlyChange decode parameter.
+func decodeLZW(data []byte, earlyChange int) ([]byte, error) {
+	const (
+		clearCode = 256
+		eodCode   = 257
+	)
+
+	var (
+		out     []byte
+		table   [][]byte
+		prev    []byte
+		codeLen = 9
+		bitBuf  uint32
+		bitCnt  uint
+		pos     int
+	)
+	reset := func() {
+		table = table[:0]
+		for i := 0; i < 256; i++ {
+			table = append(table, []byte{byte(i)})
+		}
+		table = append(table, nil, nil) // clear and EOD
+		codeLen = 9
+		prev = nil
+	}
+	reset()
+
+	for {
+		for bitCnt < uint(codeLen) {
+			if pos >= len(data) {
+				return out, nil
+			}
+			bitBuf = bitBuf<<8 | uint32(data[pos])
+			bitCnt += 8
+			pos++
+		}
+		code := int(bitBuf>>(bitCnt-uint(codeLen))) & (1<<codeLen - 1)
+		bitCnt -= uint(codeLen)
+
+		switch {
+		case code == clearCode:
+			reset()
+			continue
+		case code == eodCode:
+			return out, nil
+		}
+
+		var entry []byte
+		switch {
+		case code < len(table) && table[code] != nil:
+			entry = table[code]
+		case code == len(table) && prev != nil:
+			entry = append(append([]byte{}, prev...), prev[0])
+		default:
+			return out, fmt.Errorf("invalid code %d", code)
+		}
+
+		out = append(out, entry...)
+		if len(out) > maxDecodedSize {
+			return nil, errors.New("decoded stream too large")
+		}
+
+		if prev != nil && len(table) < 4096 {
+			table = append(table, append(append([]byte{}, prev...), entry[0]))
+		}
+		prev = entry
+
+		if len(table)+earlyChange >= 1<<codeLen && codeLen < 12 {
+			codeLen++
+		}
+	}
+}
+
+// decodeASCII85 decodes ASCII base-85 data terminated by "~>"
+func decodeASCII85(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	data = bytes.TrimPrefix(data, []byte("<~"))
+	if end := bytes.Index(data, []byte("~>")); end >= 0 {
+		data = data[:end]
+	}
+
+	out := make([]byte, 4*len(data)+4)
+	n, _, err := ascii85.Decode(out, data, true)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+// decodeASCIIHex decodes hexadecimal data terminated by ">"; whitespace is ignored
+func decodeASCIIHex(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data)/2)
+	var hi byte
+	half := false
+loop:
+	for _, c := range data {
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		case c == '>':
+			break loop
+		case isWhitespace(c):
+			continue
+		default:
+			return nil, fmt.Errorf("invalid hex character %q", c)
+		}
+		if half {
+			out = append(out, hi<<4|v)
+		} else {
+			hi = v
+		}
+		half = !half
+	}
+	if half {
+		// An odd final digit is treated as if followed by 0
+		out = append(out, hi<<4)
+	}
+	return out, nil
+}
+
+// applyPredictor reverses TIFF (2) and PNG (>= 10) predictors
+func applyPredictor(data []byte, predictor, colors, bpc, columns int) ([]byte, error) {
+	if predictor <= 1 || len(data) == 0 {
+		return data, nil
+	}
+	if colors <= 0 || bpc <= 0 || columns <= 0 {
+		return nil, errors.New("invalid predictor parameters")
+	}
+	// The parameters come from the file, so a row is checked against the
+	// data before one is allocated
+	if colors > math.MaxInt/bpc || columns > (math.MaxInt-7)/(colors*bpc) {
+		return nil, errors.New("predictor row too long")
+	}
+	bpp := (colors*bpc + 7) / 8
+	rowLen := (colors*bpc*columns + 7) / 8
+	if rowLen > len(data) || rowLen > maxDecodedSize {
+		return nil, fmt.Errorf("predictor row of %d bytes exceeds the %d bytes of data", rowLen, len(data))
+	}
+
+	if predictor == 2 {
+		if bpc != 8 {
+			return nil, errors.New("unsupported TIFF predictor bit depth")
+		}
+		out := append([]byte{}, data...)
+		for row := 0; row+rowLen <= len(out); row += rowLen {
+			for i := bpp; i < rowLen; i++ {
+				out[row+i] += out[row+i-bpp]
+			}
+		}
+		return out, nil
+	}
+
+	// PNG predictors: every row is prefixed by its filter type byte
+	var out []byte
+	prior := make([]byte, rowLen)
+	for pos := 0; pos+1 <= len(data); pos += rowLen + 1 {
+		end := pos + 1 + rowLen
+		if end > len(data) {
+			end = len(data)
+		}
+		filter := data[pos]
+		row := append([]byte{}, data[pos+1:end]...)
+		for i := range row {
+			var left, up, upLeft byte
+			if i >= bpp {
+				left = row[i-bpp]
+				upLeft = prior[i-bpp]
+			}
+			up = prior[i]
+			switch filter {
+			case 0:
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			default:
+				return nil, fmt.Errorf("invalid PNG filter %d", filter)
+			}
+		}
+		out = append(out, row...)
+		copy(prior, row)
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
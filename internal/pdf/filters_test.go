@@ -0,0 +1,131 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/lzw"
+	"encoding/ascii85"
+	"math"
+	"testing"
+)
+
+func TestDecodeLZW(t *testing.T) {
+	// Example from the PDF specification (EarlyChange 1)
+	encoded := []byte{0x80, 0x0B, 0x60, 0x50, 0x22, 0x0C, 0x0C, 0x85, 0x01}
+	out, err := decodeLZW(encoded, 1)
+	if err != nil {
+		t.Fatalf("decodeLZW returned error: %v", err)
+	}
+	if want := "-----A---B"; string(out) != want {
+		t.Errorf("decodeLZW = %q, want %q", out, want)
+	}
+
+	// The standard library encoder never uses early change
+	input := bytes.Repeat([]byte("BT /F1 12 Tf (Hello LZW) Tj ET\n"), 200)
+	var buf bytes.Buffer
+	w := lzw.NewWriter(&buf, lzw.MSB, 8)
+	w.Write(input)
+	w.Close()
+
+	out, err = decodeLZW(buf.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("decodeLZW returned error: %v", err)
+	}
+	if !bytes.Equal(out, input) {
+		t.Errorf("decodeLZW round trip mismatch: got %d bytes, want %d", len(out), len(input))
+	}
+}
+
+func TestDecodeASCII85(t *testing.T) {
+	input := []byte("Total: $100.00")
+	encoded := make([]byte, ascii85.MaxEncodedLen(len(input)))
+	n := ascii85.Encode(encoded, input)
+
+	out, err := decodeASCII85(append(append([]byte("<~"), encoded[:n]...), "~>"...))
+	if err != nil {
+		t.Fatalf("decodeASCII85 returned error: %v", err)
+	}
+	if !bytes.Equal(out, input) {
+		t.Errorf("decodeASCII85 = %q, want %q", out, input)
+	}
+}
+
+func TestDecodeASCIIHex(t *testing.T) {
+	out, err := decodeASCIIHex([]byte("48 65 6C\n6c 6F7>"))
+	if err != nil {
+		t.Fatalf("decodeASCIIHex returned error: %v", err)
+	}
+	if want := "Hello\x70"; string(out) != want {
+		t.Errorf("decodeASCIIHex = %q, want %q", out, want)
+	}
+
+	if _, err := decodeASCIIHex([]byte("zz")); err == nil {
+		t.Error("Expected error for invalid hex, got nil")
+	}
+}
+
+func TestDecodeStreamFilterChain(t *testing.T) {
+	content := []byte("BT (chained) Tj ET")
+	compressed := flate(content)
+	encoded := make([]byte, ascii85.MaxEncodedLen(len(compressed)))
+	n := ascii85.Encode(encoded, compressed)
+
+	doc := &document{objects: map[int]interface{}{}}
+	s := stream{
+		hdr: dict{"Filter": array{name("ASCII85Decode"), name("FlateDecode")}},
+		raw: append(encoded[:n], "~>"...),
+	}
+	out, err := doc.decodeStream(s)
+	if err != nil {
+		t.Fatalf("decodeStream returned error: %v", err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Errorf("decodeStream = %q, want %q", out, content)
+	}
+
+	s.hdr = dict{"Filter": name("DCTDecode")}
+	if _, err := doc.decodeStream(s); err == nil {
+		t.Error("Expected error for unsupported filter, got nil")
+	}
+}
+
+func TestApplyPNGPredictor(t *testing.T) {
+	// Two rows of three bytes: "None" then "Up"
+	data := []byte{0, 1, 2, 3, 2, 1, 1, 1}
+	out, err := applyPredictor(data, 12, 1, 8, 3)
+	if err != nil {
+		t.Fatalf("applyPredictor returned error: %v", err)
+	}
+	if want := []byte{1, 2, 3, 2, 3, 4}; !bytes.Equal(out, want) {
+		t.Errorf("applyPredictor = %v, want %v", out, want)
+	}
+}
+
+func TestApplyPredictorRejectsOversizedRows(t *testing.T) {
+	data := []byte{0, 1, 2, 3}
+	for _, tc := range []struct {
+		name                 string
+		colors, bpc, columns int
+	}{
+		{"row longer than the data", 1, 8, 1 << 40},
+		{"overflowing row", 1 << 40, 1 << 20, 1 << 20},
+		{"overflowing pixel", math.MaxInt / 2, 4, 1},
+		{"negative columns", 1, 8, -1},
+	} {
+		if _, err := applyPredictor(data, 12, tc.colors, tc.bpc, tc.columns); err == nil {
+			t.Errorf("%s: expected error, got nil", tc.name)
+		}
+	}
+
+	// A small stream claiming huge rows fails instead of allocating them
+	doc := &document{objects: map[int]interface{}{}}
+	s := stream{
+		hdr: dict{
+			"Filter":      name("FlateDecode"),
+			"DecodeParms": dict{"Predictor": 12, "Columns": math.MaxInt / 8},
+		},
+		raw: flate([]byte{0, 1, 2, 3}),
+	}
+	if _, err := doc.decodeStream(s); err == nil {
+		t.Error("Expected error for oversized predictor rows, got nil")
+	}
+}
@@ -0,0 +1,297 @@
+package pdf
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// font maps character codes in shown strings to Unicode text
+type font struct {
+	// toUnicode is the font's ToUnicode CMap, if it has one
+	toUnicode *cmap
+	// composite is set for Type0 fonts, whose codes default to two bytes
+	composite bool
+	// encoding maps single-byte codes for simple fonts
+	encoding [256]rune
+}
+
+// loadFont builds a font decoder from a font dictionary
+func (d *document) loadFont(fd dict) *font {
+	f := &font{encoding: winAnsiEncoding}
+	if fd == nil {
+		return f
+	}
+
+	if subtype, _ := d.resolve(fd["Subtype"]).(name); subtype == "Type0" {
+		f.composite = true
+	}
+
+	if s, ok := d.resolve(fd["ToUnicode"]).(stream); ok {
+		if data, err := d.decodeStream(s); err == nil {
+			f.toUnicode = parseCMap(data)
+		}
+	}
+
+	// The standard Latin encodings agree on printable ASCII, which is what
+	// matters for extraction, so WinAnsi stands in for all named base
+	// encodings and only /Differences is applied on top of it.
+	if enc, ok := d.resolve(fd["Encoding"]).(dict); ok {
+		if diffs, ok := d.resolve(enc["Differences"]).(array); ok {
+			code := 0
+			for _, item := range diffs {
+				switch v := d.resolve(item).(type) {
+				case int:
+					code = v
+				case name:
+					if code >= 0 && code < 256 {
+						if r, ok := glyphRune(string(v)); ok {
+							f.encoding[code] = r
+						}
+					}
+					code++
+				}
+			}
+		}
+	}
+	return f
+}
+
+// decode converts a shown string to text
+func (f *font) decode(s string) string {
+	var b strings.Builder
+	raw := []byte(s)
+	for i := 0; i < len(raw); {
+		n := f.codeLength(raw[i:])
+		code := raw[i : i+n]
+		i += n
+
+		if f.toUnicode != nil {
+			if text, ok := f.toUnicode.chars[string(code)]; ok {
+				b.WriteString(text)
+				continue
+			}
+		}
+		if f.composite {
+			// Without a ToUnicode entry, CID codes carry no recoverable text
+			continue
+		}
+		if r := f.encoding[code[0]]; r != 0 {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// codeLength returns the byte length of the code at the start of s
+func (f *font) codeLength(s []byte) int {
+	if f.toUnicode != nil && len(f.toUnicode.ranges) > 0 {
+		for n := 1; n <= 4 && n <= len(s); n++ {
+			for _, r := range f.toUnicode.ranges {
+				if r.contains(s[:n]) {
+					return n
+				}
+			}
+		}
+	}
+	if f.composite && len(s) >= 2 {
+		return 2
+	}
+	return 1
+}
+
+// cmap is a parsed ToUnicode CMap
+type cmap struct {
+	ranges []codespaceRange
+	// chars maps raw code bytes to their Unicode text
+	chars map[string]string
+}
+
+type codespaceRange struct {
+	lo, hi []byte
+}
+
+func (r codespaceRange) contains(code []byte) bool {
+	if len(code) != len(r.lo) {
+		return false
+	}
+	for i, c := range code {
+		if c < r.lo[i] || c > r.hi[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// maxCMapRange caps how many codes a single bfrange entry may expand to
+const maxCMapRange = 1 << 16
+
+// parseCMap reads the codespace ranges and bfchar/bfrange mappings of a CMap
+func parseCMap(data []byte) *cmap {
+	cm := &cmap{chars: make(map[string]string)}
+	l := newLexer(data)
+	var operands []interface{}
+	for {
+		obj, err := l.next()
+		if err != nil {
+			break
+		}
+		kw, ok := obj.(keyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch kw {
+		case "endcodespacerange":
+			for i := 0; i+1 < len(operands); i += 2 {
+				lo, ok1 := operands[i].(string)
+				hi, ok2 := operands[i+1].(string)
+				if ok1 && ok2 && len(lo) == len(hi) && len(lo) > 0 {
+					cm.ranges = append(cm.ranges, codespaceRange{lo: []byte(lo), hi: []byte(hi)})
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].(string)
+				dst, ok2 := operands[i+1].(string)
+				if ok1 && ok2 {
+					cm.chars[src] = utf16BEToString([]byte(dst))
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(string)
+				hi, ok2 := operands[i+1].(string)
+				if !ok1 || !ok2 || len(lo) != len(hi) || len(lo) == 0 || len(lo) > 4 {
+					continue
+				}
+				cm.addRange([]byte(lo), []byte(hi), operands[i+2])
+			}
+		}
+		operands = operands[:0]
+	}
+	return cm
+}
+
+func (cm *cmap) addRange(lo, hi []byte, dst interface{}) {
+	start, end := bytesToInt(lo), bytesToInt(hi)
+	if end < start || end-start >= maxCMapRange {
+		return
+	}
+
+	for code := start; code <= end; code++ {
+		key := string(intToBytes(code, len(lo)))
+		offset := code - start
+		switch v := dst.(type) {
+		case string:
+			// Increment the last byte of the destination for each code
+			out := []byte(v)
+			if len(out) == 0 {
+				continue
+			}
+			last := int(out[len(out)-1]) + int(offset)
+			out[len(out)-1] = byte(last)
+			if last > 0xFF && len(out) >= 2 {
+				out[len(out)-2] += byte(last >> 8)
+			}
+			cm.chars[key] = utf16BEToString(out)
+		case array:
+			if int(offset) < len(v) {
+				if s, ok := v[offset].(string); ok {
+					cm.chars[key] = utf16BEToString([]byte(s))
+				}
+			}
+		}
+	}
+}
+
+func bytesToInt(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func intToBytes(v uint32, n int) []byte {
+	out := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		out[i] = byte(v)
+		v >>= 8
+	}
+	return out
+}
+
+func utf16BEToString(b []byte) string {
+	if len(b) == 1 {
+		return string(rune(b[0]))
+	}
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// winAnsiEncoding is Windows code page 1252
+var winAnsiEncoding = func() [256]rune {
+	var t [256]rune
+	for i := 0x20; i < 0x7F; i++ {
+		t[i] = rune(i)
+	}
+	for i := 0xA0; i <= 0xFF; i++ {
+		t[i] = rune(i)
+	}
+	t['\t'], t['\n'], t['\r'] = '\t', '\n', '\r'
+	high := []rune{
+		'€', 0, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0, 'Ž', 0,
+		0, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0, 'ž', 'Ÿ',
+	}
+	for i, r := range high {
+		t[0x80+i] = r
+	}
+	return t
+}()
+
+// glyphNames covers the glyph names that commonly appear in /Differences
+// arrays; single-letter names and uniXXXX names are handled in glyphRune.
+var glyphNames = map[string]rune{
+	"space": ' ', "exclam": '!', "quotedbl": '"', "numbersign": '#', "dollar": '$',
+	"percent": '%', "ampersand": '&', "quotesingle": '\'', "parenleft": '(',
+	"parenright": ')', "asterisk": '*', "plus": '+', "comma": ',', "hyphen": '-',
+	"period": '.', "slash": '/', "zero": '0', "one": '1', "two": '2', "three": '3',
+	"four": '4', "five": '5', "six": '6', "seven": '7', "eight": '8', "nine": '9',
+	"colon": ':', "semicolon": ';', "less": '<', "equal": '=', "greater": '>',
+	"question": '?', "at": '@', "bracketleft": '[', "backslash": '\\',
+	"bracketright": ']', "asciicircum": '^', "underscore": '_', "grave": '`',
+	"braceleft": '{', "bar": '|', "braceright": '}', "asciitilde": '~',
+	"bullet": '•', "endash": '–', "emdash": '—', "quoteleft": '‘', "quoteright": '’',
+	"quotedblleft": '“', "quotedblright": '”', "quotesinglbase": '‚',
+	"quotedblbase": '„', "ellipsis": '…', "Euro": '€', "copyright": '©',
+	"registered": '®', "trademark": '™', "degree": '°', "section": '§',
+	"paragraph": '¶', "sterling": '£', "yen": '¥', "cent": '¢', "minus": '−',
+	"multiply": '×', "divide": '÷', "fi": 'ﬁ', "fl": 'ﬂ', "nbspace": ' ',
+	"eacute": 'é', "egrave": 'è', "agrave": 'à', "ccedilla": 'ç', "udieresis": 'ü',
+	"odieresis": 'ö', "adieresis": 'ä', "germandbls": 'ß',
+}
+
+func glyphRune(glyph string) (rune, bool) {
+	if len(glyph) == 1 {
+		return rune(glyph[0]), true
+	}
+	if r, ok := glyphNames[glyph]; ok {
+		return r, true
+	}
+	if strings.HasPrefix(glyph, "uni") && len(glyph) == 7 {
+		if v, err := strconv.ParseUint(glyph[3:], 16, 32); err == nil {
+			return rune(v), true
+		}
+	}
+	if strings.HasPrefix(glyph, "u") && len(glyph) >= 5 && len(glyph) <= 7 {
+		if v, err := strconv.ParseUint(glyph[1:], 16, 32); err == nil {
+			return rune(v), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,378 @@
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// PDF object model. Values parsed from a document are one of:
+// nil, bool, int, float64, name, string, array, dict, stream, ref or keyword.
+type (
+	name    string
+	keyword string
+	array   []interface{}
+	dict    map[name]interface{}
+)
+
+// ref is an indirect object reference ("12 0 R")
+type ref struct {
+	num int
+	gen int
+}
+
+// stream is a dictionary followed by raw (still encoded) stream data
+type stream struct {
+	hdr dict
+	raw []byte
+}
+
+var errUnexpectedEOF = errors.New("unexpected end of data")
+
+// lexer reads PDF objects from a byte slice. It is used both for the file
+// body and for content streams and CMaps, which share the same syntax.
+type lexer struct {
+	data []byte
+	pos  int
+	// streams enables "stream ... endstream" handling after dictionaries
+	streams bool
+}
+
+func newLexer(data []byte) *lexer {
+	return &lexer{data: data}
+}
+
+func isWhitespace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func isRegular(c byte) bool {
+	return !isWhitespace(c) && !isDelimiter(c)
+}
+
+// skipSpace skips whitespace and comments
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isWhitespace(c) {
+			l.pos++
+			continue
+		}
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		return
+	}
+}
+
+// next returns the next object. Operators and structural tokens such as
+// "]" and ">>" are returned as keywords.
+func (l *lexer) next() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, errUnexpectedEOF
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		return l.readName(), nil
+	case c == '(':
+		return l.readLiteralString()
+	case c == '<':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '<' {
+			l.pos += 2
+			return l.readDict()
+		}
+		return l.readHexString()
+	case c == '>':
+		if l.pos+1 < len(l.data) && l.data[l.pos+1] == '>' {
+			l.pos += 2
+			return keyword(">>"), nil
+		}
+		l.pos++
+		return nil, fmt.Errorf("unexpected '>' at offset %d", l.pos-1)
+	case c == '[':
+		l.pos++
+		return l.readArray()
+	case c == ']':
+		l.pos++
+		return keyword("]"), nil
+	case c == '{' || c == '}':
+		l.pos++
+		return keyword(string(c)), nil
+	case c == ')':
+		l.pos++
+		return nil, fmt.Errorf("unexpected ')' at offset %d", l.pos-1)
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return l.readNumber()
+	}
+
+	start := l.pos
+	for l.pos < len(l.data) && isRegular(l.data[l.pos]) {
+		l.pos++
+	}
+	switch word := string(l.data[start:l.pos]); word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	default:
+		return keyword(word), nil
+	}
+}
+
+func (l *lexer) readName() name {
+	l.pos++ // skip '/'
+	var buf []byte
+	for l.pos < len(l.data) && isRegular(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if v, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+				buf = append(buf, byte(v))
+				l.pos += 3
+				continue
+			}
+		}
+		buf = append(buf, c)
+		l.pos++
+	}
+	return name(buf)
+}
+
+func (l *lexer) readNumber() (interface{}, error) {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if (c >= '0' && c <= '9') || c == '.' {
+			l.pos++
+			continue
+		}
+		break
+	}
+	tok := string(l.data[start:l.pos])
+
+	if i, err := strconv.Atoi(tok); err == nil {
+		// An integer may be the start of an indirect reference
+		if l.streams {
+			if r, ok := l.tryRef(i); ok {
+				return r, nil
+			}
+		}
+		return i, nil
+	}
+
+	f, err := strconv.ParseFloat(tok, 64)
+	if err != nil {
+		// Malformed numbers such as "--5" or "5.-2" show up in real files; treat as 0
+		return 0.0, nil
+	}
+	return f, nil
+}
+
+// tryRef checks whether the integer just read is followed by "<gen> R"
+func (l *lexer) tryRef(num int) (ref, bool) {
+	save := l.pos
+	l.skipSpace()
+	genStart := l.pos
+	for l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '9' {
+		l.pos++
+	}
+	if l.pos == genStart {
+		l.pos = save
+		return ref{}, false
+	}
+	gen, _ := strconv.Atoi(string(l.data[genStart:l.pos]))
+	l.skipSpace()
+	if l.pos < len(l.data) && l.data[l.pos] == 'R' &&
+		(l.pos+1 == len(l.data) || !isRegular(l.data[l.pos+1])) {
+		l.pos++
+		return ref{num: num, gen: gen}, true
+	}
+	l.pos = save
+	return ref{}, false
+}
+
+func (l *lexer) readLiteralString() (string, error) {
+	l.pos++ // skip '('
+	var buf []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+			buf = append(buf, c)
+		case ')':
+			depth--
+			if depth == 0 {
+				return string(buf), nil
+			}
+			buf = append(buf, c)
+		case '\\':
+			if l.pos >= len(l.data) {
+				return string(buf), nil
+			}
+			e := l.data[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'b':
+				buf = append(buf, '\b')
+			case 'f':
+				buf = append(buf, '\f')
+			case '\r':
+				// Line continuation
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			case '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					buf = append(buf, byte(v))
+				} else {
+					buf = append(buf, e)
+				}
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(buf), nil
+}
+
+func (l *lexer) readHexString() (string, error) {
+	l.pos++ // skip '<'
+	end := bytes.IndexByte(l.data[l.pos:], '>')
+	if end < 0 {
+		return "", errUnexpectedEOF
+	}
+	decoded, err := decodeASCIIHex(l.data[l.pos : l.pos+end])
+	l.pos += end + 1
+	return string(decoded), err
+}
+
+func (l *lexer) readArray() (array, error) {
+	var arr array
+	for {
+		obj, err := l.next()
+		if err != nil {
+			return arr, err
+		}
+		if kw, ok := obj.(keyword); ok {
+			if kw == "]" {
+				return arr, nil
+			}
+			if kw == "R" {
+				// References are normally folded by readNumber; tolerate stray Rs
+				continue
+			}
+		}
+		arr = append(arr, obj)
+	}
+}
+
+func (l *lexer) readDict() (interface{}, error) {
+	d := dict{}
+	for {
+		obj, err := l.next()
+		if err != nil {
+			return d, err
+		}
+		if kw, ok := obj.(keyword); ok && kw == ">>" {
+			break
+		}
+		key, ok := obj.(name)
+		if !ok {
+			// Skip junk keys rather than failing the whole document
+			continue
+		}
+		val, err := l.next()
+		if err != nil {
+			return d, err
+		}
+		if kw, ok := val.(keyword); ok && kw == ">>" {
+			d[key] = nil
+			break
+		}
+		d[key] = val
+	}
+
+	if l.streams {
+		if s, ok := l.readStream(d); ok {
+			return s, nil
+		}
+	}
+	return d, nil
+}
+
+// readStream consumes "stream ... endstream" following a dictionary, if present
+func (l *lexer) readStream(d dict) (stream, bool) {
+	save := l.pos
+	l.skipSpace()
+	if !bytes.HasPrefix(l.data[l.pos:], []byte("stream")) {
+		l.pos = save
+		return stream{}, false
+	}
+	l.pos += len("stream")
+	if l.pos < len(l.data) && l.data[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+		l.pos++
+	}
+	start := l.pos
+
+	// Trust /Length when it is direct and points at "endstream"; otherwise
+	// fall back to searching for the keyword.
+	if n, ok := d["Length"].(int); ok && n >= 0 && start+n <= len(l.data) {
+		rest := l.data[start+n:]
+		trimmed := bytes.TrimLeft(rest, "\r\n \t")
+		if bytes.HasPrefix(trimmed, []byte("endstream")) {
+			l.pos = start + n + (len(rest) - len(trimmed)) + len("endstream")
+			return stream{hdr: d, raw: l.data[start : start+n]}, true
+		}
+	}
+
+	end := bytes.Index(l.data[start:], []byte("endstream"))
+	if end < 0 {
+		l.pos = len(l.data)
+		return stream{hdr: d, raw: l.data[start:]}, true
+	}
+	raw := l.data[start : start+end]
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	raw = bytes.TrimSuffix(raw, []byte("\r"))
+	l.pos = start + end + len("endstream")
+	return stream{hdr: d, raw: raw}, true
+}
@@ -0,0 +1,348 @@
+// Package pdf extracts plain text from PDF documents without external
+// dependencies. It understands the subset of the format needed for text:
+// indirect objects (including object streams), the page tree, the Flate,
+// LZW, ASCII85 and ASCIIHex filters, and fonts with ToUnicode CMaps.
+package pdf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var (
+	// ErrNotPDF is returned when the data does not start with a PDF header
+	ErrNotPDF = errors.New("not a PDF document")
+	// ErrEncrypted is returned for encrypted documents, which are not supported
+	ErrEncrypted = errors.New("encrypted PDF documents are not supported")
+	// ErrNoPages is returned when no pages could be located in the document
+	ErrNoPages = errors.New("no pages found in PDF document")
+	// ErrTooComplex is returned for a page whose content, counting the form
+	// XObjects it draws, takes more work to interpret than a page is allowed
+	ErrTooComplex = errors.New("PDF page content is too complex")
+)
+
+// Page holds the text extracted from a single page
+type Page struct {
+	// Number is the 1-based page number
+	Number int `json:"number"`
+	// Text is the page's text in content stream order
+	Text string `json:"text"`
+}
+
+// ExtractText extracts the text of each page of the PDF held in data.
+// If maxPages is greater than zero, only the first maxPages pages are read.
+func ExtractText(data []byte, maxPages int) ([]Page, error) {
+	doc, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := doc.pages()
+	if len(pages) == 0 {
+		return nil, ErrNoPages
+	}
+	if maxPages > 0 && len(pages) > maxPages {
+		pages = pages[:maxPages]
+	}
+
+	result := make([]Page, 0, len(pages))
+	for i, p := range pages {
+		text, err := doc.pageText(p)
+		if err != nil {
+			return nil, fmt.Errorf("page %d: %w", i+1, err)
+		}
+		result = append(result, Page{
+			Number: i + 1,
+			Text:   text,
+		})
+	}
+	return result, nil
+}
+
+// ExtractTextFromFile reads a PDF from disk and extracts its text
+func ExtractTextFromFile(path string, maxPages int) ([]Page, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return ExtractText(data, maxPages)
+}
+
+// document is a parsed PDF file
+type document struct {
+	// objects holds the latest definition of every indirect object
+	objects map[int]interface{}
+	// trailers holds trailer dictionaries, including those of xref streams
+	trailers []dict
+}
+
+// maxResolveDepth bounds reference chains so cyclic files cannot hang us
+const maxResolveDepth = 32
+
+// objHeader matches the start of an indirect object definition
+var objHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// parseDocument scans the file body for indirect objects. Scanning rather
+// than trusting the xref table keeps damaged or incrementally updated files
+// readable: later definitions simply replace earlier ones.
+func parseDocument(data []byte) (*document, error) {
+	header := data
+	if len(header) > 1024 {
+		header = header[:1024]
+	}
+	if !bytes.Contains(header, []byte("%PDF-")) {
+		return nil, ErrNotPDF
+	}
+
+	doc := &document{objects: make(map[int]interface{})}
+	var objStreams []stream
+
+	pos := 0
+	for pos < len(data) {
+		loc := objHeader.FindSubmatchIndex(data[pos:])
+		if loc == nil {
+			break
+		}
+		num, _ := strconv.Atoi(string(data[pos+loc[2] : pos+loc[3]]))
+
+		l := newLexer(data)
+		l.streams = true
+		l.pos = pos + loc[1]
+		obj, err := l.next()
+		if err != nil {
+			pos += loc[1]
+			continue
+		}
+		doc.objects[num] = obj
+		pos = l.pos
+
+		if s, ok := obj.(stream); ok {
+			switch t, _ := s.hdr["Type"].(name); t {
+			case "ObjStm":
+				objStreams = append(objStreams, s)
+			case "XRef":
+				doc.trailers = append(doc.trailers, s.hdr)
+			}
+		}
+	}
+
+	// Classic trailers follow the "trailer" keyword
+	for _, idx := range allIndexes(data, []byte("trailer")) {
+		l := newLexer(data)
+		l.pos = idx + len("trailer")
+		if t, err := l.next(); err == nil {
+			if d, ok := t.(dict); ok {
+				doc.trailers = append(doc.trailers, d)
+			}
+		}
+	}
+	for _, t := range doc.trailers {
+		if _, ok := t["Encrypt"]; ok {
+			return nil, ErrEncrypted
+		}
+	}
+
+	for _, s := range objStreams {
+		doc.loadObjectStream(s)
+	}
+
+	return doc, nil
+}
+
+// loadObjectStream adds the objects compressed inside an object stream.
+// Objects already defined directly in the file take precedence.
+func (d *document) loadObjectStream(s stream) {
+	data, err := d.decodeStream(s)
+	if err != nil {
+		return
+	}
+	n, _ := d.resolve(s.hdr["N"]).(int)
+	first, _ := d.resolve(s.hdr["First"]).(int)
+	if n <= 0 || first <= 0 || first > len(data) {
+		return
+	}
+
+	l := newLexer(data[:first])
+	type entry struct{ num, offset int }
+	entries := make([]entry, 0, n)
+	for i := 0; i < n; i++ {
+		num, err1 := l.next()
+		off, err2 := l.next()
+		if err1 != nil || err2 != nil {
+			break
+		}
+		ni, ok1 := num.(int)
+		oi, ok2 := off.(int)
+		if !ok1 || !ok2 {
+			break
+		}
+		entries = append(entries, entry{num: ni, offset: oi})
+	}
+
+	for _, e := range entries {
+		if _, exists := d.objects[e.num]; exists {
+			continue
+		}
+		if first+e.offset >= len(data) {
+			continue
+		}
+		ol := newLexer(data)
+		ol.streams = true
+		ol.pos = first + e.offset
+		if obj, err := ol.next(); err == nil {
+			d.objects[e.num] = obj
+		}
+	}
+}
+
+// resolve follows indirect references until a direct object is reached
+func (d *document) resolve(obj interface{}) interface{} {
+	for i := 0; i < maxResolveDepth; i++ {
+		r, ok := obj.(ref)
+		if !ok {
+			return obj
+		}
+		obj = d.objects[r.num]
+	}
+	return nil
+}
+
+// dictOf resolves obj to a dictionary, using the header of streams
+func (d *document) dictOf(obj interface{}) dict {
+	switch v := d.resolve(obj).(type) {
+	case dict:
+		return v
+	case stream:
+		return v.hdr
+	}
+	return nil
+}
+
+// page is a leaf of the page tree with its inherited resources
+type page struct {
+	dict      dict
+	resources dict
+}
+
+// pages returns the document's pages in order
+func (d *document) pages() []page {
+	var root dict
+	for _, t := range d.trailers {
+		if c := d.dictOf(t["Root"]); c != nil {
+			root = c
+		}
+	}
+	if root == nil {
+		root = d.findByType("Catalog")
+	}
+
+	var out []page
+	if root != nil {
+		visited := make(map[int]bool)
+		d.walkPages(root["Pages"], nil, visited, &out)
+	}
+	if len(out) > 0 {
+		return out
+	}
+
+	// Without a usable page tree, fall back to every page object in object order
+	var nums []int
+	for num, obj := range d.objects {
+		if pd := d.dictOf(obj); pd != nil {
+			if t, _ := pd["Type"].(name); t == "Page" {
+				nums = append(nums, num)
+			}
+		}
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		pd := d.dictOf(d.objects[num])
+		out = append(out, page{dict: pd, resources: d.dictOf(pd["Resources"])})
+	}
+	return out
+}
+
+func (d *document) walkPages(node interface{}, inherited dict, visited map[int]bool, out *[]page) {
+	if r, ok := node.(ref); ok {
+		if visited[r.num] {
+			return
+		}
+		visited[r.num] = true
+	}
+	nd := d.dictOf(node)
+	if nd == nil {
+		return
+	}
+
+	resources := inherited
+	if res := d.dictOf(nd["Resources"]); res != nil {
+		resources = res
+	}
+
+	kids, hasKids := d.resolve(nd["Kids"]).(array)
+	if t, _ := nd["Type"].(name); t == "Page" || !hasKids {
+		*out = append(*out, page{dict: nd, resources: resources})
+		return
+	}
+	for _, kid := range kids {
+		d.walkPages(kid, resources, visited, out)
+	}
+}
+
+// findByType returns the last object whose /Type matches t
+func (d *document) findByType(t name) dict {
+	var found dict
+	best := -1
+	for num, obj := range d.objects {
+		if od := d.dictOf(obj); od != nil {
+			if ot, _ := od["Type"].(name); ot == t && num > best {
+				found, best = od, num
+			}
+		}
+	}
+	return found
+}
+
+// pageText decodes and interprets a page's content streams
+func (d *document) pageText(p page) (string, error) {
+	var content []byte
+	switch c := d.resolve(p.dict["Contents"]).(type) {
+	case stream:
+		content, _ = d.decodeStream(c)
+	case array:
+		for _, item := range c {
+			if s, ok := d.resolve(item).(stream); ok {
+				if data, err := d.decodeStream(s); err == nil {
+					content = append(content, data...)
+					content = append(content, '\n')
+				}
+			}
+		}
+	}
+	if len(content) == 0 {
+		return "", nil
+	}
+
+	e := newTextExtractor(d)
+	if err := e.run(content, p.resources, 0); err != nil {
+		return "", err
+	}
+	return e.text(), nil
+}
+
+func allIndexes(data, sep []byte) []int {
+	var out []int
+	for pos := 0; ; {
+		i := bytes.Index(data[pos:], sep)
+		if i < 0 {
+			return out
+		}
+		out = append(out, pos+i)
+		pos += i + len(sep)
+	}
+}
@@ -0,0 +1,264 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// buildPDF assembles a PDF file from numbered object bodies (object 1 must
+// be the catalog) and writes a matching xref table and trailer.
+func buildPDF(objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, body := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, body)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func streamObject(hdr string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", hdr, len(data), data)
+}
+
+func flate(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// simplePDF returns a document with one page per content stream, all using Helvetica as /F1
+func simplePDF(contents ...string) []byte {
+	kids := make([]string, len(contents))
+	for i := range contents {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+i*2)
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d /Resources << /Font << /F1 3 0 R >> >> >>", strings.Join(kids, " "), len(contents)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}
+	for i, c := range contents {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /Contents %d 0 R >>", 5+i*2),
+			streamObject("/Filter /FlateDecode", flate([]byte(c))),
+		)
+	}
+	return buildPDF(objects...)
+}
+
+func TestExtractTextSimplePages(t *testing.T) {
+	data := simplePDF(
+		"BT /F1 12 Tf 72 720 Td (Invoice #12345) Tj 0 -14 Td (Total: $100.00) Tj ET",
+		"BT /F1 12 Tf 72 720 Td [(Hel) 20 (lo) -300 (World)] TJ ET",
+	)
+
+	pages, err := ExtractText(data, 0)
+	if err != nil {
+		t.Fatalf("ExtractText returned error: %v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("Expected 2 pages, got %d", len(pages))
+	}
+	if pages[0].Number != 1 || pages[1].Number != 2 {
+		t.Errorf("Unexpected page numbers: %d, %d", pages[0].Number, pages[1].Number)
+	}
+	if want := "Invoice #12345\nTotal: $100.00"; pages[0].Text != want {
+		t.Errorf("Page 1 text = %q, want %q", pages[0].Text, want)
+	}
+	if want := "Hello World"; pages[1].Text != want {
+		t.Errorf("Page 2 text = %q, want %q", pages[1].Text, want)
+	}
+}
+
+func TestExtractTextMaxPages(t *testing.T) {
+	data := simplePDF(
+		"BT /F1 12 Tf (one) Tj ET",
+		"BT /F1 12 Tf (two) Tj ET",
+		"BT /F1 12 Tf (three) Tj ET",
+	)
+
+	pages, err := ExtractText(data, 2)
+	if err != nil {
+		t.Fatalf("ExtractText returned error: %v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("Expected 2 pages with maxPages=2, got %d", len(pages))
+	}
+	if pages[1].Text != "two" {
+		t.Errorf("Page 2 text = %q, want %q", pages[1].Text, "two")
+	}
+}
+
+func TestExtractTextToUnicodeCMap(t *testing.T) {
+	cmap := `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+1 begincodespacerange
+<0000> <FFFF>
+endcodespacerange
+2 beginbfchar
+<0001> <0048>
+<0002> <0069>
+endbfchar
+1 beginbfrange
+<0010> <0012> <0041>
+endbfrange
+endcmap
+end end`
+	content := "BT /F1 10 Tf <00010002> Tj T* <001000110012> Tj ET"
+
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type0 /BaseFont /Custom /Encoding /Identity-H /ToUnicode 6 0 R >>",
+		streamObject("/Filter /FlateDecode", flate([]byte("14 TL "+content))),
+		streamObject("", []byte(cmap)),
+	)
+
+	pages, err := ExtractText(data, 0)
+	if err != nil {
+		t.Fatalf("ExtractText returned error: %v", err)
+	}
+	if want := "Hi\nABC"; pages[0].Text != want {
+		t.Errorf("Text = %q, want %q", pages[0].Text, want)
+	}
+}
+
+func TestExtractTextDifferencesEncoding(t *testing.T) {
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 4 0 R >> >> /Contents 5 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /Encoding << /Differences [1 /E /u /r /o /space /Euro] >> >>",
+		streamObject("", []byte(`BT /F1 10 Tf (\001\002\003\004\005\006) Tj ET`)),
+	)
+
+	pages, err := ExtractText(data, 0)
+	if err != nil {
+		t.Fatalf("ExtractText returned error: %v", err)
+	}
+	if want := "Euro €"; pages[0].Text != want {
+		t.Errorf("Text = %q, want %q", pages[0].Text, want)
+	}
+}
+
+func TestExtractTextObjectStream(t *testing.T) {
+	// Catalog, page tree and font live inside a compressed object stream
+	inner := []string{
+		"<< /Type /Catalog /Pages 3 0 R >>",
+		"<< /Type /Pages /Kids [4 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 3 0 R /Resources << /Font << /F1 5 0 R >> >> /Contents 6 0 R >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+	var header, body bytes.Buffer
+	for i, obj := range inner {
+		fmt.Fprintf(&header, "%d %d ", i+2, body.Len())
+		body.WriteString(obj)
+		body.WriteString("\n")
+	}
+	objStm := append(header.Bytes(), body.Bytes()...)
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	fmt.Fprintf(&buf, "1 0 obj\n%s\nendobj\n", streamObject(
+		fmt.Sprintf("/Type /ObjStm /N %d /First %d /Filter /FlateDecode", len(inner), header.Len()),
+		flate(objStm)))
+	fmt.Fprintf(&buf, "6 0 obj\n%s\nendobj\n", streamObject("", []byte("BT /F1 9 Tf (compressed objects) Tj ET")))
+	fmt.Fprintf(&buf, "7 0 obj\n%s\nendobj\n", streamObject("/Type /XRef /Size 8 /Root 2 0 R", nil))
+	buf.WriteString("%%EOF\n")
+
+	pages, err := ExtractText(buf.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("ExtractText returned error: %v", err)
+	}
+	if len(pages) != 1 || pages[0].Text != "compressed objects" {
+		t.Errorf("Unexpected pages: %+v", pages)
+	}
+}
+
+func TestExtractTextFormXObject(t *testing.T) {
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /XObject << /X1 4 0 R >> /Font << /F1 5 0 R >> >> /Contents 6 0 R >>",
+		streamObject("/Type /XObject /Subtype /Form", []byte("BT /F1 10 Tf (inside form) Tj ET")),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		streamObject("", []byte("q /X1 Do Q BI /W 1 /H 1 ID \x00\xffEI stuff EI Q")),
+	)
+
+	pages, err := ExtractText(data, 0)
+	if err != nil {
+		t.Fatalf("ExtractText returned error: %v", err)
+	}
+	if pages[0].Text != "inside form" {
+		t.Errorf("Text = %q, want %q", pages[0].Text, "inside form")
+	}
+}
+
+func TestExtractTextFormFanOut(t *testing.T) {
+	// The form draws itself ten times, which would be 10^8 forms within
+	// maxFormDepth
+	data := buildPDF(
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /XObject << /X1 4 0 R >> >> /Contents 5 0 R >>",
+		streamObject("/Type /XObject /Subtype /Form", []byte(strings.Repeat("/X1 Do ", 10))),
+		streamObject("", []byte("/X1 Do")),
+	)
+
+	if _, err := ExtractText(data, 0); !errors.Is(err, ErrTooComplex) {
+		t.Errorf("Expected ErrTooComplex, got %v", err)
+	}
+}
+
+func TestExtractTextErrors(t *testing.T) {
+	if _, err := ExtractText([]byte("hello world"), 0); !errors.Is(err, ErrNotPDF) {
+		t.Errorf("Expected ErrNotPDF, got %v", err)
+	}
+
+	encrypted := []byte("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R /Encrypt 2 0 R >>\n%%EOF")
+	if _, err := ExtractText(encrypted, 0); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Expected ErrEncrypted, got %v", err)
+	}
+
+	noPages := buildPDF("<< /Type /Catalog >>")
+	if _, err := ExtractText(noPages, 0); !errors.Is(err, ErrNoPages) {
+		t.Errorf("Expected ErrNoPages, got %v", err)
+	}
+}
+
+func TestExtractTextFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doc.pdf")
+	if err := os.WriteFile(path, simplePDF("BT /F1 12 Tf (from disk) Tj ET"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	pages, err := ExtractTextFromFile(path, 0)
+	if err != nil {
+		t.Fatalf("ExtractTextFromFile returned error: %v", err)
+	}
+	if pages[0].Text != "from disk" {
+		t.Errorf("Text = %q, want %q", pages[0].Text, "from disk")
+	}
+
+	if _, err := ExtractTextFromFile(filepath.Join(t.TempDir(), "missing.pdf"), 0); err == nil {
+		t.Error("Expected error for missing file, got nil")
+	}
+}
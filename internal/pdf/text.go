@@ -0,0 +1,255 @@
+package pdf
+
+import (
+	"bytes"
+	"math"
+	"strings"
+)
+
+const (
+	// maxFormDepth bounds nesting of form XObjects
+	maxFormDepth = 8
+	// maxPageForms and maxPageOperators bound the work of a page across all
+	// the forms it draws, so forms drawing several forms each can't make it
+	// grow exponentially within maxFormDepth
+	maxPageForms     = 1000
+	maxPageOperators = 1 << 20
+	// kerningSpace is the TJ adjustment (in thousandths of an em) beyond
+	// which a gap is treated as a word break
+	kerningSpace = 180
+	// lineTolerance is how far the baseline may move before starting a new line
+	lineTolerance = 0.5
+)
+
+// textExtractor interprets content stream operators and collects shown text
+type textExtractor struct {
+	doc *document
+	out strings.Builder
+
+	// Text state
+	font    *font
+	leading float64
+	lineY   float64
+
+	// Layout state
+	emitted      bool
+	lastY        float64
+	pendingSpace bool
+
+	// Work done on the page so far
+	forms     int
+	operators int
+}
+
+func newTextExtractor(doc *document) *textExtractor {
+	return &textExtractor{doc: doc}
+}
+
+// run interprets a content stream using the given resource dictionary. It
+// fails with ErrTooComplex once the page exceeds its limits.
+func (e *textExtractor) run(content []byte, resources dict, depth int) error {
+	fonts := make(map[name]*font)
+	fontDicts := e.doc.dictOf(resources["Font"])
+	xobjects := e.doc.dictOf(resources["XObject"])
+
+	l := newLexer(content)
+	var operands []interface{}
+	for {
+		obj, err := l.next()
+		if err != nil {
+			return nil
+		}
+		op, ok := obj.(keyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+		e.operators++
+		if e.operators > maxPageOperators {
+			return ErrTooComplex
+		}
+
+		switch op {
+		case "BT":
+			e.lineY = 0
+		case "Tf":
+			if len(operands) >= 2 {
+				if fn, ok := operands[len(operands)-2].(name); ok {
+					f, cached := fonts[fn]
+					if !cached {
+						f = e.doc.loadFont(e.doc.dictOf(fontDicts[fn]))
+						fonts[fn] = f
+					}
+					e.font = f
+				}
+			}
+		case "TL":
+			if len(operands) >= 1 {
+				e.leading = number(operands[len(operands)-1])
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				tx := number(operands[len(operands)-2])
+				ty := number(operands[len(operands)-1])
+				if op == "TD" {
+					e.leading = -ty
+				}
+				e.lineY += ty
+				if tx != 0 {
+					e.pendingSpace = true
+				}
+			}
+		case "Tm":
+			if len(operands) >= 6 {
+				e.lineY = number(operands[5])
+				e.pendingSpace = true
+			}
+		case "T*":
+			e.lineY -= e.leading
+		case "Tj":
+			if len(operands) >= 1 {
+				e.show(operands[len(operands)-1])
+			}
+		case "'":
+			e.lineY -= e.leading
+			if len(operands) >= 1 {
+				e.show(operands[len(operands)-1])
+			}
+		case "\"":
+			e.lineY -= e.leading
+			if len(operands) >= 3 {
+				e.show(operands[len(operands)-1])
+			}
+		case "TJ":
+			if len(operands) >= 1 {
+				if arr, ok := operands[len(operands)-1].(array); ok {
+					for _, item := range arr {
+						if s, ok := item.(string); ok {
+							e.show(s)
+						} else if number(item) <= -kerningSpace {
+							e.pendingSpace = true
+						}
+					}
+				}
+			}
+		case "Do":
+			if len(operands) >= 1 && depth < maxFormDepth {
+				if xn, ok := operands[len(operands)-1].(name); ok {
+					if err := e.runForm(xobjects[xn], resources, depth); err != nil {
+						return err
+					}
+				}
+			}
+		case "BI":
+			skipInlineImage(l)
+		}
+		operands = operands[:0]
+	}
+}
+
+// runForm interprets a form XObject's content stream
+func (e *textExtractor) runForm(obj interface{}, parentResources dict, depth int) error {
+	s, ok := e.doc.resolve(obj).(stream)
+	if !ok {
+		return nil
+	}
+	if subtype, _ := e.doc.resolve(s.hdr["Subtype"]).(name); subtype != "Form" {
+		return nil
+	}
+	e.forms++
+	if e.forms > maxPageForms {
+		return ErrTooComplex
+	}
+	data, err := e.doc.decodeStream(s)
+	if err != nil {
+		return nil
+	}
+	resources := parentResources
+	if res := e.doc.dictOf(s.hdr["Resources"]); res != nil {
+		resources = res
+	}
+
+	saved := e.font
+	err = e.run(data, resources, depth+1)
+	e.font = saved
+	return err
+}
+
+// show appends the text of a shown string, inserting line breaks and spaces
+// based on how the text position moved since the previous string
+func (e *textExtractor) show(obj interface{}) {
+	s, ok := obj.(string)
+	if !ok {
+		return
+	}
+	f := e.font
+	if f == nil {
+		f = e.doc.loadFont(nil)
+		e.font = f
+	}
+	text := f.decode(s)
+	if text == "" {
+		return
+	}
+
+	if e.emitted {
+		if math.Abs(e.lineY-e.lastY) > lineTolerance {
+			e.out.WriteByte('\n')
+		} else if e.pendingSpace && !e.endsWithSpace() && !strings.HasPrefix(text, " ") {
+			e.out.WriteByte(' ')
+		}
+	}
+	e.out.WriteString(text)
+	e.emitted = true
+	e.lastY = e.lineY
+	e.pendingSpace = false
+}
+
+func (e *textExtractor) endsWithSpace() bool {
+	s := e.out.String()
+	return len(s) > 0 && (s[len(s)-1] == ' ' || s[len(s)-1] == '\n')
+}
+
+// text returns the collected text with trailing whitespace trimmed from each line
+func (e *textExtractor) text() string {
+	lines := strings.Split(e.out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// skipInlineImage advances past inline image data ("BI ... ID <data> EI")
+func skipInlineImage(l *lexer) {
+	id := bytes.Index(l.data[l.pos:], []byte("ID"))
+	if id < 0 {
+		l.pos = len(l.data)
+		return
+	}
+	l.pos += id + 2
+	for l.pos < len(l.data) {
+		ei := bytes.Index(l.data[l.pos:], []byte("EI"))
+		if ei < 0 {
+			l.pos = len(l.data)
+			return
+		}
+		at := l.pos + ei
+		l.pos = at + 2
+		before := at == 0 || isWhitespace(l.data[at-1])
+		after := l.pos >= len(l.data) || !isRegular(l.data[l.pos])
+		if before && after {
+			return
+		}
+	}
+}
+
+// number converts a numeric operand to float64
+func number(obj interface{}) float64 {
+	switch v := obj.(type) {
+	case int:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,214 @@
+// Package scheduler releases scheduled jobs once they are due. Every API
+// replica runs a scheduler, but they elect a leader through Redis and only
+// the leader releases jobs, so they don't compete for the same rows.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/jobs"
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/outbox"
+	"github.com/illegalcall/task-master/pkg/database"
+)
+
+// leaderKey holds the ID of the scheduler currently leading
+const leaderKey = "jobs:scheduler:leader"
+
+// renewLeadership extends the leadership in KEYS[1] by ARGV[2] ms if it is
+// still held by ARGV[1]
+var renewLeadership = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// resignLeadership gives up the leadership in KEYS[1] if ARGV[1] holds it
+var resignLeadership = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// dueJob is a scheduled job with the payload kept for it until it is due
+type dueJob struct {
+	models.Job
+	Payload []byte `db:"payload"`
+}
+
+// Scheduler queues scheduled jobs through the outbox when their run_at
+// passes
+type Scheduler struct {
+	cfg        config.SchedulerConfig
+	topic      string
+	payloadTTL time.Duration
+	db         *database.Clients
+	id         string
+	leader     bool
+}
+
+func NewScheduler(cfg *config.Config, db *database.Clients) *Scheduler {
+	schedulerCfg := cfg.Scheduler
+	if schedulerCfg.PollInterval <= 0 {
+		schedulerCfg.PollInterval = time.Second
+	}
+	if schedulerCfg.BatchSize <= 0 {
+		schedulerCfg.BatchSize = 100
+	}
+	if schedulerCfg.LeaderTTL <= schedulerCfg.PollInterval {
+		schedulerCfg.LeaderTTL = 10 * schedulerCfg.PollInterval
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "api"
+	}
+	return &Scheduler{
+		cfg:        schedulerCfg,
+		topic:      cfg.Kafka.Topic,
+		payloadTTL: cfg.Storage.TTL,
+		db:         db,
+		id:         fmt.Sprintf("%s-%d", host, os.Getpid()),
+	}
+}
+
+// Run releases due jobs every PollInterval while this scheduler leads, until
+// ctx is done. Leadership is given up on return so another replica can take
+// over without waiting for it to expire.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+	defer s.resign()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			leading, err := s.lead(ctx)
+			if err != nil {
+				slog.Error("Failed to elect scheduler leader", "error", err)
+				continue
+			}
+			if !leading {
+				continue
+			}
+			// Keep going while there is a backlog
+			for ctx.Err() == nil {
+				released, err := s.releaseDue(ctx, time.Now())
+				if err != nil {
+					slog.Error("Failed to release scheduled jobs", "error", err)
+					break
+				}
+				if released < s.cfg.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// lead renews this scheduler's leadership, or takes it if no one holds it,
+// and reports whether this scheduler leads
+func (s *Scheduler) lead(ctx context.Context) (bool, error) {
+	if s.leader {
+		renewed, err := renewLeadership.Run(ctx, s.db.Redis, []string{leaderKey}, s.id, s.cfg.LeaderTTL.Milliseconds()).Int()
+		if err != nil {
+			s.leader = false
+			return false, err
+		}
+		if renewed == 1 {
+			return true, nil
+		}
+		slog.Warn("Lost scheduler leadership", "id", s.id)
+	}
+
+	acquired, err := s.db.Redis.SetNX(ctx, leaderKey, s.id, s.cfg.LeaderTTL).Result()
+	if err != nil {
+		s.leader = false
+		return false, err
+	}
+	if acquired {
+		slog.Info("Became scheduler leader", "id", s.id)
+	}
+	s.leader = acquired
+	return acquired, nil
+}
+
+// resign gives up the leadership if this scheduler holds it
+func (s *Scheduler) resign() {
+	if !s.leader {
+		return
+	}
+	s.leader = false
+	if err := resignLeadership.Run(context.Background(), s.db.Redis, []string{leaderKey}, s.id).Err(); err != nil {
+		slog.Error("Failed to resign scheduler leadership", "error", err)
+	}
+}
+
+// releaseDue queues up to BatchSize scheduled jobs whose run_at is at or
+// before now, and returns how many it queued. Each job's payload is moved to
+// Redis for the worker, its status becomes pending and its Kafka message is
+// added to the outbox in one transaction. The rows are locked, so even two
+// schedulers both believing they lead don't queue a job twice.
+func (s *Scheduler) releaseDue(ctx context.Context, now time.Time) (int, error) {
+	tx, err := s.db.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var due []dueJob
+	if err := tx.SelectContext(ctx, &due,
+		"SELECT id, name, type, owner_id, run_at, payload FROM jobs WHERE status = $1 AND run_at <= $2 ORDER BY run_at LIMIT $3 FOR UPDATE SKIP LOCKED",
+		models.StatusScheduled, now, s.cfg.BatchSize,
+	); err != nil {
+		return 0, fmt.Errorf("failed to load due jobs: %w", err)
+	}
+
+	for _, job := range due {
+		payload := job.Payload
+		if len(payload) == 0 {
+			payload = []byte("{}")
+		}
+		if err := s.db.Redis.Set(ctx, fmt.Sprintf("job:%d:payload", job.ID), payload, s.payloadTTL).Err(); err != nil {
+			return 0, fmt.Errorf("failed to store payload of job %d: %w", job.ID, err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE jobs SET status = $1 WHERE id = $2", models.StatusPending, job.ID,
+		); err != nil {
+			return 0, fmt.Errorf("failed to release job %d: %w", job.ID, err)
+		}
+		job.Status = models.StatusPending
+		value, err := json.Marshal(jobs.NewMessage(job.Job))
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode job %d: %w", job.ID, err)
+		}
+		if err := outbox.Enqueue(ctx, tx, outbox.Message{Topic: s.topic, Value: value}); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, job := range due {
+		if err := s.db.Redis.Set(ctx, fmt.Sprintf("job:%d", job.ID), models.StatusPending, 0).Err(); err != nil {
+			slog.Error("Failed to update Redis status", "jobID", job.ID, "error", err)
+		}
+	}
+	if len(due) > 0 {
+		slog.Info("Released scheduled jobs", "count", len(due))
+	}
+	return len(due), nil
+}
@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/pkg/database"
+)
+
+func setupTestScheduler(t *testing.T) (*Scheduler, sqlmock.Sqlmock, *miniredis.Miniredis) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	miniRedis := miniredis.RunT(t)
+
+	db := &database.Clients{
+		DB:    sqlx.NewDb(sqlDB, "sqlmock"),
+		Redis: redis.NewClient(&redis.Options{Addr: miniRedis.Addr()}),
+	}
+	cfg := &config.Config{
+		Kafka:     config.KafkaConfig{Topic: "test-topic"},
+		Scheduler: config.SchedulerConfig{PollInterval: time.Second, BatchSize: 10, LeaderTTL: 10 * time.Second},
+		Storage:   config.StorageConfig{TTL: time.Hour},
+	}
+	return NewScheduler(cfg, db), mock, miniRedis
+}
+
+func TestReleaseDue(t *testing.T) {
+	scheduler, mock, miniRedis := setupTestScheduler(t)
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, type, owner_id, run_at, payload FROM jobs WHERE status = $1 AND run_at <= $2 ORDER BY run_at LIMIT $3 FOR UPDATE SKIP LOCKED")).
+		WithArgs(models.StatusScheduled, now, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "type", "owner_id", "run_at", "payload"}).
+			AddRow(1, "Nightly Job", models.JobTypeSleep, 7, now.Add(-time.Minute), []byte(`{"duration_ms": 10}`)).
+			AddRow(2, "Legacy Job", models.JobTypeSleep, 7, now, nil))
+	for id := 1; id <= 2; id++ {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE jobs SET status = $1 WHERE id = $2")).
+			WithArgs(models.StatusPending, id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO outbox (topic, key, value, headers) VALUES ($1, $2, $3, $4)")).
+			WithArgs("test-topic", nil, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	released, err := scheduler.releaseDue(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, released)
+
+	// The worker finds the payload and the jobs show as pending
+	payload, err := miniRedis.Get("job:1:payload")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"duration_ms": 10}`, payload)
+	assert.Equal(t, time.Hour, miniRedis.TTL("job:1:payload"))
+	payload, _ = miniRedis.Get("job:2:payload")
+	assert.Equal(t, "{}", payload)
+	for _, key := range []string{"job:1", "job:2"} {
+		status, _ := miniRedis.Get(key)
+		assert.Equal(t, models.StatusPending, status)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLeaderElection(t *testing.T) {
+	first, _, miniRedis := setupTestScheduler(t)
+	second := NewScheduler(&config.Config{Scheduler: first.cfg}, first.db)
+	second.id = "other-replica"
+	ctx := context.Background()
+
+	leading, err := first.lead(ctx)
+	require.NoError(t, err)
+	assert.True(t, leading)
+	leading, err = second.lead(ctx)
+	require.NoError(t, err)
+	assert.False(t, leading, "only one scheduler leads")
+
+	// The leader keeps its leadership by renewing it
+	miniRedis.FastForward(8 * time.Second)
+	leading, err = first.lead(ctx)
+	require.NoError(t, err)
+	assert.True(t, leading)
+	assert.Equal(t, 10*time.Second, miniRedis.TTL(leaderKey))
+
+	// A leader that stops renewing, say because it crashed, is replaced
+	miniRedis.FastForward(11 * time.Second)
+	leading, err = second.lead(ctx)
+	require.NoError(t, err)
+	assert.True(t, leading)
+	leading, err = first.lead(ctx)
+	require.NoError(t, err)
+	assert.False(t, leading)
+
+	// Resigning hands over leadership right away
+	second.resign()
+	leading, err = first.lead(ctx)
+	require.NoError(t, err)
+	assert.True(t, leading)
+}
@@ -1,94 +1,236 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/illegalcall/task-master/internal/fetch"
 )
 
-// Storage defines the interface for file storage operations
+// Storage defines the interface for file storage operations. Files are
+// stored once per content; every Store call returns a new reference to the
+// file, which is removed once all its references are released.
 type Storage interface {
 	// StoreFromURL downloads and stores a file from a URL
-	StoreFromURL(ctx context.Context, url string) (string, error)
-	
+	StoreFromURL(ctx context.Context, url string) (Blob, error)
+
 	// StoreFromBytes stores a file from bytes
-	StoreFromBytes(ctx context.Context, data []byte) (string, error)
-	
-	// Delete removes a file from storage
-	Delete(ctx context.Context, path string) error
+	StoreFromBytes(ctx context.Context, data []byte) (Blob, error)
+
+	// StoreFromReader stores a file read from r as it is read, without
+	// holding it in memory
+	StoreFromReader(ctx context.Context, r io.Reader) (Blob, error)
+
+	// Release releases a reference returned by a Store call, removing the
+	// file once no references to it remain
+	Release(ctx context.Context, path string) error
+
+	// Exists reports whether a stored file is still available
+	Exists(ctx context.Context, path string) (bool, error)
+}
+
+// Blob is a reference to a stored file
+type Blob struct {
+	Digest string // hex-encoded SHA-256 of the content
+	Path   string // where the file can be read until the reference is released
 }
 
-// LocalStorage implements Storage interface using local filesystem
+// ErrFileTooLarge is returned for files larger than the storage's maximum
+// size. Nothing is stored for them.
+var ErrFileTooLarge = errors.New("file exceeds the maximum allowed size")
+
+// LocalStorage implements Storage interface using local filesystem. The
+// content of each file is kept once, in blobs/<digest>.pdf, and every
+// reference is a hard link to it in refs/<digest>-<id>.pdf. A file's
+// references are counted by its links, so the count is shared by every
+// process using the directory and survives restarts, and the content stays
+// readable through a reference even if its blob is removed concurrently.
 type LocalStorage struct {
 	tempDir string
+	maxSize int64
+	fetcher *fetch.Fetcher
 }
 
-// NewLocalStorage creates a new LocalStorage instance
-func NewLocalStorage(tempDir string) (*LocalStorage, error) {
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+// NewLocalStorage creates a new LocalStorage instance storing files of up to
+// maxSize bytes; a maxSize of 0 or less means no limit. Files are downloaded
+// by fetcher.
+func NewLocalStorage(tempDir string, maxSize int64, fetcher *fetch.Fetcher) (*LocalStorage, error) {
+	s := &LocalStorage{tempDir: tempDir, maxSize: maxSize, fetcher: fetcher}
+	for _, dir := range []string{s.blobDir(), s.refDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		}
 	}
-	return &LocalStorage{tempDir: tempDir}, nil
+	return s, nil
+}
+
+func (s *LocalStorage) blobDir() string { return filepath.Join(s.tempDir, "blobs") }
+func (s *LocalStorage) refDir() string  { return filepath.Join(s.tempDir, "refs") }
+
+func (s *LocalStorage) blobPath(digest string) string {
+	return filepath.Join(s.blobDir(), digest+".pdf")
 }
 
-func (s *LocalStorage) StoreFromURL(ctx context.Context, url string) (string, error) {
-	// Create HTTP request with context
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+// StoreFromURL downloads a PDF within the fetcher's limits. Downloads over
+// the maximum size fail with ErrFileTooLarge.
+func (s *LocalStorage) StoreFromURL(ctx context.Context, url string) (Blob, error) {
+	body, err := s.fetcher.Open(ctx, url)
+	if errors.Is(err, fetch.ErrTooLarge) {
+		return Blob{}, ErrFileTooLarge
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return Blob{}, fmt.Errorf("failed to download file: %w", err)
 	}
+	defer body.Close()
 
-	// Execute request
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to download file: %w", err)
+	blob, err := s.StoreFromReader(ctx, body)
+	if errors.Is(err, fetch.ErrTooLarge) {
+		return Blob{}, ErrFileTooLarge
 	}
-	defer resp.Body.Close()
+	return blob, err
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download file: status %d", resp.StatusCode)
+// StoreFromBytes references the stored file with the same content if there
+// is one, and only writes data otherwise
+func (s *LocalStorage) StoreFromBytes(ctx context.Context, data []byte) (Blob, error) {
+	if s.maxSize > 0 && int64(len(data)) > s.maxSize {
+		return Blob{}, ErrFileTooLarge
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	path, err := s.reference(digest, "")
+	if err == nil {
+		return Blob{Digest: digest, Path: path}, nil
 	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return Blob{}, err
+	}
+	return s.StoreFromReader(ctx, bytes.NewReader(data))
+}
 
+// StoreFromReader copies r to a new file while hashing it, then references
+// the stored file with the same content if there is one, or stores the new
+// file under its digest. Once more than maxSize bytes have been read it
+// stops reading, removes the file and returns ErrFileTooLarge.
+func (s *LocalStorage) StoreFromReader(ctx context.Context, r io.Reader) (Blob, error) {
 	// Create temporary file
-	tempFile, err := os.CreateTemp(s.tempDir, "pdf-*.pdf")
+	tempFile, err := os.CreateTemp(s.tempDir, "incoming-*.pdf")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return Blob{}, fmt.Errorf("failed to create temp file: %w", err)
 	}
+	defer os.Remove(tempFile.Name()) // Stored files are linked elsewhere
 	defer tempFile.Close()
 
-	// Copy data to file
-	if _, err := io.Copy(tempFile, resp.Body); err != nil {
-		os.Remove(tempFile.Name()) // Clean up on error
-		return "", fmt.Errorf("failed to write file: %w", err)
+	// Read one byte past the limit to tell a file of exactly maxSize bytes
+	// from a larger one
+	if s.maxSize > 0 {
+		r = io.LimitReader(r, s.maxSize+1)
+	}
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tempFile, hash), r)
+	if err != nil {
+		return Blob{}, fmt.Errorf("failed to write file: %w", err)
+	}
+	if s.maxSize > 0 && written > s.maxSize {
+		return Blob{}, ErrFileTooLarge
+	}
+	if err := tempFile.Close(); err != nil {
+		return Blob{}, fmt.Errorf("failed to write file: %w", err)
 	}
 
-	return tempFile.Name(), nil
+	digest := hex.EncodeToString(hash.Sum(nil))
+	path, err := s.reference(digest, tempFile.Name())
+	if err != nil {
+		return Blob{}, err
+	}
+	return Blob{Digest: digest, Path: path}, nil
 }
 
-func (s *LocalStorage) StoreFromBytes(ctx context.Context, data []byte) (string, error) {
-	// Create temporary file
-	tempFile, err := os.CreateTemp(s.tempDir, "pdf-*.pdf")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+// reference adds a reference to the blob with digest. If there is no such
+// blob, the file at newPath becomes it, or fs.ErrNotExist is returned if
+// newPath is empty.
+func (s *LocalStorage) reference(digest, newPath string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to name reference: %w", err)
 	}
-	defer tempFile.Close()
+	ref := filepath.Join(s.refDir(), digest+"-"+hex.EncodeToString(id)+".pdf")
 
-	// Write data to file
-	if _, err := tempFile.Write(data); err != nil {
-		os.Remove(tempFile.Name()) // Clean up on error
-		return "", fmt.Errorf("failed to write file: %w", err)
+	err := os.Link(s.blobPath(digest), ref)
+	if err == nil {
+		return ref, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) || newPath == "" {
+		return "", fmt.Errorf("failed to reference file: %w", err)
 	}
 
-	return tempFile.Name(), nil
+	// Reference the new file before storing it as the blob, so a concurrent
+	// Release never finds the blob without references. If another request
+	// stored the same content in the meantime, its blob is kept.
+	if err := os.Link(newPath, ref); err != nil {
+		return "", fmt.Errorf("failed to reference file: %w", err)
+	}
+	if err := os.Link(newPath, s.blobPath(digest)); err != nil && !errors.Is(err, fs.ErrExist) {
+		os.Remove(ref)
+		return "", fmt.Errorf("failed to store file: %w", err)
+	}
+	return ref, nil
 }
 
-func (s *LocalStorage) Delete(ctx context.Context, path string) error {
+// Release removes the reference at path, and the blob it refers to if that
+// was its last reference. Files stored before content addressing are
+// removed outright.
+func (s *LocalStorage) Release(ctx context.Context, path string) error {
 	// Verify the path is within our temp directory
 	if !filepath.HasPrefix(path, s.tempDir) {
 		return fmt.Errorf("invalid file path: must be within temp directory")
 	}
-	return os.Remove(path)
-} 
\ No newline at end of file
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if filepath.Dir(path) != s.refDir() {
+		return nil
+	}
+
+	digest, _, ok := strings.Cut(filepath.Base(path), "-")
+	if !ok {
+		return nil
+	}
+	remaining, err := filepath.Glob(filepath.Join(s.refDir(), digest+"-*.pdf"))
+	if err != nil {
+		return fmt.Errorf("failed to count references: %w", err)
+	}
+	if len(remaining) > 0 {
+		return nil
+	}
+	// A reference added concurrently keeps the content through its own
+	// link; at worst the next file with this content is stored again
+	if err := os.Remove(s.blobPath(digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Exists(ctx context.Context, path string) (bool, error) {
+	if !filepath.HasPrefix(path, s.tempDir) {
+		return false, fmt.Errorf("invalid file path: must be within temp directory")
+	}
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return true, nil
+}
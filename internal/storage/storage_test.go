@@ -1,15 +1,23 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/fetch"
 )
 
 func TestLocalStorage(t *testing.T) {
@@ -18,8 +26,9 @@ func TestLocalStorage(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(tempDir)
 
-	// Create storage instance
-	storage, err := NewLocalStorage(tempDir)
+	// Create storage instance; the test servers listen on loopback
+	fetcher := fetch.New(config.FetchConfig{AllowPrivateNetworks: true}, 1024)
+	storage, err := NewLocalStorage(tempDir, 1024, fetcher)
 	require.NoError(t, err)
 
 	t.Run("StoreFromURL", func(t *testing.T) {
@@ -31,17 +40,26 @@ func TestLocalStorage(t *testing.T) {
 
 		// Test storing from URL
 		ctx := context.Background()
-		path, err := storage.StoreFromURL(ctx, ts.URL)
+		blob, err := storage.StoreFromURL(ctx, ts.URL)
 		require.NoError(t, err)
-		assert.True(t, filepath.HasPrefix(path, tempDir))
+		assert.True(t, filepath.HasPrefix(blob.Path, tempDir))
 		
 		// Verify file content
-		content, err := os.ReadFile(path)
+		content, err := os.ReadFile(blob.Path)
 		require.NoError(t, err)
 		assert.Contains(t, string(content), "%PDF-1.4")
 		
 		// Clean up
-		require.NoError(t, storage.Delete(ctx, path))
+		require.NoError(t, storage.Release(ctx, blob.Path))
+
+		// Downloads over the maximum size are not stored
+		large := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("%PDF-1.4\n" + strings.Repeat("x", 2048)))
+		}))
+		defer large.Close()
+		_, err = storage.StoreFromURL(ctx, large.URL)
+		assert.ErrorIs(t, err, ErrFileTooLarge)
+		assert.Empty(t, storedFiles(t, tempDir))
 	})
 
 	t.Run("StoreFromBytes", func(t *testing.T) {
@@ -49,54 +67,144 @@ func TestLocalStorage(t *testing.T) {
 		testData := []byte("%PDF-1.4\nTest PDF content")
 
 		// Test storing bytes
-		path, err := storage.StoreFromBytes(ctx, testData)
+		blob, err := storage.StoreFromBytes(ctx, testData)
 		require.NoError(t, err)
-		assert.True(t, filepath.HasPrefix(path, tempDir))
+		assert.True(t, filepath.HasPrefix(blob.Path, tempDir))
+		sum := sha256.Sum256(testData)
+		assert.Equal(t, hex.EncodeToString(sum[:]), blob.Digest)
 
 		// Verify file content
-		content, err := os.ReadFile(path)
+		content, err := os.ReadFile(blob.Path)
 		require.NoError(t, err)
 		assert.Equal(t, testData, content)
 
 		// Clean up
-		require.NoError(t, storage.Delete(ctx, path))
+		require.NoError(t, storage.Release(ctx, blob.Path))
+	})
+
+	t.Run("StoreFromReader", func(t *testing.T) {
+		ctx := context.Background()
+		testData := "%PDF-1.4\n" + strings.Repeat("x", 1015)
+
+		// A file of exactly the maximum size is stored
+		blob, err := storage.StoreFromReader(ctx, strings.NewReader(testData))
+		require.NoError(t, err)
+		content, err := os.ReadFile(blob.Path)
+		require.NoError(t, err)
+		assert.Equal(t, testData, string(content))
+		require.NoError(t, storage.Release(ctx, blob.Path))
+
+		// A larger one is not, and nothing is left behind
+		_, err = storage.StoreFromReader(ctx, strings.NewReader(testData+"x"))
+		assert.ErrorIs(t, err, ErrFileTooLarge)
+		_, err = storage.StoreFromBytes(ctx, []byte(testData+"x"))
+		assert.ErrorIs(t, err, ErrFileTooLarge)
+		assert.Empty(t, storedFiles(t, tempDir))
 	})
 
-	t.Run("Delete", func(t *testing.T) {
+	t.Run("Deduplication", func(t *testing.T) {
+		ctx := context.Background()
+		testData := []byte("%PDF-1.4\nInvoice #42")
+
+		// The same content is stored once, however it arrives
+		first, err := storage.StoreFromBytes(ctx, testData)
+		require.NoError(t, err)
+		second, err := storage.StoreFromReader(ctx, bytes.NewReader(testData))
+		require.NoError(t, err)
+		third, err := storage.StoreFromBytes(ctx, testData)
+		require.NoError(t, err)
+		assert.Equal(t, first.Digest, second.Digest)
+		assert.Equal(t, first.Digest, third.Digest)
+		assert.NotEqual(t, first.Path, second.Path, "every reference has its own path")
+		for _, blob := range []Blob{first, second, third} {
+			assert.True(t, os.SameFile(stat(t, first.Path), stat(t, blob.Path)))
+		}
+		assert.Len(t, storedFiles(t, filepath.Join(tempDir, "blobs")), 1)
+
+		// The file stays until its last reference is released
+		require.NoError(t, storage.Release(ctx, first.Path))
+		require.NoError(t, storage.Release(ctx, third.Path))
+		content, err := os.ReadFile(second.Path)
+		require.NoError(t, err)
+		assert.Equal(t, testData, content)
+		assert.Len(t, storedFiles(t, filepath.Join(tempDir, "blobs")), 1)
+
+		require.NoError(t, storage.Release(ctx, second.Path))
+		assert.Empty(t, storedFiles(t, tempDir))
+
+		// Releasing a reference twice fails
+		assert.Error(t, storage.Release(ctx, second.Path))
+	})
+
+	t.Run("Release", func(t *testing.T) {
 		ctx := context.Background()
 		
 		// Create test file
-		path, err := storage.StoreFromBytes(ctx, []byte("test"))
+		blob, err := storage.StoreFromBytes(ctx, []byte("test"))
 		require.NoError(t, err)
+		path := blob.Path
+
+		exists, err := storage.Exists(ctx, path)
+		require.NoError(t, err)
+		assert.True(t, exists)
 
 		// Test deletion
-		require.NoError(t, storage.Delete(ctx, path))
+		require.NoError(t, storage.Release(ctx, path))
 		_, err = os.Stat(path)
 		assert.True(t, os.IsNotExist(err))
 
+		exists, err = storage.Exists(ctx, path)
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		// Files stored before content addressing are removed
+		legacy := filepath.Join(tempDir, "pdf-legacy.pdf")
+		require.NoError(t, os.WriteFile(legacy, []byte("test"), 0644))
+		require.NoError(t, storage.Release(ctx, legacy))
+		assert.NoFileExists(t, legacy)
+
 		// Test deleting non-existent file
-		err = storage.Delete(ctx, "nonexistent")
+		err = storage.Release(ctx, "nonexistent")
 		assert.Error(t, err)
 
 		// Test deleting file outside temp directory
-		err = storage.Delete(ctx, "/tmp/outside")
+		err = storage.Release(ctx, "/tmp/outside")
 		assert.Error(t, err)
 	})
 }
 
+// storedFiles lists the files under dir
+func storedFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func stat(t *testing.T, path string) os.FileInfo {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info
+}
+
 func TestNewLocalStorage(t *testing.T) {
 	t.Run("Valid directory", func(t *testing.T) {
 		tempDir, err := os.MkdirTemp("", "storage-test-*")
 		require.NoError(t, err)
 		defer os.RemoveAll(tempDir)
 
-		storage, err := NewLocalStorage(tempDir)
+		storage, err := NewLocalStorage(tempDir, 0, nil)
 		assert.NoError(t, err)
 		assert.NotNil(t, storage)
 	})
 
 	t.Run("Invalid directory", func(t *testing.T) {
-		_, err := NewLocalStorage("/nonexistent/directory")
+		_, err := NewLocalStorage("/nonexistent/directory", 0, nil)
 		if err == nil {
 			// Some systems might allow creating directories in /nonexistent
 			// In this case, clean up
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+const (
+	// sweepInterval is how often the sweeper looks for documents to release
+	sweepInterval = 10 * time.Minute
+	// sweepBatchSize is how many documents the sweeper releases per
+	// transaction
+	sweepBatchSize = 100
+)
+
+// heldDocument is a job's reference to its stored document
+type heldDocument struct {
+	JobID    int    `db:"id"`
+	Document string `db:"document"`
+}
+
+// Sweeper releases the documents of finished jobs. A job's reference to its
+// document is recorded in jobs.document when the job is created, and is
+// released once the job has finished and retention has passed, so retries
+// within that time still find the document and references outlive
+// restarts. Several sweepers can run against the same database; each job is
+// claimed by one of them at a time.
+type Sweeper struct {
+	storage   Storage
+	db        *sqlx.DB
+	retention time.Duration
+}
+
+func NewSweeper(storage Storage, db *sqlx.DB, retention time.Duration) *Sweeper {
+	return &Sweeper{storage: storage, db: db, retention: retention}
+}
+
+// Run releases expired documents every sweepInterval until ctx is done
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep going while there is a backlog
+			for ctx.Err() == nil {
+				released, err := s.sweep(ctx, time.Now())
+				if err != nil {
+					slog.Error("Failed to release expired documents", "error", err)
+					break
+				}
+				if released < sweepBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// sweep releases the documents of up to sweepBatchSize jobs that finished
+// more than retention before now, returning how many were released. A
+// document that is already gone, say because a sweeper died before
+// committing, counts as released.
+func (s *Sweeper) sweep(ctx context.Context, now time.Time) (int, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var held []heldDocument
+	if err := tx.SelectContext(ctx, &held,
+		"SELECT id, document FROM jobs WHERE document IS NOT NULL AND status IN ($1, $2, $3) AND finished_at < $4 ORDER BY finished_at LIMIT $5 FOR UPDATE SKIP LOCKED",
+		models.StatusCompleted, models.StatusFailed, models.StatusCancelled, now.Add(-s.retention), sweepBatchSize,
+	); err != nil {
+		return 0, fmt.Errorf("failed to load expired documents: %w", err)
+	}
+
+	released := 0
+	for _, doc := range held {
+		if err := s.storage.Release(ctx, doc.Document); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to release document", "jobID", doc.JobID, "document", doc.Document, "error", err)
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE jobs SET document = NULL WHERE id = $1", doc.JobID); err != nil {
+			return 0, fmt.Errorf("failed to mark document of job %d as released: %w", doc.JobID, err)
+		}
+		released++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return released, nil
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+var (
+	selectExpired = regexp.QuoteMeta("SELECT id, document FROM jobs WHERE document IS NOT NULL AND status IN ($1, $2, $3) AND finished_at < $4 ORDER BY finished_at LIMIT $5 FOR UPDATE SKIP LOCKED")
+	markReleased  = regexp.QuoteMeta("UPDATE jobs SET document = NULL WHERE id = $1")
+)
+
+func TestSweep(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), 0, nil)
+	require.NoError(t, err)
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	sweeper := NewSweeper(local, sqlx.NewDb(db, "sqlmock"), time.Hour)
+	ctx := context.Background()
+
+	// Two jobs share a document, and a third one's is already gone
+	first, err := local.StoreFromBytes(ctx, []byte("%PDF-1.4\ninvoice"))
+	require.NoError(t, err)
+	second, err := local.StoreFromBytes(ctx, []byte("%PDF-1.4\ninvoice"))
+	require.NoError(t, err)
+	gone, err := local.StoreFromBytes(ctx, []byte("%PDF-1.4\nreceipt"))
+	require.NoError(t, err)
+	require.NoError(t, local.Release(ctx, gone.Path))
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectExpired).
+		WithArgs(models.StatusCompleted, models.StatusFailed, models.StatusCancelled, now.Add(-time.Hour), sweepBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "document"}).AddRow(1, first.Path).AddRow(3, gone.Path))
+	mock.ExpectExec(markReleased).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(markReleased).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	released, err := sweeper.sweep(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, released)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// The document is kept for the job still holding it
+	_, err = os.Stat(first.Path)
+	assert.True(t, os.IsNotExist(err))
+	content, err := os.ReadFile(second.Path)
+	require.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4\ninvoice", string(content))
+	_, err = os.Stat(local.blobPath(second.Digest))
+	assert.NoError(t, err)
+}
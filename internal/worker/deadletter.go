@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/pkg/kafka"
+)
+
+// jobError is returned by processJob when a message can't be processed and
+// should be dead-lettered
+type jobError struct {
+	JobID    int // 0 when the message couldn't be decoded
+	Attempts int
+	Err      error
+}
+
+func (e *jobError) Error() string { return e.Err.Error() }
+
+func (e *jobError) Unwrap() error { return e.Err }
+
+// deadLetter publishes a failed message to Kafka.DeadLetterTopic with its
+// original headers plus the failure details, and records it so the API can
+// list and replay it
+func (w *Worker) deadLetter(msg *sarama.ConsumerMessage, failure *jobError) error {
+	if w.cfg.Kafka.DeadLetterTopic == "" || w.producer == nil {
+		slog.Warn("Dead-lettering disabled, dropping failed message", "jobID", failure.JobID, "error", failure.Err)
+		return nil
+	}
+
+	headers := make(models.Headers, len(msg.Headers)+6)
+	for _, h := range msg.Headers {
+		// Replays start counting attempts afresh
+		if h != nil && string(h.Key) != models.HeaderAttempts {
+			headers[string(h.Key)] = string(h.Value)
+		}
+	}
+	headers[models.HeaderDeadLetterError] = failure.Err.Error()
+	headers[models.HeaderDeadLetterAttempts] = strconv.Itoa(failure.Attempts)
+	headers[models.HeaderDeadLetterTopic] = msg.Topic
+	headers[models.HeaderDeadLetterPartition] = strconv.FormatInt(int64(msg.Partition), 10)
+	headers[models.HeaderDeadLetterOffset] = strconv.FormatInt(msg.Offset, 10)
+	headers[models.HeaderDeadLetterFailedAt] = time.Now().UTC().Format(time.RFC3339)
+
+	dlqMsg := &sarama.ProducerMessage{
+		Topic:   w.cfg.Kafka.DeadLetterTopic,
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: kafka.RecordHeaders(headers),
+	}
+	if msg.Key != nil {
+		dlqMsg.Key = sarama.ByteEncoder(msg.Key)
+	}
+	if _, _, err := w.producer.SendMessage(dlqMsg); err != nil {
+		return fmt.Errorf("failed to publish to dead-letter topic: %w", err)
+	}
+
+	var jobID *int
+	if failure.JobID > 0 {
+		jobID = &failure.JobID
+	}
+	if _, err := w.db.DB.Exec(
+		"INSERT INTO dead_letters (job_id, topic, kafka_partition, kafka_offset, key, value, headers, error, attempts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		jobID, msg.Topic, msg.Partition, msg.Offset, msg.Key, msg.Value, headers, failure.Err.Error(), failure.Attempts,
+	); err != nil {
+		// The message is safe in the dead-letter topic even if it can't be indexed
+		return fmt.Errorf("failed to record dead letter: %w", err)
+	}
+
+	slog.Warn("Job dead-lettered", "jobID", failure.JobID, "attempts", failure.Attempts, "topic", w.cfg.Kafka.DeadLetterTopic)
+	return nil
+}
+
+// asJobError reports whether err should dead-letter its message
+func asJobError(err error) (*jobError, bool) {
+	var failure *jobError
+	ok := errors.As(err, &failure)
+	return failure, ok
+}
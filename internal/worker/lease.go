@@ -0,0 +1,186 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/illegalcall/task-master/internal/jobs"
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/internal/outbox"
+)
+
+// errLeaseLost aborts a job whose lease could not be renewed, because it was
+// cancelled or reclaimed by another worker
+var errLeaseLost = errors.New("job lease lost")
+
+// reclaimBatchSize bounds how many expired leases one reaper pass reclaims
+const reclaimBatchSize = 100
+
+// defaultWorkerID names the worker's leases when WORKER_ID isn't set
+func defaultWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// claimJob leases a job to this worker and marks it as processing,
+// returning how many attempts the job has already had. It reports false if
+// the job isn't pending, such as a duplicate delivery of a job another
+// worker holds a live lease on, or one that was cancelled or already
+// finished. An expired lease is taken over.
+func (w *Worker) claimJob(ctx context.Context, jobID int) (int, bool, error) {
+	now := time.Now()
+	var attempts int
+	err := w.db.DB.QueryRowContext(ctx,
+		"UPDATE jobs SET status = $1, started_at = $2, lease_owner = $3, lease_expires_at = $4 WHERE id = $5 AND (status = $6 OR (status = $1 AND lease_expires_at < $2)) RETURNING attempts",
+		models.StatusProcessing, now, w.id, now.Add(w.leaseDuration), jobID, models.StatusPending,
+	).Scan(&attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return attempts, true, nil
+}
+
+// holdLease renews the lease on a running job until ctx is done. If the
+// lease can't be renewed because the job is no longer processing under
+// this worker, the job is cancelled with errLeaseLost.
+func (w *Worker) holdLease(ctx context.Context, jobID int, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(w.leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := w.db.DB.ExecContext(ctx,
+				"UPDATE jobs SET lease_expires_at = $1 WHERE id = $2 AND status = $3 AND lease_owner = $4",
+				time.Now().Add(w.leaseDuration), jobID, models.StatusProcessing, w.id,
+			)
+			if err != nil {
+				// The lease is still good until it expires; try again on the next tick
+				slog.Warn("Failed to renew job lease", "jobID", jobID, "error", err)
+				continue
+			}
+			if n, _ := result.RowsAffected(); n == 0 {
+				cancel(errLeaseLost)
+				return
+			}
+		}
+	}
+}
+
+// runLeaseReaper reclaims jobs with expired leases every lease duration
+// until ctx is done
+func (w *Worker) runLeaseReaper(ctx context.Context) {
+	ticker := time.NewTicker(w.leaseDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.reclaimExpiredLeases(ctx, time.Now()); err != nil {
+				slog.Error("Failed to reclaim expired job leases", "error", err)
+			}
+		}
+	}
+}
+
+// reclaimExpiredLeases takes back the jobs whose worker stopped renewing
+// their lease, most likely because it crashed, and returns how many there
+// were. The lost run counts as an attempt: jobs with attempts left are put
+// back to pending and queued again through the outbox, and the others fail.
+func (w *Worker) reclaimExpiredLeases(ctx context.Context, now time.Time) (int, error) {
+	tx, err := w.db.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var expired []models.Job
+	if err := tx.SelectContext(ctx, &expired,
+		"SELECT id, name, type, owner_id, attempts FROM jobs WHERE status = $1 AND lease_expires_at < $2 ORDER BY lease_expires_at LIMIT $3 FOR UPDATE SKIP LOCKED",
+		models.StatusProcessing, now, reclaimBatchSize,
+	); err != nil {
+		return 0, fmt.Errorf("failed to load expired leases: %w", err)
+	}
+
+	statuses := make(map[int]string, len(expired))
+	for _, job := range expired {
+		status, err := w.requeueOrFail(ctx, tx, job, now, "job lease expired: worker stopped responding")
+		if err != nil {
+			return 0, err
+		}
+		statuses[job.ID] = status
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for jobID, status := range statuses {
+		slog.Warn("Reclaimed job with expired lease", "jobID", jobID, "status", status)
+		if err := w.db.Redis.Set(ctx, fmt.Sprintf("job:%d", jobID), status, 0).Err(); err != nil {
+			slog.Error("Failed to update Redis status", "jobID", jobID, "error", err)
+		}
+	}
+	return len(expired), nil
+}
+
+// requeueOrFail counts an attempt lost to a dead or missing worker against
+// job as part of tx. A job with attempts left is put back to pending and
+// queued again; otherwise it fails with reason. It returns the new status.
+func (w *Worker) requeueOrFail(ctx context.Context, tx *sqlx.Tx, job models.Job, now time.Time, reason string) (string, error) {
+	attempts := job.Attempts + 1
+	if attempts >= w.cfg.Kafka.RetryMax {
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE jobs SET status = $1, error = $2, finished_at = $3, attempts = $4 WHERE id = $5",
+			models.StatusFailed, reason, now, attempts, job.ID,
+		); err != nil {
+			return "", fmt.Errorf("failed to fail job %d: %w", job.ID, err)
+		}
+		return models.StatusFailed, nil
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE jobs SET status = $1, started_at = NULL, attempts = $2 WHERE id = $3",
+		models.StatusPending, attempts, job.ID,
+	); err != nil {
+		return "", fmt.Errorf("failed to requeue job %d: %w", job.ID, err)
+	}
+	job.Status = models.StatusPending
+	job.Attempts = attempts
+	if err := w.enqueueJob(ctx, tx, job); err != nil {
+		return "", err
+	}
+	return models.StatusPending, nil
+}
+
+// enqueueJob queues a message for job through the outbox as part of tx
+func (w *Worker) enqueueJob(ctx context.Context, tx *sqlx.Tx, job models.Job) error {
+	value, err := json.Marshal(jobs.NewMessage(job))
+	if err != nil {
+		return fmt.Errorf("failed to encode job %d: %w", job.ID, err)
+	}
+	return outbox.Enqueue(ctx, tx, outbox.Message{
+		Topic:   w.cfg.Kafka.Topic,
+		Value:   value,
+		Headers: models.Headers{models.HeaderAttempts: strconv.Itoa(job.Attempts)},
+	})
+}
@@ -0,0 +1,117 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+var renewLease = regexp.QuoteMeta("UPDATE jobs SET lease_expires_at = $1 WHERE id = $2 AND status = $3 AND lease_owner = $4")
+
+func TestProcessJobSkipsLeasedJob(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+
+	// Another worker holds a live lease, e.g. after a rebalance redelivered
+	// the message
+	mock.ExpectQuery(markProcessing).
+		WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+		WillReturnRows(leased())
+
+	err := worker.processJob(&sarama.ConsumerMessage{Value: []byte(`{"id": 1, "name": "Test Job", "type": "sleep"}`)})
+	assert.NoError(t, err)
+	assert.False(t, miniRedis.Exists("job:1"), "the job's status is left to its lease holder")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessJobRetriesWhenLeaseFails(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+
+	mock.ExpectQuery(markProcessing).WillReturnError(errors.New("connection refused"))
+
+	err := worker.processJob(&sarama.ConsumerMessage{Value: []byte(`{"id": 1, "name": "Test Job", "type": "sleep"}`)})
+	assert.NoError(t, err)
+
+	// The message is tried again later without counting an attempt
+	retries, err := miniRedis.ZMembers(retryQueueKey)
+	require.NoError(t, err)
+	assert.Len(t, retries, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessJobStopsWhenLeaseLost(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.leaseDuration = 30 * time.Millisecond
+
+	worker.db.Redis.Set(context.Background(), "job:1:payload", `{"duration_ms": 60000}`, 0)
+	mock.ExpectQuery(markProcessing).
+		WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+		WillReturnRows(leased(0))
+	mock.ExpectExec(renewLease).
+		WithArgs(sqlmock.AnyArg(), 1, models.StatusProcessing, testWorkerID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// The job was reclaimed by another worker after a long pause
+	mock.ExpectExec(renewLease).
+		WithArgs(sqlmock.AnyArg(), 1, models.StatusProcessing, testWorkerID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- worker.processJob(&sarama.ConsumerMessage{Value: []byte(`{"id": 1, "name": "Test Job", "type": "sleep"}`)})
+	}()
+
+	// The attempt is abandoned without touching the job
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("job kept running without its lease")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReclaimExpiredLeases(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, type, owner_id, attempts FROM jobs WHERE status = $1 AND lease_expires_at < $2 ORDER BY lease_expires_at LIMIT $3 FOR UPDATE SKIP LOCKED")).
+		WithArgs(models.StatusProcessing, now, reclaimBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "type", "owner_id", "attempts"}).
+			AddRow(1, "Crashed Job", models.JobTypeSleep, 7, 0).
+			AddRow(2, "Crashing Job", models.JobTypeSleep, 7, 2))
+	// Job 1 has attempts left and is queued again
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE jobs SET status = $1, started_at = NULL, attempts = $2 WHERE id = $3")).
+		WithArgs(models.StatusPending, 1, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO outbox (topic, key, value, headers) VALUES ($1, $2, $3, $4)")).
+		WithArgs("test-topic", nil, sqlmock.AnyArg(), `{"x-attempts":"1"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Job 2 used its last attempt, perhaps crashing its workers each time
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE jobs SET status = $1, error = $2, finished_at = $3, attempts = $4 WHERE id = $5")).
+		WithArgs(models.StatusFailed, sqlmock.AnyArg(), now, 3, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	n, err := worker.reclaimExpiredLeases(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	status, _ := miniRedis.Get("job:1")
+	assert.Equal(t, models.StatusPending, status)
+	status, _ = miniRedis.Get("job:2")
+	assert.Equal(t, models.StatusFailed, status)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
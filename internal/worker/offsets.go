@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// offsetWindow tracks the messages of one partition that are being
+// processed concurrently and marks them as consumed in offset order, so a
+// commit never skips past a message that is still in flight
+type offsetWindow struct {
+	session sarama.ConsumerGroupSession
+	slots   chan struct{} // one per message received but not yet marked
+
+	mu      sync.Mutex
+	pending []*pendingMessage // in offset order
+}
+
+type pendingMessage struct {
+	msg  *sarama.ConsumerMessage
+	done bool
+}
+
+func newOffsetWindow(session sarama.ConsumerGroupSession, size int) *offsetWindow {
+	if size < 1 {
+		size = 1
+	}
+	return &offsetWindow{
+		session: session,
+		slots:   make(chan struct{}, size),
+	}
+}
+
+// add waits until the window has room and starts tracking msg. It returns
+// false if ctx is done first.
+func (w *offsetWindow) add(ctx context.Context, msg *sarama.ConsumerMessage) (*pendingMessage, bool) {
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	m := &pendingMessage{msg: msg}
+	w.mu.Lock()
+	w.pending = append(w.pending, m)
+	w.mu.Unlock()
+	return m, true
+}
+
+// done records that m has been processed and marks the longest run of
+// processed messages at the start of the window
+func (w *offsetWindow) done(m *pendingMessage) {
+	w.mu.Lock()
+	m.done = true
+	n := 0
+	for n < len(w.pending) && w.pending[n].done {
+		n++
+	}
+	if n > 0 {
+		w.session.MarkMessage(w.pending[n-1].msg, "")
+		w.pending = w.pending[n:]
+	}
+	w.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		<-w.slots
+	}
+}
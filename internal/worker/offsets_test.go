@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+func TestOffsetWindow(t *testing.T) {
+	session := &mockSession{}
+	window := newOffsetWindow(session, 3)
+	ctx := context.Background()
+
+	var pending []*pendingMessage
+	for offset := int64(0); offset < 3; offset++ {
+		m, ok := window.add(ctx, &sarama.ConsumerMessage{Offset: offset})
+		require.True(t, ok)
+		pending = append(pending, m)
+	}
+
+	// A full window holds back the partition
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, ok := window.add(timeout, &sarama.ConsumerMessage{Offset: 3})
+	assert.False(t, ok)
+
+	// Offsets are only marked once every earlier message is done
+	window.done(pending[2])
+	assert.Empty(t, session.marked)
+	window.done(pending[0])
+	require.Len(t, session.marked, 1)
+	assert.Equal(t, int64(0), session.marked[0].Offset)
+	window.done(pending[1])
+	require.Len(t, session.marked, 2)
+	assert.Equal(t, int64(2), session.marked[1].Offset)
+
+	// Marking frees the window
+	_, ok = window.add(ctx, &sarama.ConsumerMessage{Offset: 3})
+	assert.True(t, ok)
+}
+
+func TestConsumeClaimProcessesConcurrently(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Worker.Concurrency = 4
+	worker = NewWorker(worker.cfg, worker.db, worker.consumer, worker.producer) // resize the pool
+	mock.MatchExpectationsInOrder(false)
+
+	var msgs []*sarama.ConsumerMessage
+	for id := 1; id <= 4; id++ {
+		worker.db.Redis.Set(context.Background(), fmt.Sprintf("job:%d:payload", id), `{"duration_ms": 100}`, 0)
+		mock.ExpectQuery(markProcessing).
+			WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), id, models.StatusPending).
+			WillReturnRows(leased(0))
+		mock.ExpectExec(markCompleted).
+			WithArgs(models.StatusCompleted, resultContaining(`"slept_ms"`), sqlmock.AnyArg(), id, models.StatusProcessing, testWorkerID).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		msgs = append(msgs, &sarama.ConsumerMessage{
+			Offset: int64(id),
+			Value:  []byte(fmt.Sprintf(`{"id": %d, "name": "Test Job", "type": "sleep"}`, id)),
+		})
+	}
+
+	session := &mockSession{}
+	start := time.Now()
+	require.NoError(t, worker.ConsumeClaim(session, newMockClaim(msgs...)))
+
+	// The jobs ran side by side, and the partition ends up committed past the last one
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	require.NotEmpty(t, session.marked)
+	assert.Equal(t, int64(4), session.marked[len(session.marked)-1].Offset)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
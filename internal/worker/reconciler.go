@@ -0,0 +1,217 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+// reconcilerLockKey is held by the worker running the current reconciler
+// pass, so that one worker per interval reconciles
+const reconcilerLockKey = "jobs:reconciler:lock"
+
+// reconcileBatchSize bounds how many stuck jobs one pass recovers, and how
+// many statuses are compared with Redis at a time
+const reconcileBatchSize = 500
+
+// driftGracePeriod leaves alone the jobs whose status changed recently, as
+// the Redis update following the change may still be on its way
+const driftGracePeriod = time.Minute
+
+// setStatusIfUnchanged sets the status in KEYS[1] to ARGV[2] only if it is
+// still ARGV[1] (empty for a missing key), so a status written by a worker
+// since it was read isn't overwritten
+var setStatusIfUnchanged = redis.NewScript(`
+local current = redis.call('GET', KEYS[1]) or ''
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// runReconciler reconciles job statuses every ReconcileInterval until ctx is
+// done. Every worker runs it, but only one of them makes each pass.
+func (w *Worker) runReconciler(ctx context.Context) {
+	interval := w.cfg.Worker.ReconcileInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.tryReconcile(ctx, interval)
+		}
+	}
+}
+
+// tryReconcile makes a reconciler pass unless another worker made one within
+// interval, and adds what it fixed to the stats in Redis
+func (w *Worker) tryReconcile(ctx context.Context, interval time.Duration) {
+	acquired, err := w.db.Redis.SetNX(ctx, reconcilerLockKey, w.id, interval).Result()
+	if err != nil {
+		slog.Error("Failed to acquire reconciler lock", "error", err)
+		return
+	}
+	if !acquired {
+		return
+	}
+
+	now := time.Now()
+	stats, err := w.reconcile(ctx, now)
+	if err != nil {
+		slog.Error("Failed to reconcile jobs", "error", err)
+	}
+	if stats.Requeued+stats.Failed+stats.RedisRepaired > 0 {
+		slog.Info("Reconciled jobs", "requeued", stats.Requeued, "failed", stats.Failed, "redisRepaired", stats.RedisRepaired)
+	}
+
+	_, err = w.db.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, models.ReconcilerStatsKey, models.ReconcilerStatRuns, 1)
+		pipe.HIncrBy(ctx, models.ReconcilerStatsKey, models.ReconcilerStatRequeued, stats.Requeued)
+		pipe.HIncrBy(ctx, models.ReconcilerStatsKey, models.ReconcilerStatFailed, stats.Failed)
+		pipe.HIncrBy(ctx, models.ReconcilerStatsKey, models.ReconcilerStatRedisRepaired, stats.RedisRepaired)
+		pipe.HSet(ctx, models.ReconcilerStatsKey, models.ReconcilerStatLastRunAt, now.UTC().Format(time.RFC3339))
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to record reconciler stats", "error", err)
+	}
+}
+
+// reconcile recovers stuck jobs and then repairs the Redis statuses that
+// drifted from Postgres, returning what it fixed. Stats are returned for the
+// work done even if it fails partway.
+func (w *Worker) reconcile(ctx context.Context, now time.Time) (models.ReconcilerStats, error) {
+	var stats models.ReconcilerStats
+	if err := w.recoverStuckJobs(ctx, now, &stats); err != nil {
+		return stats, err
+	}
+	if err := w.repairRedisStatuses(ctx, now, &stats); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// recoverStuckJobs queues again the jobs pending for longer than StuckAfter,
+// whose message was lost or never published. Jobs processing for that long
+// without a live lease are treated like reclaimed leases: the run counts as
+// an attempt, and jobs out of attempts fail.
+func (w *Worker) recoverStuckJobs(ctx context.Context, now time.Time, stats *models.ReconcilerStats) error {
+	tx, err := w.db.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var stuck []models.Job
+	if err := tx.SelectContext(ctx, &stuck,
+		"SELECT id, name, status, type, owner_id, attempts FROM jobs "+
+			"WHERE status_updated_at < $1 AND (status = $2 OR (status = $3 AND (lease_expires_at IS NULL OR lease_expires_at < $4))) "+
+			"ORDER BY status_updated_at LIMIT $5 FOR UPDATE SKIP LOCKED",
+		now.Add(-w.cfg.Worker.StuckAfter), models.StatusPending, models.StatusProcessing, now, reconcileBatchSize,
+	); err != nil {
+		return fmt.Errorf("failed to load stuck jobs: %w", err)
+	}
+
+	statuses := make(map[int]string, len(stuck))
+	for _, job := range stuck {
+		if job.Status == models.StatusProcessing {
+			status, err := w.requeueOrFail(ctx, tx, job, now, "job stuck processing: no worker holds its lease")
+			if err != nil {
+				return err
+			}
+			statuses[job.ID] = status
+			continue
+		}
+
+		// The status doesn't change, so restart the deadline by hand
+		if _, err := tx.ExecContext(ctx,
+			"UPDATE jobs SET status_updated_at = $1 WHERE id = $2", now, job.ID,
+		); err != nil {
+			return fmt.Errorf("failed to requeue job %d: %w", job.ID, err)
+		}
+		if err := w.enqueueJob(ctx, tx, job); err != nil {
+			return err
+		}
+		statuses[job.ID] = models.StatusPending
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for jobID, status := range statuses {
+		slog.Warn("Recovered stuck job", "jobID", jobID, "status", status)
+		if status == models.StatusFailed {
+			stats.Failed++
+		} else {
+			stats.Requeued++
+		}
+		if err := w.db.Redis.Set(ctx, fmt.Sprintf("job:%d", jobID), status, 0).Err(); err != nil {
+			slog.Error("Failed to update Redis status", "jobID", jobID, "error", err)
+		}
+	}
+	return nil
+}
+
+// repairRedisStatuses sets the Redis status of the jobs whose status changed
+// within ReconcileLookback to their status in Postgres where the two differ,
+// such as after a Redis write failed following a database update
+func (w *Worker) repairRedisStatuses(ctx context.Context, now time.Time, stats *models.ReconcilerStats) error {
+	since := now.Add(-w.cfg.Worker.ReconcileLookback)
+	until := now.Add(-driftGracePeriod)
+
+	lastID := 0
+	for {
+		var jobs []models.Job
+		if err := w.db.DB.SelectContext(ctx, &jobs,
+			"SELECT id, status FROM jobs WHERE status_updated_at > $1 AND status_updated_at < $2 AND id > $3 ORDER BY id LIMIT $4",
+			since, until, lastID, reconcileBatchSize,
+		); err != nil {
+			return fmt.Errorf("failed to load job statuses: %w", err)
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+
+		keys := make([]string, len(jobs))
+		for i, job := range jobs {
+			keys[i] = fmt.Sprintf("job:%d", job.ID)
+		}
+		cached, err := w.db.Redis.MGet(ctx, keys...).Result()
+		if err != nil {
+			return fmt.Errorf("failed to load Redis statuses: %w", err)
+		}
+
+		for i, job := range jobs {
+			current, _ := cached[i].(string)
+			if current == job.Status {
+				continue
+			}
+			set, err := setStatusIfUnchanged.Run(ctx, w.db.Redis, []string{keys[i]}, current, job.Status).Int()
+			if err != nil {
+				return fmt.Errorf("failed to repair Redis status of job %d: %w", job.ID, err)
+			}
+			if set == 1 {
+				slog.Warn("Repaired Redis job status", "jobID", job.ID, "was", current, "status", job.Status)
+				stats.RedisRepaired++
+			}
+		}
+
+		if len(jobs) < reconcileBatchSize {
+			return nil
+		}
+		lastID = jobs[len(jobs)-1].ID
+	}
+}
@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+var (
+	selectStuck = regexp.QuoteMeta("SELECT id, name, status, type, owner_id, attempts FROM jobs " +
+		"WHERE status_updated_at < $1 AND (status = $2 OR (status = $3 AND (lease_expires_at IS NULL OR lease_expires_at < $4))) " +
+		"ORDER BY status_updated_at LIMIT $5 FOR UPDATE SKIP LOCKED")
+	selectStatuses = regexp.QuoteMeta("SELECT id, status FROM jobs WHERE status_updated_at > $1 AND status_updated_at < $2 AND id > $3 ORDER BY id LIMIT $4")
+	insertOutbox   = regexp.QuoteMeta("INSERT INTO outbox (topic, key, value, headers) VALUES ($1, $2, $3, $4)")
+)
+
+func TestReconcileRecoversStuckJobs(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Worker.StuckAfter = 15 * time.Minute
+	worker.cfg.Worker.ReconcileLookback = time.Hour
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectStuck).
+		WithArgs(now.Add(-15*time.Minute), models.StatusPending, models.StatusProcessing, now, reconcileBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "status", "type", "owner_id", "attempts"}).
+			AddRow(1, "Lost Job", models.StatusPending, models.JobTypeSleep, 7, 1).
+			AddRow(2, "Orphaned Job", models.StatusProcessing, models.JobTypeSleep, 7, 0).
+			AddRow(3, "Doomed Job", models.StatusProcessing, models.JobTypeSleep, 7, 2))
+	// Job 1's message was lost; it is queued again without using an attempt
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE jobs SET status_updated_at = $1 WHERE id = $2")).
+		WithArgs(now, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("test-topic", nil, sqlmock.AnyArg(), `{"x-attempts":"1"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Jobs 2 and 3 are processing without a lease, so their run is lost
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE jobs SET status = $1, started_at = NULL, attempts = $2 WHERE id = $3")).
+		WithArgs(models.StatusPending, 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertOutbox).
+		WithArgs("test-topic", nil, sqlmock.AnyArg(), `{"x-attempts":"1"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE jobs SET status = $1, error = $2, finished_at = $3, attempts = $4 WHERE id = $5")).
+		WithArgs(models.StatusFailed, sqlmock.AnyArg(), now, 3, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(selectStatuses).
+		WithArgs(now.Add(-time.Hour), now.Add(-driftGracePeriod), 0, reconcileBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status"}))
+
+	stats, err := worker.reconcile(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Requeued)
+	assert.Equal(t, int64(1), stats.Failed)
+
+	for id, want := range map[string]string{"job:1": models.StatusPending, "job:2": models.StatusPending, "job:3": models.StatusFailed} {
+		status, _ := miniRedis.Get(id)
+		assert.Equal(t, want, status, id)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReconcileRepairsRedisStatuses(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Worker.ReconcileLookback = time.Hour
+	now := time.Now()
+
+	// Job 1's completion wasn't written to Redis and job 2's status is gone
+	miniRedis.Set("job:1", models.StatusProcessing)
+	miniRedis.Set("job:3", models.StatusPending)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectStuck).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "status", "type", "owner_id", "attempts"}))
+	mock.ExpectCommit()
+	mock.ExpectQuery(selectStatuses).
+		WithArgs(now.Add(-time.Hour), now.Add(-driftGracePeriod), 0, reconcileBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).
+			AddRow(1, models.StatusCompleted).
+			AddRow(2, models.StatusFailed).
+			AddRow(3, models.StatusPending))
+
+	stats, err := worker.reconcile(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.RedisRepaired)
+
+	for id, want := range map[string]string{"job:1": models.StatusCompleted, "job:2": models.StatusFailed, "job:3": models.StatusPending} {
+		status, _ := miniRedis.Get(id)
+		assert.Equal(t, want, status, id)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetStatusIfUnchanged(t *testing.T) {
+	worker, _, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	ctx := context.Background()
+
+	// A worker finished the job after its status was read
+	miniRedis.Set("job:1", models.StatusCompleted)
+	set, err := setStatusIfUnchanged.Run(ctx, worker.db.Redis, []string{"job:1"}, models.StatusPending, models.StatusProcessing).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 0, set)
+	status, _ := miniRedis.Get("job:1")
+	assert.Equal(t, models.StatusCompleted, status)
+
+	set, err = setStatusIfUnchanged.Run(ctx, worker.db.Redis, []string{"job:2"}, "", models.StatusFailed).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 1, set)
+	status, _ = miniRedis.Get("job:2")
+	assert.Equal(t, models.StatusFailed, status)
+}
+
+func TestTryReconcileRunsOncePerInterval(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectStuck).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "status", "type", "owner_id", "attempts"}))
+	mock.ExpectCommit()
+	mock.ExpectQuery(selectStatuses).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow(1, models.StatusCompleted))
+
+	worker.tryReconcile(context.Background(), time.Minute)
+	// Another worker's tick within the interval finds the lock taken
+	worker.tryReconcile(context.Background(), time.Minute)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	var stats models.ReconcilerStats
+	require.NoError(t, worker.db.Redis.HGetAll(context.Background(), models.ReconcilerStatsKey).Scan(&stats))
+	assert.Equal(t, int64(1), stats.Runs)
+	assert.Equal(t, int64(1), stats.RedisRepaired)
+	assert.NotEmpty(t, stats.LastRunAt)
+	assert.True(t, miniRedis.Exists(reconcilerLockKey))
+}
@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/illegalcall/task-master/internal/models"
+	"github.com/illegalcall/task-master/pkg/kafka"
+)
+
+// retryQueueKey is the Redis sorted set of scheduled job retries, scored by
+// the Unix time in milliseconds at which they are due
+const retryQueueKey = "jobs:retry"
+
+// retryBatchSize bounds how many due retries one poll republishes
+const retryBatchSize = 100
+
+// popDueRetries atomically removes and returns the retries due by ARGV[1],
+// so several workers can poll the same queue without republishing twice
+var popDueRetries = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #due > 0 then
+	redis.call('ZREM', KEYS[1], unpack(due))
+end
+return due
+`)
+
+// scheduledRetry is a job message waiting in the retry queue
+type scheduledRetry struct {
+	Topic    string            `json:"topic"`
+	Key      []byte            `json:"key,omitempty"`
+	Value    []byte            `json:"value"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	JobID    int               `json:"job_id"`
+	Attempts int               `json:"attempts"`
+}
+
+// messageAttempts returns how many times msg's job was already attempted
+// according to its attempts header, for when jobs.attempts can't be read
+func messageAttempts(msg *sarama.ConsumerMessage) int {
+	for _, h := range msg.Headers {
+		if h != nil && string(h.Key) == models.HeaderAttempts {
+			n, err := strconv.Atoi(string(h.Value))
+			if err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// retryBackoff returns the delay before retrying a job that failed its
+// attempts'th attempt: RetryBackoff doubled per attempt, capped at
+// RetryMaxBackoff, with the upper half jittered so retries of jobs that
+// failed together spread out
+func (w *Worker) retryBackoff(attempts int) time.Duration {
+	backoff := w.cfg.Kafka.RetryBackoff
+	maxBackoff := w.cfg.Kafka.RetryMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = backoff
+	}
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	half := backoff / 2
+	return half + rand.N(backoff-half+1)
+}
+
+// scheduleRetry queues msg to be republished to its topic after the backoff
+// for the given number of attempts
+func (w *Worker) scheduleRetry(ctx context.Context, msg *sarama.ConsumerMessage, jobID, attempts int) (time.Time, error) {
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for _, h := range msg.Headers {
+		if h != nil {
+			headers[string(h.Key)] = string(h.Value)
+		}
+	}
+	headers[models.HeaderAttempts] = strconv.Itoa(attempts)
+
+	entry, err := json.Marshal(scheduledRetry{
+		Topic:    msg.Topic,
+		Key:      msg.Key,
+		Value:    msg.Value,
+		Headers:  headers,
+		JobID:    jobID,
+		Attempts: attempts,
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to encode retry: %w", err)
+	}
+
+	due := time.Now().Add(w.retryBackoff(attempts))
+	if err := w.db.Redis.ZAdd(ctx, retryQueueKey, redis.Z{Score: float64(due.UnixMilli()), Member: entry}).Err(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to schedule retry: %w", err)
+	}
+	return due, nil
+}
+
+// retryLater schedules the message of a job that failed an attempt to be
+// redelivered after a backoff, and puts the job back to pending meanwhile
+func (w *Worker) retryLater(ctx context.Context, msg *sarama.ConsumerMessage, jobID, attempts int, jobErr error) error {
+	due, err := w.scheduleRetry(ctx, msg, jobID, attempts)
+	if err != nil {
+		return err
+	}
+	slog.Warn("Job processing failed, retry scheduled", "jobID", jobID, "attempt", attempts, "retryAt", due, "error", jobErr)
+
+	// A job cancelled meanwhile keeps its status and the retry is skipped
+	// when it is redelivered
+	result, err := w.db.DB.Exec(
+		"UPDATE jobs SET status = $1, error = $2, attempts = attempts + 1 WHERE id = $3 AND status = $4 AND lease_owner = $5",
+		models.StatusPending, jobErr.Error(), jobID, models.StatusProcessing, w.id,
+	)
+	if err != nil {
+		slog.Error("Failed to update job status to pending in DB", "jobID", jobID, "error", err)
+		return nil
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	if err := w.db.Redis.Set(ctx, fmt.Sprintf("job:%d", jobID), models.StatusPending, 0).Err(); err != nil {
+		slog.Error("Failed to update Redis status to pending", "jobID", jobID, "error", err)
+	}
+	return nil
+}
+
+// runRetryScheduler republishes due retries every RetryPollInterval until
+// ctx is done
+func (w *Worker) runRetryScheduler(ctx context.Context) {
+	interval := w.cfg.Kafka.RetryPollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.releaseDueRetries(ctx, time.Now()); err != nil {
+				slog.Error("Failed to release due job retries", "error", err)
+			}
+		}
+	}
+}
+
+// releaseDueRetries republishes the retries due by now and returns how many
+// were published. A retry that can't be published is put back in the queue.
+func (w *Worker) releaseDueRetries(ctx context.Context, now time.Time) (int, error) {
+	due, err := popDueRetries.Run(ctx, w.db.Redis, []string{retryQueueKey}, now.UnixMilli(), retryBatchSize).StringSlice()
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, member := range due {
+		var retry scheduledRetry
+		if err := json.Unmarshal([]byte(member), &retry); err != nil {
+			slog.Error("Dropping invalid scheduled retry", "error", err)
+			continue
+		}
+
+		msg := &sarama.ProducerMessage{
+			Topic:   retry.Topic,
+			Value:   sarama.ByteEncoder(retry.Value),
+			Headers: kafka.RecordHeaders(retry.Headers),
+		}
+		if retry.Key != nil {
+			msg.Key = sarama.ByteEncoder(retry.Key)
+		}
+		if _, _, err := w.producer.SendMessage(msg); err != nil {
+			slog.Error("Failed to republish job retry", "jobID", retry.JobID, "error", err)
+			retryAt := now.Add(w.cfg.Kafka.RetryBackoff)
+			if err := w.db.Redis.ZAdd(ctx, retryQueueKey, redis.Z{Score: float64(retryAt.UnixMilli()), Member: member}).Err(); err != nil {
+				slog.Error("Lost job retry", "jobID", retry.JobID, "error", err)
+			}
+			continue
+		}
+		slog.Info("Job retry released", "jobID", retry.JobID, "attempts", retry.Attempts)
+		released++
+	}
+	return released, nil
+}
@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/illegalcall/task-master/internal/models"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	worker, _, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Kafka.RetryBackoff = time.Second
+	worker.cfg.Kafka.RetryMaxBackoff = 10 * time.Second
+
+	// The backoff doubles per attempt, jittered within its upper half,
+	// until it reaches the cap
+	for attempts, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			backoff := worker.retryBackoff(attempts)
+			assert.GreaterOrEqual(t, backoff, want/2, "attempt %d", attempts)
+			assert.LessOrEqual(t, backoff, want, "attempt %d", attempts)
+		}
+	}
+}
+
+func TestReleaseDueRetries(t *testing.T) {
+	worker, _, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Kafka.RetryBackoff = time.Minute
+	worker.cfg.Kafka.RetryMaxBackoff = time.Minute
+	producer := worker.producer.(*MockProducer)
+	ctx := context.Background()
+
+	msg := &sarama.ConsumerMessage{
+		Topic:   "test-topic",
+		Key:     []byte("job-5"),
+		Value:   []byte(`{"id": 5, "type": "unknown"}`),
+		Headers: []*sarama.RecordHeader{{Key: []byte("trace-id"), Value: []byte("abc")}},
+	}
+	due, err := worker.scheduleRetry(ctx, msg, 5, 1)
+	require.NoError(t, err)
+
+	// Nothing is published before the backoff has passed
+	released, err := worker.releaseDueRetries(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, released)
+	assert.Empty(t, producer.messages)
+
+	// A retry that can't be published stays queued
+	producer.err = errors.New("broker down")
+	released, err = worker.releaseDueRetries(ctx, due)
+	require.NoError(t, err)
+	assert.Zero(t, released)
+	retries, _ := miniRedis.ZMembers(retryQueueKey)
+	assert.Len(t, retries, 1)
+
+	// Once due, the message goes back to its topic with the attempt counted
+	producer.err = nil
+	released, err = worker.releaseDueRetries(ctx, due.Add(worker.cfg.Kafka.RetryBackoff))
+	require.NoError(t, err)
+	assert.Equal(t, 1, released)
+	require.Len(t, producer.messages, 1)
+	published := producer.messages[0]
+	assert.Equal(t, "test-topic", published.Topic)
+	assert.Equal(t, sarama.ByteEncoder("job-5"), published.Key)
+	assert.Equal(t, sarama.ByteEncoder(msg.Value), published.Value)
+	headers := map[string]string{}
+	for _, h := range published.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	assert.Equal(t, map[string]string{"trace-id": "abc", models.HeaderAttempts: "1"}, headers)
+	assert.False(t, miniRedis.Exists(retryQueueKey))
+}
@@ -3,44 +3,79 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/IBM/sarama"
 
 	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/jobs"
 	"github.com/illegalcall/task-master/internal/models"
 	"github.com/illegalcall/task-master/pkg/database"
-	"github.com/illegalcall/task-master/internal/jobs"
 )
 
+// errShuttingDown aborts the jobs still running when the shutdown timeout
+// expires
+var errShuttingDown = errors.New("worker is shutting down")
+
 type Worker struct {
-	cfg      *config.Config
-	db       *database.Clients
-	consumer sarama.ConsumerGroup
-	ready    chan bool
+	cfg       *config.Config
+	db        *database.Clients
+	consumer  sarama.ConsumerGroup
+	producer  sarama.SyncProducer // publishes retries and dead letters
+	ready     chan struct{}       // closed once the first session is set up
+	readyOnce sync.Once
+
+	// pool bounds the jobs processed at once across all partitions
+	pool chan struct{}
+
+	// id names the leases this worker holds on the jobs it runs
+	id            string
+	leaseDuration time.Duration
+
+	// running holds the cancel functions of the jobs being processed
+	mu      sync.Mutex
+	running map[int]context.CancelCauseFunc
 }
 
-func NewWorker(cfg *config.Config, db *database.Clients, consumer sarama.ConsumerGroup) *Worker {
+func NewWorker(cfg *config.Config, db *database.Clients, consumer sarama.ConsumerGroup, producer sarama.SyncProducer) *Worker {
+	concurrency := cfg.Worker.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	id := cfg.Worker.ID
+	if id == "" {
+		id = defaultWorkerID()
+	}
+	leaseDuration := cfg.Worker.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = 30 * time.Second
+	}
 	return &Worker{
-		cfg:      cfg,
-		db:       db,
-		consumer: consumer,
-		ready:    make(chan bool),
+		cfg:           cfg,
+		db:            db,
+		consumer:      consumer,
+		producer:      producer,
+		ready:         make(chan struct{}),
+		pool:          make(chan struct{}, concurrency),
+		id:            id,
+		leaseDuration: leaseDuration,
+		running:       make(map[int]context.CancelCauseFunc),
 	}
 }
 
+// Start consumes jobs until ctx is done and then shuts down gracefully: it
+// stops reading new messages and gives running jobs Worker.ShutdownTimeout to
+// finish and have their offsets committed. Jobs still running after that are
+// aborted and put back to pending, and their messages are left uncommitted so
+// they are redelivered.
 func (w *Worker) Start(ctx context.Context) error {
 	topics := []string{w.cfg.Kafka.Topic}
 
-	// Setup signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
 	// Start error logging for consumer errors
 	go func() {
 		for err := range w.consumer.Errors() {
@@ -48,8 +83,26 @@ func (w *Worker) Start(ctx context.Context) error {
 		}
 	}()
 
-	// Start consuming messages
+	// Abort running jobs when the API cancels them, including while they
+	// drain after ctx is done
+	listenCtx, stopListening := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopListening()
+	go w.listenForCancellations(listenCtx)
+
+	// Republish failed jobs once their retry backoff has passed
+	go w.runRetryScheduler(ctx)
+
+	// Take back jobs from workers that died holding their lease
+	go w.runLeaseReaper(ctx)
+
+	// Recover stuck jobs and repair Redis statuses that drifted from Postgres
+	go w.runReconciler(ctx)
+
+	// Start consuming messages. Jobs don't run under ctx, so when it is done
+	// the sessions stop reading but wait for the jobs in flight.
+	consumed := make(chan struct{})
 	go func() {
+		defer close(consumed)
 		for {
 			if err := w.consumer.Consume(ctx, topics, w); err != nil {
 				slog.Error("Error from consumer", "error", err)
@@ -57,27 +110,34 @@ func (w *Worker) Start(ctx context.Context) error {
 			if ctx.Err() != nil {
 				return
 			}
-			w.ready = make(chan bool)
 		}
 	}()
 
-	<-w.ready // Wait till the consumer has been set up
-	slog.Info("Worker started successfully", "topics", topics)
-
-	// Wait for shutdown signal
 	select {
-	case sig := <-sigChan:
-		slog.Info("Received shutdown signal", "signal", sig)
+	case <-w.ready:
+		slog.Info("Worker started successfully", "topics", topics)
 	case <-ctx.Done():
-		slog.Info("Context cancelled")
 	}
 
+	<-ctx.Done()
+	slog.Info("Shutting down worker, waiting for running jobs", "timeout", w.cfg.Worker.ShutdownTimeout)
+
+	timeout := time.NewTimer(w.cfg.Worker.ShutdownTimeout)
+	defer timeout.Stop()
+	select {
+	case <-consumed:
+	case <-timeout.C:
+		slog.Warn("Shutdown timeout reached, aborting running jobs", "jobs", w.abortRunningJobs())
+		<-consumed
+	}
+
+	slog.Info("Worker stopped")
 	return nil
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim.
 func (w *Worker) Setup(sarama.ConsumerGroupSession) error {
-	close(w.ready)
+	w.readyOnce.Do(func() { close(w.ready) })
 	return nil
 }
 
@@ -86,63 +146,232 @@ func (w *Worker) Cleanup(sarama.ConsumerGroupSession) error {
 	return nil
 }
 
+// listenForCancellations cancels the context of running jobs whose IDs are
+// published on models.JobCancelChannel
+func (w *Worker) listenForCancellations(ctx context.Context) {
+	sub := w.db.Redis.Subscribe(ctx, models.JobCancelChannel)
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-sub.Channel():
+			if !ok {
+				return
+			}
+			jobID, err := strconv.Atoi(msg.Payload)
+			if err != nil {
+				slog.Warn("Ignoring invalid cancellation message", "payload", msg.Payload)
+				continue
+			}
+			if w.cancelJob(jobID) {
+				slog.Info("Cancelling running job", "jobID", jobID)
+			}
+		}
+	}
+}
+
+// trackJob registers the cancel function of a job being processed and
+// returns a function that unregisters it
+func (w *Worker) trackJob(jobID int, cancel context.CancelCauseFunc) func() {
+	w.mu.Lock()
+	w.running[jobID] = cancel
+	w.mu.Unlock()
+	return func() {
+		w.mu.Lock()
+		delete(w.running, jobID)
+		w.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// cancelJob cancels the job if this worker is processing it
+func (w *Worker) cancelJob(jobID int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cancel, ok := w.running[jobID]
+	if ok {
+		cancel(nil)
+	}
+	return ok
+}
+
+// abortRunningJobs interrupts every job being processed for shutdown and
+// returns how many there were
+func (w *Worker) abortRunningJobs() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, cancel := range w.running {
+		cancel(errShuttingDown)
+	}
+	return len(w.running)
+}
+
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
+// Messages are processed concurrently in the worker pool and marked in offset
+// order. Reading stops while the pool or the partition's window of uncommitted
+// messages is full, so a slow job holds back its partition rather than
+// buffering it.
 func (w *Worker) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ctx := session.Context()
+	window := newOffsetWindow(session, max(w.cfg.Worker.MaxPending, cap(w.pool)))
+
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		session.Commit()
+	}()
+
 	for message := range claim.Messages() {
-		if err := w.processJob(message); err != nil {
-			slog.Error("Failed to process job", "error", err)
+		pending, ok := window.add(ctx, message)
+		if !ok {
+			return nil
+		}
+		select {
+		case w.pool <- struct{}{}:
+		case <-ctx.Done():
+			return nil
 		}
-		session.MarkMessage(message, "")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handled := w.handleMessage(message)
+			<-w.pool
+			// A job aborted by shutdown holds back the partition's offset
+			// so it is redelivered
+			if handled {
+				window.done(pending)
+			}
+		}()
 	}
 	return nil
 }
 
-func (w *Worker) processJob(msg *sarama.ConsumerMessage) error {
-	var job struct {
-		ID   int    `json:"id"`
-		Name string `json:"name"`
-		Type string `json:"type"`
+// handleMessage processes a message, dead-lettering it if it fails for good.
+// It reports false if the job was interrupted by shutdown and the message
+// must be consumed again.
+func (w *Worker) handleMessage(message *sarama.ConsumerMessage) bool {
+	err := w.processJob(message)
+	if errors.Is(err, errShuttingDown) {
+		return false
 	}
+	if err != nil {
+		slog.Error("Failed to process job", "error", err)
+		if failure, ok := asJobError(err); ok {
+			if err := w.deadLetter(message, failure); err != nil {
+				slog.Error("Failed to dead-letter job", "jobID", failure.JobID, "error", err)
+			}
+		}
+	}
+	return true
+}
+
+func (w *Worker) processJob(msg *sarama.ConsumerMessage) error {
+	var job jobs.Message
 
 	// Parse JSON message
 	if err := json.Unmarshal(msg.Value, &job); err != nil {
-		return fmt.Errorf("failed to parse job: %w", err)
+		return &jobError{Err: fmt.Errorf("failed to parse job: %w", err)}
 	}
 
 	slog.Info("Processing job", "jobID", job.ID, "jobName", job.Name)
 
-	// Process job with retries
-	var err error
-	for attempt := 1; attempt <= w.cfg.Kafka.RetryMax; attempt++ {
-		err = w.processJobLogic(job)
-		if err == nil {
-			break
+	ctx := context.Background()
+	redisKey := fmt.Sprintf("job:%d", job.ID)
+
+	// The job runs under its own context so a cancellation aborts it. It is
+	// registered first so a cancellation published from here on is seen.
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer w.trackJob(job.ID, cancel)()
+
+	// Lease the job, so a message delivered twice, say after a rebalance,
+	// runs once, and one cancelled while queued doesn't run at all
+	previous, claimed, err := w.claimJob(ctx, job.ID)
+	if err != nil {
+		// Try the message again later rather than run the job unleased
+		slog.Error("Failed to lease job", "jobID", job.ID, "error", err)
+		if _, err := w.scheduleRetry(ctx, msg, job.ID, messageAttempts(msg)); err != nil {
+			return fmt.Errorf("failed to lease job %d: %w", job.ID, err)
 		}
-		slog.Error("Job processing failed, retrying", "jobID", job.ID, "attempt", attempt, "error", err)
-		time.Sleep(w.cfg.Kafka.RetryBackoff)
+		return nil
+	}
+	if !claimed {
+		slog.Info("Skipping job that is not pending", "jobID", job.ID)
+		return nil
+	}
+	go w.holdLease(jobCtx, job.ID, cancel)
+	if err := w.db.Redis.Set(ctx, redisKey, models.StatusProcessing, 0).Err(); err != nil {
+		slog.Error("Failed to update Redis status to processing", "jobID", job.ID, "error", err)
 	}
 
-	// Update job status based on processing result
-	ctx := context.Background()
-	redisKey := fmt.Sprintf("job:%d", job.ID)
+	// Each message gets one attempt; failures are retried later through the
+	// retry queue so the partition keeps moving. Attempts are counted by
+	// jobs.attempts, which the attempts header of a retry only mirrors.
+	attempts := previous + 1
+	output, err := w.processJobLogic(jobCtx, job)
 
+	if errors.Is(context.Cause(jobCtx), errShuttingDown) {
+		w.requeueAborted(ctx, job.ID)
+		return errShuttingDown
+	}
+
+	// Another worker reclaimed the job, or it was cancelled
+	if errors.Is(context.Cause(jobCtx), errLeaseLost) {
+		slog.Warn("Job lease lost, discarding attempt", "jobID", job.ID, "attempts", attempts)
+		return nil
+	}
+
+	// The API has already recorded the cancellation
+	if jobCtx.Err() != nil {
+		slog.Info("Job cancelled", "jobID", job.ID, "attempts", attempts)
+		return nil
+	}
+
+	// Invalid jobs fail for good on the first attempt
+	if err != nil && attempts < w.cfg.Kafka.RetryMax && !errors.Is(err, jobs.ErrInvalidJob) {
+		retryErr := w.retryLater(ctx, msg, job.ID, attempts, err)
+		if retryErr == nil {
+			return nil
+		}
+		slog.Error("Failed to schedule job retry", "jobID", job.ID, "error", retryErr)
+	}
+
+	// Update job status based on processing result. The status and lease
+	// conditions keep a cancellation or reclaim that raced with the attempt
+	// from being overwritten.
 	if err != nil {
 		// Job failed after all retries
-		slog.Error("Job processing failed after retries", "jobID", job.ID, "error", err)
-		if _, dbErr := w.db.DB.Exec("UPDATE jobs SET status = $1 WHERE id = $2", models.StatusFailed, job.ID); dbErr != nil {
+		slog.Error("Job processing failed after retries", "jobID", job.ID, "attempts", attempts, "error", err)
+		result, dbErr := w.db.DB.Exec(
+			"UPDATE jobs SET status = $1, error = $2, finished_at = $3, attempts = attempts + 1 WHERE id = $4 AND status = $5 AND lease_owner = $6",
+			models.StatusFailed, err.Error(), time.Now(), job.ID, models.StatusProcessing, w.id,
+		)
+		if dbErr != nil {
 			slog.Error("Failed to update job status to failed in DB", "jobID", job.ID, "error", dbErr)
+		} else if n, _ := result.RowsAffected(); n == 0 {
+			return nil
 		}
 		if err := w.db.Redis.Set(ctx, redisKey, models.StatusFailed, 0).Err(); err != nil {
 			slog.Error("Failed to update Redis status to failed", "jobID", job.ID, "error", err)
 		}
-		return err
+		return &jobError{JobID: job.ID, Attempts: attempts, Err: err}
 	}
 
 	// Job completed successfully
-	if _, err := w.db.DB.Exec("UPDATE jobs SET status = $1 WHERE id = $2", models.StatusCompleted, job.ID); err != nil {
+	result, err := w.db.DB.Exec(
+		"UPDATE jobs SET status = $1, result = $2, error = NULL, finished_at = $3, attempts = attempts + 1 WHERE id = $4 AND status = $5 AND lease_owner = $6",
+		models.StatusCompleted, jsonColumn(output), time.Now(), job.ID, models.StatusProcessing, w.id,
+	)
+	if err != nil {
 		slog.Error("Failed to update job status in DB", "jobID", job.ID, "error", err)
 		return err
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		slog.Info("Discarding result of cancelled or reclaimed job", "jobID", job.ID)
+		return nil
+	}
 	if err := w.db.Redis.Set(ctx, redisKey, models.StatusCompleted, 0).Err(); err != nil {
 		slog.Error("Failed to update Redis status", "jobID", job.ID, "error", err)
 	}
@@ -151,43 +380,72 @@ func (w *Worker) processJob(msg *sarama.ConsumerMessage) error {
 	return nil
 }
 
-func (w *Worker) processJobLogic(job struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
-}) error {
-	ctx := context.Background()
+// requeueAborted puts a job interrupted by shutdown back to pending for its
+// redelivery
+func (w *Worker) requeueAborted(ctx context.Context, jobID int) {
+	slog.Info("Job aborted by shutdown, returning it to the queue", "jobID", jobID)
+	result, err := w.db.DB.Exec(
+		"UPDATE jobs SET status = $1, started_at = NULL WHERE id = $2 AND status = $3 AND lease_owner = $4",
+		models.StatusPending, jobID, models.StatusProcessing, w.id,
+	)
+	if err != nil {
+		slog.Error("Failed to update job status to pending in DB", "jobID", jobID, "error", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+	if err := w.db.Redis.Set(ctx, fmt.Sprintf("job:%d", jobID), models.StatusPending, 0).Err(); err != nil {
+		slog.Error("Failed to update Redis status to pending", "jobID", jobID, "error", err)
+	}
+}
+
+// processJobLogic runs the registered handler for the job type and returns
+// its JSON result
+func (w *Worker) processJobLogic(ctx context.Context, job jobs.Message) ([]byte, error) {
+	// A newer build queued the job; one of its workers can run it
+	if job.SchemaVersion > jobs.SchemaVersion {
+		return nil, fmt.Errorf("%w: job %d was queued at version %d, this build reads up to %d",
+			jobs.ErrUnsupportedSchemaVersion, job.ID, job.SchemaVersion, jobs.SchemaVersion)
+	}
+	jobType, ok := jobs.LookupJobType(job.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown job type %q", jobs.ErrInvalidJob, job.Type)
+	}
 
 	// Get job payload from Redis
 	redisKey := fmt.Sprintf("job:%d:payload", job.ID)
-	payloadBytes, err := w.db.Redis.Get(ctx, redisKey).Bytes()
+	stored, err := w.db.Redis.Get(ctx, redisKey).Bytes()
 	if err != nil {
-		return fmt.Errorf("failed to get job payload: %w", err)
+		return nil, fmt.Errorf("failed to get job payload: %w", err)
+	}
+	env, err := jobs.DecodeEnvelope(stored, job.Type)
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes := []byte(env.Payload)
+	if _, err := jobType.Prepare(payloadBytes); err != nil {
+		return nil, err
 	}
 
-	switch job.Type {
-	case models.JobTypePDFParse:
-		// Process PDF parsing job
-		result, err := jobs.ParseDocumentHandler(ctx, payloadBytes)
-		if err != nil {
-			return fmt.Errorf("failed to process PDF: %w", err)
-		}
-
-		// Store result in Redis
-		resultKey := fmt.Sprintf("job:%d:result", job.ID)
-		resultBytes, _ := json.Marshal(result)
-		if err := w.db.Redis.Set(ctx, resultKey, resultBytes, w.cfg.Storage.TTL).Err(); err != nil {
-			return fmt.Errorf("failed to store result: %w", err)
-		}
+	result, err := jobType.Handle(ctx, payloadBytes)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode result: %w", err)
+	}
+	return resultBytes, nil
+}
 
-	default:
-		// For other job types, use default processing
-		time.Sleep(w.cfg.Kafka.ProcessingTime)
-		if job.ID%5 == 0 {
-			return fmt.Errorf("simulated error for job %d", job.ID)
-		}
+// jsonColumn converts a JSON document into a value for a JSONB column; lib/pq
+// sends []byte as bytea, so the document is passed as text and empty results
+// are stored as NULL
+func jsonColumn(data []byte) interface{} {
+	if len(data) == 0 {
 		return nil
 	}
+	return string(data)
 }
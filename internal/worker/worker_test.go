@@ -2,7 +2,11 @@ package worker
 
 import (
 	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,12 +14,14 @@ import (
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/illegalcall/task-master/internal/config"
+	"github.com/illegalcall/task-master/internal/jobs"
 	"github.com/illegalcall/task-master/internal/models"
 	"github.com/illegalcall/task-master/pkg/database"
 	"github.com/jmoiron/sqlx"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // MockConsumerGroup mocks sarama.ConsumerGroup
@@ -54,6 +60,66 @@ func (m *MockConsumerGroup) ResumeAll() {
 	m.Called()
 }
 
+// MockProducer records the messages published by the worker
+type MockProducer struct {
+	sarama.SyncProducer
+	mu       sync.Mutex
+	messages []*sarama.ProducerMessage
+	err      error // returned instead of publishing when set
+}
+
+func (m *MockProducer) SendMessage(msg *sarama.ProducerMessage) (partition int32, offset int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, 0, m.err
+	}
+	m.messages = append(m.messages, msg)
+	return 0, int64(len(m.messages) - 1), nil
+}
+
+// mockSession records the messages marked as consumed
+type mockSession struct {
+	sarama.ConsumerGroupSession
+	ctx       context.Context
+	marked    []*sarama.ConsumerMessage
+	committed bool
+}
+
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked = append(s.marked, msg)
+}
+
+func (s *mockSession) Commit() {
+	s.committed = true
+}
+
+func (s *mockSession) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+// mockClaim delivers a fixed set of messages
+type mockClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func newMockClaim(msgs ...*sarama.ConsumerMessage) *mockClaim {
+	claim := &mockClaim{messages: make(chan *sarama.ConsumerMessage, len(msgs))}
+	for _, msg := range msgs {
+		claim.messages <- msg
+	}
+	close(claim.messages)
+	return claim
+}
+
+func (c *mockClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
 // setupTestWorker creates a test worker with mocked dependencies
 func setupTestWorker(t *testing.T) (*Worker, sqlmock.Sqlmock, *miniredis.Miniredis, *MockConsumerGroup) {
 	// Setup SQL mock
@@ -81,10 +147,12 @@ func setupTestWorker(t *testing.T) (*Worker, sqlmock.Sqlmock, *miniredis.Minired
 	// Setup config
 	cfg := &config.Config{
 		Kafka: config.KafkaConfig{
-			Topic:          "test-topic",
-			RetryMax:       3,
-			RetryBackoff:   time.Millisecond,
-			ProcessingTime: time.Millisecond,
+			Topic:        "test-topic",
+			RetryMax:     3,
+			RetryBackoff: time.Millisecond,
+		},
+		Worker: config.WorkerConfig{
+			ID: testWorkerID,
 		},
 		Storage: config.StorageConfig{
 			TTL: time.Hour,
@@ -95,65 +163,242 @@ func setupTestWorker(t *testing.T) (*Worker, sqlmock.Sqlmock, *miniredis.Minired
 	mockConsumerGroup := new(MockConsumerGroup)
 
 	// Create worker
-	worker := NewWorker(cfg, dbClients, mockConsumerGroup)
+	worker := NewWorker(cfg, dbClients, mockConsumerGroup, &MockProducer{})
 
 	return worker, mock, miniRedis, mockConsumerGroup
 }
 
+// stubExtractor returns a canned LLM response
+type stubExtractor struct {
+	response []byte
+}
+
+func (s *stubExtractor) GenerateContent(ctx context.Context, text string, schema map[string]interface{}, description string) ([]byte, error) {
+	return s.response, nil
+}
+
+// stubParsing replaces PDF extraction and the LLM provider for the duration of the test
+func stubParsing(t *testing.T) {
+	originalExtractPDFText := jobs.ExtractPDFText
+	jobs.ExtractPDFText = func(ctx context.Context, documentSource string, documentType string, maxPages int) (string, error) {
+		return "Invoice #12345", nil
+	}
+	jobs.RegisterExtractor("stub", func(ctx context.Context, cfg config.LLMProviderConfig, timeout time.Duration) (jobs.StructuredExtractor, error) {
+		return &stubExtractor{response: []byte(`{"invoiceNumber":"12345"}`)}, nil
+	})
+	jobs.InitExtractors(config.LLMConfig{Provider: "stub"})
+
+	t.Cleanup(func() {
+		jobs.ExtractPDFText = originalExtractPDFText
+		jobs.InitExtractors(config.LLMConfig{})
+	})
+}
+
+// testWorkerID names the leases of the test worker
+const testWorkerID = "test-worker"
+
+// failingSleep is the payload of a sleep job that fails
+const failingSleep = `{"duration_ms": 1, "error": "simulated error for job 5"}`
+
+var (
+	markProcessing = regexp.QuoteMeta("UPDATE jobs SET status = $1, started_at = $2, lease_owner = $3, lease_expires_at = $4 WHERE id = $5 AND (status = $6 OR (status = $1 AND lease_expires_at < $2)) RETURNING attempts")
+	markCompleted  = regexp.QuoteMeta("UPDATE jobs SET status = $1, result = $2, error = NULL, finished_at = $3, attempts = attempts + 1 WHERE id = $4 AND status = $5 AND lease_owner = $6")
+	markFailed     = regexp.QuoteMeta("UPDATE jobs SET status = $1, error = $2, finished_at = $3, attempts = attempts + 1 WHERE id = $4 AND status = $5 AND lease_owner = $6")
+	markRetrying   = regexp.QuoteMeta("UPDATE jobs SET status = $1, error = $2, attempts = attempts + 1 WHERE id = $3 AND status = $4 AND lease_owner = $5")
+)
+
+// leased returns the rows of markProcessing for a job leased with the given
+// attempts recorded, or for no job leased if attempts is empty
+func leased(attempts ...int) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"attempts"})
+	for _, n := range attempts {
+		rows.AddRow(n)
+	}
+	return rows
+}
+
 func TestProcessJob(t *testing.T) {
 	worker, mock, miniRedis, _ := setupTestWorker(t)
 	defer miniRedis.Close()
+	stubParsing(t)
 
 	// Test cases
 	testCases := []struct {
 		name        string
+		jobID       int
 		jobType     string
+		attempts    string // value of the attempts header, if any
+		version     int    // schema version of the message, if not the current one
 		setupMocks  func()
 		expectError bool
+		checkResult func(t *testing.T)
 	}{
 		{
 			name:    "PDF Parse Job Success",
+			jobID:   1,
 			jobType: models.JobTypePDFParse,
 			setupMocks: func() {
 				// Setup Redis payload
-				payload := models.ParseDocumentPayload{
-					PDFSource:      "test.pdf",
-					ExpectedSchema: json.RawMessage(`{"field": "value"}`),
-				}
-				payloadBytes, _ := json.Marshal(payload)
+				envelope, _ := jobs.NewEnvelope(models.JobTypePDFParse, jobs.ParseDocumentPayload{
+					Document:     "test.pdf",
+					DocumentType: "path",
+					OutputSchema: map[string]interface{}{"field": "value"},
+				})
+				payloadBytes, _ := json.Marshal(envelope)
 				worker.db.Redis.Set(context.Background(), "job:1:payload", payloadBytes, 0)
 
-				// Expect status update in DB
-				mock.ExpectExec("UPDATE jobs SET status = \\$1 WHERE id = \\$2").
-					WithArgs(models.StatusCompleted, 1).
+				mock.ExpectQuery(markProcessing).
+					WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+					WillReturnRows(leased(0))
+
+				// Expect the result to be persisted with the completed status
+				mock.ExpectExec(markCompleted).
+					WithArgs(models.StatusCompleted, resultContaining(`"invoiceNumber":"12345"`), sqlmock.AnyArg(), 1, models.StatusProcessing, testWorkerID).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
 			expectError: false,
+			checkResult: func(t *testing.T) {
+				status, _ := miniRedis.Get("job:1")
+				assert.Equal(t, models.StatusCompleted, status)
+				// Results live in Postgres; Redis is only a read-through cache
+				assert.False(t, miniRedis.Exists("job:1:result"))
+			},
 		},
 		{
 			name:    "Unknown Job Type",
+			jobID:   1,
 			jobType: "unknown",
 			setupMocks: func() {
-				// Expect status update in DB for failed job
-				mock.ExpectExec("UPDATE jobs SET status = \\$1 WHERE id = \\$2").
-					WithArgs(models.StatusCompleted, 1).
+				mock.ExpectQuery(markProcessing).
+					WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+					WillReturnRows(leased(0))
+
+				// The job can never succeed, so it fails without a retry
+				mock.ExpectExec(markFailed).
+					WithArgs(models.StatusFailed, `invalid job: unknown job type "unknown"`, sqlmock.AnyArg(), 1, models.StatusProcessing, testWorkerID).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectError: true,
+			checkResult: func(t *testing.T) {
+				status, _ := miniRedis.Get("job:1")
+				assert.Equal(t, models.StatusFailed, status)
+				assert.False(t, miniRedis.Exists(retryQueueKey))
+			},
+		},
+		{
+			name:     "Failure Schedules Retry",
+			jobID:    5,
+			jobType:  models.JobTypeSleep,
+			attempts: "2", // stale; jobs.attempts counts
+			setupMocks: func() {
+				worker.db.Redis.Set(context.Background(), "job:5:payload", failingSleep, 0)
+
+				mock.ExpectQuery(markProcessing).
+					WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 5, models.StatusPending).
+					WillReturnRows(leased(0))
+
+				// The job waits for its retry as pending, with the error of the attempt
+				mock.ExpectExec(markRetrying).
+					WithArgs(models.StatusPending, "simulated error for job 5", 5, models.StatusProcessing, testWorkerID).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectError: false,
+			checkResult: func(t *testing.T) {
+				status, _ := miniRedis.Get("job:5")
+				assert.Equal(t, models.StatusPending, status)
+
+				retries, err := miniRedis.ZMembers(retryQueueKey)
+				require.NoError(t, err)
+				require.Len(t, retries, 1)
+				var retry scheduledRetry
+				require.NoError(t, json.Unmarshal([]byte(retries[0]), &retry))
+				assert.Equal(t, 5, retry.JobID)
+				assert.Equal(t, 1, retry.Attempts)
+				assert.Equal(t, "1", retry.Headers[models.HeaderAttempts])
+			},
+		},
+		{
+			name:    "Newer Schema Version Is Retried",
+			jobID:   7,
+			jobType: models.JobTypeSleep,
+			version: jobs.SchemaVersion + 1,
+			setupMocks: func() {
+				miniRedis.Del(retryQueueKey)
+				worker.db.Redis.Set(context.Background(), "job:7:payload", `{"schema_version": 3, "type": "sleep", "payload": {}}`, 0)
+
+				mock.ExpectQuery(markProcessing).
+					WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 7, models.StatusPending).
+					WillReturnRows(leased(0))
+
+				// A worker of the newer build may pick the retry up
+				mock.ExpectExec(markRetrying).
+					WithArgs(models.StatusPending, sqlmock.AnyArg(), 7, models.StatusProcessing, testWorkerID).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectError: false,
+			checkResult: func(t *testing.T) {
+				status, _ := miniRedis.Get("job:7")
+				assert.Equal(t, models.StatusPending, status)
+				retries, err := miniRedis.ZMembers(retryQueueKey)
+				require.NoError(t, err)
+				assert.Len(t, retries, 1)
+			},
+		},
+		{
+			name:     "Failure After Retries",
+			jobID:    5,
+			jobType:  models.JobTypeSleep,
+			attempts: "1", // stale; jobs.attempts counts
+			setupMocks: func() {
+				miniRedis.Del(retryQueueKey)
+				worker.db.Redis.Set(context.Background(), "job:5:payload", failingSleep, 0)
+
+				mock.ExpectQuery(markProcessing).
+					WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 5, models.StatusPending).
+					WillReturnRows(leased(2))
+
+				// Expect the error and attempt to be persisted
+				mock.ExpectExec(markFailed).
+					WithArgs(models.StatusFailed, "simulated error for job 5", sqlmock.AnyArg(), 5, models.StatusProcessing, testWorkerID).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
+			expectError: true,
+			checkResult: func(t *testing.T) {
+				status, _ := miniRedis.Get("job:5")
+				assert.Equal(t, models.StatusFailed, status)
+				assert.False(t, miniRedis.Exists(retryQueueKey), "the last attempt is not retried")
+			},
+		},
+		{
+			name:    "Cancelled While Queued",
+			jobID:   6,
+			jobType: models.JobTypeSleep,
+			setupMocks: func() {
+				miniRedis.Set("job:6", models.StatusCancelled)
+
+				// No row is marked as processing, so the job is skipped
+				mock.ExpectQuery(markProcessing).
+					WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 6, models.StatusPending).
+					WillReturnRows(leased())
+			},
 			expectError: false,
+			checkResult: func(t *testing.T) {
+				status, _ := miniRedis.Get("job:6")
+				assert.Equal(t, models.StatusCancelled, status)
+			},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Setup test data
-			job := struct {
-				ID   int    `json:"id"`
-				Name string `json:"name"`
-				Type string `json:"type"`
-			}{
-				ID:   1,
+			job := jobs.NewMessage(models.Job{
+				ID:   tc.jobID,
 				Name: "Test Job",
 				Type: tc.jobType,
+			})
+			if tc.version != 0 {
+				job.SchemaVersion = tc.version
 			}
 
 			// Setup mocks
@@ -164,6 +409,9 @@ func TestProcessJob(t *testing.T) {
 			msg := &sarama.ConsumerMessage{
 				Value: msgValue,
 			}
+			if tc.attempts != "" {
+				msg.Headers = []*sarama.RecordHeader{{Key: []byte(models.HeaderAttempts), Value: []byte(tc.attempts)}}
+			}
 
 			// Process job
 			err := worker.processJob(msg)
@@ -174,6 +422,9 @@ func TestProcessJob(t *testing.T) {
 			} else {
 				assert.NoError(t, err)
 			}
+			if tc.checkResult != nil {
+				tc.checkResult(t)
+			}
 
 			// Verify all expectations were met
 			assert.NoError(t, mock.ExpectationsWereMet())
@@ -181,6 +432,109 @@ func TestProcessJob(t *testing.T) {
 	}
 }
 
+func TestProcessJobCancelled(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go worker.listenForCancellations(ctx)
+
+	worker.db.Redis.Set(context.Background(), "job:1:payload", `{"duration_ms": 60000}`, 0)
+	mock.ExpectQuery(markProcessing).
+		WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+		WillReturnRows(leased(0))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- worker.processJob(&sarama.ConsumerMessage{Value: []byte(`{"id": 1, "name": "Test Job", "type": "sleep"}`)})
+	}()
+
+	// Wait for the job to start, then cancel it the way the API does
+	assert.Eventually(t, func() bool {
+		worker.mu.Lock()
+		defer worker.mu.Unlock()
+		return worker.running[1] != nil
+	}, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return worker.db.Redis.Publish(context.Background(), models.JobCancelChannel, 1).Val() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled job did not stop")
+	}
+
+	// The worker leaves the cancelled status recorded by the API alone
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, worker.running)
+}
+
+func TestConsumeClaimDeadLettersFailedJobs(t *testing.T) {
+	worker, mock, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Kafka.DeadLetterTopic = "test-dead-letter"
+	worker.cfg.Kafka.RetryMax = 2
+	producer := worker.producer.(*MockProducer)
+
+	worker.db.Redis.Set(context.Background(), "job:5:payload", failingSleep, 0)
+	mock.ExpectQuery(markProcessing).
+		WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 5, models.StatusPending).
+		WillReturnRows(leased(1))
+	mock.ExpectExec(markFailed).
+		WithArgs(models.StatusFailed, "simulated error for job 5", sqlmock.AnyArg(), 5, models.StatusProcessing, testWorkerID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	insertDeadLetter := regexp.QuoteMeta("INSERT INTO dead_letters (job_id, topic, kafka_partition, kafka_offset, key, value, headers, error, attempts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)")
+	mock.ExpectExec(insertDeadLetter).
+		WithArgs(5, "test-topic", int32(0), int64(42), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "simulated error for job 5", 2).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// Messages that can't even be decoded are dead-lettered too
+	mock.ExpectExec(insertDeadLetter).
+		WithArgs(nil, "test-topic", int32(0), int64(43), sqlmock.AnyArg(), []byte("not json"), sqlmock.AnyArg(), sqlmock.AnyArg(), 0).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	failed := &sarama.ConsumerMessage{
+		Topic:   "test-topic",
+		Offset:  42,
+		Value:   []byte(`{"id": 5, "name": "Test Job", "type": "sleep"}`),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("trace-id"), Value: []byte("abc")},
+			{Key: []byte(models.HeaderAttempts), Value: []byte("1")},
+		},
+	}
+	poison := &sarama.ConsumerMessage{Topic: "test-topic", Offset: 43, Value: []byte("not json")}
+	session := &mockSession{}
+	assert.NoError(t, worker.ConsumeClaim(session, newMockClaim(failed, poison)))
+
+	// Both messages move on, and each ends up in the dead-letter topic
+	assert.Len(t, session.marked, 2)
+	require.Len(t, producer.messages, 2)
+	dlq := producer.messages[0]
+	assert.Equal(t, "test-dead-letter", dlq.Topic)
+	headers := map[string]string{}
+	for _, h := range dlq.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	assert.Equal(t, "abc", headers["trace-id"], "original headers are kept")
+	assert.NotContains(t, headers, models.HeaderAttempts, "replays start counting attempts afresh")
+	assert.Equal(t, "simulated error for job 5", headers[models.HeaderDeadLetterError])
+	assert.Equal(t, "2", headers[models.HeaderDeadLetterAttempts])
+	assert.Equal(t, "test-topic", headers[models.HeaderDeadLetterTopic])
+	assert.Equal(t, "42", headers[models.HeaderDeadLetterOffset])
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// resultContaining matches a JSON result argument containing substr
+type resultContaining string
+
+func (r resultContaining) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && strings.Contains(s, string(r))
+}
+
 func TestWorkerStart(t *testing.T) {
 	worker, _, miniRedis, mockConsumerGroup := setupTestWorker(t)
 	defer miniRedis.Close()
@@ -202,3 +556,133 @@ func TestWorkerStart(t *testing.T) {
 	// Verify expectations
 	mockConsumerGroup.AssertExpectations(t)
 }
+
+// sessionConsumer is a consumer group with one session that delivers claim
+type sessionConsumer struct {
+	sarama.ConsumerGroup
+	session *mockSession
+	claim   *mockClaim
+}
+
+func (c *sessionConsumer) Errors() <-chan error {
+	return make(chan error)
+}
+
+func (c *sessionConsumer) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	claim := c.claim
+	if claim == nil {
+		<-ctx.Done()
+		return nil
+	}
+	c.claim = nil
+	c.session.ctx = ctx
+	if err := handler.Setup(c.session); err != nil {
+		return err
+	}
+	return handler.ConsumeClaim(c.session, claim)
+}
+
+// startWithJob starts the worker with a session that delivers a message for
+// job 1, and stops it once the job is running, calling draining, if set,
+// after that. It returns once Start has returned.
+func startWithJob(t *testing.T, worker *Worker, draining func()) *mockSession {
+	session := &mockSession{}
+	worker.consumer = &sessionConsumer{
+		session: session,
+		claim: newMockClaim(&sarama.ConsumerMessage{
+			Offset: 7,
+			Value:  []byte(`{"id": 1, "name": "Test Job", "type": "sleep"}`),
+		}),
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- worker.Start(ctx) }()
+
+	require.Eventually(t, func() bool {
+		worker.mu.Lock()
+		defer worker.mu.Unlock()
+		return worker.running[1] != nil
+	}, time.Second, time.Millisecond)
+	stop()
+	if draining != nil {
+		draining()
+	}
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not stop")
+	}
+	return session
+}
+
+func TestWorkerStartDrainsRunningJobs(t *testing.T) {
+	worker, db, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Worker.ShutdownTimeout = 5 * time.Second
+
+	worker.db.Redis.Set(context.Background(), "job:1:payload", `{"duration_ms": 100}`, 0)
+	db.ExpectQuery(markProcessing).
+		WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+		WillReturnRows(leased(0))
+	db.ExpectExec(markCompleted).
+		WithArgs(models.StatusCompleted, resultContaining(`"slept_ms"`), sqlmock.AnyArg(), 1, models.StatusProcessing, testWorkerID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	session := startWithJob(t, worker, nil)
+
+	// The running job finished and its offset was committed before Start returned
+	require.Len(t, session.marked, 1)
+	assert.Equal(t, int64(7), session.marked[0].Offset)
+	assert.True(t, session.committed)
+	status, _ := miniRedis.Get("job:1")
+	assert.Equal(t, models.StatusCompleted, status)
+	assert.NoError(t, db.ExpectationsWereMet())
+}
+
+func TestWorkerStartCancelsJobsWhileDraining(t *testing.T) {
+	worker, db, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Worker.ShutdownTimeout = 10 * time.Second
+
+	worker.db.Redis.Set(context.Background(), "job:1:payload", `{"duration_ms": 60000}`, 0)
+	db.ExpectQuery(markProcessing).
+		WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+		WillReturnRows(leased(0))
+
+	// The API cancels the job after shutdown began
+	session := startWithJob(t, worker, func() {
+		assert.Eventually(t, func() bool {
+			return worker.db.Redis.Publish(context.Background(), models.JobCancelChannel, 1).Val() > 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	// The job stopped without waiting for the shutdown timeout
+	assert.Len(t, session.marked, 1)
+	assert.NoError(t, db.ExpectationsWereMet())
+}
+
+func TestWorkerStartAbortsJobsAfterShutdownTimeout(t *testing.T) {
+	worker, db, miniRedis, _ := setupTestWorker(t)
+	defer miniRedis.Close()
+	worker.cfg.Worker.ShutdownTimeout = 50 * time.Millisecond
+
+	worker.db.Redis.Set(context.Background(), "job:1:payload", `{"duration_ms": 60000}`, 0)
+	db.ExpectQuery(markProcessing).
+		WithArgs(models.StatusProcessing, sqlmock.AnyArg(), testWorkerID, sqlmock.AnyArg(), 1, models.StatusPending).
+		WillReturnRows(leased(0))
+	db.ExpectExec(regexp.QuoteMeta("UPDATE jobs SET status = $1, started_at = NULL WHERE id = $2 AND status = $3 AND lease_owner = $4")).
+		WithArgs(models.StatusPending, 1, models.StatusProcessing, testWorkerID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	session := startWithJob(t, worker, nil)
+
+	// The aborted job is queued again and its message left to be redelivered
+	assert.Empty(t, session.marked)
+	assert.True(t, session.committed)
+	status, _ := miniRedis.Get("job:1")
+	assert.Equal(t, models.StatusPending, status)
+	assert.NoError(t, db.ExpectationsWereMet())
+}
@@ -2,8 +2,8 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log/slog"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -17,9 +17,9 @@ type Clients struct {
 
 func NewClients(dbURL, redisAddr string) (*Clients, error) {
 	// Connect to PostgreSQL
-	db, err := sqlx.Connect("postgres", dbURL)
+	db, err := ConnectPostgres(dbURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to database: %w", err)
+		return nil, err
 	}
 
 	// Initialize Redis client
@@ -40,18 +40,16 @@ func NewClients(dbURL, redisAddr string) (*Clients, error) {
 	}, nil
 }
 
-func (c *Clients) CreateJobsTable() error {
-	schema := `CREATE TABLE IF NOT EXISTS jobs (
-		id SERIAL PRIMARY KEY,
-		name TEXT NOT NULL,
-		status TEXT DEFAULT 'pending',
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
+// Close closes the Redis client and the PostgreSQL connection pool
+func (c *Clients) Close() error {
+	return errors.Join(c.Redis.Close(), c.DB.Close())
+}
 
-	if _, err := c.DB.Exec(schema); err != nil {
-		return fmt.Errorf("failed to create jobs table: %w", err)
+// ConnectPostgres opens and verifies a PostgreSQL connection
+func ConnectPostgres(dbURL string) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("postgres", dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
-
-	slog.Info("✅ Jobs table is ready!")
-	return nil
+	return db, nil
 }
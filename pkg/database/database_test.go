@@ -1,5 +1,153 @@
 package database
 
-// ... other imports
+import (
+	"context"
+	"regexp"
+	"testing"
+	"testing/fstest"
 
-// Move your database-related tests here
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_index.up.sql":      {Data: []byte("CREATE INDEX i ON t (c);")},
+		"0002_add_index.down.sql":    {Data: []byte("DROP INDEX i;")},
+		"0001_create_table.up.sql":   {Data: []byte("CREATE TABLE t (c INT);")},
+		"0001_create_table.down.sql": {Data: []byte("DROP TABLE t;")},
+		"README.md":                  {Data: []byte("ignored")},
+	}
+
+	migrations, err := LoadMigrations(fsys)
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, 1, migrations[0].Version)
+	assert.Equal(t, "create_table", migrations[0].Name)
+	assert.Equal(t, "DROP TABLE t;", migrations[0].Down)
+	assert.Equal(t, 2, migrations[1].Version)
+
+	// Every migration needs an up script
+	_, err = LoadMigrations(fstest.MapFS{"0001_only_down.down.sql": {Data: []byte("SELECT 1;")}})
+	assert.Error(t, err)
+
+	// Versions must be unique
+	_, err = LoadMigrations(fstest.MapFS{
+		"0001_first.up.sql":  {Data: []byte("SELECT 1;")},
+		"0001_second.up.sql": {Data: []byte("SELECT 2;")},
+	})
+	assert.Error(t, err)
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrator, err := NewMigrator(nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrator.migrations)
+
+	for i, m := range migrator.migrations {
+		assert.Equal(t, i+1, m.Version, "migration versions should be contiguous")
+		assert.NotEmpty(t, m.Down, "migration %d_%s should have a down script", m.Version, m.Name)
+	}
+}
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "create_table", Up: "CREATE TABLE t (c INT);", Down: "DROP TABLE t;"},
+	{Version: 2, Name: "add_column", Up: "ALTER TABLE t ADD COLUMN d INT;", Down: "ALTER TABLE t DROP COLUMN d;"},
+}
+
+func setupMigrator(t *testing.T) (*Migrator, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	return NewMigratorWithMigrations(sqlx.NewDb(sqlDB, "sqlmock"), testMigrations), mock
+}
+
+func expectLock(mock sqlmock.Sqlmock, applied ...int) {
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).
+		WithArgs(migrationLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rows := sqlmock.NewRows([]string{"version"})
+	for _, v := range applied {
+		rows.AddRow(v)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM schema_migrations")).WillReturnRows(rows)
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).
+		WithArgs(migrationLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigratorUp(t *testing.T) {
+	migrator, mock := setupMigrator(t)
+
+	// Version 1 is already applied, so only version 2 runs
+	expectLock(mock, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE t ADD COLUMN d INT;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)")).
+		WithArgs(2, "add_column").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	n, err := migrator.Up(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorUpRollsBackFailedMigration(t *testing.T) {
+	migrator, mock := setupMigrator(t)
+
+	expectLock(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE t (c INT);")).WillReturnError(assert.AnError)
+	mock.ExpectRollback()
+	expectUnlock(mock)
+
+	n, err := migrator.Up(context.Background())
+	assert.ErrorContains(t, err, "migration 1_create_table failed")
+	assert.Equal(t, 0, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorDown(t *testing.T) {
+	migrator, mock := setupMigrator(t)
+
+	// Roll back only the latest applied migration
+	expectLock(mock, 1, 2)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE t DROP COLUMN d;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations WHERE version = $1")).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	n, err := migrator.Down(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorStatus(t *testing.T) {
+	migrator, mock := setupMigrator(t)
+
+	expectLock(mock, 1)
+	expectUnlock(mock)
+
+	statuses, err := migrator.Status(context.Background())
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	assert.True(t, statuses[0].Applied)
+	assert.False(t, statuses[1].Applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
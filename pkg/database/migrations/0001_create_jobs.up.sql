@@ -5,4 +5,8 @@ CREATE TABLE IF NOT EXISTS jobs (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     type TEXT NOT NULL,
     payload JSON
-);
\ No newline at end of file
+);
+
+-- Tables created before migrations existed may lack these columns
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS type TEXT NOT NULL DEFAULT '';
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS payload JSON;
@@ -0,0 +1,5 @@
+ALTER TABLE jobs DROP COLUMN IF EXISTS attempts;
+ALTER TABLE jobs DROP COLUMN IF EXISTS finished_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS started_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS error;
+ALTER TABLE jobs DROP COLUMN IF EXISTS result;
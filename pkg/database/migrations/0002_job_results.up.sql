@@ -0,0 +1,5 @@
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS result JSONB;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS error TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS started_at TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS finished_at TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS jobs_owner_id_idx;
+ALTER TABLE jobs DROP COLUMN IF EXISTS owner_id;
+
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS jobs_owner_id_idx ON jobs (owner_id);
+DROP INDEX IF EXISTS jobs_owner_created_at_id_idx;
+DROP INDEX IF EXISTS jobs_created_at_id_idx;
@@ -0,0 +1,4 @@
+-- Keyset pagination on GET /api/jobs orders by (created_at, id)
+CREATE INDEX IF NOT EXISTS jobs_created_at_id_idx ON jobs (created_at, id);
+CREATE INDEX IF NOT EXISTS jobs_owner_created_at_id_idx ON jobs (owner_id, created_at, id);
+DROP INDEX IF EXISTS jobs_owner_id_idx;
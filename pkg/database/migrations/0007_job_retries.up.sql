@@ -0,0 +1,2 @@
+-- Number of times a job was re-queued through the retry API
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS retries INTEGER NOT NULL DEFAULT 0;
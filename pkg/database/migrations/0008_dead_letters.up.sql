@@ -0,0 +1,18 @@
+-- Messages published to the dead-letter topic, kept so they can be
+-- inspected and replayed through the API
+CREATE TABLE IF NOT EXISTS dead_letters (
+    id SERIAL PRIMARY KEY,
+    job_id INTEGER REFERENCES jobs(id) ON DELETE CASCADE,
+    topic TEXT NOT NULL,
+    kafka_partition INTEGER NOT NULL,
+    kafka_offset BIGINT NOT NULL,
+    key BYTEA,
+    value BYTEA NOT NULL,
+    headers JSONB NOT NULL DEFAULT '{}',
+    error TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    replayed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS dead_letters_job_id_idx ON dead_letters (job_id);
@@ -0,0 +1,12 @@
+-- Idempotency-Key headers of job submissions, with a hash of the request
+-- they were first used with and the job it created
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    job_id INTEGER NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (owner_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_job_id_idx ON idempotency_keys (job_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS jobs_lease_expires_at_idx;
+ALTER TABLE jobs DROP COLUMN IF EXISTS lease_expires_at;
+ALTER TABLE jobs DROP COLUMN IF EXISTS lease_owner;
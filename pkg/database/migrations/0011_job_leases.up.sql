@@ -0,0 +1,5 @@
+-- Workers lease the jobs they process and renew the lease while running;
+-- jobs whose lease expired are reclaimed from crashed workers
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS lease_owner TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS jobs_lease_expires_at_idx ON jobs (lease_expires_at) WHERE status = 'processing';
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS jobs_unfinished_status_updated_at_idx;
+DROP INDEX IF EXISTS jobs_status_updated_at_idx;
+DROP TRIGGER IF EXISTS jobs_status_updated_at ON jobs;
+DROP FUNCTION IF EXISTS jobs_touch_status_updated_at();
+ALTER TABLE jobs DROP COLUMN IF EXISTS status_updated_at;
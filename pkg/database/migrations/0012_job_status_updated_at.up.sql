@@ -0,0 +1,20 @@
+-- When a job last changed status, kept by a trigger so the reconciler can
+-- find jobs stuck in one status
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS status_updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+CREATE OR REPLACE FUNCTION jobs_touch_status_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.status IS DISTINCT FROM OLD.status THEN
+        NEW.status_updated_at := CURRENT_TIMESTAMP;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS jobs_status_updated_at ON jobs;
+CREATE TRIGGER jobs_status_updated_at BEFORE UPDATE ON jobs
+    FOR EACH ROW EXECUTE FUNCTION jobs_touch_status_updated_at();
+
+CREATE INDEX IF NOT EXISTS jobs_status_updated_at_idx ON jobs (status_updated_at);
+CREATE INDEX IF NOT EXISTS jobs_unfinished_status_updated_at_idx ON jobs (status_updated_at)
+    WHERE status IN ('pending', 'processing');
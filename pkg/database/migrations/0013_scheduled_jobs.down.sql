@@ -0,0 +1,9 @@
+UPDATE jobs SET status = 'cancelled', finished_at = CURRENT_TIMESTAMP WHERE status = 'scheduled';
+
+DROP INDEX IF EXISTS jobs_run_at_idx;
+
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS jobs_status_check;
+ALTER TABLE jobs ADD CONSTRAINT jobs_status_check
+    CHECK (status IN ('pending', 'processing', 'completed', 'failed', 'cancelled'));
+
+ALTER TABLE jobs DROP COLUMN IF EXISTS run_at;
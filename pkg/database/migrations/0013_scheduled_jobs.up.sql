@@ -0,0 +1,9 @@
+-- Jobs can be scheduled to run later: they wait in the 'scheduled' status
+-- until run_at, when the scheduler queues them
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS run_at TIMESTAMP;
+
+ALTER TABLE jobs DROP CONSTRAINT IF EXISTS jobs_status_check;
+ALTER TABLE jobs ADD CONSTRAINT jobs_status_check
+    CHECK (status IN ('scheduled', 'pending', 'processing', 'completed', 'failed', 'cancelled'));
+
+CREATE INDEX IF NOT EXISTS jobs_run_at_idx ON jobs (run_at) WHERE status = 'scheduled';
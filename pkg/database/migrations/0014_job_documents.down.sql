@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS jobs_document_finished_at_idx;
+ALTER TABLE jobs DROP COLUMN IF EXISTS document;
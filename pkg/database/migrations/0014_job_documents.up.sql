@@ -0,0 +1,4 @@
+-- The stored document a job holds a reference to, released once the job
+-- has finished and its retention has passed
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS document TEXT;
+CREATE INDEX IF NOT EXISTS jobs_document_finished_at_idx ON jobs (finished_at) WHERE document IS NOT NULL;
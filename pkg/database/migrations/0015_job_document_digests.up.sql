@@ -0,0 +1,3 @@
+-- The SHA-256 digest of a job's document, returned when the job is
+-- replayed for an idempotent request even after the document is released
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS document_digest TEXT;
@@ -55,3 +55,12 @@ func NewConsumer(broker, group string) (sarama.ConsumerGroup, error) {
 
 	return sarama.NewConsumerGroup(brokers, group, config)
 }
+
+// RecordHeaders converts a header map into Kafka record headers
+func RecordHeaders(headers map[string]string) []sarama.RecordHeader {
+	records := make([]sarama.RecordHeader, 0, len(headers))
+	for k, v := range headers {
+		records = append(records, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+	return records
+}